@@ -3,11 +3,23 @@ package redis
 //// TODO: Document!
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHashes(t *testing.T) {
@@ -116,13 +128,64 @@ func TestServer(t *testing.T) {
 	baseFileName := fmt.Sprintf("localRedisTest.%d.json", os.Getpid())
 	fileName := filepath.Join(tmpDir, baseFileName)
 	println(BgSave(fileName, complete))
-	<-complete
+	if !<-complete {
+		t.Errorf("BgSave failed")
+	}
+
+	// A second background save is refused while one runs.
+	saveMu.Lock()
+	bgsaveRunning = true
+	saveMu.Unlock()
+	reply := BgSave(fileName, complete)
+	saveMu.Lock()
+	bgsaveRunning = false
+	saveMu.Unlock()
+	if reply != "ERR Background save already in progress" || <-complete {
+		t.Errorf("BgSave during a background save returned %q", reply)
+	}
+}
+
+func TestSavePoints(t *testing.T) {
+	defaultDumpFileName := DefaultDumpFileName
+	DefaultDumpFileName = filepath.Join(os.TempDir(), fmt.Sprintf("localRedisTest.%d.savepoint.json", os.Getpid()))
+	defer func() {
+		SetSavePoints()
+		os.Remove(DefaultDumpFileName)
+		DefaultDumpFileName = defaultDumpFileName
+	}()
+
+	if err := Save(DefaultDumpFileName); err != nil {
+		t.Fatal(err)
+	}
+	println(Lastsave())
+	os.Remove(DefaultDumpFileName)
+
+	SetSavePoints(SavePoint{Seconds: 0, Changes: 2})
+	Set("save point string", "one")
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := os.Stat(DefaultDumpFileName); err == nil {
+		t.Errorf("Saved before the save point was reached")
+	}
+
+	Set("save point string", "two")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(DefaultDumpFileName); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Save point never triggered a save")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func TestPubSubSimple(t *testing.T) {
 	var w sync.WaitGroup
 	w.Add(2)
-	consumer := Psubscribe(".*first.*")
+	consumer := Psubscribe("*first*")
 
 	go func() {
 		match := <-consumer.Channel
@@ -146,7 +209,8 @@ func TestPubSubMultiple(t *testing.T) {
 	w.Add(3)
 
 	go func() {
-		consumer := Psubscribe("my first hash", ".*list.*")
+		// The regular expressions Psubscribe took before it matched globs.
+		consumer, _ := PsubscribeWithOptions(SubscriptionOptions{Regexp: true}, "my first hash", ".*list.*")
 
 		go func() {
 			println(Rpush("a list", "item 1", "item 2"))
@@ -173,7 +237,7 @@ func TestPubSubMultiple(t *testing.T) {
 
 func TestPubSubValidHash(t *testing.T) {
 	key := "TestPubSubValidHash:"
-	sub := Psubscribe(fmt.Sprintf("%s.*", key))
+	sub := Psubscribe(key + "*")
 
 	go func() {
 		t.Log("HSet")
@@ -212,3 +276,2026 @@ func TestPubSubRedisSetUpdates(t *testing.T) {
 
 	w.Wait()
 }
+
+func TestExpire(t *testing.T) {
+	Set("expiring string", "soon gone")
+	println(Ttl("expiring string"))
+	println(Pexpire("expiring string", 50))
+	println(Pttl("expiring string"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if Exists("expiring string") != 0 {
+		t.Errorf("Key survived its expire time")
+	}
+	if ttl := Ttl("expiring string"); ttl != -2 {
+		t.Errorf("Expected TTL -2 for a missing key, got %d", ttl)
+	}
+
+	Set("persisting string", "here to stay")
+	Expire("persisting string", 100)
+	println(Persist("persisting string"))
+	if ttl := Ttl("persisting string"); ttl != -1 {
+		t.Errorf("Expected TTL -1 after PERSIST, got %d", ttl)
+	}
+}
+
+func TestRDB(t *testing.T) {
+	if sum := crc64Update(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("Unexpected CRC64 check value %x", sum)
+	}
+
+	key := "TestRDB:"
+	Set(key+"string", "fun is ok")
+	Set(key+"int", "-12345")
+	Expire(key+"int", 100)
+	HSet(key+"hash", "my key", "yo yo yo")
+	Rpush(key+"queue", "A", "B", "C")
+	Sadd(key+"set", "X", "Y", "X")
+
+	fileName := filepath.Join(os.TempDir(), fmt.Sprintf("localRedisTest.%d.rdb", os.Getpid()))
+	defer os.Remove(fileName)
+
+	if err := SaveRDB(fileName); err != nil {
+		t.Fatal(err)
+	}
+	Del(key+"string", key+"int", key+"hash", key+"queue", key+"set")
+
+	skipped, err := LoadRDB(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("Unexpected skipped keys: %v", skipped)
+	}
+
+	if v := Get(key + "string"); v != "fun is ok" {
+		t.Errorf("Loaded string %q", v)
+	}
+	if v := Get(key + "int"); v != "-12345" {
+		t.Errorf("Loaded integer string %q", v)
+	}
+	if ttl := Ttl(key + "int"); ttl <= 0 {
+		t.Errorf("Loaded TTL %d", ttl)
+	}
+	if v := HGet(key+"hash", "my key"); v != "yo yo yo" {
+		t.Errorf("Loaded hash field %q", v)
+	}
+	if v := Lrange(key+"queue", 0, -1); len(v) != 3 || v[2] != "C" {
+		t.Errorf("Loaded list %v", v)
+	}
+	if n := Scard(key + "set"); n != 2 {
+		t.Errorf("Loaded set with %d members", n)
+	}
+
+	// Loads wait for a running script to finish, which holds execMu.
+	Del(key + "string")
+	execMu.Lock()
+	loaded := make(chan error)
+	go func() {
+		_, err := LoadRDB(fileName)
+		loaded <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s := shardFor(key + "string")
+	s.mu.RLock()
+	_, exists := s.entries[key+"string"]
+	s.mu.RUnlock()
+	execMu.Unlock()
+	if exists {
+		t.Error("LoadRDB loaded a key while a script ran")
+	}
+	if err := <-loaded; err != nil || Get(key+"string") != "fun is ok" {
+		t.Errorf("LoadRDB after the script returned %v", err)
+	}
+
+	// Corrupt lengths fail without allocating what they announce.
+	corrupt := []struct {
+		body string
+		err  error
+	}{
+		{"\x00\x01k\x81\x00\x00\x01\x00\x00\x00\x00\x00", errRDBCorrupt},
+		{"\x00\x01k\x80\x10\x00\x00\x00abc", io.ErrUnexpectedEOF},
+		{"\x01\x01k\x80\x10\x00\x00\x00\x01a", io.ErrUnexpectedEOF},
+		{"\x04\x01k\x80\x7f\xff\xff\xff", errRDBCorrupt},
+		{"\x00\x01k\xc3\x05\x08\x00a\xe0\xff\x00", errRDBCorrupt},
+		{"\xfc\xff\xff\xff\xff\xff\xff\xff\x7f\x00\x01k\x01v", errRDBCorrupt},
+		{"\x00\x01k\xc3\x02\x80\x10\x00\x00\x00\x01\x00", errRDBCorrupt},
+	}
+	for _, test := range corrupt {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ReadRDB(strings.NewReader("REDIS0009" + test.body))
+		runtime.ReadMemStats(&after)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
+			t.Errorf("ReadRDB of %q failed with %v", test.body, err)
+		}
+		if grown := after.TotalAlloc - before.TotalAlloc; grown > 4<<20 {
+			t.Errorf("ReadRDB of %q allocated %d bytes", test.body, grown)
+		}
+	}
+}
+
+func TestRDBCompactEncodings(t *testing.T) {
+	ziplist := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 3, 0,
+		0x00, 0x02, 'a', 'b',
+		0x04, 0xF2,
+		0x02, 0xC0, 0x39, 0x30,
+		0xFF,
+	}
+	listpack := []byte{
+		0, 0, 0, 0, 3, 0,
+		0x81, 'a', 0x02,
+		0x05, 0x01,
+		0xDF, 0xFF, 0x02,
+		0xFF,
+	}
+	intset := []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFF, 0xFF, 7, 0}
+
+	for name, c := range map[string]struct {
+		parse    func([]byte) ([]string, error)
+		in       []byte
+		expected string
+	}{
+		"ziplist":  {parseZiplist, ziplist, "[ab 1 12345]"},
+		"listpack": {parseListpack, listpack, "[a 5 -1]"},
+		"intset":   {parseIntset, intset, "[-1 7]"},
+	} {
+		out, err := c.parse(c.in)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if fmt.Sprint(out) != c.expected {
+			t.Errorf("%s: got %v, expected %s", name, out, c.expected)
+		}
+	}
+
+	compressed := []byte{2, 'a', 'b', 'c', 0xE0, 1, 2}
+	if out, err := lzfDecompress(compressed, 13); err != nil || string(out) != "abcabcabcabca" {
+		t.Errorf("lzf: got %q, %v", out, err)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	if err := SetNotifyKeyspaceEvents("KEQ"); err == nil {
+		t.Errorf("Accepted an invalid keyspace event flag")
+	}
+	if err := SetNotifyKeyspaceEvents("Kx$gE"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetNotifyKeyspaceEvents("")
+
+	if flags := GetNotifyKeyspaceEvents(); flags != "g$xKE" {
+		t.Errorf("Unexpected flags %q", flags)
+	}
+
+	key := "TestKeyspaceNotifications"
+	sub := Psubscribe("__keyspace@0__:"+key, "__keyevent@0__:expired")
+	all := Psubscribe("__key*__:*")
+	defer all.Close()
+
+	HSet(key+" hash", "field", "value")
+	Set(key, "soon gone")
+	Pexpire(key, 10)
+
+	expected := []string{
+		"__keyspace@0__:" + key + " set",
+		"__keyspace@0__:" + key + " expire",
+		"__keyspace@0__:" + key + " expired",
+		"__keyevent@0__:expired " + key,
+	}
+	for _, e := range expected {
+		select {
+		case n := <-sub.Channel:
+			if got := n.Channel + " " + n.Data.(string); got != e {
+				t.Errorf("Got notification %q, expected %q", got, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %q", e)
+		}
+	}
+
+	// The pattern Redis consumers subscribe with receives them too.
+	for {
+		select {
+		case n := <-all.Channel:
+			if n.Channel == "__keyspace@0__:"+key && n.Data.(string) == "set" {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting on __key*__:*")
+		}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	channel := "TestPublishSubscribe news"
+	sub := Subscribe(channel)
+	psub := Psubscribe("TestPublishSubscribe *")
+
+	if n := Publish(channel, "extra extra"); n != 2 {
+		t.Errorf("Expected 2 receivers, got %d", n)
+	}
+	if n := Publish("TestPublishSubscribe weather", "sunny"); n != 1 {
+		t.Errorf("Expected 1 receiver, got %d", n)
+	}
+	if n := Publish("nobody home", "hello?"); n != 0 {
+		t.Errorf("Expected no receivers, got %d", n)
+	}
+
+	if m := <-sub.Channel; m.Channel != channel || m.Data.(string) != "extra extra" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	for _, expected := range []string{"extra extra", "sunny"} {
+		if m := <-psub.Channel; m.Data.(string) != expected {
+			t.Errorf("Unexpected message %+v", m)
+		}
+	}
+
+	if channels, err := PubsubChannels("TestPublishSubscribe*"); err != nil || len(channels) != 1 || channels[0] != channel {
+		t.Errorf("Unexpected active channels %v, %v", channels, err)
+	}
+	if channels, err := PubsubChannels("^TestPublishSubscribe"); err != nil || len(channels) != 0 {
+		t.Errorf("PubsubChannels matched a regular expression: %v, %v", channels, err)
+	}
+	if _, err := PubsubChannels("TestPublishSubscribe["); err == nil {
+		t.Error("PubsubChannels accepted an invalid pattern")
+	}
+	if numsub := PubsubNumsub(channel, "nobody home"); numsub[channel] != 1 || numsub["nobody home"] != 0 {
+		t.Errorf("Unexpected subscriber counts %v", numsub)
+	}
+	if PubsubNumpat() == 0 {
+		t.Errorf("Expected subscribed patterns")
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	channel := "TestSubscriptionLifecycle"
+	sub := Subscribe(channel, channel+" other")
+	patterns, exps, _ := compilePatterns([]string{channel + " p"}, compileGlob, false)
+	sub.addPatterns(patterns, exps)
+
+	if n := sub.Unsubscribe(channel + " other"); n != 2 {
+		t.Errorf("Expected 2 remaining subscriptions, got %d", n)
+	}
+	if n := sub.PUnsubscribe(); n != 1 {
+		t.Errorf("Expected 1 remaining subscription, got %d", n)
+	}
+	if n := Publish(channel+" p", "unheard"); n != 0 {
+		t.Errorf("Expected no receivers after PUNSUBSCRIBE, got %d", n)
+	}
+
+	// A subscription nobody reads from must not hold up dispatch once closed.
+	for i := 0; i < cap(sub.Channel)+10; i++ {
+		Publish(channel, "filler")
+	}
+	sub.Close()
+	sub.Close()
+
+	if n := PubsubNumsub(channel)[channel]; n != 0 {
+		t.Errorf("Closed subscription still counted, %d subscribers", n)
+	}
+	drained := 0
+	for range sub.Channel {
+		drained++
+	}
+	println("Drained", drained)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctxSub := SubscribeContext(ctx, channel+" ctx")
+	if n := Publish(channel+" ctx", "hello"); n != 1 {
+		t.Errorf("Expected 1 receiver, got %d", n)
+	}
+	if m := <-ctxSub.Channel; m.Data.(string) != "hello" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ctxSub.Channel:
+		if ok {
+			t.Errorf("Received a message after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Subscription was not closed when its context was cancelled")
+	}
+
+	// Invalid patterns are refused, or ignored by Psubscribe, and never
+	// matched against the writes that follow.
+	if bad, err := PsubscribeWithOptions(SubscriptionOptions{}, channel+" key", "["); bad != nil || err == nil {
+		t.Errorf("PsubscribeWithOptions of an invalid pattern returned %v, %v", bad, err)
+	}
+	lenient := Psubscribe("[", channel+" key")
+	defer lenient.Close()
+	Set(channel+" key", "written")
+	defer Del(channel + " key")
+	if n := <-lenient.Channel; n.KeyName != channel+" key" {
+		t.Errorf("Unexpected event %+v", n)
+	}
+	if n := lenient.PUnsubscribe("["); n != 1 {
+		t.Errorf("Expected the valid pattern only, got %d subscriptions", n)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	channel := "TestSlowConsumerPolicies"
+	received := func(s *Subscription) (out []string) {
+		for {
+			select {
+			case m, ok := <-s.Channel:
+				if !ok {
+					return append(out, "closed")
+				}
+				out = append(out, m.Data.(string))
+			default:
+				return
+			}
+		}
+	}
+
+	for policy, expected := range map[SlowConsumerPolicy]string{
+		DropOldest: "[4 5]",
+		DropNewest: "[1 2]",
+		Disconnect: "[1 2 closed]",
+	} {
+		sub := SubscribeWithOptions(SubscriptionOptions{BufferSize: 2, Policy: policy}, channel)
+		for i := 1; i <= 5; i++ {
+			Publish(channel, fmt.Sprint(i))
+		}
+		if got := fmt.Sprint(received(sub)); got != expected {
+			t.Errorf("Policy %d: received %s, expected %s", policy, got, expected)
+		}
+		if policy != Disconnect && sub.Dropped() != 3 {
+			t.Errorf("Policy %d: dropped %d, expected 3", policy, sub.Dropped())
+		}
+		sub.Close()
+	}
+
+	soft := SubscribeWithOptions(SubscriptionOptions{
+		BufferSize:        10,
+		Policy:            Disconnect,
+		SoftLimit:         2,
+		SoftLimitDuration: 50 * time.Millisecond,
+	}, channel)
+	Publish(channel, "1")
+	Publish(channel, "2")
+	Publish(channel, "3")
+	time.Sleep(60 * time.Millisecond)
+	Publish(channel, "4")
+	if got := fmt.Sprint(received(soft)); got != "[1 2 3 closed]" {
+		t.Errorf("Soft limit: received %s", got)
+	}
+
+	// Writers carry on while a subscriber sleeps.
+	stalled := Psubscribe("TestSlowConsumerPolicies*")
+	defer stalled.Close()
+	for i := 0; i < 3*defaultSubscriptionBufferSize; i++ {
+		Set("TestSlowConsumerPolicies key", fmt.Sprint(i))
+	}
+	if stalled.Pending() != defaultSubscriptionBufferSize || stalled.Dropped() == 0 {
+		t.Errorf("Expected a full buffer and dropped notices, got %d pending and %d dropped", stalled.Pending(), stalled.Dropped())
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	key := "TestChangeEvents"
+	sub := Psubscribe(key + "*")
+	defer sub.Close()
+
+	Set(key, "one")
+	Set(key, "two")
+	HSet(key+" hash", "field", "value")
+	Del(key)
+
+	expected := []struct {
+		op, key       string
+		old, newValue interface{}
+	}{
+		{"set", key, nil, "one"},
+		{"set", key, "one", "two"},
+		{"hset", key + " hash", nil, "value"},
+		{"del", key, "two", nil},
+	}
+
+	var lastSeq uint64
+	for _, e := range expected {
+		ev := <-sub.Channel
+		if ev.Op != e.op || ev.KeyName != e.key || ev.OldValue != e.old || ev.NewValue != e.newValue {
+			t.Errorf("Got %+v, expected %+v", ev, e)
+		}
+		if ev.Seq <= lastSeq {
+			t.Errorf("Sequence number %d does not follow %d", ev.Seq, lastSeq)
+		}
+		if ev.DB != 0 || ev.Time.IsZero() {
+			t.Errorf("Unexpected database or time in %+v", ev)
+		}
+		lastSeq = ev.Seq
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := "TestChangeFeed"
+	feed := NewChangeFeed(key)
+
+	Set(key, "one")
+	Set(key, "two")
+	Set(key, "three")
+
+	next := func(f *ChangeFeed) ChangeEvent {
+		for {
+			ev, err := f.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev.KeyName == key {
+				return ev
+			}
+		}
+	}
+
+	ev := next(feed)
+	if ev.NewValue != "one" {
+		t.Errorf("Got %v, expected one", ev.NewValue)
+	}
+	feed.Ack(ev.Seq)
+
+	// A restarted consumer resumes after its acknowledged offset.
+	restarted := NewChangeFeed(key)
+	for _, expected := range []string{"two", "three"} {
+		if ev := next(restarted); ev.NewValue != expected {
+			t.Errorf("Got %v after restart, expected %s", ev.NewValue, expected)
+		}
+	}
+
+	go Set(key, "four")
+	if ev := next(restarted); ev.NewValue != "four" {
+		t.Errorf("Got %v while waiting, expected four", ev.NewValue)
+	}
+
+	SetChangeLogSize(2)
+	defer SetChangeLogSize(defaultChangeLogSize)
+	Set(key, "five")
+	Set(key, "six")
+	Set(key, "seven")
+	if _, err := NewChangeFeed(key).Next(ctx); err != ErrChangeLogTruncated {
+		t.Errorf("Expected ErrChangeLogTruncated, got %v", err)
+	}
+	DeleteChangeFeed(key)
+
+	first, last := ChangeLogRange()
+	if last-first != 1 {
+		t.Errorf("Change log holds %d..%d, expected 2 events", first, last)
+	}
+}
+
+func TestChangeFeedConcurrentWriters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	feed := NewChangeFeed("TestChangeFeedConcurrentWriters")
+	defer DeleteChangeFeed("TestChangeFeedConcurrentWriters")
+
+	const writers, writes = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("TestChangeFeedConcurrentWriters%d", w)
+			defer Del(key)
+			for i := 0; i < writes; i++ {
+				Set(key, strconv.Itoa(i))
+			}
+		}(w)
+	}
+
+	// Events are read in Seq order without gaps while they are being appended,
+	// and each writer's come in the order it made them.
+	last := make(map[string]int)
+	prev := feed.cursor
+	for seen := 0; seen < writers*writes; {
+		ev, err := feed.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Seq != prev+1 {
+			t.Fatalf("Got Seq %d after %d", ev.Seq, prev)
+		}
+		prev = ev.Seq
+		if ev.Op != "set" || !strings.HasPrefix(ev.KeyName, "TestChangeFeedConcurrentWriters") {
+			continue
+		}
+		i, _ := strconv.Atoi(ev.NewValue.(string))
+		if n, ok := last[ev.KeyName]; ok && i != n+1 {
+			t.Errorf("Got %s=%d after %d", ev.KeyName, i, n)
+		}
+		last[ev.KeyName] = i
+		seen++
+	}
+	wg.Wait()
+}
+
+func TestEviction(t *testing.T) {
+	defer SetMaxmemory(0)
+	defer SetMaxmemoryPolicy("noeviction")
+	defer SetMaxmemorySamples(5)
+	defer SetNotifyKeyspaceEvents("")
+
+	key := "TestEviction"
+	before := UsedMemory()
+	Set(key, "value")
+	if UsedMemory() <= before {
+		t.Errorf("Used memory did not grow from %d", before)
+	}
+	Del(key)
+	if UsedMemory() != before {
+		t.Errorf("Used memory is %d after delete, expected %d", UsedMemory(), before)
+	}
+
+	// Every write that may grow the keyspace is refused: the functions reply
+	// their zero value, and Conn.Do and Client the error.
+	SetMaxmemory(UsedMemory() - 1)
+	conn := NewConn()
+	defer conn.Close()
+	client := NewClient(&Options{})
+	for _, w := range []struct {
+		args  []interface{}
+		write func() interface{}
+	}{
+		{[]interface{}{"set", key, "value"}, func() interface{} { return Set(key, "value") }},
+		{[]interface{}{"setnx", key, "value"}, func() interface{} { return Setnx(key, "value") }},
+		{[]interface{}{"incr", key}, func() interface{} { return Incr(key) }},
+		{[]interface{}{"decr", key}, func() interface{} { return Decr(key) }},
+		{[]interface{}{"hset", key, "f", "v"}, func() interface{} { return HSet(key, "f", "v") }},
+		{[]interface{}{"sadd", key, "m"}, func() interface{} { return Sadd(key, "m") }},
+		{[]interface{}{"rpush", key, "v"}, func() interface{} { return Rpush(key, "v") }},
+		{[]interface{}{"lpush", key, "v"}, func() interface{} { return Lpush(key, "v") }},
+	} {
+		name := w.args[0].(string)
+		if reply := w.write(); (reply != "" && reply != 0) || Exists(key) != 0 {
+			t.Errorf("%s under noeviction replied %v", name, reply)
+		}
+		if _, err := conn.Do(name, w.args[1:]...); err == nil || err.Error() != ErrOOM.Error() {
+			t.Errorf("Conn.Do(%s) under noeviction returned %v", name, err)
+		}
+		if err := client.Do(context.Background(), w.args...).Err(); err == nil || err.Error() != ErrOOM.Error() {
+			t.Errorf("Client.Do(%s) under noeviction returned %v", name, err)
+		}
+	}
+
+	if err := SetMaxmemoryPolicy("volatile-ttl"); err != nil {
+		t.Fatal(err)
+	}
+	SetMaxmemory(0)
+	SetMaxmemorySamples(1000)
+	for i, seconds := range []int{30, 10, 20} {
+		k := fmt.Sprintf("%s:%d", key, i)
+		Set(k, "value")
+		Expire(k, seconds)
+	}
+	SetNotifyKeyspaceEvents("Ee")
+	sub := Subscribe("__keyevent@0__:evicted")
+	defer sub.Close()
+
+	SetMaxmemory(UsedMemory() - 1)
+	Set(key, "value")
+	if ev := <-sub.Channel; ev.Data != key+":1" {
+		t.Errorf("Evicted %v, expected the key closest to expiring", ev.Data)
+	}
+	if Exists(key+":0") != 1 || Exists(key+":2") != 1 {
+		t.Error("Evicted more keys than needed")
+	}
+
+	if err := SetMaxmemoryPolicy("allkeys-lru"); err != nil {
+		t.Fatal(err)
+	}
+	limit := UsedMemory() - 1
+	SetMaxmemory(limit)
+	Set(key+":new", "value")
+	<-sub.Channel
+	if UsedMemory()-int64(keyOverhead+len(key+":new")+len("value")) > limit {
+		t.Errorf("Used memory %d is over the limit of %d", UsedMemory(), limit)
+	}
+
+	if err := SetMaxmemoryPolicy("sometimes-lru"); err == nil {
+		t.Error("Accepted an invalid policy")
+	}
+}
+
+func TestObjectAndMemory(t *testing.T) {
+	key := "TestObjectAndMemory"
+	for i := 0; i < 200; i++ {
+		HSet(key, fmt.Sprintf("field %d", i), "value")
+	}
+	Set(key+" string", "value")
+
+	if enc := ObjectEncoding(key); enc != "hashtable" {
+		t.Errorf("Hash encoding is %q", enc)
+	}
+	if enc := ObjectEncoding(key + " string"); enc != "embstr" {
+		t.Errorf("String encoding is %q", enc)
+	}
+	if ObjectEncoding(key+" missing") != "" || ObjectIdletime(key+" missing") != -1 {
+		t.Error("Got an encoding or idle time for a missing key")
+	}
+	if idle := ObjectIdletime(key); idle != 0 {
+		t.Errorf("Idle time of a fresh key is %d", idle)
+	}
+	if freq := ObjectFreq(key); freq < lfuInitVal {
+		t.Errorf("Frequency of a used key is %d", freq)
+	}
+	if ObjectRefcount(key) != 1 {
+		t.Errorf("Reference count is %d", ObjectRefcount(key))
+	}
+
+	exact := MemoryUsage(key, 0)
+	if sampled := MemoryUsage(key, 5); sampled < exact*9/10 || sampled > exact*11/10 {
+		t.Errorf("Sampled usage %d is far from %d", sampled, exact)
+	}
+	if usage := MemoryUsage(key+" string", 0); usage != int64(keyOverhead+len(key+" string")+len("value")) {
+		t.Errorf("String usage is %d", usage)
+	}
+	if usage := MemoryUsage(key+" missing", 0); usage != 0 {
+		t.Errorf("Missing key usage is %d", usage)
+	}
+
+	stats := MemoryStats()
+	if stats["keys.count"] < 2 || stats["total.allocated"] != stats["overhead.total"]+stats["dataset.bytes"] ||
+		stats["peak.allocated"] < stats["total.allocated"] {
+		t.Errorf("Inconsistent memory stats %v", stats)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	key := "TestInfo"
+	Set(key, "value")
+	Expire(key, 100)
+	Get(key)
+	Get(key + " missing")
+
+	info := Info()
+	for _, field := range []string{"# Server\r\n", "uptime_in_seconds:", "# Clients\r\n", "used_memory:",
+		"rdb_last_bgsave_status:", "total_commands_processed:", "keyspace_hits:", "keyspace_misses:",
+		"pubsub_patterns:", "# Keyspace\r\ndb0:keys="} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO lacks %q", field)
+		}
+	}
+	if strings.Contains(info, "cmdstat_") {
+		t.Error("Default INFO includes commandstats")
+	}
+
+	stats := Info("stats")
+	if strings.Contains(stats, "# Server") || !strings.HasPrefix(stats, "# Stats\r\n") {
+		t.Errorf("INFO stats returned other sections:\n%s", stats)
+	}
+	if !strings.Contains(Info("commandstats"), "cmdstat_get:calls=") {
+		t.Error("Calls to GET were not counted")
+	}
+	if Info("no such section") != "" {
+		t.Error("Unknown section was not empty")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	key := "TestMetrics"
+	Set(key, "value")
+	Get(key)
+	sub := Psubscribe(key + "*")
+	defer sub.Close()
+
+	for _, accept := range []string{"text/plain", "application/openmetrics-text; version=1.0.0"} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		MetricsHandler().ServeHTTP(w, r)
+
+		body := w.Body.String()
+		for _, line := range []string{
+			`redis_commands_total{cmd="get"} `,
+			`redis_command_duration_seconds_bucket{cmd="get",le="+Inf"} `,
+			`redis_keys{type="string"} `,
+			fmt.Sprintf(`redis_pubsub_pending_messages{subscription="%d"} 0`, sub.ID()),
+			"redis_rdb_save_failures_total ",
+			"redis_evicted_keys_total ",
+		} {
+			if !strings.Contains(body, line) {
+				t.Errorf("%s metrics lack %q", accept, line)
+			}
+		}
+		if openMetrics := strings.HasSuffix(body, "# EOF\n"); openMetrics != strings.HasPrefix(accept, "application/openmetrics-text") {
+			t.Errorf("Wrong format for %s", accept)
+		}
+	}
+
+	PublishExpvar()
+	PublishExpvar()
+	if v := expvar.Get("redis"); v == nil || !strings.Contains(v.String(), `"commands":`) {
+		t.Errorf("Expvar not published: %v", v)
+	}
+}
+
+func TestSlowlog(t *testing.T) {
+	SetSlowlogLogSlowerThan(0)
+	defer SetSlowlogLogSlowerThan(10 * time.Millisecond)
+	SlowlogReset()
+
+	key := "TestSlowlog"
+	long := strings.Repeat("x", 200)
+	Set(key, long)
+	ObjectEncoding(key)
+
+	// SLOWLOG commands are logged too, starting with the RESET.
+	entries := SlowlogGet(-1)
+	if len(entries) != 3 || SlowlogLen() != 4 {
+		t.Fatalf("Got %d entries, %d logged: %v", len(entries), SlowlogLen(), entries)
+	}
+	if got := fmt.Sprint(entries[0].Args); got != "[object encoding TestSlowlog]" {
+		t.Errorf("Newest entry is %s", got)
+	}
+	if got := entries[1].Args[2]; got != strings.Repeat("x", 128)+"... (72 more bytes)" {
+		t.Errorf("Long argument logged as %q", got)
+	}
+	if entries[0].ID <= entries[1].ID {
+		t.Errorf("IDs %d and %d do not increase", entries[1].ID, entries[0].ID)
+	}
+
+	// Arguments built only when needed are logged all the same.
+	Lrange(key, 0, -1)
+	if got := fmt.Sprint(SlowlogGet(1)[0].Args); got != "[lrange TestSlowlog 0 -1]" {
+		t.Errorf("Newest entry is %s", got)
+	}
+
+	SetSlowlogMaxLen(1)
+	defer SetSlowlogMaxLen(128)
+	if n := len(SlowlogGet(10)); n != 1 {
+		t.Errorf("Kept %d entries beyond the max length", n)
+	}
+
+	SetSlowlogLogSlowerThan(-1)
+	SlowlogReset()
+	Get(key)
+	if SlowlogLen() != 0 {
+		t.Error("Disabled slow log logged a command")
+	}
+}
+
+func TestLatencyMonitor(t *testing.T) {
+	LatencyReset()
+	if !strings.HasPrefix(LatencyDoctor(), "Dave, no latency spike") {
+		t.Error("Doctor found spikes before any was recorded")
+	}
+
+	SetLatencyMonitorThreshold(time.Nanosecond)
+	Get("TestLatencyMonitor")
+	SetLatencyMonitorThreshold(0)
+
+	latest := LatencyLatest()
+	if len(latest) == 0 || latest[0].Name != "command" || latest[0].Max < latest[0].Latest {
+		t.Fatalf("Latest events %+v", latest)
+	}
+	if n := len(LatencyHistory("command")); n != 1 {
+		t.Errorf("Got %d samples in the same second", n)
+	}
+	if doctor := LatencyDoctor(); !strings.Contains(doctor, "1. command: 1 latency spikes") {
+		t.Errorf("Doctor said:\n%s", doctor)
+	}
+	if n := LatencyReset("command", "no such event"); n != 1 {
+		t.Errorf("Reset %d events", n)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	m := Monitor()
+
+	key := "TestMonitor"
+	Set(key, "two\nlines")
+	Rpush(key+" queue", "a", "b")
+	m.Close()
+	m.Close()
+
+	var events []MonitorEvent
+	for ev := range m.Channel {
+		if strings.HasPrefix(ev.Args[1], key) {
+			events = append(events, ev)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("Got %d events: %v", len(events), events)
+	}
+
+	if !strings.HasPrefix(events[0].Client, "all_test.go:") {
+		t.Errorf("Client is %q, not the test", events[0].Client)
+	}
+	line := events[0].String()
+	if !strings.HasSuffix(line, " [0 "+events[0].Client+`] "set" "TestMonitor" "two\nlines"`) {
+		t.Errorf("Monitor line %s", line)
+	}
+	if got := fmt.Sprint(events[1].Args); got != "[rpush TestMonitor queue a b]" {
+		t.Errorf("Got arguments %s", got)
+	}
+
+	Get(key)
+	if m.Dropped() != 0 {
+		t.Errorf("Closed monitor dropped %d commands", m.Dropped())
+	}
+}
+
+func TestShardedMultiKeyLocking(t *testing.T) {
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("TestShardedMultiKeyLocking %d", i)
+	}
+
+	// Goroutines deleting the same keys in opposite orders would deadlock if
+	// shards were not locked in a fixed order.
+	var w sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		w.Add(1)
+		go func(g int) {
+			defer w.Done()
+			for i := 0; i < 100; i++ {
+				for _, k := range keys {
+					Set(k, "v")
+				}
+				order := append([]string(nil), keys...)
+				if g%2 == 1 {
+					for l, r := 0, len(order)-1; l < r; l, r = l+1, r-1 {
+						order[l], order[r] = order[r], order[l]
+					}
+				}
+				Del(order...)
+			}
+		}(g)
+	}
+	w.Wait()
+
+	for _, k := range keys {
+		if Exists(k) != 0 {
+			t.Errorf("%q still exists", k)
+		}
+	}
+}
+
+// parallelKeys hands every goroutine of a parallel benchmark its own keys, so
+// that the benchmarks measure how shards scale rather than contention on a key.
+func parallelKeys(prefix string) func() func() string {
+	var goroutines int64
+	return func() func() string {
+		g := atomic.AddInt64(&goroutines, 1)
+		i := 0
+		return func() string {
+			i++
+			return fmt.Sprintf("%s %d %d", prefix, g, i%1024)
+		}
+	}
+}
+
+// Run the parallel benchmarks with -cpu 1,2,4,8,... to see how they scale with
+// GOMAXPROCS.
+func BenchmarkHSetParallel(b *testing.B) {
+	next := parallelKeys("BenchmarkHSetParallel")
+	b.RunParallel(func(pb *testing.PB) {
+		key := next()
+		for pb.Next() {
+			HSet(key(), "field", "value")
+		}
+	})
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	next := parallelKeys("BenchmarkSetParallel")
+	b.RunParallel(func(pb *testing.PB) {
+		key := next()
+		for pb.Next() {
+			Set(key(), "value")
+		}
+	})
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	next := parallelKeys("BenchmarkGetParallel")
+	b.RunParallel(func(pb *testing.PB) {
+		key := next()
+		for pb.Next() {
+			Get(key())
+		}
+	})
+}
+
+func BenchmarkRpushParallel(b *testing.B) {
+	next := parallelKeys("BenchmarkRpushParallel")
+	b.RunParallel(func(pb *testing.PB) {
+		key := next()
+		for pb.Next() {
+			Rpush(key(), "value")
+		}
+	})
+}
+
+func BenchmarkDelParallel(b *testing.B) {
+	next := parallelKeys("BenchmarkDelParallel")
+	b.RunParallel(func(pb *testing.PB) {
+		key := next()
+		for pb.Next() {
+			k := key()
+			Sadd(k, "member")
+			Del(k, k+" other")
+		}
+	})
+}
+
+func TestWrongType(t *testing.T) {
+	key := "TestWrongType"
+	Del(key)
+	errors := atomic.LoadUint64(&errorReplies)
+
+	Set(key, "a string")
+	if HSet(key, "field", "value") != 0 || Rpush(key, "a") != 0 || Sadd(key, "a") != 0 {
+		t.Errorf("Wrote to a string as another type")
+	}
+	if HGet(key, "field") != "" || Llen(key) != 0 || Scard(key) != 0 || len(Smembers(key)) != 0 {
+		t.Errorf("Read a string as another type")
+	}
+	if Type(key) != "string" || Get(key) != "a string" {
+		t.Errorf("Type %q, value %q", Type(key), Get(key))
+	}
+	if n := atomic.LoadUint64(&errorReplies) - errors; n != 7 {
+		t.Errorf("Counted %d errors", n)
+	}
+
+	// TestPubSubMultiple's subscription to .*list.* outlives it, so the keys
+	// here avoid that name.
+	Rpush(key+" l", "a", "b")
+	if Incr(key+" l") != "" || Get(key+" l") != "" {
+		t.Errorf("Incremented a list")
+	}
+
+	// SET overwrites a key of any type, and its timeout.
+	HSet(key+" h", "field", "value")
+	Expire(key+" h", 100)
+	Set(key+" h", "now a string")
+	if Type(key+" h") != "string" || Ttl(key+" h") != -1 || HGet(key+" h", "field") != "" {
+		t.Errorf("SET did not replace the hash")
+	}
+	if Setnx(key+" l", "x") != 0 {
+		t.Errorf("SETNX replaced a list")
+	}
+
+	if n := Del(key, key+" l", key+" h"); n != 3 {
+		t.Errorf("Deleted %d keys", n)
+	}
+}
+
+func TestQuicklist(t *testing.T) {
+	SetListMaxListpackSize(4)
+	SetListCompressDepth(1)
+	defer SetListMaxListpackSize(-2)
+	defer SetListCompressDepth(0)
+
+	// Not named after the test, which TestPubSubMultiple's .*list.*
+	// subscription would match.
+	key := "TestQuickDeque"
+	Del(key)
+
+	var want List
+	for i := 0; i < 50; i++ {
+		v := fmt.Sprintf("element %d %s", i, strings.Repeat("x", 20))
+		if i%2 == 0 {
+			Rpush(key, v)
+			want = append(want, v)
+		} else {
+			Lpush(key, v)
+			want = append(List{v}, want...)
+		}
+	}
+
+	if n := Llen(key); n != len(want) {
+		t.Fatalf("Length %d", n)
+	}
+	if got := Lrange(key, 0, -1); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Got %v", got)
+	}
+	if got := Lrange(key, 9, 20); fmt.Sprint(got) != fmt.Sprint(want[9:21]) {
+		t.Errorf("Got %v", got)
+	}
+	if got := Lrange(key, -100, 2); fmt.Sprint(got) != fmt.Sprint(want[:3]) {
+		t.Errorf("Out of range start got %v", got)
+	}
+	if got := Lrange(key, 48, 100); fmt.Sprint(got) != fmt.Sprint(want[48:]) {
+		t.Errorf("Out of range stop got %v", got)
+	}
+	for _, i := range []int{0, 7, 25, 42, -1, -13} {
+		w := want[(i+len(want))%len(want)]
+		if got := Lindex(key, i); got != w {
+			t.Errorf("Index %d is %q, not %q", i, got, w)
+		}
+	}
+	if Lindex(key, 50) != "" || Lindex(key, -51) != "" {
+		t.Errorf("Indexes out of range found elements")
+	}
+
+	s := shardFor(key)
+	s.mu.RLock()
+	q := s.entries[key].value.(*quicklist)
+	compressed := 0
+	for node := q.head; node != nil; node = node.next {
+		if node.entries == nil {
+			compressed++
+		}
+	}
+	if q.head.entries == nil || q.tail.entries == nil || compressed != q.nodes-2 {
+		t.Errorf("%d of %d nodes compressed", compressed, q.nodes)
+	}
+	s.mu.RUnlock()
+
+	for len(want) > 1 {
+		if v := Lpop(key); v != want[0] {
+			t.Fatalf("Popped %q from the head, not %q", v, want[0])
+		}
+		if v := Rpop(key); v != want[len(want)-1] {
+			t.Fatalf("Popped %q from the tail, not %q", v, want[len(want)-1])
+		}
+		want = want[1 : len(want)-1]
+	}
+	if Exists(key) != 0 || Lpop(key) != "" {
+		t.Errorf("Emptied list still exists")
+	}
+
+	// Pushes and pops at the head do not copy the elements, and a list used as
+	// a queue keeps to the room it needs.
+	var l listpackList
+	for i := 0; i < 1000; i++ {
+		l.pushHead(strconv.Itoa(i))
+	}
+	l.popHead()
+	second := &l.view()[1]
+	l.popHead()
+	l.pushHead("x")
+	l.pushHead("y")
+	if &l.view()[2] != second {
+		t.Error("Pushes and pops at the head moved the other elements")
+	}
+	for i := 0; i < 10000; i++ {
+		l.pushTail(strconv.Itoa(i))
+		l.popHead()
+	}
+	if first, _ := l.index(0); first != "9000" || l.len() != 1000 {
+		t.Errorf("Queue holds %d elements from %q", l.len(), first)
+	}
+	if cap(l.entries) > 4*l.len() {
+		t.Errorf("Queue of %d elements takes room for %d", l.len(), cap(l.entries))
+	}
+}
+
+func TestCompactEncodings(t *testing.T) {
+	key := "TestCompactEncodings"
+	SetHashMaxListpackEntries(4)
+	SetSetMaxIntsetEntries(4)
+	SetSetMaxListpackEntries(4)
+	SetListMaxListpackSize(4)
+	defer SetHashMaxListpackEntries(128)
+	defer SetSetMaxIntsetEntries(512)
+	defer SetSetMaxListpackEntries(128)
+	defer SetListMaxListpackSize(-2)
+
+	Set(key+" int", "-42")
+	Set(key+" long", strings.Repeat("x", 45))
+	if ObjectEncoding(key+" int") != "int" || ObjectEncoding(key+" long") != "raw" {
+		t.Errorf("String encodings %q and %q", ObjectEncoding(key+" int"), ObjectEncoding(key+" long"))
+	}
+
+	encodings := func(k string, add func(i int), want ...string) {
+		for i, enc := range want {
+			add(i)
+			if got := ObjectEncoding(k); got != enc {
+				t.Errorf("%s is %q after %d additions, not %q", k, got, i+1, enc)
+			}
+		}
+	}
+
+	encodings(key+" hash", func(i int) { HSet(key+" hash", fmt.Sprint("field ", i), "value") },
+		"listpack", "listpack", "listpack", "listpack", "hashtable")
+	HSet(key+" long value", "field", strings.Repeat("x", 65))
+	if ObjectEncoding(key+" long value") != "hashtable" {
+		t.Errorf("Hash with a long value is %q", ObjectEncoding(key+" long value"))
+	}
+	if HGet(key+" hash", "field 2") != "value" || len(Hkeys(key+" hash")) != 5 {
+		t.Errorf("Converted hash lost fields: %v", Hkeys(key+" hash"))
+	}
+
+	encodings(key+" ints", func(i int) { Sadd(key+" ints", fmt.Sprint(i)) },
+		"intset", "intset", "intset", "intset", "hashtable")
+	encodings(key+" mixed", func(i int) {
+		if i == 1 {
+			Sadd(key+" mixed", "a")
+		} else {
+			Sadd(key+" mixed", fmt.Sprint(i))
+		}
+	}, "intset", "listpack", "listpack", "listpack", "hashtable")
+	if Scard(key+" mixed") != 5 || Sadd(key+" mixed", "a") != 0 {
+		t.Errorf("Converted set has %d members", Scard(key+" mixed"))
+	}
+	Sadd(key+" padded", "007")
+	if ObjectEncoding(key+" padded") != "listpack" {
+		t.Errorf("Set of a non-canonical integer is %q", ObjectEncoding(key+" padded"))
+	}
+
+	encodings(key+" deque", func(i int) { Rpush(key+" deque", fmt.Sprint(i)) },
+		"listpack", "listpack", "listpack", "listpack", "quicklist")
+	if got := Lrange(key+" deque", 0, -1); fmt.Sprint(got) != "[0 1 2 3 4]" {
+		t.Errorf("Converted list is %v", got)
+	}
+
+	small := MemoryUsage(key+" ints", 0)
+	Sadd(key+" small ints", "1", "2", "3", "4")
+	if compact := MemoryUsage(key+" small ints", 0); compact >= small {
+		t.Errorf("Intset uses %d bytes, the hashtable %d", compact, small)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	key := "TestBinaryValues \xff\xfe"
+	blob := []byte{0, 1, 0xff, 0xc3, 0x28, '\n', '"'}
+	marked := "\x00base64:not base64"
+
+	SetBytes(key, blob)
+	Set(key+" marked", marked)
+	HSetBytes(key+" hash", "\x80field", blob)
+	RpushBytes(key+" deque", blob, []byte("text"))
+	SaddBytes(key+" set", blob)
+
+	if got := GetBytes(key); !bytes.Equal(got, blob) || Get(key) != string(blob) {
+		t.Errorf("GetBytes returned %q", got)
+	}
+	if got := HGetBytes(key+" hash", "\x80field"); !bytes.Equal(got, blob) {
+		t.Errorf("HGetBytes returned %q", got)
+	}
+	if got := LrangeBytes(key+" deque", 0, -1); len(got) != 2 || !bytes.Equal(got[0], blob) {
+		t.Errorf("LrangeBytes returned %q", got)
+	}
+
+	// Missing values are nil, empty ones are not.
+	if got := GetBytes(key + " missing"); got != nil {
+		t.Errorf("GetBytes of a missing key returned %q", got)
+	}
+	if got := HGetBytes(key+" hash", "missing"); got != nil {
+		t.Errorf("HGetBytes of a missing field returned %q", got)
+	}
+	if got := LpopBytes(key + " missing"); got != nil {
+		t.Errorf("LpopBytes of a missing key returned %q", got)
+	}
+	if got := LindexBytes(key+" deque", 5); got != nil {
+		t.Errorf("LindexBytes out of range returned %q", got)
+	}
+	SetBytes(key+" empty", nil)
+	defer Del(key + " empty")
+	if got := GetBytes(key + " empty"); got == nil || len(got) != 0 {
+		t.Errorf("GetBytes of an empty string returned %#v", got)
+	}
+
+	fileName := filepath.Join(os.TempDir(), fmt.Sprintf("localRedisTest.%d.binary.json", os.Getpid()))
+	defer os.Remove(fileName)
+	if err := Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	Del(key, key+" marked", key+" hash", key+" deque", key+" set")
+	InitDB(fileName)
+
+	if got := GetBytes(key); !bytes.Equal(got, blob) {
+		t.Errorf("String loaded from the dump is %q", got)
+	}
+	if got := Get(key + " marked"); got != marked {
+		t.Errorf("String with the base64 prefix loaded as %q", got)
+	}
+	if got := HGetBytes(key+" hash", "\x80field"); !bytes.Equal(got, blob) {
+		t.Errorf("Hash value loaded from the dump is %q", got)
+	}
+	if got := LpopBytes(key + " deque"); !bytes.Equal(got, blob) {
+		t.Errorf("List element loaded from the dump is %q", got)
+	}
+	if got := SmembersBytes(key + " set"); len(got) != 1 || !bytes.Equal(got[0], blob) {
+		t.Errorf("Set loaded from the dump is %q", got)
+	}
+}
+
+func TestEval(t *testing.T) {
+	key := "TestEval"
+	defer Del(key, key+" counter", key+" hash", key+" deque")
+
+	tests := []struct {
+		script string
+		keys   []string
+		args   []string
+		want   interface{}
+	}{
+		{"return 1 + 2 * 3 ^ 2 % 5", nil, nil, int64(4)},
+		{"return 3.99", nil, nil, int64(3)},
+		{"return 'a' .. 1 .. 2.5", nil, nil, "a12.5"},
+		{"return {1, 'two', {3}, nil, 5}", nil, nil, []interface{}{int64(1), "two", []interface{}{int64(3)}}},
+		{"return true", nil, nil, int64(1)},
+		{"return false", nil, nil, nil},
+		{"return {KEYS[1], ARGV[1], #ARGV}", []string{key}, []string{"x", "y"}, []interface{}{key, "x", int64(2)}},
+		{"return redis.call('set', KEYS[1], ARGV[1])", []string{key}, []string{"v"}, "OK"},
+		{"return redis.call('get', KEYS[1])", []string{key}, nil, "v"},
+		{"return redis.call('GET', KEYS[1] .. ' missing') == false", []string{key}, nil, int64(1)},
+		{"return redis.status_reply('PONG')", nil, nil, "PONG"},
+		{"return redis.call('incr', KEYS[1]) + redis.call('incr', KEYS[1])", []string{key + " counter"}, nil, int64(3)},
+		{"redis.call('hset', KEYS[1], 'a', 1, 'b', 2) return redis.call('hget', KEYS[1], 'b')", []string{key + " hash"}, nil, "2"},
+		{"redis.call('rpush', KEYS[1], 'a', 'b', 'c') return redis.call('lrange', KEYS[1], 0, -1)", []string{key + " deque"}, nil, []interface{}{"a", "b", "c"}},
+		{"return redis.pcall('incr', KEYS[1])['err']", []string{key}, nil, "ERR value is not an integer or out of range"},
+		{"local ok, err = pcall(error, {code = 42}) return err.code", nil, nil, int64(42)},
+		{"local ok, err = pcall(error, 'boom') return {tostring(ok), err}", nil, nil, []interface{}{"false", "user_script:1: boom"}},
+
+		// The language and its libraries.
+		{`local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(20)`, nil, nil, int64(6765)},
+		{`local t = {} for i = 1, 10 do t[#t+1] = function() return i end end return t[3]() + t[10]()`, nil, nil, int64(13)},
+		{`local s = 0 for k, v in pairs({a = 1, b = 2, 3}) do s = s + v end return s`, nil, nil, int64(6)},
+		{`local s = '' for i, v in ipairs({'a', 'b', nil, 'd'}) do s = s .. i .. v end return s`, nil, nil, "1a2b"},
+		{`local n = 0 while true do n = n + 1 if n == 5 then break end end repeat n = n + 1 until n > 7 return n`, nil, nil, int64(8)},
+		{`local function f(...) return select('#', ...), select(2, ...) end return {f(1, 2, 3)}`, nil, nil, []interface{}{int64(3), int64(2), int64(3)}},
+		{`local a, b, c = (function() return 1, 2 end)() return {a, b, c == nil}`, nil, nil, []interface{}{int64(1), int64(2), int64(1)}},
+		{`return string.format('%5.2f|%d|%s|%x|%q', 3.14159, 42, 'hi', 255, 'a"b')`, nil, nil, ` 3.14|42|hi|ff|"a\"b"`},
+		{`return {string.find('hello world', 'o w'), string.find('hello', 'l+')}`, nil, nil, []interface{}{int64(5), int64(3), int64(4)}},
+		{`return {string.match('key:123:abc', '(%a+):(%d+)')}`, nil, nil, []interface{}{"key", "123"}},
+		{`return (string.gsub('hello world', '(%w+)', '<%1>'))`, nil, nil, "<hello> <world>"},
+		{`local t = {} for w in string.gmatch('one two  three', '%S+') do t[#t+1] = w end return t`, nil, nil, []interface{}{"one", "two", "three"}},
+		{`return ('abc'):upper() .. ('x'):rep(3) .. string.sub('hello', -3) .. #'four'`, nil, nil, "ABCxxxllo4"},
+		{`local t = {5, 2, 8, 1} table.sort(t) table.insert(t, 1, 0) table.remove(t) return table.concat(t, ',')`, nil, nil, "0,1,2,5"},
+		{`local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return t`, nil, nil, []interface{}{int64(3), int64(2), int64(1)}},
+		{`return {math.floor(-3.5), math.max(1, 5, 3), math.fmod(7, 3), tonumber('0x10'), tonumber('z', 36), tonumber('x')}`, nil, nil, []interface{}{int64(-4), int64(5), int64(1), int64(16), int64(35)}},
+		{`return {bit.band(12, 10), bit.bor(12, 10), bit.bxor(12, 10), bit.lshift(1, 4), bit.tohex(255, 4)}`, nil, nil, []interface{}{int64(8), int64(14), int64(6), int64(16), "00ff"}},
+		{`return cjson.encode({a = 1, b = {1, 2, 'x'}, c = true})`, nil, nil, `{"a":1,"b":[1,2,"x"],"c":true}`},
+		{`local v = cjson.decode('{"name":"x","list":[1,2,{"n":null}]}') return {v.name, v.list[2], tostring(v.list[3].n == cjson.null)}`, nil, nil, []interface{}{"x", int64(2), "true"}},
+		{`local mt = {__add = function(a, b) return a.v + b.v end, __index = function(t, k) return k .. '!' end}
+		  local a = setmetatable({v = 1}, mt) local b = setmetatable({v = 2}, mt)
+		  return {a + b, a.missing}`, nil, nil, []interface{}{int64(3), "missing!"}},
+		{`return redis.sha1hex('')`, nil, nil, "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{`return {math.random(10), math.random(10)}`, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := Eval(tt.script, tt.keys, tt.args...)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", tt.script, err)
+			continue
+		}
+		if tt.want == nil && strings.Contains(tt.script, "random") {
+			// random is seeded the same way for every script.
+			again, _ := Eval(tt.script, nil)
+			if !reflect.DeepEqual(got, again) {
+				t.Errorf("math.random returned %v, then %v", got, again)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", tt.script, got, tt.want)
+		}
+	}
+
+	errorTests := []struct {
+		script string
+		want   string
+	}{
+		{"return x", "ERR user_script:1: Script attempted to access nonexistent global variable 'x'"},
+		{"x = 1", "ERR user_script:1: Attempt to modify a readonly table"},
+		{"local t = nil\nreturn t.field", "ERR user_script:2: attempt to index local 't' (a nil value)"},
+		{"return 1 +", "ERR Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'"},
+		{"return redis.call('incr', KEYS[1])", "ERR value is not an integer or out of range"},
+		{"return redis.call('nosuchcommand')", "ERR unknown command 'nosuchcommand'"},
+		{"return redis.error_reply('MY failure')", "MY failure"},
+		{"error('plain')", "ERR user_script:1: plain"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+		{"string.upper = nil", "Attempt to modify a readonly table"},
+	}
+	for _, tt := range errorTests {
+		_, err := Eval(tt.script, []string{key})
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) && !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Eval(%q) failed with %v, want %q", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestEvalSha(t *testing.T) {
+	key := "TestEvalSha"
+	defer Del(key)
+
+	script := "return redis.call('incr', KEYS[1])"
+	sha, err := ScriptLoad(script)
+	if err != nil || sha != "2bab3b661081db58bd2341920e0ba7cf5dc77b25" {
+		t.Fatalf("ScriptLoad returned %q, %v", sha, err)
+	}
+	if got := ScriptExists(sha, "ffffffffffffffffffffffffffffffffffffffff"); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Errorf("ScriptExists returned %v", got)
+	}
+	if got, err := EvalSha(strings.ToUpper(sha), []string{key}); got != int64(1) || err != nil {
+		t.Errorf("EvalSha returned %v, %v", got, err)
+	}
+
+	ScriptFlush()
+	if _, err := EvalSha(sha, []string{key}); err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		t.Errorf("EvalSha of a flushed script failed with %v", err)
+	}
+	if got, _ := Eval(script, []string{key}); got != int64(2) {
+		t.Errorf("Eval returned %v", got)
+	}
+	if got := ScriptExists(sha); got[0] != 1 {
+		t.Error("Eval did not cache the script")
+	}
+}
+
+func TestEvalAtomic(t *testing.T) {
+	key := "TestEvalAtomic"
+	defer Del(key, key+" lock")
+
+	// A rate limiter: INCR and EXPIRE must not be split by other commands.
+	limiter := `
+local current = redis.call('incr', KEYS[1])
+if current == 1 then
+	redis.call('expire', KEYS[1], ARGV[2])
+end
+if current > tonumber(ARGV[1]) then
+	return 0
+end
+return 1`
+	var wg sync.WaitGroup
+	var allowed int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				got, err := Eval(limiter, []string{key}, "50", "60")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				atomic.AddInt64(&allowed, got.(int64))
+				Get(key)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 50 || Get(key) != "100" || Ttl(key) <= 0 {
+		t.Errorf("Rate limiter allowed %d of %s calls, TTL %d", allowed, Get(key), Ttl(key))
+	}
+
+	// Releasing a lock only held by the caller.
+	release := `
+if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+	Set(key+" lock", "owner")
+	if got, _ := Eval(release, []string{key + " lock"}, "other"); got != int64(0) || Get(key+" lock") != "owner" {
+		t.Errorf("Lock released by another owner: %v", got)
+	}
+	if got, _ := Eval(release, []string{key + " lock"}, "owner"); got != int64(1) || Exists(key+" lock") != 0 {
+		t.Errorf("Lock not released by its owner: %v", got)
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	key := "TestScriptKill"
+	defer Del(key)
+	defer SetLuaTimeLimit(5 * time.Second)
+	SetLuaTimeLimit(50 * time.Millisecond)
+
+	if err := ScriptKill(); err == nil || !strings.HasPrefix(err.Error(), "NOTBUSY") {
+		t.Errorf("ScriptKill with no script running failed with %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := Eval("while true do end", nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := ScriptKill(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "Script killed") {
+		t.Errorf("Killed script failed with %v", err)
+	}
+
+	// Scripts that wrote cannot be killed, and run to the end.
+	go func() {
+		_, err := Eval("redis.call('set', KEYS[1], 'x') local n = 0 while n < 1e6 do n = n + 1 end", []string{key})
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := ScriptKill(); err == nil || !strings.HasPrefix(err.Error(), "UNKILLABLE") {
+		t.Errorf("ScriptKill of a script that wrote failed with %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	key := "TestFunctions"
+	defer Del(key, key+" stock")
+	defer FunctionFlush()
+
+	lib := Library{Name: "inventory", Functions: []Function{
+		{
+			Name:        "reserve",
+			Description: "Takes n items from stock, if there are enough.",
+			Fn: func(fc *FunctionCall) (interface{}, error) {
+				stock, err := fc.Call("get", fc.Keys[0])
+				if err != nil {
+					return nil, err
+				}
+				have, _ := strconv.Atoi(fmt.Sprint(stock))
+				want, _ := strconv.Atoi(fc.Args[0])
+				if have < want {
+					return nil, errors.New("ERR not enough stock")
+				}
+				return fc.Call("set", fc.Keys[0], strconv.Itoa(have-want))
+			},
+		},
+		{
+			Name:  "stock",
+			Flags: FunctionNoWrites,
+			Fn: func(fc *FunctionCall) (interface{}, error) {
+				return fc.Call("get", fc.Keys[0])
+			},
+		},
+		{
+			Name:  "sneaky",
+			Flags: FunctionNoWrites,
+			Fn: func(fc *FunctionCall) (interface{}, error) {
+				return fc.Call("set", fc.Keys[0], "0")
+			},
+		},
+	}}
+	if name, err := FunctionLoad(lib, false); name != "inventory" || err != nil {
+		t.Fatalf("FunctionLoad returned %q, %v", name, err)
+	}
+	if _, err := FunctionLoad(lib, false); err == nil || err.Error() != "ERR Library 'inventory' already exists" {
+		t.Errorf("Loading a library twice failed with %v", err)
+	}
+	if _, err := FunctionLoad(lib, true); err != nil {
+		t.Errorf("Replacing a library failed with %v", err)
+	}
+	clash := Library{Name: "other", Functions: []Function{{Name: "stock", Fn: lib.Functions[1].Fn}}}
+	if _, err := FunctionLoad(clash, false); err == nil || err.Error() != "ERR Function stock already exists" {
+		t.Errorf("Loading a function twice failed with %v", err)
+	}
+	if _, err := FunctionLoad(Library{Name: "bad-name", Functions: lib.Functions}, false); err == nil {
+		t.Error("Library with an invalid name loaded")
+	}
+
+	Set(key+" stock", "10")
+	var wg sync.WaitGroup
+	var reserved int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Fcall("reserve", []string{key + " stock"}, "3"); err == nil {
+				atomic.AddInt64(&reserved, 1)
+			} else if err.Error() != "ERR not enough stock" {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 3 || Get(key+" stock") != "1" {
+		t.Errorf("%d reservations left %s in stock", reserved, Get(key+" stock"))
+	}
+
+	if got, err := FcallRo("stock", []string{key + " stock"}); got != "1" || err != nil {
+		t.Errorf("FcallRo returned %v, %v", got, err)
+	}
+	if _, err := FcallRo("reserve", []string{key + " stock"}, "1"); err == nil || !strings.Contains(err.Error(), "write flag") {
+		t.Errorf("FcallRo of a writing function failed with %v", err)
+	}
+	if _, err := Fcall("sneaky", []string{key + " stock"}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Write from a no-writes function failed with %v", err)
+	}
+	if _, err := Fcall("missing", nil); err == nil || err.Error() != "ERR Function not found" {
+		t.Errorf("Fcall of a missing function failed with %v", err)
+	}
+
+	list, err := FunctionList("inv*")
+	if err != nil || len(list) != 1 || len(list[0].Functions) != 3 || list[0].Functions[1].Flags[0] != "no-writes" {
+		t.Errorf("FunctionList returned %+v, %v", list, err)
+	}
+	if list, err := FunctionList("^inv"); err != nil || len(list) != 0 {
+		t.Errorf("FunctionList matched a regular expression: %+v, %v", list, err)
+	}
+	if _, err := FunctionList("inv[a-"); err == nil {
+		t.Error("FunctionList accepted an invalid pattern")
+	}
+	if err := FunctionDelete("inventory"); err != nil {
+		t.Error(err)
+	}
+	if err := FunctionDelete("inventory"); err == nil {
+		t.Error("Deleted a library twice")
+	}
+	if _, err := Fcall("stock", []string{key + " stock"}); err == nil {
+		t.Error("Function of a deleted library ran")
+	}
+}
+
+// commandsOn returns how many commands fn runs on key.
+func commandsOn(key string, fn func()) int {
+	m := Monitor()
+	fn()
+	m.Close()
+
+	n := 0
+	for ev := range m.Channel {
+		if len(ev.Args) > 1 && ev.Args[1] == key {
+			n++
+		}
+	}
+	return n
+}
+
+func TestClientTracking(t *testing.T) {
+	key := "TestClientTracking"
+	defer Del(key, key+" hash", "other:"+key)
+
+	invalidated := make(chan []string, 10)
+	var push bytes.Buffer
+	var pushMu sync.Mutex
+	c, err := ClientTracking(TrackingOptions{
+		OnInvalidate: func(keys []string) { invalidated <- keys },
+		Push:         writerFunc(func(p []byte) (int, error) { pushMu.Lock(); defer pushMu.Unlock(); return push.Write(p) }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	Set(key, "v1")
+	HSet(key+" hash", "f", "1")
+	if n := commandsOn(key, func() {
+		for i := 0; i < 5; i++ {
+			if got := c.Get(key); got != "v1" {
+				t.Errorf("Get returned %q", got)
+			}
+		}
+	}); n != 1 {
+		t.Errorf("5 cached reads ran %d commands", n)
+	}
+	if got := c.Hgetall(key + " hash").Get("f"); got != "1" {
+		t.Errorf("Hgetall returned %q for f", got)
+	}
+
+	Set(key, "v2")
+	select {
+	case keys := <-invalidated:
+		if len(keys) != 1 || keys[0] != key {
+			t.Errorf("Invalidated %v", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No invalidation")
+	}
+	if got := c.Get(key); got != "v2" {
+		t.Errorf("Get after a change returned %q", got)
+	}
+	HSet(key+" hash", "f", "2")
+	if got := c.Hgetall(key + " hash").Get("f"); got != "2" {
+		t.Errorf("Hgetall after a change returned %q", got)
+	}
+	<-invalidated
+
+	// Keys are only invalidated once until they are read again.
+	Set(key, "v3")
+	<-invalidated
+	Set(key, "v4")
+	Set("other:"+key, "x")
+	select {
+	case keys := <-invalidated:
+		t.Errorf("Invalidated %v, which were not read again", keys)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pushMu.Lock()
+	if !strings.HasPrefix(push.String(), ">2\r\n$10\r\ninvalidate\r\n*1\r\n$18\r\nTestClientTracking\r\n") {
+		t.Errorf("Push messages %q", push.String())
+	}
+	pushMu.Unlock()
+
+	if err := c.Caching(true); err == nil {
+		t.Error("Caching allowed without OPTIN or OPTOUT")
+	}
+	if _, err := ClientTracking(TrackingOptions{Prefixes: []string{"a"}}); err == nil {
+		t.Error("PREFIX allowed without BCAST")
+	}
+}
+
+func TestClientTrackingModes(t *testing.T) {
+	key := "TestClientTrackingModes"
+	defer Del(key, "user:"+key)
+
+	// BCAST: every change to a key with the prefix is invalidated, read or not.
+	invalidated := make(chan string, 10)
+	bcast, _ := ClientTracking(TrackingOptions{BCast: true, Prefixes: []string{"user:"}, NoLoop: true,
+		OnInvalidate: func(keys []string) { invalidated <- keys[0] }})
+	Set(key, "x")
+	Set("user:"+key, "1")
+	if got := <-invalidated; got != "user:"+key {
+		t.Errorf("BCAST invalidated %q", got)
+	}
+	bcast.Get("user:" + key)
+	if _, err := bcast.Do("set", "user:"+key, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := bcast.Get("user:" + key); got != "2" {
+		t.Errorf("Own write left %q in the near cache", got)
+	}
+	select {
+	case got := <-invalidated:
+		t.Errorf("NOLOOP client was told about its own write to %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	bcast.Close()
+
+	// OPTIN: only reads after Caching(true) are cached.
+	optin, _ := ClientTracking(TrackingOptions{OptIn: true})
+	defer optin.Close()
+	Set(key, "1")
+	if n := commandsOn(key, func() {
+		optin.Get(key)
+		optin.Get(key)
+		optin.Caching(true)
+		optin.Get(key)
+		optin.Get(key)
+		optin.Get(key)
+	}); n != 3 {
+		t.Errorf("OPTIN reads ran %d commands", n)
+	}
+
+	// Do caches read-only commands by their arguments.
+	if n := commandsOn(key, func() {
+		optin.Caching(true)
+		optin.Do("GET", key)
+		optin.Do("get", key)
+		optin.Do("strlen", key)
+	}); n != 1 {
+		t.Errorf("Reads with Do ran %d commands", n)
+	}
+
+	// Loading a key from an RDB stream drops a cached miss.
+	Set(key, "loaded")
+	var rdb bytes.Buffer
+	if err := WriteRDB(&rdb); err != nil {
+		t.Fatal(err)
+	}
+	Del(key)
+	optin.Caching(true)
+	if got := optin.Get(key); got != "" {
+		t.Errorf("Get of a deleted key returned %q", got)
+	}
+	if _, err := ReadRDB(&rdb); err != nil {
+		t.Fatal(err)
+	}
+	if got := optin.Get(key); got != "loaded" {
+		t.Errorf("Get after ReadRDB returned %q from the near cache", got)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	key := "TestClient"
+	c := NewClient(&Options{Addr: "localhost:6379"})
+	defer c.Del(ctx, key, key+" hash", key+" set", key+" queue", key+" n")
+
+	if got, err := c.Ping(ctx).Result(); got != "PONG" || err != nil {
+		t.Errorf("Ping returned %q, %v", got, err)
+	}
+	if err := c.Get(ctx, key).Err(); err != Nil {
+		t.Errorf("Get of a missing key returned %v", err)
+	}
+	if got, err := c.Set(ctx, key, 42, time.Minute).Result(); got != "OK" || err != nil {
+		t.Errorf("Set returned %q, %v", got, err)
+	}
+	if n, err := c.Get(ctx, key).Int(); n != 42 || err != nil {
+		t.Errorf("Get returned %d, %v", n, err)
+	}
+	if ttl := c.TTL(ctx, key).Val(); ttl != time.Minute {
+		t.Errorf("TTL returned %v", ttl)
+	}
+	if ok := c.SetNX(ctx, key, "x", 0).Val(); ok {
+		t.Error("SetNX set an existing key")
+	}
+	if ok := c.SetNX(ctx, key+" n", "x", 1500*time.Millisecond).Val(); !ok {
+		t.Error("SetNX did not set a missing key")
+	}
+	if ttl := c.PTTL(ctx, key+" n").Val(); ttl <= time.Second || ttl > 1500*time.Millisecond {
+		t.Errorf("PTTL returned %v", ttl)
+	}
+	if err := c.Set(ctx, key, "v", KeepTTL).Err(); err != nil || c.TTL(ctx, key).Val() != time.Minute {
+		t.Errorf("Set with KeepTTL returned %v, and left a TTL of %v", err, c.TTL(ctx, key).Val())
+	}
+	if _, err := c.Incr(ctx, key).Result(); err == nil || err.Error() != errNotInteger.Error() {
+		t.Errorf("Incr of a string returned %v", err)
+	}
+
+	c.HSet(ctx, key+" hash", map[string]interface{}{"a": 1, "b": true})
+	c.HSet(ctx, key+" hash", "c", 1.5)
+	if h := c.HGetAll(ctx, key+" hash").Val(); !reflect.DeepEqual(h, map[string]string{"a": "1", "b": "1", "c": "1.5"}) {
+		t.Errorf("HGetAll returned %v", h)
+	}
+	if _, err := c.HGet(ctx, key+" hash", "d").Result(); err != Nil {
+		t.Errorf("HGet of a missing field returned %v", err)
+	}
+	c.SAdd(ctx, key+" set", []string{"x", "y", "x"})
+	if n := c.SCard(ctx, key+" set").Val(); n != 2 {
+		t.Errorf("SCard returned %d", n)
+	}
+	c.RPush(ctx, key+" queue", "a", "b", "c")
+	if got := c.LRange(ctx, key+" queue", 0, -1).Val(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("LRange returned %v", got)
+	}
+	if got := c.LPop(ctx, key+" queue").Val(); got != "a" {
+		t.Errorf("LPop returned %q", got)
+	}
+
+	if got, err := c.Do(ctx, "GET", key).Text(); got != "v" || err != nil {
+		t.Errorf("Do returned %q, %v", got, err)
+	}
+	if err := c.Do(ctx, "nosuchcommand").Err(); err == nil || err.Error() != "ERR unknown command 'nosuchcommand'" {
+		t.Errorf("Do of an unknown command returned %v", err)
+	}
+	if got, err := c.Eval(ctx, "return redis.call('get', KEYS[1]) .. ARGV[1]", []string{key}, 1).Text(); got != "v1" || err != nil {
+		t.Errorf("Eval returned %q, %v", got, err)
+	}
+	if _, err := c.Set(ctx, key, struct{}{}, 0).Result(); err == nil {
+		t.Error("Set of a struct did not fail")
+	}
+
+	if keys, err := c.Keys(ctx, "*").Result(); err != nil || len(keys) < 2 {
+		t.Errorf("Keys * returned %v, %v", keys, err)
+	}
+	if keys := c.Keys(ctx, key+" h*").Val(); !reflect.DeepEqual(keys, []string{key + " hash"}) {
+		t.Errorf("Keys h* returned %v", keys)
+	}
+	if err := c.Keys(ctx, "[").Err(); err == nil {
+		t.Error("Keys with an invalid pattern did not fail")
+	}
+
+	if cmd := c.Exists(ctx, key, key+" hash", key+" missing"); cmd.Val() != 2 || cmd.String() != "exists TestClient TestClient hash TestClient missing: 2" {
+		t.Errorf("Exists returned %s", cmd)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Get(cancelled, key).Err(); err != context.Canceled {
+		t.Errorf("Get with a cancelled context returned %v", err)
+	}
+	c.Close()
+	if err := c.Get(ctx, key).Err(); err != ErrClosed {
+		t.Errorf("Get on a closed client returned %v", err)
+	}
+}
+
+func TestRedigoConn(t *testing.T) {
+	key := "TestRedigoConn"
+	defer Del(key, key+" hash", key+" n")
+
+	pool := &Pool{MaxIdle: 3, Dial: func() (Conn, error) { return Dial("tcp", ":6379") }}
+	conn := pool.Get()
+	defer conn.Close()
+
+	if got, err := conn.Do("SET", key, 1.5); got != "OK" || err != nil {
+		t.Errorf("SET returned %v, %v", got, err)
+	}
+	if got, err := conn.Do("GET", key); !reflect.DeepEqual(got, []byte("1.5")) || err != nil {
+		t.Errorf("GET returned %#v, %v", got, err)
+	}
+	if _, err := String(conn.Do("GET", key+" missing")); err != ErrNil {
+		t.Errorf("String of a nil reply returned %v", err)
+	}
+	if _, err := conn.Do("INCR", key); err == nil || err.Error() != errNotInteger.Error() {
+		t.Errorf("INCR of a float returned %v", err)
+	} else if _, ok := err.(Error); !ok {
+		t.Errorf("INCR returned a %T error", err)
+	}
+
+	if keys, err := Strings(conn.Do("KEYS", "*")); err != nil || len(keys) == 0 {
+		t.Errorf("KEYS * returned %v, %v", keys, err)
+	}
+	if keys, err := Strings(conn.Do("KEYS", "TestRedigo?onn")); !reflect.DeepEqual(keys, []string{key}) || err != nil {
+		t.Errorf("KEYS with ? returned %v, %v", keys, err)
+	}
+
+	// Pipelining.
+	conn.Send("HSET", key+" hash", "a", 1, "b", 2)
+	conn.Send("HGETALL", key+" hash")
+	conn.Send("INCR", key+" n")
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Int(conn.Receive()); n != 2 || err != nil {
+		t.Errorf("HSET returned %d, %v", n, err)
+	}
+	if h, err := StringMap(conn.Receive()); !reflect.DeepEqual(h, map[string]string{"a": "1", "b": "2"}) || err != nil {
+		t.Errorf("HGETALL returned %v, %v", h, err)
+	}
+	if n, err := Int(conn.Receive()); n != 1 || err != nil {
+		t.Errorf("INCR returned %d, %v", n, err)
+	}
+	if _, err := conn.Receive(); err == nil {
+		t.Error("Receive with no reply pending did not fail")
+	}
+
+	// Do returns the reply of its own command, after those sent before it.
+	conn.Send("INCR", key+" n")
+	if n, err := Int(conn.Do("INCR", key+" n")); n != 3 || err != nil {
+		t.Errorf("INCR returned %d, %v", n, err)
+	}
+
+	// Transactions.
+	conn.Send("MULTI")
+	conn.Send("INCR", key+" n")
+	conn.Send("HKEYS", key+" hash")
+	replies, err := Values(conn.Do("EXEC"))
+	if err != nil || len(replies) != 2 || replies[0] != int64(4) {
+		t.Errorf("EXEC returned %#v, %v", replies, err)
+	}
+	conn.Send("MULTI")
+	conn.Send("INCR", key+" n")
+	conn.Send("NOSUCHCOMMAND")
+	if _, err := conn.Do("EXEC"); err == nil || !strings.HasPrefix(err.Error(), "ERR unknown command") {
+		t.Errorf("EXEC with an unknown command returned %v", err)
+	}
+	if n, _ := Int(conn.Do("GET", key+" n")); n != 4 {
+		t.Errorf("Aborted transaction left %d", n)
+	}
+	if _, err := conn.Do("EXEC"); err == nil {
+		t.Error("EXEC without MULTI did not fail")
+	}
+
+	conn.Close()
+	if conn.Err() == nil {
+		t.Error("Closed connection has no error")
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000000000, 0))
+	defer SetClock(SetClock(clock))
+
+	key := "TestManualClock"
+	defer Del(key, key+" volatile")
+
+	Set(key, "v")
+	Expire(key, 10)
+	clock.Advance(9 * time.Second)
+	if ttl := Ttl(key); ttl != 1 {
+		t.Errorf("TTL after 9s is %d", ttl)
+	}
+	if idle := ObjectIdletime(key); idle != 9 {
+		t.Errorf("Idle time after 9s is %d", idle)
+	}
+	clock.Advance(time.Second)
+	if Exists(key) != 0 {
+		t.Error("Key outlived its TTL")
+	}
+
+	// Keys nobody reads are expired by the periodic job, when the clock moves.
+	Set(key+" volatile", "v")
+	Pexpire(key+" volatile", 50)
+	expired := atomic.LoadUint64(&expiredKeys)
+	clock.Advance(100 * time.Millisecond)
+	if got := atomic.LoadUint64(&expiredKeys) - expired; got != 1 {
+		t.Errorf("Active expiry expired %d keys", got)
+	}
+
+	// Periodic jobs run once however many periods the clock skips.
+	var runs []time.Time
+	stop := make(chan struct{})
+	every(time.Second, stop, func(now time.Time) { runs = append(runs, now) })
+	clock.Advance(500 * time.Millisecond)
+	if len(runs) != 0 {
+		t.Errorf("Job ran after half a period")
+	}
+	clock.Advance(500 * time.Millisecond)
+	clock.Advance(time.Hour)
+	if len(runs) != 2 || !runs[1].Equal(clock.Now()) {
+		t.Errorf("Job ran at %v", runs)
+	}
+	close(stop)
+	clock.Advance(time.Hour)
+	if len(runs) != 2 {
+		t.Errorf("Stopped job ran %d times", len(runs))
+	}
+
+	timer := clock.AfterFunc(time.Second, func() { t.Error("Stopped timer fired") })
+	if !timer.Stop() || timer.Stop() {
+		t.Error("Stop did not report the pending call once")
+	}
+	clock.Set(clock.Now().Add(time.Minute))
+
+	if clock := SetClock(nil); clock == nil {
+		t.Error("SetClock returned no clock")
+	}
+	if since := time.Since(timeNow()); since < 0 || since > time.Second {
+		t.Errorf("Restored clock is %v off", since)
+	}
+}
+
+func TestKeysGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{"*", []string{"", "a", "a\nb"}, nil},
+		{"h?llo", []string{"hello", "hallo"}, []string{"hllo", "heello", "hello!"}},
+		{"h*llo", []string{"hllo", "heeeello"}, []string{"hell"}},
+		{"h[ae]llo", []string{"hello", "hallo"}, []string{"hillo"}},
+		{"h[^e]llo", []string{"hallo", "hbllo"}, []string{"hello"}},
+		{"h[a-b]llo", []string{"hallo", "hbllo"}, []string{"hello"}},
+		{"h[b-a]llo", []string{"hallo"}, []string{"hello"}},
+		{`a\*b`, []string{"a*b"}, []string{"axb"}},
+		{"a.b(", []string{"a.b("}, []string{"axb("}},
+		{"a[]b", nil, []string{"ab", "axb"}},
+	} {
+		r, err := compileGlob(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+		for _, s := range test.match {
+			if !r.MatchString(s) {
+				t.Errorf("%q does not match %q", test.pattern, s)
+			}
+		}
+		for _, s := range test.nomatch {
+			if r.MatchString(s) {
+				t.Errorf("%q matches %q", test.pattern, s)
+			}
+		}
+	}
+	for _, pattern := range []string{"a[b", `a\`, `[a\`} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("%q is valid", pattern)
+		}
+	}
+
+	defer Del("TestKeysGlob:a", "TestKeysGlob:b")
+	Set("TestKeysGlob:a", "1")
+	Set("TestKeysGlob:b", "1")
+	got, err := Eval("return #redis.call('keys', '*')", nil)
+	if n, _ := got.(int64); err != nil || n < 2 {
+		t.Errorf("KEYS * returned %v, %v", got, err)
+	}
+	got, err = Eval("local k = redis.call('keys', 'TestKeysGlob:[a]') return k[1]", nil)
+	if err != nil || got != "TestKeysGlob:a" {
+		t.Errorf("KEYS with a set returned %v, %v", got, err)
+	}
+	if _, err := Eval("return redis.call('keys', 'a[')", nil); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("KEYS with an invalid pattern returned %v", err)
+	}
+	// The shards are not left locked.
+	Set("TestKeysGlob:a", "2")
+}
+
+func TestPublishBlockOtherShards(t *testing.T) {
+	a, b := "TestPublishBlock:a", "TestPublishBlock:b"
+	for i := 0; shardFor(b) == shardFor(a); i++ {
+		b = "TestPublishBlock:b" + strconv.Itoa(i)
+	}
+	defer Del(a, b)
+
+	sub, err := PsubscribeWithOptions(SubscriptionOptions{BufferSize: 1, Policy: Block}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	Set(a, "1")
+	stalled := make(chan struct{})
+	go func() {
+		Set(a, "2")
+		close(stalled)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		Set(b, "1")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("A stalled Block subscriber stalled a write to another shard")
+	}
+
+	<-sub.Channel
+	<-stalled
+}
@@ -0,0 +1,161 @@
+package redis
+
+import "strconv"
+
+// The commands below are the variants of the string commands of the same names
+// for values held as []byte, such as protobuf payloads or images. Values are
+// binary safe whichever variant stores them: a value set with SetBytes can be read
+// with Get, and the other way around.
+//
+// Values passed in are copied once, into the strings the keyspace holds, so the
+// caller may reuse its buffers, and values returned are copied once out of them,
+// so they are the caller's own to modify. The variants spare the caller the
+// conversions, not the copies: there is no zero-copy access to values. Values
+// read from keys, fields or elements that do not exist are nil, while existing
+// empty ones are empty but not nil.
+
+// SetBytes is SET for a value held as []byte.
+//
+// Return value
+// Simple string reply: OK.
+func SetBytes(key string, value []byte) string {
+	return Set(key, string(value))
+}
+
+// GetBytes is GET returning the value as []byte.
+//
+// Return value
+// Bulk string reply: the value of key, or nil when key does not exist.
+func GetBytes(key string) []byte {
+	defer call("get", key)()
+
+	return bulkBytes(getString(key))
+}
+
+// SetnxBytes is SETNX for a value held as []byte.
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the key was set
+// 0 if the key was not set
+func SetnxBytes(key string, value []byte) int {
+	return Setnx(key, string(value))
+}
+
+// HSetBytes is HSET for a value held as []byte.
+//
+// Return value
+// Integer reply, specifically:
+// 1 if field is a new field in the hash and value was set.
+// 0 if field already exists in the hash and the value was updated.
+func HSetBytes(key, field string, value []byte) int {
+	return HSet(key, field, string(value))
+}
+
+// HGetBytes is HGET returning the value as []byte.
+//
+// Return value
+// Bulk string reply: the value associated with field, or nil when field is not
+// present in the hash or key does not exist.
+func HGetBytes(key, field string) []byte {
+	defer call("hget", key, field)()
+
+	return bulkBytes(hget(key, field))
+}
+
+// RpushBytes is RPUSH for values held as []byte.
+//
+// Return value
+// Integer reply: the length of the list after the push operation.
+func RpushBytes(key string, value ...[]byte) int {
+	return Rpush(key, byteStrings(value)...)
+}
+
+// LpushBytes is LPUSH for values held as []byte.
+//
+// Return value
+// Integer reply: the length of the list after the push operations.
+func LpushBytes(key string, value ...[]byte) int {
+	return Lpush(key, byteStrings(value)...)
+}
+
+// LpopBytes is LPOP returning the element as []byte.
+//
+// Return value
+// Bulk string reply: the value of the first element, or nil when key does not
+// exist.
+func LpopBytes(key string) []byte {
+	defer call("lpop", key)()
+
+	return bulkBytes(pop(key, "lpop"))
+}
+
+// RpopBytes is RPOP returning the element as []byte.
+//
+// Return value
+// Bulk string reply: the value of the last element, or nil when key does not
+// exist.
+func RpopBytes(key string) []byte {
+	defer call("rpop", key)()
+
+	return bulkBytes(pop(key, "rpop"))
+}
+
+// LindexBytes is LINDEX returning the element as []byte.
+//
+// Return value
+// Bulk string reply: the requested element, or nil when index is out of range.
+func LindexBytes(key string, index int) []byte {
+	defer callKey("lindex", key, func() []string { return []string{strconv.Itoa(index)} })()
+
+	return bulkBytes(lindex(key, index))
+}
+
+// LrangeBytes is LRANGE returning the elements as []byte.
+//
+// Return value
+// Array reply: list of elements in the specified range.
+func LrangeBytes(key string, start, stop int) [][]byte {
+	return stringBytes(Lrange(key, start, stop))
+}
+
+// SaddBytes is SADD for members held as []byte.
+//
+// Return value
+// Integer reply: the number of elements that were added to the set, not including
+// all the elements already present into the set.
+func SaddBytes(key string, member ...[]byte) int {
+	return Sadd(key, byteStrings(member)...)
+}
+
+// SmembersBytes is SMEMBERS returning the members as []byte.
+//
+// Return value
+// Array reply: all elements of the set.
+func SmembersBytes(key string) [][]byte {
+	return stringBytes(Smembers(key))
+}
+
+// bulkBytes returns value as []byte, or nil when there is none.
+func bulkBytes(value string, ok bool, _ error) []byte {
+	if !ok {
+		return nil
+	}
+	return []byte(value)
+}
+
+func byteStrings(values [][]byte) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = string(v)
+	}
+	return out
+}
+
+func stringBytes(values []string) [][]byte {
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		out[i] = []byte(v)
+	}
+	return out
+}
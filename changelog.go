@@ -0,0 +1,271 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrChangeLogTruncated is returned when a change feed asks for events that have
+// already been overwritten in the change log. The consumer has to resynchronize,
+// for example from a snapshot, and continue from ChangeLogRange's first sequence
+// number.
+var ErrChangeLogTruncated = errors.New("redis: change log no longer holds the requested events")
+
+const defaultChangeLogSize = 10000
+
+// changeLogRing holds the most recent change events. As sequence numbers have
+// no gaps, the event numbered seq lives at seq % len(slots). Writers to
+// different keys append to it concurrently, each locking the slot of its event
+// only, so a slot may lag behind changeSeq while its event is being appended.
+type changeLogRing struct {
+	slots []changeLogSlot
+
+	// first is the oldest sequence number the ring may hold, after which it
+	// was created by SetChangeLogSize.
+	first uint64
+}
+
+type changeLogSlot struct {
+	mu  sync.Mutex
+	seq uint64
+	ev  ChangeEvent
+}
+
+var (
+	// changeLog is the current *changeLogRing, replaced by SetChangeLogSize
+	// under changeLogResizeMu.
+	changeLog         atomic.Value
+	changeLogResizeMu sync.Mutex
+
+	// changeLogSignal is closed, and replaced, when an event is appended while
+	// changeLogWaiters feeds are waiting for one.
+	changeLogSignal  = make(chan struct{})
+	changeLogWaiters int32
+	changeLogMu      sync.Mutex
+
+	// feedOffsets remembers the last acknowledged sequence number of every
+	// named change feed. It is guarded by changeLogMu.
+	feedOffsets = make(map[string]uint64)
+)
+
+func init() {
+	changeLog.Store(newChangeLogRing(defaultChangeLogSize, 1))
+}
+
+func newChangeLogRing(size int, first uint64) *changeLogRing {
+	return &changeLogRing{slots: make([]changeLogSlot, size), first: first}
+}
+
+func currentChangeLog() *changeLogRing {
+	return changeLog.Load().(*changeLogRing)
+}
+
+// firstHeld returns the oldest sequence number the ring holds once every event
+// up to last has been appended.
+func (r *changeLogRing) firstHeld(last uint64) uint64 {
+	if size := uint64(len(r.slots)); last+1 > r.first+size {
+		return last + 1 - size
+	}
+	return r.first
+}
+
+// put stores ev in its slot, unless the slot already holds a later event.
+func (r *changeLogRing) put(ev ChangeEvent) {
+	slot := &r.slots[ev.Seq%uint64(len(r.slots))]
+	slot.mu.Lock()
+	if slot.seq < ev.Seq {
+		slot.seq, slot.ev = ev.Seq, ev
+	}
+	slot.mu.Unlock()
+}
+
+// get returns the event held in the slot of seq, along with its sequence
+// number: one lower than seq while the event of seq is still being appended,
+// and a higher one once it has been overwritten.
+func (r *changeLogRing) get(seq uint64) (ChangeEvent, uint64) {
+	slot := &r.slots[seq%uint64(len(r.slots))]
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	return slot.ev, slot.seq
+}
+
+// ChangeFeed reads change events from the change log in sequence order. A feed
+// is identified by its name; its acknowledged offset outlives it, so a consumer
+// that is restarted and opens the feed again resumes after the last event it
+// acknowledged, seeing every later change exactly as long as the change log still
+// holds it.
+//
+// The change log lives in memory: it survives consumers restarting, not the
+// process.
+type ChangeFeed struct {
+	name   string
+	cursor uint64
+}
+
+// NewChangeFeed opens the change feed called name, positioned after its last
+// acknowledged event. A feed that never acknowledged anything starts with the
+// next change made.
+func NewChangeFeed(name string) *ChangeFeed {
+	changeLogMu.Lock()
+	defer changeLogMu.Unlock()
+
+	offset, ok := feedOffsets[name]
+	if !ok {
+		offset = atomic.LoadUint64(&changeSeq)
+		feedOffsets[name] = offset
+	}
+
+	return &ChangeFeed{name: name, cursor: offset}
+}
+
+// Next returns the event after the last one returned, waiting for it to happen
+// if necessary, until ctx is done.
+func (f *ChangeFeed) Next(ctx context.Context) (ChangeEvent, error) {
+	for {
+		changeLogMu.Lock()
+		signal := changeLogSignal
+		changeLogMu.Unlock()
+
+		// Appenders only signal while a feed is waiting, so the feed counts
+		// itself before reading: an event appended before that is read below.
+		atomic.AddInt32(&changeLogWaiters, 1)
+		events, err := ReadChanges(f.cursor, 1)
+		if err != nil || len(events) == 1 {
+			atomic.AddInt32(&changeLogWaiters, -1)
+			if err != nil {
+				return ChangeEvent{}, err
+			}
+			f.cursor = events[0].Seq
+			return events[0], nil
+		}
+
+		if f.cursor < atomic.LoadUint64(&changeSeq) {
+			// The next event is numbered but still being appended.
+			atomic.AddInt32(&changeLogWaiters, -1)
+			runtime.Gosched()
+			continue
+		}
+
+		select {
+		case <-signal:
+			atomic.AddInt32(&changeLogWaiters, -1)
+		case <-ctx.Done():
+			atomic.AddInt32(&changeLogWaiters, -1)
+			return ChangeEvent{}, ctx.Err()
+		}
+	}
+}
+
+// Ack records that every event up to and including seq has been processed, so
+// the feed resumes after it when opened again.
+func (f *ChangeFeed) Ack(seq uint64) {
+	changeLogMu.Lock()
+	if seq > feedOffsets[f.name] {
+		feedOffsets[f.name] = seq
+	}
+	changeLogMu.Unlock()
+}
+
+// Acked returns the sequence number of the last acknowledged event.
+func (f *ChangeFeed) Acked() uint64 {
+	changeLogMu.Lock()
+	defer changeLogMu.Unlock()
+
+	return feedOffsets[f.name]
+}
+
+// Seek positions the feed so that Next returns the event following seq.
+func (f *ChangeFeed) Seek(seq uint64) {
+	f.cursor = seq
+}
+
+// DeleteChangeFeed forgets the acknowledged offset of the feed called name.
+func DeleteChangeFeed(name string) {
+	changeLogMu.Lock()
+	delete(feedOffsets, name)
+	changeLogMu.Unlock()
+}
+
+// ReadChanges returns up to count events from the change log following the
+// event numbered after, oldest first. Change log events carry OldValue and
+// NewValue but not Data, which would otherwise show the key's current value
+// rather than its value at the time of the change. Events still being appended
+// end the result, so the events returned never skip one.
+func ReadChanges(after uint64, count int) ([]ChangeEvent, error) {
+	r, last := currentChangeLog(), atomic.LoadUint64(&changeSeq)
+	if after+1 < r.firstHeld(last) {
+		return nil, ErrChangeLogTruncated
+	}
+
+	var out []ChangeEvent
+	for seq := after + 1; seq <= last && len(out) < count; seq++ {
+		ev, held := r.get(seq)
+		if held > seq && len(out) == 0 {
+			// Overwritten since last was read.
+			return nil, ErrChangeLogTruncated
+		}
+		if held != seq {
+			break
+		}
+		out = append(out, ev)
+	}
+	return out, nil
+}
+
+// ChangeLogRange returns the sequence numbers of the oldest and newest events
+// held in the change log. When it is empty, first is one more than last.
+func ChangeLogRange() (first, last uint64) {
+	last = atomic.LoadUint64(&changeSeq)
+	return currentChangeLog().firstHeld(last), last
+}
+
+// SetChangeLogSize changes how many of the most recent change events the change
+// log holds, keeping as many of the current ones as fit.
+func SetChangeLogSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+
+	changeLogResizeMu.Lock()
+	defer changeLogResizeMu.Unlock()
+
+	// The new ring is in place before the events are copied to it, so that
+	// an event appended to the old ring meanwhile is either copied or, as
+	// appendChangeLog sees the ring replaced, appended again to the new one.
+	old, last := currentChangeLog(), atomic.LoadUint64(&changeSeq)
+	first := old.firstHeld(last)
+	if last+1 > first+uint64(size) {
+		first = last + 1 - uint64(size)
+	}
+	resized := newChangeLogRing(size, first)
+	changeLog.Store(resized)
+
+	for seq := first; seq <= last; seq++ {
+		if ev, held := old.get(seq); held == seq {
+			resized.put(ev)
+		}
+	}
+}
+
+// appendChangeLog adds a numbered change event to the change log. publish calls
+// it concurrently for the writers of different shards, without ordering them.
+func appendChangeLog(ev ChangeEvent) {
+	ev.Data = nil
+
+	r := currentChangeLog()
+	r.put(ev)
+	if resized := currentChangeLog(); resized != r {
+		resized.put(ev)
+	}
+
+	if atomic.LoadInt32(&changeLogWaiters) > 0 {
+		changeLogMu.Lock()
+		close(changeLogSignal)
+		changeLogSignal = make(chan struct{})
+		changeLogMu.Unlock()
+	}
+}
@@ -0,0 +1,969 @@
+package redis
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client is an adapter with the API of the go-redis client, for code written
+// against it to run on the package in development and tests. It implements the
+// commonly used commands of Cmdable, named and typed as go-redis names and
+// types them, so that such code only needs its import changed, or an interface
+// of its own listing the methods it uses.
+//
+// Commands run as a client sending them would: their arguments are formatted as
+// go-redis formats them, and their replies and errors are those Redis sends.
+
+// Nil is the error of commands replying nil, such as GET on a missing key,
+// as go-redis reports it.
+var Nil = errors.New("redis: nil")
+
+// ErrClosed is the error of commands run on a closed Client.
+var ErrClosed = errors.New("redis: client is closed")
+
+// KeepTTL is the expiration of Set keeping the time to live of the key.
+const KeepTTL = -1
+
+// Options are the options of NewClient. They are accepted for compatibility
+// only, as there is a single keyspace and no server to connect to.
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+// Cmdable is the go-redis Cmdable interface, for the commands Client runs.
+type Cmdable interface {
+	Ping(ctx context.Context) *StatusCmd
+	Do(ctx context.Context, args ...interface{}) *Cmd
+
+	Get(ctx context.Context, key string) *StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *BoolCmd
+	Incr(ctx context.Context, key string) *IntCmd
+	Decr(ctx context.Context, key string) *IntCmd
+
+	Del(ctx context.Context, keys ...string) *IntCmd
+	Exists(ctx context.Context, keys ...string) *IntCmd
+	Type(ctx context.Context, key string) *StatusCmd
+	Keys(ctx context.Context, pattern string) *StringSliceCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *BoolCmd
+	PExpire(ctx context.Context, key string, expiration time.Duration) *BoolCmd
+	ExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd
+	PExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd
+	TTL(ctx context.Context, key string) *DurationCmd
+	PTTL(ctx context.Context, key string) *DurationCmd
+	Persist(ctx context.Context, key string) *BoolCmd
+
+	LPush(ctx context.Context, key string, values ...interface{}) *IntCmd
+	RPush(ctx context.Context, key string, values ...interface{}) *IntCmd
+	LPop(ctx context.Context, key string) *StringCmd
+	RPop(ctx context.Context, key string) *StringCmd
+	LRange(ctx context.Context, key string, start, stop int64) *StringSliceCmd
+	LLen(ctx context.Context, key string) *IntCmd
+	LIndex(ctx context.Context, key string, index int64) *StringCmd
+
+	SAdd(ctx context.Context, key string, members ...interface{}) *IntCmd
+	SMembers(ctx context.Context, key string) *StringSliceCmd
+	SCard(ctx context.Context, key string) *IntCmd
+
+	HSet(ctx context.Context, key string, values ...interface{}) *IntCmd
+	HGet(ctx context.Context, key, field string) *StringCmd
+	HDel(ctx context.Context, key string, fields ...string) *IntCmd
+	HExists(ctx context.Context, key, field string) *BoolCmd
+	HGetAll(ctx context.Context, key string) *MapStringStringCmd
+	HKeys(ctx context.Context, key string) *StringSliceCmd
+	HVals(ctx context.Context, key string) *StringSliceCmd
+
+	Publish(ctx context.Context, channel string, message interface{}) *IntCmd
+
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *Cmd
+	ScriptLoad(ctx context.Context, script string) *StringCmd
+	FCall(ctx context.Context, function string, keys []string, args ...interface{}) *Cmd
+	FCallRo(ctx context.Context, function string, keys []string, args ...interface{}) *Cmd
+}
+
+// Client runs commands on the keyspace with the API of go-redis.
+type Client struct {
+	closed int32
+}
+
+var _ Cmdable = (*Client)(nil)
+
+// NewClient returns a Client. opt is ignored.
+func NewClient(opt *Options) *Client {
+	return &Client{}
+}
+
+// Close closes the client: the commands run afterwards fail with ErrClosed.
+func (c *Client) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+// cmder is the reply of a command, read from the reply the package gives.
+type cmder interface {
+	Args() []interface{}
+	SetErr(err error)
+	readReply(reply interface{}) error
+}
+
+func (c *Client) process(ctx context.Context, cmd cmder) {
+	if err := ctx.Err(); err != nil {
+		cmd.SetErr(err)
+		return
+	}
+	if atomic.LoadInt32(&c.closed) != 0 {
+		cmd.SetErr(ErrClosed)
+		return
+	}
+	args, err := argStrings(cmd.Args())
+	if err != nil {
+		cmd.SetErr(err)
+		return
+	}
+	reply, err := runClientCommand(args)
+	if err == nil {
+		err = cmd.readReply(plainReply(reply))
+	}
+	cmd.SetErr(err)
+}
+
+// runClientCommand is runCommand for the adapters to client libraries: it also
+// runs the commands that are functions of their own rather than entries of the
+// command table, as they run atomically.
+func runClientCommand(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return runCommand(args)
+	}
+
+	var reply interface{}
+	var err error
+	switch name := strings.ToLower(args[0]); name {
+	case "eval", "evalsha", "fcall", "fcall_ro":
+		if len(args) < 3 {
+			return nil, errorReply(fmt.Errorf("ERR wrong number of arguments for '%s' command", name))
+		}
+		var n int64
+		if n, err = parseInt(args[2]); err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errorReply(errors.New("ERR Number of keys can't be negative"))
+		}
+		if n > int64(len(args)-3) {
+			return nil, errorReply(errors.New("ERR Number of keys can't be greater than number of args"))
+		}
+		keys, rest := args[3:3+n], args[3+n:]
+		switch name {
+		case "eval":
+			reply, err = Eval(args[1], keys, rest...)
+		case "evalsha":
+			reply, err = EvalSha(args[1], keys, rest...)
+		case "fcall":
+			reply, err = Fcall(args[1], keys, rest...)
+		case "fcall_ro":
+			reply, err = FcallRo(args[1], keys, rest...)
+		}
+	case "script":
+		if len(args) == 3 && strings.EqualFold(args[1], "load") {
+			reply, err = ScriptLoad(args[2])
+			break
+		}
+		reply, err = runCommand(args)
+	default:
+		reply, err = runCommand(args)
+	}
+	return reply, err
+}
+
+// argStrings formats the arguments of a command as go-redis does.
+func argStrings(args []interface{}) ([]string, error) {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			out[i] = ""
+		case string:
+			out[i] = v
+		case []byte:
+			out[i] = string(v)
+		case int:
+			out[i] = strconv.Itoa(v)
+		case int8:
+			out[i] = strconv.FormatInt(int64(v), 10)
+		case int16:
+			out[i] = strconv.FormatInt(int64(v), 10)
+		case int32:
+			out[i] = strconv.FormatInt(int64(v), 10)
+		case int64:
+			out[i] = strconv.FormatInt(v, 10)
+		case uint:
+			out[i] = strconv.FormatUint(uint64(v), 10)
+		case uint8:
+			out[i] = strconv.FormatUint(uint64(v), 10)
+		case uint16:
+			out[i] = strconv.FormatUint(uint64(v), 10)
+		case uint32:
+			out[i] = strconv.FormatUint(uint64(v), 10)
+		case uint64:
+			out[i] = strconv.FormatUint(v, 10)
+		case float32:
+			out[i] = strconv.FormatFloat(float64(v), 'f', -1, 64)
+		case float64:
+			out[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			out[i] = strconv.Itoa(boolToInt(v))
+		case time.Time:
+			out[i] = v.Format(time.RFC3339Nano)
+		case time.Duration:
+			out[i] = strconv.FormatInt(int64(v), 10)
+		case encoding.BinaryMarshaler:
+			b, err := v.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			out[i] = string(b)
+		default:
+			return nil, fmt.Errorf("redis: can't marshal %T (implement encoding.BinaryMarshaler)", arg)
+		}
+	}
+	return out, nil
+}
+
+func unexpectedReply(reply interface{}) error {
+	return fmt.Errorf("redis: unexpected reply type %T", reply)
+}
+
+type baseCmd struct {
+	args []interface{}
+	err  error
+}
+
+// Name returns the name of the command, in lower case.
+func (cmd *baseCmd) Name() string {
+	if len(cmd.args) == 0 {
+		return ""
+	}
+	name, _ := cmd.args[0].(string)
+	return strings.ToLower(name)
+}
+
+// Args returns the command and its arguments.
+func (cmd *baseCmd) Args() []interface{} {
+	return cmd.args
+}
+
+// Err returns the error of the command, Nil if it replied nil.
+func (cmd *baseCmd) Err() error {
+	return cmd.err
+}
+
+// SetErr sets the error of the command.
+func (cmd *baseCmd) SetErr(err error) {
+	cmd.err = err
+}
+
+func (cmd *baseCmd) string(val interface{}) string {
+	var b strings.Builder
+	for i, arg := range cmd.args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprint(&b, arg)
+	}
+	if cmd.err != nil {
+		fmt.Fprintf(&b, ": %v", cmd.err)
+	} else {
+		fmt.Fprintf(&b, ": %v", val)
+	}
+	return b.String()
+}
+
+// Cmd is the reply of a command run with Do, Eval or FCall: nil, an int64, a
+// string or an []interface{} of those.
+type Cmd struct {
+	baseCmd
+	val interface{}
+}
+
+// NewCmd returns a Cmd of the command args, for the Do of interfaces
+// implemented by Client.
+func NewCmd(ctx context.Context, args ...interface{}) *Cmd {
+	return &Cmd{baseCmd: baseCmd{args: args}}
+}
+
+func (cmd *Cmd) readReply(reply interface{}) error {
+	if reply == nil {
+		return Nil
+	}
+	cmd.val = reply
+	return nil
+}
+
+func (cmd *Cmd) Val() interface{} {
+	return cmd.val
+}
+
+func (cmd *Cmd) Result() (interface{}, error) {
+	return cmd.val, cmd.err
+}
+
+// Text returns the reply as a string.
+func (cmd *Cmd) Text() (string, error) {
+	if cmd.err != nil {
+		return "", cmd.err
+	}
+	switch v := cmd.val.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", unexpectedReply(cmd.val)
+}
+
+// Int64 returns the reply as an integer, parsing string replies.
+func (cmd *Cmd) Int64() (int64, error) {
+	if cmd.err != nil {
+		return 0, cmd.err
+	}
+	switch v := cmd.val.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, unexpectedReply(cmd.val)
+}
+
+// Int returns the reply as an integer, parsing string replies.
+func (cmd *Cmd) Int() (int, error) {
+	n, err := cmd.Int64()
+	return int(n), err
+}
+
+// Bool returns whether the reply is a non-zero integer or OK.
+func (cmd *Cmd) Bool() (bool, error) {
+	if cmd.err == Nil {
+		return false, nil
+	}
+	if cmd.err != nil {
+		return false, cmd.err
+	}
+	switch v := cmd.val.(type) {
+	case int64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, unexpectedReply(cmd.val)
+}
+
+// Slice returns the reply as an array.
+func (cmd *Cmd) Slice() ([]interface{}, error) {
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	if v, ok := cmd.val.([]interface{}); ok {
+		return v, nil
+	}
+	return nil, unexpectedReply(cmd.val)
+}
+
+// StringSlice returns the reply as an array of strings.
+func (cmd *Cmd) StringSlice() ([]string, error) {
+	values, err := cmd.Slice()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok && v != nil {
+			return nil, unexpectedReply(v)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func (cmd *Cmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// StringCmd is the reply of a command replying a bulk string.
+type StringCmd struct {
+	baseCmd
+	val string
+}
+
+func (cmd *StringCmd) readReply(reply interface{}) error {
+	switch v := reply.(type) {
+	case nil:
+		return Nil
+	case string:
+		cmd.val = v
+		return nil
+	}
+	return unexpectedReply(reply)
+}
+
+func (cmd *StringCmd) Val() string {
+	return cmd.val
+}
+
+func (cmd *StringCmd) Result() (string, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *StringCmd) Bytes() ([]byte, error) {
+	return []byte(cmd.val), cmd.err
+}
+
+func (cmd *StringCmd) Int64() (int64, error) {
+	if cmd.err != nil {
+		return 0, cmd.err
+	}
+	return strconv.ParseInt(cmd.val, 10, 64)
+}
+
+func (cmd *StringCmd) Int() (int, error) {
+	n, err := cmd.Int64()
+	return int(n), err
+}
+
+func (cmd *StringCmd) Float64() (float64, error) {
+	if cmd.err != nil {
+		return 0, cmd.err
+	}
+	return strconv.ParseFloat(cmd.val, 64)
+}
+
+func (cmd *StringCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// StatusCmd is the reply of a command replying a simple string, such as OK.
+type StatusCmd struct {
+	baseCmd
+	val string
+}
+
+func (cmd *StatusCmd) readReply(reply interface{}) error {
+	switch v := reply.(type) {
+	case nil:
+		return Nil
+	case string:
+		cmd.val = v
+		return nil
+	}
+	return unexpectedReply(reply)
+}
+
+func (cmd *StatusCmd) Val() string {
+	return cmd.val
+}
+
+func (cmd *StatusCmd) Result() (string, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *StatusCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// IntCmd is the reply of a command replying an integer.
+type IntCmd struct {
+	baseCmd
+	val int64
+}
+
+func (cmd *IntCmd) readReply(reply interface{}) error {
+	switch v := reply.(type) {
+	case nil:
+		return Nil
+	case int64:
+		cmd.val = v
+		return nil
+	}
+	return unexpectedReply(reply)
+}
+
+func (cmd *IntCmd) Val() int64 {
+	return cmd.val
+}
+
+func (cmd *IntCmd) Result() (int64, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *IntCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// BoolCmd is the reply of a command replying 1 or 0, or OK or nil.
+type BoolCmd struct {
+	baseCmd
+	val bool
+}
+
+func (cmd *BoolCmd) readReply(reply interface{}) error {
+	switch v := reply.(type) {
+	case nil:
+		cmd.val = false
+		return nil
+	case int64:
+		cmd.val = v == 1
+		return nil
+	case string:
+		cmd.val = v == "OK"
+		return nil
+	}
+	return unexpectedReply(reply)
+}
+
+func (cmd *BoolCmd) Val() bool {
+	return cmd.val
+}
+
+func (cmd *BoolCmd) Result() (bool, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *BoolCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// StringSliceCmd is the reply of a command replying an array of bulk strings.
+type StringSliceCmd struct {
+	baseCmd
+	val []string
+}
+
+func (cmd *StringSliceCmd) readReply(reply interface{}) error {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return unexpectedReply(reply)
+	}
+	cmd.val = make([]string, len(values))
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok && v != nil {
+			return unexpectedReply(v)
+		}
+		cmd.val[i] = s
+	}
+	return nil
+}
+
+func (cmd *StringSliceCmd) Val() []string {
+	return cmd.val
+}
+
+func (cmd *StringSliceCmd) Result() ([]string, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *StringSliceCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// MapStringStringCmd is the reply of a command replying field and value pairs,
+// like HGETALL.
+type MapStringStringCmd struct {
+	baseCmd
+	val map[string]string
+}
+
+func (cmd *MapStringStringCmd) readReply(reply interface{}) error {
+	values, ok := reply.([]interface{})
+	if !ok || len(values)%2 != 0 {
+		return unexpectedReply(reply)
+	}
+	cmd.val = make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		field, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		cmd.val[field] = value
+	}
+	return nil
+}
+
+func (cmd *MapStringStringCmd) Val() map[string]string {
+	return cmd.val
+}
+
+func (cmd *MapStringStringCmd) Result() (map[string]string, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *MapStringStringCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// DurationCmd is the reply of TTL and PTTL. Their negative replies, -1 for keys
+// without a time to live and -2 for missing keys, are kept as they are.
+type DurationCmd struct {
+	baseCmd
+	val       time.Duration
+	precision time.Duration
+}
+
+func (cmd *DurationCmd) readReply(reply interface{}) error {
+	n, ok := reply.(int64)
+	if !ok {
+		return unexpectedReply(reply)
+	}
+	if n < 0 {
+		cmd.val = time.Duration(n)
+	} else {
+		cmd.val = time.Duration(n) * cmd.precision
+	}
+	return nil
+}
+
+func (cmd *DurationCmd) Val() time.Duration {
+	return cmd.val
+}
+
+func (cmd *DurationCmd) Result() (time.Duration, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *DurationCmd) String() string {
+	return cmd.string(cmd.val)
+}
+
+// expireArgs appends the expiration of SET to args, in milliseconds unless it
+// is a whole number of seconds.
+func expireArgs(args []interface{}, expiration time.Duration) []interface{} {
+	switch {
+	case expiration > 0 && expiration%time.Second != 0:
+		return append(args, "px", int64(expiration/time.Millisecond))
+	case expiration > 0:
+		return append(args, "ex", int64(expiration/time.Second))
+	case expiration == KeepTTL:
+		return append(args, "keepttl")
+	}
+	return args
+}
+
+func keyArgs(name string, keys []string) []interface{} {
+	args := make([]interface{}, 1, 1+len(keys))
+	args[0] = name
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return args
+}
+
+func scriptArgs(name, script string, keys []string, args []interface{}) []interface{} {
+	out := make([]interface{}, 0, 3+len(keys)+len(args))
+	out = append(out, name, script, len(keys))
+	for _, key := range keys {
+		out = append(out, key)
+	}
+	return append(out, args...)
+}
+
+func (c *Client) Ping(ctx context.Context) *StatusCmd {
+	cmd := &StatusCmd{baseCmd: baseCmd{args: []interface{}{"ping"}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// Do runs any command, given by name and arguments.
+func (c *Client) Do(ctx context.Context, args ...interface{}) *Cmd {
+	cmd := NewCmd(ctx, args...)
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Get(ctx context.Context, key string) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"get", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// Set sets key to value, which expires after expiration if it is positive. Zero
+// means the key does not expire, and KeepTTL that it keeps its time to live.
+func (c *Client) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *StatusCmd {
+	cmd := &StatusCmd{baseCmd: baseCmd{args: expireArgs([]interface{}{"set", key, value}, expiration)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// SetNX sets key to value if it does not exist, like Set.
+func (c *Client) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *BoolCmd {
+	args := []interface{}{"setnx", key, value}
+	if expiration != 0 {
+		args = append(expireArgs([]interface{}{"set", key, value}, expiration), "nx")
+	}
+	cmd := &BoolCmd{baseCmd: baseCmd{args: args}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Incr(ctx context.Context, key string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: []interface{}{"incr", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Decr(ctx context.Context, key string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: []interface{}{"decr", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Del(ctx context.Context, keys ...string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: keyArgs("del", keys)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Exists(ctx context.Context, keys ...string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: keyArgs("exists", keys)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Type(ctx context.Context, key string) *StatusCmd {
+	cmd := &StatusCmd{baseCmd: baseCmd{args: []interface{}{"type", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// Keys returns the keys matching pattern, glob-style like KEYS in Redis, rather
+// than the regular expression of the package's Keys. An invalid pattern is an
+// error.
+func (c *Client) Keys(ctx context.Context, pattern string) *StringSliceCmd {
+	cmd := &StringSliceCmd{baseCmd: baseCmd{args: []interface{}{"keys", pattern}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Expire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"expire", key, int64(expiration / time.Second)}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) PExpire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"pexpire", key, int64(expiration / time.Millisecond)}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) ExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"expireat", key, tm.Unix()}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) PExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"pexpireat", key, tm.UnixNano() / int64(time.Millisecond)}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) TTL(ctx context.Context, key string) *DurationCmd {
+	cmd := &DurationCmd{baseCmd: baseCmd{args: []interface{}{"ttl", key}}, precision: time.Second}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) PTTL(ctx context.Context, key string) *DurationCmd {
+	cmd := &DurationCmd{baseCmd: baseCmd{args: []interface{}{"pttl", key}}, precision: time.Millisecond}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Persist(ctx context.Context, key string) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"persist", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) LPush(ctx context.Context, key string, values ...interface{}) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: append([]interface{}{"lpush", key}, flattenArgs(values)...)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) RPush(ctx context.Context, key string, values ...interface{}) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: append([]interface{}{"rpush", key}, flattenArgs(values)...)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) LPop(ctx context.Context, key string) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"lpop", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) RPop(ctx context.Context, key string) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"rpop", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) LRange(ctx context.Context, key string, start, stop int64) *StringSliceCmd {
+	cmd := &StringSliceCmd{baseCmd: baseCmd{args: []interface{}{"lrange", key, start, stop}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) LLen(ctx context.Context, key string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: []interface{}{"llen", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) LIndex(ctx context.Context, key string, index int64) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"lindex", key, index}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) SAdd(ctx context.Context, key string, members ...interface{}) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: append([]interface{}{"sadd", key}, flattenArgs(members)...)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) SMembers(ctx context.Context, key string) *StringSliceCmd {
+	cmd := &StringSliceCmd{baseCmd: baseCmd{args: []interface{}{"smembers", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) SCard(ctx context.Context, key string) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: []interface{}{"scard", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// HSet sets fields of the hash at key. As with go-redis, values are field and
+// value pairs, given as arguments, in a slice or in a map[string]interface{}.
+func (c *Client) HSet(ctx context.Context, key string, values ...interface{}) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: append([]interface{}{"hset", key}, flattenArgs(values)...)}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HGet(ctx context.Context, key, field string) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"hget", key, field}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) *IntCmd {
+	args := []interface{}{"hdel", key}
+	for _, field := range fields {
+		args = append(args, field)
+	}
+	cmd := &IntCmd{baseCmd: baseCmd{args: args}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HExists(ctx context.Context, key, field string) *BoolCmd {
+	cmd := &BoolCmd{baseCmd: baseCmd{args: []interface{}{"hexists", key, field}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HGetAll(ctx context.Context, key string) *MapStringStringCmd {
+	cmd := &MapStringStringCmd{baseCmd: baseCmd{args: []interface{}{"hgetall", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HKeys(ctx context.Context, key string) *StringSliceCmd {
+	cmd := &StringSliceCmd{baseCmd: baseCmd{args: []interface{}{"hkeys", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) HVals(ctx context.Context, key string) *StringSliceCmd {
+	cmd := &StringSliceCmd{baseCmd: baseCmd{args: []interface{}{"hvals", key}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Publish(ctx context.Context, channel string, message interface{}) *IntCmd {
+	cmd := &IntCmd{baseCmd: baseCmd{args: []interface{}{"publish", channel, message}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *Cmd {
+	cmd := NewCmd(ctx, scriptArgs("eval", script, keys, args)...)
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *Cmd {
+	cmd := NewCmd(ctx, scriptArgs("evalsha", sha1, keys, args)...)
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) ScriptLoad(ctx context.Context, script string) *StringCmd {
+	cmd := &StringCmd{baseCmd: baseCmd{args: []interface{}{"script", "load", script}}}
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) FCall(ctx context.Context, function string, keys []string, args ...interface{}) *Cmd {
+	cmd := NewCmd(ctx, scriptArgs("fcall", function, keys, args)...)
+	c.process(ctx, cmd)
+	return cmd
+}
+
+func (c *Client) FCallRo(ctx context.Context, function string, keys []string, args ...interface{}) *Cmd {
+	cmd := NewCmd(ctx, scriptArgs("fcall_ro", function, keys, args)...)
+	c.process(ctx, cmd)
+	return cmd
+}
+
+// flattenArgs spreads slices and maps among values, as go-redis does for the
+// variadic arguments of commands such as HSet and RPush.
+func flattenArgs(values []interface{}) []interface{} {
+	if len(values) != 1 {
+		return values
+	}
+	switch v := values[0].(type) {
+	case []string:
+		out := make([]interface{}, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out
+	case []interface{}:
+		return v
+	case map[string]interface{}:
+		out := make([]interface{}, 0, 2*len(v))
+		for field, value := range v {
+			out = append(out, field, value)
+		}
+		return out
+	case map[string]string:
+		out := make([]interface{}, 0, 2*len(v))
+		for field, value := range v {
+			out = append(out, field, value)
+		}
+		return out
+	}
+	return values
+}
@@ -0,0 +1,253 @@
+package redis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the package the time: every time it reads, from the expire times
+// of keys and the idle time of objects to the slowlog, the save points and the
+// periodic jobs that run them, comes from the clock set with SetClock. Tests
+// set a ManualClock to move time forward at will instead of sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc calls f once d has passed, unless the returned Timer is
+	// stopped first. f may run synchronously in the goroutine that moves the
+	// clock, as with ManualClock, so it must not wait for that goroutine.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call to a function scheduled by Clock.AfterFunc.
+type Timer interface {
+	// Stop cancels the call, reporting whether it was still to come.
+	Stop() bool
+}
+
+// realClock is the clock of the system, the default.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// clockHolder holds the clock in clockValue, which needs the same concrete
+// type for every value it stores.
+type clockHolder struct{ Clock }
+
+var clockValue atomic.Value
+
+// SetClock sets the clock of the package, or restores the clock of the system
+// if c is nil, and returns the clock it replaces. Periodic jobs, such as active
+// expiry and save points, are rescheduled on the new clock.
+func SetClock(c Clock) (previous Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	previous = currentClock()
+	clockValue.Store(clockHolder{c})
+	for _, j := range jobs {
+		j.schedule(c)
+	}
+	return previous
+}
+
+func currentClock() Clock {
+	if h, ok := clockValue.Load().(clockHolder); ok {
+		return h.Clock
+	}
+	return realClock{}
+}
+
+// timeNow is time.Now on the clock of the package.
+func timeNow() time.Time {
+	return currentClock().Now()
+}
+
+// timeSince is time.Since on the clock of the package.
+func timeSince(t time.Time) time.Duration {
+	return timeNow().Sub(t)
+}
+
+// sleep is time.Sleep on the clock of the package.
+func sleep(d time.Duration) {
+	done := make(chan struct{})
+	currentClock().AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// periodicJob runs f every period on the clock of the package, until stop is
+// closed. gen tells the timers of the clock in use from those of a clock
+// replaced, which must not run f again.
+type periodicJob struct {
+	period time.Duration
+	stop   <-chan struct{}
+	f      func(now time.Time)
+
+	mu    sync.Mutex
+	gen   uint64
+	timer Timer
+}
+
+var (
+	jobs   []*periodicJob
+	jobsMu sync.Mutex
+)
+
+// every starts a periodic job.
+func every(period time.Duration, stop <-chan struct{}, f func(now time.Time)) {
+	j := &periodicJob{period: period, stop: stop, f: f}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	jobs = append(jobs, j)
+	j.schedule(currentClock())
+}
+
+// schedule runs the job a period from now on c, instead of when it was due.
+func (j *periodicJob) schedule(c Clock) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.arm(c)
+}
+
+// arm schedules the next run. The caller holds j.mu.
+func (j *periodicJob) arm(c Clock) {
+	j.gen++
+	gen := j.gen
+	j.timer = c.AfterFunc(j.period, func() { j.run(c, gen) })
+}
+
+func (j *periodicJob) run(c Clock, gen uint64) {
+	select {
+	case <-j.stop:
+		return
+	default:
+	}
+
+	j.mu.Lock()
+	current := j.gen == gen
+	j.mu.Unlock()
+	if !current {
+		return
+	}
+
+	j.f(c.Now())
+
+	j.mu.Lock()
+	if j.gen == gen {
+		j.arm(c)
+	}
+	j.mu.Unlock()
+}
+
+// ManualClock is a Clock that only moves when told to, for tests of expiry,
+// timeouts and periodic jobs that must not depend on the time they take.
+//
+// Calls scheduled with AfterFunc run in the goroutine calling Advance or Set, so
+// periodic jobs such as active expiry run on that goroutine's stack, taking the
+// locks they need. Waits on the clock last until it is moved: ScriptKill, for
+// one, returns only once the clock is advanced past the script time limit, even
+// if the script has ended before.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	c    *ManualClock
+	when time.Time
+	f    func()
+}
+
+// NewManualClock returns a ManualClock telling the time now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// AfterFunc calls f once the clock has moved d forward. Calls due are made by
+// Advance and Set, so f runs before they return.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &manualTimer{c: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d. See Set.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+
+	c.fire()
+}
+
+// Set sets the time of the clock, then makes the calls that are due, earliest
+// first, before returning. Like a process resuming after being suspended,
+// periodic jobs run once however many periods were skipped, and the calls all
+// see the new time.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+
+	c.fire()
+}
+
+func (c *ManualClock) fire() {
+	for {
+		c.mu.Lock()
+		next := -1
+		for i, t := range c.timers {
+			if !t.when.After(c.now) && (next < 0 || t.when.Before(c.timers[next].when)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[next]
+		c.timers = append(c.timers[:next], c.timers[next+1:]...)
+		c.mu.Unlock()
+
+		t.f()
+	}
+}
+
+func (t *manualTimer) Stop() bool {
+	c := t.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,469 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors of commands run by name, worded as Redis words them.
+var (
+	errNotInteger    = errors.New("ERR value is not an integer or out of range")
+	errOverflow      = errors.New("ERR increment or decrement would overflow")
+	errSyntax        = errors.New("ERR syntax error")
+	errInvalidExpire = errors.New("ERR invalid expire time in 'set' command")
+)
+
+const (
+	maxInt64 = 1<<63 - 1
+	minInt64 = -1 << 63
+)
+
+// execMu is held for reading by every command and for writing by scripts, so
+// that nothing runs while a script does.
+var execMu execLock
+
+// execStripes is the number of locks execLock is split into.
+const execStripes = 32
+
+// execLock is a reader/writer lock split into stripes, so that the commands
+// holding it for reading do not all contend for the same lock word: each
+// read-locks the stripe of its first argument, usually a key, while Lock locks
+// every stripe. Scripts remain a serialization point: one running keeps every
+// command waiting.
+type execLock struct {
+	stripes [execStripes]struct {
+		sync.RWMutex
+		_ [40]byte // pads each stripe to a cache line of its own
+	}
+}
+
+// stripe returns the stripe commands whose first argument is key read-lock.
+func (l *execLock) stripe(key string) *sync.RWMutex {
+	return &l.stripes[shardIndex(key)%execStripes].RWMutex
+}
+
+// Lock locks every stripe for writing, in order.
+func (l *execLock) Lock() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+func (l *execLock) Unlock() {
+	for i := len(l.stripes) - 1; i >= 0; i-- {
+		l.stripes[i].Unlock()
+	}
+}
+
+// lockKeys locks the stripes of keys for writing, in order, so that no other
+// command whose first argument is one of keys runs until the returned function
+// is called.
+func (l *execLock) lockKeys(keys []string) (unlock func()) {
+	var locked [execStripes]bool
+	for _, key := range keys {
+		locked[shardIndex(key)%execStripes] = true
+	}
+	for i := range l.stripes {
+		if locked[i] {
+			l.stripes[i].Lock()
+		}
+	}
+
+	return func() {
+		for i := len(l.stripes) - 1; i >= 0; i-- {
+			if locked[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// RLock locks the first stripe for reading, for the callers with no key.
+func (l *execLock) RLock() {
+	l.stripes[0].RLock()
+}
+
+func (l *execLock) RUnlock() {
+	l.stripes[0].RUnlock()
+}
+
+// statusReply is a simple string reply, such as OK, told apart from bulk string
+// replies for the callers that care, like scripts.
+type statusReply string
+
+// commandFlags describe what a command does, like the flags of COMMAND INFO.
+type commandFlags uint8
+
+const (
+	// cmdWrite commands may modify the keyspace.
+	cmdWrite commandFlags = 1 << iota
+	// cmdReadonly commands only read the keyspace.
+	cmdReadonly
+	// cmdDenyOOM commands may grow the keyspace, and are refused over maxmemory.
+	cmdDenyOOM
+)
+
+// command is an entry of the command table, which runs commands given by name
+// and arguments, as a client sends them to a Redis server.
+type command struct {
+	name string
+	// arity is the number of arguments, counting the name, or the minimum
+	// number, negated, for variadic commands.
+	arity int
+	flags commandFlags
+	// firstKey, lastKey and keyStep locate the key arguments, counting the name
+	// as 0. lastKey is -1 for keys up to the last argument.
+	firstKey, lastKey, keyStep int
+
+	// proc runs the command with its arguments, without the name. It replies
+	// nil, an int64, a string, a statusReply or a []interface{} of those.
+	proc func(args []string) (interface{}, error)
+}
+
+// commandTable holds the commands that can be run by name: the commands on keys,
+// PUBLISH and PING.
+var commandTable = map[string]*command{
+	"get": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return bulkOrNil(getString(args[0]))
+	}},
+	"set": {arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: setCommand},
+	"setnx": {arity: 3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		ok, err := setString(args[0], args[1], setOptions{nx: true})
+		return int64(boolToInt(ok)), err
+	}},
+	"incr": {arity: 2, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return incrBy(args[0], 1, "incrby")
+	}},
+	"decr": {arity: 2, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return incrBy(args[0], -1, "decrby")
+	}},
+
+	"del": {arity: -2, flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return int64(delKeys(notifyGeneric, "del", args...)), nil
+	}},
+	"exists": {arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		var n int64
+		for _, key := range args {
+			if keyType(key) != "" {
+				n++
+			}
+		}
+		return n, nil
+	}},
+	"type": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		if typ := keyType(args[0]); typ != "" {
+			return statusReply(typ), nil
+		}
+		return statusReply("none"), nil
+	}},
+	"keys": {arity: 2, flags: cmdReadonly, proc: func(args []string) (interface{}, error) {
+		// As in Redis, the pattern of KEYS run by name is glob-style.
+		r, err := compileGlob(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return arrayReply(matchKeys(r)), nil
+	}},
+	"expire": {arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return expireCommand(args, time.Second, false)
+	}},
+	"pexpire": {arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return expireCommand(args, time.Millisecond, false)
+	}},
+	"expireat": {arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return expireCommand(args, time.Second, true)
+	}},
+	"pexpireat": {arity: 3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return expireCommand(args, time.Millisecond, true)
+	}},
+	"ttl": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		ttl := pttl(args[0])
+		if ttl < 0 {
+			return ttl, nil
+		}
+		return (ttl + 500) / 1000, nil
+	}},
+	"pttl": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return pttl(args[0]), nil
+	}},
+	"persist": {arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return int64(persist(args[0])), nil
+	}},
+
+	"rpush": {arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return intReply(push(args[0], "rpush", args[1:]))
+	}},
+	"lpush": {arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return intReply(push(args[0], "lpush", args[1:]))
+	}},
+	"rpop": {arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return bulkOrNil(pop(args[0], "rpop"))
+	}},
+	"lpop": {arity: 2, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return bulkOrNil(pop(args[0], "lpop"))
+	}},
+	"lrange": {arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		start, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		stop, err := parseInt(args[2])
+		if err != nil {
+			return nil, err
+		}
+		list, err := lrange(args[0], int(start), int(stop))
+		return arrayReply(list), err
+	}},
+	"llen": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return intReply(llen(args[0]))
+	}},
+	"lindex": {arity: 3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		index, err := parseInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return bulkOrNil(lindex(args[0], int(index)))
+	}},
+
+	"sadd": {arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return intReply(sadd(args[0], args[1:]))
+	}},
+	"smembers": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		members, err := smembers(args[0])
+		return arrayReply(members), err
+	}},
+	"scard": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return intReply(scard(args[0]))
+	}},
+
+	"hset": {arity: -4, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		if len(args)%2 != 1 {
+			return nil, errorReply(fmt.Errorf("ERR wrong number of arguments for 'hset' command"))
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			_, ok, err := hset(args[0], args[i], args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				added++
+			}
+		}
+		return added, nil
+	}},
+	"hget": {arity: 3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		return bulkOrNil(hget(args[0], args[1]))
+	}},
+	"hdel": {arity: -3, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		var removed int64
+		for _, field := range args[1:] {
+			n, err := hdel(args[0], field)
+			if err != nil {
+				return nil, err
+			}
+			removed += int64(n)
+		}
+		return removed, nil
+	}},
+	"hexists": {arity: 3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		_, ok, err := hget(args[0], args[1])
+		return int64(boolToInt(ok)), err
+	}},
+	"hgetall": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		h, err := hgetall(args[0])
+		out := make([]interface{}, 0, 2*h.Size())
+		for field, value := range h.m {
+			out = append(out, field, value)
+		}
+		return out, err
+	}},
+	"hkeys": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		fields, err := hashFields(args[0], true)
+		return arrayReply(fields), err
+	}},
+	"hvals": {arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1, proc: func(args []string) (interface{}, error) {
+		values, err := hashFields(args[0], false)
+		return arrayReply(values), err
+	}},
+
+	"publish": {arity: 3, proc: func(args []string) (interface{}, error) {
+		return int64(publish(ChangeEvent{Data: args[1], Channel: args[0]})), nil
+	}},
+	"ping": {arity: -1, proc: func(args []string) (interface{}, error) {
+		switch len(args) {
+		case 0:
+			return statusReply("PONG"), nil
+		case 1:
+			return args[0], nil
+		}
+		return nil, errorReply(errors.New("ERR wrong number of arguments for 'ping' command"))
+	}},
+}
+
+func init() {
+	for name, cmd := range commandTable {
+		cmd.name = name
+	}
+}
+
+// lookupCommand returns the command args calls, args[0] naming it in any case,
+// after checking its number of arguments.
+func lookupCommand(args []string) (*command, error) {
+	if len(args) == 0 {
+		return nil, errorReply(errors.New("ERR unknown command ''"))
+	}
+	cmd, ok := commandTable[strings.ToLower(args[0])]
+	if !ok {
+		return nil, errorReply(fmt.Errorf("ERR unknown command '%s'", args[0]))
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		return nil, errorReply(fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.name))
+	}
+	return cmd, nil
+}
+
+// runCommand runs the command args calls, as a client sending it would.
+func runCommand(args []string) (interface{}, error) {
+	cmd, err := lookupCommand(args)
+	if err != nil {
+		return nil, err
+	}
+
+	defer call(cmd.name, args[1:]...)()
+	return cmd.proc(args[1:])
+}
+
+// keys returns the key arguments of a call to the command, args[0] naming it.
+func (cmd *command) keys(args []string) []string {
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// execCommand runs the command args calls, for scripts and functions, which hold
+// execMu already. check, if not nil, may refuse to run the command with an error.
+func execCommand(args []string, check func(cmd *command) error) (interface{}, error) {
+	cmd, err := lookupCommand(args)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(cmd); err != nil {
+			return nil, errorReply(err)
+		}
+	}
+
+	defer trace(cmd.name, args[1:]...)()
+	return cmd.proc(args[1:])
+}
+
+// errorReply counts err as an error reply and returns it.
+func errorReply(err error) error {
+	atomic.AddUint64(&errorReplies, 1)
+	return err
+}
+
+// parseInt parses an integer argument.
+func parseInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errorReply(errNotInteger)
+	}
+	return n, nil
+}
+
+// bulkOrNil replies value, or nil when there is none.
+func bulkOrNil(value string, ok bool, err error) (interface{}, error) {
+	if err != nil || !ok {
+		return nil, err
+	}
+	return value, nil
+}
+
+func intReply(n int, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return int64(n), nil
+}
+
+func arrayReply(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+// setCommand is SET key value [NX | XX] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL].
+func setCommand(args []string) (interface{}, error) {
+	var opt setOptions
+	for i := 2; i < len(args); i++ {
+		switch arg := strings.ToUpper(args[i]); {
+		case arg == "NX" && !opt.xx:
+			opt.nx = true
+		case arg == "XX" && !opt.nx:
+			opt.xx = true
+		case arg == "KEEPTTL" && opt.expireAt.IsZero():
+			opt.keepTTL = true
+		case (arg == "EX" || arg == "PX" || arg == "EXAT" || arg == "PXAT") &&
+			!opt.keepTTL && opt.expireAt.IsZero() && i+1 < len(args):
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				return nil, err
+			}
+			if n <= 0 {
+				return nil, errorReply(errInvalidExpire)
+			}
+			switch arg {
+			case "EX":
+				opt.expireAt = timeNow().Add(time.Duration(n) * time.Second)
+			case "PX":
+				opt.expireAt = timeNow().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				opt.expireAt = time.Unix(n, 0)
+			case "PXAT":
+				opt.expireAt = time.Unix(0, n*int64(time.Millisecond))
+			}
+		default:
+			return nil, errorReply(errSyntax)
+		}
+	}
+
+	ok, err := setString(args[0], args[1], opt)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return statusReply("OK"), nil
+}
+
+// expireCommand is EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, whose argument counts
+// in unit, and is a Unix time rather than a time to live when at is set.
+func expireCommand(args []string, unit time.Duration, at bool) (interface{}, error) {
+	n, err := parseInt(args[1])
+	if err != nil {
+		return nil, err
+	}
+	when := time.Unix(0, 0)
+	if !at {
+		when = timeNow()
+	}
+	return int64(setExpire(args[0], when.Add(time.Duration(n)*unit))), nil
+}
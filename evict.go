@@ -0,0 +1,274 @@
+package redis
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOOM is the error of writes refused because the keyspace is over maxmemory and
+// nothing can be evicted.
+//
+// The functions running commands reply as Redis would, without an error: when a
+// command fails with an error reply, such as ErrOOM or ErrWrongType, they return
+// the zero value of their reply, "" or 0, and change nothing. Conn.Do, Client
+// and scripts report the error itself.
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// Approximate per-key costs, in bytes, on top of the key and value strings: the
+// keyspace entry with its object header, and each list element, set member or
+// hash field.
+const (
+	keyOverhead  = 64
+	elemOverhead = 16
+)
+
+// LFU counter parameters, as Redis's lfu-log-factor and lfu-decay-time defaults.
+// New keys start at lfuInitVal so they are not evicted before they had a chance
+// to be used.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// keyInfo is the metadata kept for every key: its approximate size, when it was
+// last accessed and its LFU counter. Fields are accessed atomically.
+type keyInfo struct {
+	size       int64 // including the key and keyOverhead
+	lastAccess int64 // UnixNano
+	lfuDecrAt  int64 // UnixNano of the last LFU decrement
+	lfuCounter uint32
+}
+
+var (
+	usedMemory int64
+	peakMemory int64
+
+	maxmemory        int64
+	maxmemoryPolicy  = "noeviction"
+	maxmemorySamples = 5
+	maxmemoryMu      sync.RWMutex
+
+	evictedKeys uint64
+)
+
+var maxmemoryPolicies = map[string]bool{
+	"noeviction":      true,
+	"allkeys-lru":     true,
+	"allkeys-lfu":     true,
+	"allkeys-random":  true,
+	"volatile-lru":    true,
+	"volatile-lfu":    true,
+	"volatile-random": true,
+	"volatile-ttl":    true,
+}
+
+// SetMaxmemory sets the memory limit, in bytes, of the keyspace, as measured by
+// UsedMemory. Zero, the default, means no limit.
+func SetMaxmemory(bytes int64) {
+	maxmemoryMu.Lock()
+	maxmemory = bytes
+	maxmemoryMu.Unlock()
+}
+
+// SetMaxmemoryPolicy selects how keys are chosen for eviction when the keyspace
+// is over maxmemory:
+//
+//	volatile-lru    Evict using approximated LRU, only keys with an expire set.
+//	allkeys-lru     Evict any key using approximated LRU.
+//	volatile-lfu    Evict using approximated LFU, only keys with an expire set.
+//	allkeys-lfu     Evict any key using approximated LFU.
+//	volatile-random Remove a random key having an expire set.
+//	allkeys-random  Remove a random key, any key.
+//	volatile-ttl    Remove the key with the nearest expire time (minor TTL).
+//	noeviction      Don't evict anything, just return an error on write operations.
+func SetMaxmemoryPolicy(policy string) error {
+	if !maxmemoryPolicies[policy] {
+		return errors.New("redis: invalid maxmemory policy " + policy)
+	}
+
+	maxmemoryMu.Lock()
+	maxmemoryPolicy = policy
+	maxmemoryMu.Unlock()
+	return nil
+}
+
+// SetMaxmemorySamples sets how many keys are sampled to pick each eviction
+// victim. More samples approximate true LRU, LFU or TTL order more closely at
+// the cost of CPU. The default is 5.
+func SetMaxmemorySamples(samples int) {
+	if samples < 1 {
+		samples = 1
+	}
+
+	maxmemoryMu.Lock()
+	maxmemorySamples = samples
+	maxmemoryMu.Unlock()
+}
+
+// UsedMemory returns the approximate number of bytes used by the keyspace.
+func UsedMemory() int64 {
+	return atomic.LoadInt64(&usedMemory)
+}
+
+// grow adds delta bytes to the size of the entry and the memory used. The caller
+// holds the entry's shard lock for writing.
+func (e *entry) grow(delta int64) {
+	atomic.AddInt64(&e.size, delta)
+	used := atomic.AddInt64(&usedMemory, delta)
+	for peak := atomic.LoadInt64(&peakMemory); used > peak; peak = atomic.LoadInt64(&peakMemory) {
+		if atomic.CompareAndSwapInt64(&peakMemory, peak, used) {
+			break
+		}
+	}
+}
+
+// measure sets the recorded size of the entry of key from its value, for values
+// stored in one go. The caller holds the entry's shard lock for writing.
+func (e *entry) measure(key string) {
+	e.grow(keyOverhead + int64(len(key)) + e.valueSize(0) - atomic.LoadInt64(&e.size))
+}
+
+// compact reports whether the entry's value is in a compact encoding. Compact
+// values are small, so commands measure them again after a write rather than
+// tracking the size of what they changed.
+func (e *entry) compact() bool {
+	switch e.value.(type) {
+	case *listpackList, *listpackSet, *listpackHash, *intset:
+		return true
+	}
+	return false
+}
+
+// touchKey records an access to key for the LRU and LFU policies.
+func touchKey(key string) {
+	s := shardFor(key)
+	s.mu.RLock()
+	e, ok := s.entries[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	now := timeNow().UnixNano()
+	atomic.StoreInt64(&e.lastAccess, now)
+
+	counter := e.lfuDecrement(now)
+	atomic.StoreUint32(&e.lfuCounter, lfuLogIncr(counter))
+	atomic.StoreInt64(&e.lfuDecrAt, now)
+}
+
+// accessKey is called by commands before they use key: it deletes the key if it
+// has expired and records the access.
+func accessKey(key string) {
+	expireIfNeeded(key)
+	touchKey(key)
+}
+
+// lfuDecrement returns the LFU counter after decaying it by one for every
+// lfuDecayTime since it was last decremented.
+func (info *keyInfo) lfuDecrement(now int64) uint32 {
+	counter := atomic.LoadUint32(&info.lfuCounter)
+	periods := uint32(time.Duration(now-atomic.LoadInt64(&info.lfuDecrAt)) / lfuDecayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// lfuLogIncr increments an LFU counter logarithmically: the higher the counter,
+// the less likely an access is to increment it, so that 255 is only reached
+// after about a million accesses.
+func lfuLogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// performEvictions evicts keys, following the maxmemory policy, until the
+// keyspace is within maxmemory. Commands that may grow the keyspace call it
+// first, and refuse to run if it returns ErrOOM.
+func performEvictions() error {
+	maxmemoryMu.RLock()
+	limit, policy, samples := maxmemory, maxmemoryPolicy, maxmemorySamples
+	maxmemoryMu.RUnlock()
+
+	if limit <= 0 || UsedMemory() <= limit {
+		return nil
+	}
+
+	defer latencySample("eviction-cycle", timeNow())
+
+	for UsedMemory() > limit {
+		victim, ok := "", false
+		if policy != "noeviction" {
+			victim, ok = evictionCandidate(policy, samples)
+		}
+		if !ok {
+			atomic.AddUint64(&errorReplies, 1)
+			return ErrOOM
+		}
+
+		if delKeys(notifyEvicted, "evicted", victim) > 0 {
+			atomic.AddUint64(&evictedKeys, 1)
+		}
+	}
+
+	return nil
+}
+
+// evictionCandidate samples keys, only those with an expire for the volatile
+// policies, and returns the best one to evict. Sampling starts from a random
+// shard so that evictions are spread over the keyspace.
+func evictionCandidate(policy string, samples int) (victim string, found bool) {
+	now := timeNow()
+	volatile := policy[:len("volatile")] == "volatile"
+	best := math.Inf(-1)
+
+	consider := func(key string, e *entry) bool {
+		var score float64
+		switch policy {
+		case "allkeys-lru", "volatile-lru":
+			score = float64(now.UnixNano() - atomic.LoadInt64(&e.lastAccess))
+		case "allkeys-lfu", "volatile-lfu":
+			score = float64(255 - e.lfuDecrement(now.UnixNano()))
+		case "volatile-ttl":
+			score = -float64(e.expireAt.UnixNano())
+		}
+		if !found || score > best {
+			victim, best, found = key, score, true
+		}
+		samples--
+		return samples > 0
+	}
+
+	first := rand.Intn(shardCount)
+	for i := 0; i < shardCount && samples > 0; i++ {
+		s := shards[(first+i)%shardCount]
+		s.mu.RLock()
+		candidates := s.entries
+		if volatile {
+			candidates = s.volatile
+		}
+		for key, e := range candidates {
+			if !consider(key, e) {
+				break
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return
+}
@@ -0,0 +1,301 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Functions are the Go counterpart of Redis functions: named functions, grouped
+// in libraries loaded by the application, that run atomically against the
+// keyspace like scripts do. As they run with every other command waiting, they
+// reach the keyspace through FunctionCall.Call only: calling the package's
+// commands from a function would wait for the function itself.
+
+// FunctionFlags declare what a function may do, like the flags of Redis
+// functions.
+type FunctionFlags uint8
+
+const (
+	// FunctionNoWrites functions only read the keyspace. Only they can be run
+	// with FCALL_RO, and they run even when the keyspace is over maxmemory.
+	FunctionNoWrites FunctionFlags = 1 << iota
+
+	// FunctionAllowOOM functions run even when the keyspace is over maxmemory,
+	// like allow-oom. Commands growing the keyspace still fail with ErrOOM.
+	FunctionAllowOOM
+)
+
+// Function is a function of a library.
+type Function struct {
+	Name        string
+	Description string
+	Flags       FunctionFlags
+
+	// Fn runs the function. The commands it calls through fc, and nothing
+	// else, run atomically with it.
+	Fn func(fc *FunctionCall) (interface{}, error)
+}
+
+// Library is a named set of functions, loaded with FunctionLoad.
+type Library struct {
+	Name      string
+	Functions []Function
+}
+
+// FunctionCall is a call to a function: its keys and arguments, and the commands
+// it can run.
+type FunctionCall struct {
+	Keys []string
+	Args []string
+
+	fn *Function
+}
+
+// LibraryInfo describes a loaded library, as FUNCTION LIST does.
+type LibraryInfo struct {
+	Name      string
+	Functions []FunctionInfo
+}
+
+// FunctionInfo describes a function of a loaded library.
+type FunctionInfo struct {
+	Name        string
+	Description string
+	Flags       []string
+}
+
+var (
+	errFunctionNotFound  = errors.New("ERR Function not found")
+	errLibraryNotFound   = errors.New("ERR Library not found")
+	errNoFunctions       = errors.New("ERR No functions registered")
+	errWriteFromReadOnly = errors.New("ERR Write commands are not allowed from read-only scripts.")
+	errFcallRoWrite      = errors.New("ERR Can not execute a script with write flag using *_ro command.")
+	errLibraryName       = errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	errFunctionName      = errors.New("ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+)
+
+var (
+	// libraries holds the loaded libraries by name, and functions their
+	// functions by name, which are unique across libraries.
+	libraries   = make(map[string]*Library)
+	functions   = make(map[string]*Function)
+	functionsMu sync.Mutex
+)
+
+// Call runs a command, given by name and arguments as a client sends it, like
+// redis.call in scripts. Its reply is nil, an int64, a string or an
+// []interface{} of those. Functions flagged FunctionNoWrites cannot run write
+// commands.
+func (fc *FunctionCall) Call(name string, args ...string) (interface{}, error) {
+	reply, err := execCommand(append([]string{name}, args...), func(cmd *command) error {
+		if cmd.flags&cmdWrite != 0 && fc.fn.Flags&FunctionNoWrites != 0 {
+			return errWriteFromReadOnly
+		}
+		return nil
+	})
+	return plainReply(reply), err
+}
+
+// Loads a library of functions. A library with the same name is only replaced
+// when replace is set. The library is copied, so later changes to lib do not
+// affect the loaded library.
+//
+// Return value
+// Bulk string reply: the name of the library, or an error if its name or the
+// name of a function is invalid or taken.
+func FunctionLoad(lib Library, replace bool) (string, error) {
+	defer call("function|load", lib.Name)()
+
+	if !validFunctionName(lib.Name) {
+		return "", errorReply(errLibraryName)
+	}
+	if len(lib.Functions) == 0 {
+		return "", errorReply(errNoFunctions)
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	old, exists := libraries[lib.Name]
+	if exists && !replace {
+		return "", errorReply(fmt.Errorf("ERR Library '%s' already exists", lib.Name))
+	}
+
+	loaded := &Library{Name: lib.Name, Functions: append([]Function(nil), lib.Functions...)}
+	names := make(map[string]bool, len(loaded.Functions))
+	for _, fn := range loaded.Functions {
+		if !validFunctionName(fn.Name) {
+			return "", errorReply(errFunctionName)
+		}
+		if fn.Fn == nil {
+			return "", errorReply(fmt.Errorf("ERR Function %s has no body", fn.Name))
+		}
+		if other, ok := functions[fn.Name]; names[fn.Name] || (ok && !libraryHas(old, other)) {
+			return "", errorReply(fmt.Errorf("ERR Function %s already exists", fn.Name))
+		}
+		names[fn.Name] = true
+	}
+
+	if exists {
+		for i := range old.Functions {
+			delete(functions, old.Functions[i].Name)
+		}
+	}
+	libraries[lib.Name] = loaded
+	for i := range loaded.Functions {
+		functions[loaded.Functions[i].Name] = &loaded.Functions[i]
+	}
+
+	return lib.Name, nil
+}
+
+func libraryHas(lib *Library, fn *Function) bool {
+	if lib == nil {
+		return false
+	}
+	for i := range lib.Functions {
+		if &lib.Functions[i] == fn {
+			return true
+		}
+	}
+	return false
+}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isLuaAlpha(c) && !isDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Invokes a function of a loaded library, with the keys it accesses and further
+// arguments. The function runs atomically: no other command runs until it
+// returns.
+//
+// Return value
+// The reply of the function, or the error it returned.
+func Fcall(function string, keys []string, args ...string) (interface{}, error) {
+	defer callScript("fcall", func() []string { return scriptCallArgs(function, keys, args) })()
+
+	return fcall(function, keys, args, false)
+}
+
+// This is a read-only variant of FCALL, which can only invoke functions flagged
+// FunctionNoWrites.
+//
+// Return value
+// The reply of the function, or the error it returned.
+func FcallRo(function string, keys []string, args ...string) (interface{}, error) {
+	defer callScript("fcall_ro", func() []string { return scriptCallArgs(function, keys, args) })()
+
+	return fcall(function, keys, args, true)
+}
+
+func fcall(name string, keys, args []string, readOnly bool) (interface{}, error) {
+	functionsMu.Lock()
+	fn, ok := functions[name]
+	functionsMu.Unlock()
+	if !ok {
+		return nil, errorReply(errFunctionNotFound)
+	}
+	if readOnly && fn.Flags&FunctionNoWrites == 0 {
+		return nil, errorReply(errFcallRoWrite)
+	}
+	if fn.Flags&(FunctionNoWrites|FunctionAllowOOM) == 0 {
+		if err := performEvictions(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := fn.Fn(&FunctionCall{Keys: keys, Args: args, fn: fn})
+	if err != nil {
+		return nil, errorReply(err)
+	}
+	return reply, nil
+}
+
+// Returns information about the loaded libraries and their functions, for the
+// libraries whose name matches the glob-style pattern, as with KEYS run through
+// Conn.Do, or all of them if pattern is empty.
+//
+// Return value
+// The libraries, sorted by name, or an error if pattern is invalid.
+func FunctionList(pattern string) ([]LibraryInfo, error) {
+	defer call("function|list", pattern)()
+
+	var r *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if r, err = compileGlob(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	out := []LibraryInfo{}
+	for name, lib := range libraries {
+		if r != nil && !r.MatchString(name) {
+			continue
+		}
+		info := LibraryInfo{Name: name}
+		for _, fn := range lib.Functions {
+			flags := []string{}
+			if fn.Flags&FunctionNoWrites != 0 {
+				flags = append(flags, "no-writes")
+			}
+			if fn.Flags&FunctionAllowOOM != 0 {
+				flags = append(flags, "allow-oom")
+			}
+			info.Functions = append(info.Functions, FunctionInfo{Name: fn.Name, Description: fn.Description, Flags: flags})
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Deletes a library and all its functions.
+//
+// Return value
+// nil, or an error if there is no such library.
+func FunctionDelete(library string) error {
+	defer call("function|delete", library)()
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	lib, ok := libraries[library]
+	if !ok {
+		return errorReply(errLibraryNotFound)
+	}
+	for _, fn := range lib.Functions {
+		delete(functions, fn.Name)
+	}
+	delete(libraries, library)
+	return nil
+}
+
+// Deletes all the libraries.
+//
+// Return value
+// Simple string reply: OK.
+func FunctionFlush() string {
+	defer call("function|flush")()
+
+	functionsMu.Lock()
+	libraries = make(map[string]*Library)
+	functions = make(map[string]*Function)
+	functionsMu.Unlock()
+
+	return "OK"
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var errInvalidPattern = errors.New("ERR invalid pattern")
+
+// compileGlob translates a Redis glob-style pattern into an anchored regular
+// expression: * matches any sequence of characters, ? any single one, [...] one
+// of a set, [^...] one not in it, with ranges such as a-z, and \ escapes the
+// character following it. Unterminated sets and trailing escapes are reported as
+// invalid.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			if i+1 == len(pattern) {
+				return nil, errorReply(errInvalidPattern)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			end, set, err := compileGlobSet(pattern, i+1)
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(set)
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	b.WriteString(`)$`)
+	return regexp.Compile(b.String())
+}
+
+// compileGlobSet translates the set starting at pattern[start], after its [, and
+// returns the index of its closing ].
+func compileGlobSet(pattern string, start int) (end int, set string, err error) {
+	var b strings.Builder
+	i := start
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	members := 0
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		c := pattern[i]
+		if c == '\\' {
+			if i+1 == len(pattern) {
+				return 0, "", errorReply(errInvalidPattern)
+			}
+			i++
+			c = pattern[i]
+		}
+		lo, hi := c, c
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		b.WriteString(setChar(lo))
+		if hi != lo {
+			b.WriteString("-" + setChar(hi))
+		}
+		members++
+	}
+	if i == len(pattern) {
+		return 0, "", errorReply(errInvalidPattern)
+	}
+
+	switch {
+	case members == 0 && negate:
+		return i, `.`, nil
+	case members == 0:
+		// An empty set matches nothing.
+		return i, `[^\x00-\x{10FFFF}]`, nil
+	case negate:
+		return i, `[^` + b.String() + `]`, nil
+	}
+	return i, `[` + b.String() + `]`, nil
+}
+
+func setChar(c byte) string {
+	return fmt.Sprintf(`\x{%x}`, c)
+}
@@ -2,11 +2,6 @@ package redis
 
 import "sync"
 
-var (
-	allHashes = make(map[string]Hash)
-	hashesMu  sync.RWMutex
-)
-
 // Hash is a concurrent safe string map
 type Hash struct {
 	m  map[string]string
@@ -74,6 +69,104 @@ func (h Hash) Delete(key string) {
 	h.mu.Unlock()
 }
 
+// swap sets a key to a value, returning the previous value and whether there
+// was one.
+func (h Hash) swap(key, value string) (old string, existed bool) {
+	h.mu.Lock()
+	old, existed = h.m[key]
+	h.m[key] = value
+	h.mu.Unlock()
+	return
+}
+
+// hashValue is the value of a hash key, in one of its encodings: a listpackHash
+// while it is small, then a Hash.
+type hashValue interface {
+	get(field string) (string, bool)
+	set(field, value string) (old string, existed bool)
+	remove(field string) (old string, existed bool)
+	len() int
+	each(f func(field, value string) bool)
+	encoding() string
+}
+
+// newHashValue returns a hash holding the fields of m, in the encoding they call
+// for.
+func newHashValue(m map[string]string) hashValue {
+	var h hashValue = &listpackHash{}
+	for field, value := range m {
+		h, _, _ = hashSet(h, field, value)
+	}
+	return h
+}
+
+// hashSet sets field to value in h, returning the previous value and whether there
+// was one. The hash is returned converted to a Hash when it is a listpackHash
+// that cannot take the field.
+func hashSet(h hashValue, field, value string) (hashValue, string, bool) {
+	if lp, ok := h.(*listpackHash); ok && !lp.takes(field, value) {
+		h = toHash(lp)
+	}
+	old, existed := h.set(field, value)
+	return h, old, existed
+}
+
+// toHash returns the fields of h in a new Hash.
+func toHash(h hashValue) Hash {
+	hash := NewHash()
+	hash.m = make(map[string]string, h.len())
+	h.each(func(field, value string) bool {
+		hash.m[field] = value
+		return true
+	})
+	return hash
+}
+
+// hashData returns h as the Hash delivered in change events: h itself when it
+// is one, a copy of it otherwise.
+func hashData(h hashValue) Hash {
+	if hash, ok := h.(Hash); ok {
+		return hash
+	}
+	return toHash(h)
+}
+
+func (h Hash) get(field string) (string, bool) {
+	return h.GetExists(field)
+}
+
+func (h Hash) set(field, value string) (string, bool) {
+	return h.swap(field, value)
+}
+
+func (h Hash) len() int {
+	return h.Size()
+}
+
+func (h Hash) each(f func(field, value string) bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for field, value := range h.m {
+		if !f(field, value) {
+			return
+		}
+	}
+}
+
+func (h Hash) encoding() string {
+	return "hashtable"
+}
+
+// remove deletes a key, returning its value and whether it existed.
+func (h Hash) remove(key string) (old string, existed bool) {
+	h.mu.Lock()
+	old, existed = h.m[key]
+	delete(h.m, key)
+	h.mu.Unlock()
+	return
+}
+
 // Keys returns all keys in the hash
 func (h Hash) Keys() []string {
 	h.mu.RLock()
@@ -130,25 +223,62 @@ func (h Hash) ToMap() map[string]string {
 // Return value
 // Integer reply, specifically:
 // 1 if field is a new field in the hash and value was set.
-// 0 if field already exists in the hash and the value was updated.
+// 0 if field already exists in the hash and the value was updated, or on an
+// error reply, such as ErrOOM.
 func HSet(key, field, value string) (existed int) {
-	hashesMu.Lock()
+	defer call("hset", key, field, value)()
 
-	existed = 0
-	h, exists := allHashes[key]
-	if !exists {
-		h = NewHash()
-		allHashes[key] = h
-		existed = 1
+	created, _, _ := hset(key, field, value)
+	return boolToInt(created)
+}
+
+// hset sets field in the hash stored at key to value, reporting whether the key
+// was created and whether the field was added rather than updated.
+func hset(key, field, value string) (created, added bool, err error) {
+	if err := performEvictions(); err != nil {
+		return false, false, err
 	}
+	accessKey(key)
 
-	hashesMu.Unlock()
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	h.Set(field, value)
+	e, err := s.lookupWrite(key, typeHash)
+	if err != nil {
+		return false, false, err
+	}
+	exists := e != nil
+	if !exists {
+		e = s.add(key, typeHash, &listpackHash{})
+	}
+	compact := e.compact()
+
+	h, old, fieldExisted := hashSet(e.value.(hashValue), field, value)
+	e.value = h
+	if compact {
+		e.measure(key)
+	} else if fieldExisted {
+		e.grow(int64(len(value) - len(old)))
+	} else {
+		e.grow(elemOverhead + int64(len(field)+len(value)))
+	}
+	s.addDirty(1)
 
-	publish <- notice{"hash", key, field, h}
+	event := ChangeEvent{Op: "hset", TypeName: "hash", KeyName: key, FieldName: field, NewValue: value}
+	if subscribed() {
+		event.Data = hashData(h)
+	}
+	if fieldExisted {
+		event.OldValue = old
+	}
+	publish(event)
+	if !exists {
+		notifyKeyspaceEvent(notifyNew, "hash", "new", key)
+	}
+	notifyKeyspaceEvent(notifyHash, "hash", "hset", key)
 
-	return
+	return !exists, !fieldExisted, nil
 }
 
 // Returns the value associated with field in the hash stored at key.
@@ -157,15 +287,28 @@ func HSet(key, field, value string) (existed int) {
 // Bulk string reply: the value associated with field, or nil when field is not
 // present in the hash or key does not exist.
 func HGet(key, field string) string {
-	hashesMu.RLock()
-	h, ok := allHashes[key]
-	hashesMu.RUnlock()
+	defer call("hget", key, field)()
+
+	value, _, _ := hget(key, field)
+	return value
+}
+
+// hget returns the value of field in the hash stored at key, and whether there
+// is one.
+func hget(key, field string) (string, bool, error) {
+	accessKey(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if !ok {
-		return ""
+	e, err := s.lookupRead(key, typeHash)
+	if e == nil {
+		return "", false, err
 	}
 
-	return h.Get(field)
+	value, ok := e.value.(hashValue).get(field)
+	return value, ok, nil
 }
 
 // Removes the specified fields from the hash stored at key. Specified fields that do not
@@ -176,26 +319,52 @@ func HGet(key, field string) string {
 // Integer reply: the number of fields that were removed from the hash, not including
 // specified but non existing fields.
 func HDel(key, field string) (existed int) {
-	hashesMu.Lock()
+	defer call("hdel", key, field)()
 
-	existed = 0
-	h, exists := allHashes[key]
+	existed, _ = hdel(key, field)
+	return
+}
+
+// hdel removes field from the hash stored at key, returning 1 if it was there.
+func hdel(key, field string) (existed int, err error) {
+	accessKey(key)
 
-	if exists {
-		if h.Exists(field) {
-			h.Delete(field)
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.lookupWrite(key, typeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	event := ChangeEvent{Op: "hdel", TypeName: "hash", KeyName: key, FieldName: field}
+	if e != nil {
+		h := e.value.(hashValue)
+		if old, ok := h.remove(field); ok {
+			event.OldValue = old
 			existed++
+			if e.compact() {
+				e.measure(key)
+			} else {
+				e.grow(-(elemOverhead + int64(len(field)+len(old))))
+			}
 		}
-	} else {
+		if subscribed() {
+			event.Data = hashData(h)
+		}
+	} else if subscribed() {
 		// Publish a valid empty Hash
-		h = NewHash()
+		event.Data = NewHash()
 	}
 
-	hashesMu.Unlock()
-
-	publish <- notice{"hash", key, field, h}
+	s.addDirty(existed)
+	publish(event)
+	if existed > 0 {
+		notifyKeyspaceEvent(notifyHash, "hash", "hdel", key)
+	}
 
-	return
+	return existed, nil
 }
 
 // Returns if field is an existing field in the hash stored at key.
@@ -205,19 +374,10 @@ func HDel(key, field string) (existed int) {
 // 1 if the hash contains field.
 // 0 if the hash does not contain field, or key does not exist.
 func HExists(key, field string) (existed int) {
-	hashesMu.RLock()
-	h, hashExists := allHashes[key]
-	hashesMu.RUnlock()
-
-	existed = 0
-
-	if hashExists {
-		if h.Exists(field) {
-			existed = 1
-		}
-	}
+	defer call("hexists", key, field)()
 
-	return
+	_, ok, _ := hget(key, field)
+	return boolToInt(ok)
 }
 
 // Returns all fields and values of the hash stored at key. In the returned
@@ -227,15 +387,26 @@ func HExists(key, field string) (existed int) {
 // Return value
 // map[string]string reply: list of fields and their values stored in the hash, or an empty list when key does not exist.
 func Hgetall(key string) Hash {
-	hashesMu.RLock()
-	h, ok := allHashes[key]
-	hashesMu.RUnlock()
+	defer call("hgetall", key)()
+
+	h, _ := hgetall(key)
+	return h
+}
+
+// hgetall returns a copy of the hash stored at key.
+func hgetall(key string) (Hash, error) {
+	accessKey(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if !ok {
-		return NewHash()
+	e, err := s.lookupRead(key, typeHash)
+	if e == nil {
+		return NewHash(), err
 	}
 
-	return h.Copy()
+	return toHash(e.value.(hashValue)), nil
 }
 
 // Returns all values in the hash stored at key.
@@ -243,15 +414,10 @@ func Hgetall(key string) Hash {
 // Return value
 // Slice reply: list of values in the hash, or an empty list when key does not exist.
 func Hvals(key string) []string {
-	hashesMu.RLock()
-	h, ok := allHashes[key]
-	hashesMu.RUnlock()
+	defer call("hvals", key)()
 
-	if !ok {
-		return []string{}
-	}
-
-	return h.Values()
+	values, _ := hashFields(key, false)
+	return values
 }
 
 // Returns all field names in the hash stored at key.
@@ -259,13 +425,33 @@ func Hvals(key string) []string {
 // Return value
 // Array reply: list of fields in the hash, or an empty list when key does not exist.
 func Hkeys(key string) []string {
-	hashesMu.RLock()
-	h, ok := allHashes[key]
-	hashesMu.RUnlock()
+	defer call("hkeys", key)()
+
+	fields, _ := hashFields(key, true)
+	return fields
+}
 
-	if !ok {
-		return []string{}
+// hashFields returns the field names, or the values, of the hash stored at key,
+// for HKEYS and HVALS.
+func hashFields(key string, names bool) ([]string, error) {
+	accessKey(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := []string{}
+	e, err := s.lookupRead(key, typeHash)
+	if e != nil {
+		e.value.(hashValue).each(func(field, value string) bool {
+			if names {
+				out = append(out, field)
+			} else {
+				out = append(out, value)
+			}
+			return true
+		})
 	}
 
-	return h.Keys()
+	return out, err
 }
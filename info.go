@@ -0,0 +1,344 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startTime = timeNow()
+	runID     = newRunID()
+
+	// totalCommands counts every command called, and commandStats the calls
+	// and latency of each command by name.
+	totalCommands uint64
+	commandStats  sync.Map // name -> *commandStat
+
+	// keyspaceHits and keyspaceMisses count the lookups by read commands of keys
+	// that existed and of keys that did not.
+	keyspaceHits   uint64
+	keyspaceMisses uint64
+
+	// errorReplies counts the commands that failed with an error reply, such as
+	// ErrWrongType or ErrOOM.
+	errorReplies uint64
+)
+
+// infoSections lists the sections of the default INFO reply, in order.
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace"}
+
+// The INFO command returns information and statistics about the server in a
+// format that is simple to parse by computers and easy to read by humans.
+//
+// The optional parameter can be used to select a specific section of information:
+//
+//	server: General information about the server
+//	clients: Pub/Sub subscriptions, the only clients of the package
+//	memory: Memory consumption related information
+//	persistence: RDB related information
+//	stats: General statistics
+//	commandstats: Command statistics
+//	keyspace: Database related statistics
+//
+// It can also take the following values:
+//
+//	all: Return all sections
+//	default: Return only the default set of sections
+//	everything: Includes all and modules
+//
+// When no parameter is provided, the default option is assumed.
+//
+// Return value
+// Bulk string reply: as a collection of text lines.
+// Lines can contain a section name (starting with a # character) or a property. All
+// the properties are in the form of field:value terminated by \r\n.
+func Info(section ...string) string {
+	defer call("info", section...)()
+
+	var selected []string
+	if len(section) == 0 {
+		section = []string{"default"}
+	}
+	for _, s := range section {
+		switch s = strings.ToLower(s); s {
+		case "default":
+			selected = append(selected, infoSections...)
+		case "all", "everything":
+			selected = append(selected, infoSections[:len(infoSections)-1]...)
+			selected = append(selected, "commandstats", "keyspace")
+		default:
+			selected = append(selected, s)
+		}
+	}
+
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, s := range selected {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		lines := infoSection(s)
+		if lines == nil {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(s[:1]) + s[1:] + "\r\n")
+		for _, l := range lines {
+			b.WriteString(l + "\r\n")
+		}
+	}
+
+	return b.String()
+}
+
+// infoSection returns the field:value lines of an INFO section, or nil if there
+// is no such section.
+func infoSection(section string) []string {
+	switch section {
+	case "server":
+		uptime := timeSince(startTime)
+		return []string{
+			"redis_mode:standalone",
+			"os:" + runtime.GOOS + " " + runtime.GOARCH,
+			fmt.Sprintf("arch_bits:%d", 32<<(^uint(0)>>63)),
+			"go_version:" + runtime.Version(),
+			fmt.Sprintf("process_id:%d", os.Getpid()),
+			"run_id:" + runID,
+			fmt.Sprintf("uptime_in_seconds:%d", int64(uptime/time.Second)),
+			fmt.Sprintf("uptime_in_days:%d", int64(uptime/(24*time.Hour))),
+			"hz:10",
+		}
+
+	case "clients":
+		consumerMu.RLock()
+		subscriptions := len(consumers)
+		maxPending := 0
+		for _, c := range consumers {
+			if p := c.Pending(); p > maxPending {
+				maxPending = p
+			}
+		}
+		consumerMu.RUnlock()
+
+		return []string{
+			fmt.Sprintf("pubsub_clients:%d", subscriptions),
+			fmt.Sprintf("pubsub_max_pending_messages:%d", maxPending),
+		}
+
+	case "memory":
+		maxmemoryMu.RLock()
+		limit, policy := maxmemory, maxmemoryPolicy
+		maxmemoryMu.RUnlock()
+		used, peak := UsedMemory(), atomic.LoadInt64(&peakMemory)
+
+		return []string{
+			fmt.Sprintf("used_memory:%d", used),
+			"used_memory_human:" + humanBytes(used),
+			fmt.Sprintf("used_memory_peak:%d", peak),
+			"used_memory_peak_human:" + humanBytes(peak),
+			fmt.Sprintf("maxmemory:%d", limit),
+			"maxmemory_human:" + humanBytes(limit),
+			"maxmemory_policy:" + policy,
+		}
+
+	case "persistence":
+		saveMu.Lock()
+		last, ok, running := lastSave, lastSaveOK, bgsaveRunning
+		saveMu.Unlock()
+
+		status := "ok"
+		if !ok {
+			status = "err"
+		}
+		return []string{
+			"loading:0",
+			fmt.Sprintf("rdb_changes_since_last_save:%d", dirtyCount()-atomic.LoadUint64(&dirtyAtSave)),
+			fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(running)),
+			fmt.Sprintf("rdb_last_save_time:%d", last.Unix()),
+			"rdb_last_bgsave_status:" + status,
+		}
+
+	case "stats":
+		return []string{
+			fmt.Sprintf("total_commands_processed:%d", atomic.LoadUint64(&totalCommands)),
+			fmt.Sprintf("expired_keys:%d", atomic.LoadUint64(&expiredKeys)),
+			fmt.Sprintf("evicted_keys:%d", atomic.LoadUint64(&evictedKeys)),
+			fmt.Sprintf("keyspace_hits:%d", atomic.LoadUint64(&keyspaceHits)),
+			fmt.Sprintf("keyspace_misses:%d", atomic.LoadUint64(&keyspaceMisses)),
+			fmt.Sprintf("pubsub_channels:%d", len(activeChannels(nil))),
+			fmt.Sprintf("pubsub_patterns:%d", numPatterns()),
+			fmt.Sprintf("total_published_messages:%d", atomic.LoadUint64(&publishCount)),
+			fmt.Sprintf("pubsub_dropped_messages:%d", atomic.LoadUint64(&droppedMessages)),
+			fmt.Sprintf("pubsub_slow_disconnects:%d", atomic.LoadUint64(&slowDisconnects)),
+			fmt.Sprintf("total_error_replies:%d", atomic.LoadUint64(&errorReplies)),
+		}
+
+	case "commandstats":
+		lines := []string{}
+		commandStats.Range(func(name, stat interface{}) bool {
+			calls, usec := stat.(*commandStat).load()
+			perCall := 0.0
+			if calls > 0 {
+				perCall = float64(usec) / float64(calls)
+			}
+			lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f", name, calls, usec, perCall))
+			return true
+		})
+		sort.Strings(lines)
+		return lines
+
+	case "keyspace":
+		counts := make(map[string]int)
+		for _, key := range matchKeys(allKeys) {
+			counts[keyType(key)]++
+		}
+		keys := counts["hash"] + counts["list"] + counts["set"] + counts["string"]
+		if keys == 0 {
+			return []string{}
+		}
+
+		volatile := 0
+		var ttl time.Duration
+		now := timeNow()
+		for _, s := range shards {
+			s.mu.RLock()
+			volatile += len(s.volatile)
+			for _, e := range s.volatile {
+				if e.expireAt.After(now) {
+					ttl += e.expireAt.Sub(now)
+				}
+			}
+			s.mu.RUnlock()
+		}
+		avgTTL := int64(0)
+		if volatile > 0 {
+			avgTTL = int64(ttl/time.Millisecond) / int64(volatile)
+		}
+
+		return []string{fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=%d,hashes=%d,lists=%d,sets=%d,strings=%d",
+			keys, volatile, avgTTL, counts["hash"], counts["list"], counts["set"], counts["string"])}
+	}
+
+	return nil
+}
+
+// call records a call to the command name with its arguments. Every command
+// starts with
+//
+//	defer call("name", args...)()
+//
+// so the returned function records how long the command took when it returns.
+// Commands wait for a running script to finish before they start, so scripts
+// run atomically.
+func call(name string, args ...string) func() {
+	key := name
+	if len(args) > 0 {
+		key = args[0]
+	}
+	return callStripe(execMu.stripe(key), name, args, nil)
+}
+
+// callKey is call for commands on key whose other arguments take work to build,
+// such as formatting integers or gathering values: rest only builds them for a
+// monitor attached or an entry of the slow log.
+func callKey(name, key string, rest func() []string) func() {
+	return callStripe(execMu.stripe(key), name, nil, func() []string {
+		return append([]string{key}, rest()...)
+	})
+}
+
+func callStripe(mu *sync.RWMutex, name string, args []string, lazy func() []string) func() {
+	mu.RLock()
+	done := traceLazy(name, args, lazy)
+
+	return func() {
+		done()
+		mu.RUnlock()
+	}
+}
+
+// trace is call without waiting for scripts, for the commands scripts run and
+// the few that must not wait for them, like SCRIPT KILL.
+func trace(name string, args ...string) func() {
+	return traceLazy(name, args, nil)
+}
+
+// traceLazy is trace with the arguments built by lazy, if not nil, when they are
+// needed.
+func traceLazy(name string, args []string, lazy func() []string) func() {
+	atomic.AddUint64(&totalCommands, 1)
+	start := timeNow()
+	if lazy != nil && monitored() {
+		args, lazy = lazy(), nil
+	}
+	feedMonitors(start, name, args)
+
+	return func() {
+		took := timeSince(start)
+
+		stat, ok := commandStats.Load(name)
+		if !ok {
+			stat, _ = commandStats.LoadOrStore(name, new(commandStat))
+		}
+		stat.(*commandStat).record(took)
+
+		if lazy != nil && slowlogTakes(took) {
+			args = lazy()
+		}
+		slowlogPushIfNeeded(start, took, name, args)
+		latencyAddSampleIfNeeded("command", took)
+	}
+}
+
+// recordLookup counts a read command's lookup of key as a keyspace hit or miss,
+// publishing a keymiss notification for misses.
+func recordLookup(key string, found bool) {
+	if found {
+		atomic.AddUint64(&keyspaceHits, 1)
+		return
+	}
+
+	atomic.AddUint64(&keyspaceMisses, 1)
+	notifyKeyspaceEvent(notifyKeyMiss, "", "keymiss", key)
+}
+
+// humanBytes formats a number of bytes the way INFO does, like 1.50M.
+func humanBytes(n int64) string {
+	switch f := float64(n); {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", f/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", f/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", f/(1024*1024*1024))
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// newRunID returns a random identifier of this process, which changes on every
+// start, like Redis's run_id.
+func newRunID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,51 +1,35 @@
 package redis
 
-import "regexp"
+import (
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// expiredKeys counts the keys deleted because their timeout had passed.
+var expiredKeys uint64
 
 // Removes the specified keys. A key is ignored if it does not exist.
 //
 // Return value
 // Integer reply: The number of keys that were removed.
 func Del(key ...string) (deletedCount int) {
+	defer call("del", key...)()
 
-	hashesMu.Lock()
-	defer hashesMu.Unlock()
-
-	listsMu.Lock()
-	defer listsMu.Unlock()
-
-	setsMu.Lock()
-	defer setsMu.Unlock()
-
-	stringsMu.Lock()
-	defer stringsMu.Unlock()
+	return delKeys(notifyGeneric, "del", key...)
+}
 
-	deletedCount = 0
+// delKeys removes keys, publishing the keyspace event named event, of class, for
+// each key that existed.
+func delKeys(class int32, event string, keys ...string) (deletedCount int) {
+	unlock := lockKeys(keys...)
+	defer unlock()
 
-	for _, k := range key {
-		if _, exists := allHashes[k]; exists {
-			delete(allHashes, k)
-			deletedCount++
-			publish <- notice{"hash", k, "", nil}
-			continue
-		}
-		if _, exists := allLists[k]; exists {
-			delete(allLists, k)
+	for _, k := range keys {
+		if s := shardFor(k); s.deleteKey(class, event, k) {
+			s.addDirty(1)
 			deletedCount++
-			publish <- notice{"list", k, "", nil}
-			continue
-		}
-		if _, exists := allSets[k]; exists {
-			delete(allSets, k)
-			deletedCount++
-			publish <- notice{"set", k, "", nil}
-			continue
-		}
-		if _, exists := allStrings[k]; exists {
-			delete(allStrings, k)
-			deletedCount++
-			publish <- notice{"string", k, "", nil}
-			continue
 		}
 	}
 
@@ -59,33 +43,12 @@ func Del(key ...string) (deletedCount int) {
 // 1 if the key exists.
 // 0 if the key does not exist.
 func Exists(key string) int {
+	defer call("exists", key)()
 
-	hashesMu.RLock()
-	defer hashesMu.RUnlock()
-
-	listsMu.RLock()
-	defer listsMu.RUnlock()
-
-	setsMu.RLock()
-	defer setsMu.RUnlock()
-
-	stringsMu.RLock()
-	defer stringsMu.RUnlock()
-
-	if _, exists := allHashes[key]; exists {
-		return 1
-	}
-	if _, exists := allLists[key]; exists {
-		return 1
-	}
-	if _, exists := allSets[key]; exists {
-		return 1
-	}
-	if _, exists := allStrings[key]; exists {
-		return 1
+	if keyType(key) == "" {
+		return 0
 	}
-
-	return 0
+	return 1
 }
 
 // Returns the string representation of the type of the value stored at key. The different
@@ -94,32 +57,23 @@ func Exists(key string) int {
 // Return value
 // Simple string reply: type of key, or none when key does not exist.
 func Type(key string) string {
+	defer call("type", key)()
 
-	hashesMu.RLock()
-	defer hashesMu.RUnlock()
-
-	listsMu.RLock()
-	defer listsMu.RUnlock()
+	return keyType(key)
+}
 
-	setsMu.RLock()
-	defer setsMu.RUnlock()
+// keyType returns the type of the value stored at key, or "" when there is none,
+// after expiring the key if its timeout has passed.
+func keyType(key string) string {
+	expireIfNeeded(key)
 
-	stringsMu.RLock()
-	defer stringsMu.RUnlock()
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if _, exists := allHashes[key]; exists {
-		return "hash"
-	}
-	if _, exists := allLists[key]; exists {
-		return "list"
-	}
-	if _, exists := allSets[key]; exists {
-		return "set"
-	}
-	if _, exists := allStrings[key]; exists {
-		return "string"
+	if e, ok := s.entries[key]; ok {
+		return e.typ.String()
 	}
-
 	return ""
 }
 
@@ -134,53 +88,301 @@ func Type(key string) string {
 // as changing your keyspace layout. Don't use KEYS in your regular application code.
 // If you're looking for a way to find keys in a subset of your keyspace, consider using
 // sets.
-// Supported glob-style patterns:
+// Unlike Redis, pattern is a regular expression, matching anywhere in the key: "^h.llo$"
+// matches hello, hallo and hxllo. KEYS run by name, from scripts, functions and the
+// client adapters, takes the glob-style patterns of Redis:
 // h?llo matches hello, hallo and hxllo
 // h*llo matches hllo and heeeello
 // h[ae]llo matches hello and hallo, but not hillo
 // Use \ to escape special characters if you want to match them verbatim.
 //
 // Return value
-// Array reply: list of keys matching pattern.
+// Array reply: list of keys matching pattern, or nil if it is not a valid regular
+// expression.
 func Keys(pattern string) (out []string) {
+	defer call("keys", pattern)()
 
-	hashesMu.RLock()
-	defer hashesMu.RUnlock()
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	return matchKeys(r)
+}
 
-	listsMu.RLock()
-	defer listsMu.RUnlock()
+// allKeys matches every key.
+var allKeys = regexp.MustCompile("")
+
+// matchKeys returns the live keys matching r. Shards are scanned one at a time,
+// so commands on other shards carry on meanwhile.
+func matchKeys(r *regexp.Regexp) (out []string) {
+	now := timeNow()
+
+	for _, s := range shards {
+		func() {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			for k, e := range s.entries {
+				if r.MatchString(k) && e.live(now) {
+					out = append(out, k)
+				}
+			}
+		}()
+	}
 
-	setsMu.RLock()
-	defer setsMu.RUnlock()
+	return
+}
 
-	stringsMu.RLock()
-	defer stringsMu.RUnlock()
+// Set a timeout on key. After the timeout has expired, the key will automatically be
+// deleted. A key with an associated timeout is often said to be volatile in Redis
+// terminology.
+// The timeout is cleared only when the key is removed using the DEL command or
+// overwritten using the SET command.
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the timeout was set.
+// 0 if key does not exist.
+func Expire(key string, seconds int) int {
+	defer callKey("expire", key, func() []string { return []string{strconv.Itoa(seconds)} })()
 
-	r, _ := regexp.Compile(pattern)
+	return setExpire(key, timeNow().Add(time.Duration(seconds)*time.Second))
+}
 
-	for k, _ := range allHashes {
-		if r.MatchString(k) == true {
-			out = append(out, k)
-		}
+// This command works exactly like EXPIRE but the time to live of the key is specified
+// in milliseconds instead of seconds.
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the timeout was set.
+// 0 if key does not exist.
+func Pexpire(key string, milliseconds int64) int {
+	defer callKey("pexpire", key, func() []string { return []string{strconv.FormatInt(milliseconds, 10)} })()
+
+	return setExpire(key, timeNow().Add(time.Duration(milliseconds)*time.Millisecond))
+}
+
+// EXPIREAT has the same effect and semantic as EXPIRE, but instead of specifying the
+// number of seconds representing the TTL (time to live), it takes an absolute Unix
+// timestamp (seconds since January 1, 1970).
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the timeout was set.
+// 0 if key does not exist.
+func Expireat(key string, timestamp int64) int {
+	defer callKey("expireat", key, func() []string { return []string{strconv.FormatInt(timestamp, 10)} })()
+
+	return setExpire(key, time.Unix(timestamp, 0))
+}
+
+// PEXPIREAT has the same effect and semantic as EXPIREAT, but the Unix time at which
+// the key will expire is specified in milliseconds instead of seconds.
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the timeout was set.
+// 0 if key does not exist.
+func Pexpireat(key string, millisecondsTimestamp int64) int {
+	defer callKey("pexpireat", key, func() []string { return []string{strconv.FormatInt(millisecondsTimestamp, 10)} })()
+
+	return setExpire(key, time.Unix(0, millisecondsTimestamp*int64(time.Millisecond)))
+}
+
+// Returns the remaining time to live of a key that has a timeout.
+//
+// Return value
+// Integer reply: TTL in seconds, -2 if the key does not exist, or -1 if the key exists
+// but has no associated expire.
+func Ttl(key string) int {
+	defer call("ttl", key)()
+
+	ttl := pttl(key)
+	if ttl < 0 {
+		return int(ttl)
 	}
+	return int((ttl + 500) / 1000)
+}
 
-	for k, _ := range allLists {
-		if r.MatchString(k) == true {
-			out = append(out, k)
-		}
+// Like TTL this command returns the remaining time to live of a key that has an expire
+// set, with the sole difference that TTL returns the amount of remaining time in
+// seconds while PTTL returns it in milliseconds.
+//
+// Return value
+// Integer reply: TTL in milliseconds, -2 if the key does not exist, or -1 if the key
+// exists but has no associated expire.
+func Pttl(key string) int64 {
+	defer call("pttl", key)()
+
+	return pttl(key)
+}
+
+// pttl returns the remaining time to live of key in milliseconds, or -2 or -1 as PTTL.
+func pttl(key string) int64 {
+	if keyType(key) == "" {
+		return -2
 	}
 
-	for k, _ := range allSets {
-		if r.MatchString(k) == true {
-			out = append(out, k)
-		}
+	s := shardFor(key)
+	s.mu.RLock()
+	when := time.Time{}
+	if e, ok := s.entries[key]; ok {
+		when = e.expireAt
+	}
+	s.mu.RUnlock()
+
+	if when.IsZero() {
+		return -1
 	}
 
-	for k, _ := range allStrings {
-		if r.MatchString(k) == true {
-			out = append(out, k)
+	ttl := when.Sub(timeNow()) / time.Millisecond
+	if ttl < 0 {
+		ttl = 0
+	}
+	return int64(ttl)
+}
+
+// Remove the existing timeout on key, turning the key from volatile (a key with an
+// expire set) to persistent (a key that will never expire as no timeout is associated).
+//
+// Return value
+// Integer reply, specifically:
+// 1 if the timeout was removed.
+// 0 if key does not exist or does not have an associated timeout.
+func Persist(key string) int {
+	defer call("persist", key)()
+
+	return persist(key)
+}
+
+// persist removes the timeout of key, reporting 1 if it had one, as PERSIST.
+func persist(key string) int {
+	expireIfNeeded(key)
+
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || e.expireAt.IsZero() {
+		return 0
+	}
+	s.setExpire(key, e, time.Time{})
+
+	s.addDirty(1)
+	notifyKeyspaceEvent(notifyGeneric, e.typ.String(), "persist", key)
+
+	return 1
+}
+
+// setExpire records when key should be deleted. A deadline in the past deletes the
+// key straight away, as Redis does.
+func setExpire(key string, when time.Time) int {
+	expireIfNeeded(key)
+
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return 0
+	}
+
+	if !when.After(timeNow()) {
+		s.deleteKey(notifyGeneric, "del", key)
+		s.addDirty(1)
+		return 1
+	}
+
+	s.setExpire(key, e, when)
+
+	s.addDirty(1)
+	notifyKeyspaceEvent(notifyGeneric, e.typ.String(), "expire", key)
+
+	return 1
+}
+
+// expireIfNeeded deletes key when its timeout has passed, and reports whether it did.
+// Every command calls it before touching a key so that expired keys are never
+// observed, even between active expire cycles.
+func expireIfNeeded(key string) bool {
+	s := shardFor(key)
+	s.mu.RLock()
+	when := time.Time{}
+	if e, ok := s.entries[key]; ok {
+		when = e.expireAt
+	}
+	s.mu.RUnlock()
+
+	if when.IsZero() || timeNow().Before(when) {
+		return false
+	}
+
+	return expireKey(key, when)
+}
+
+// expireKey deletes key if its timeout is still the one the caller saw, so a key
+// that was overwritten or given a new timeout in the meantime survives.
+func expireKey(key string, when time.Time) bool {
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; !ok || !e.expireAt.Equal(when) {
+		return false
+	}
+
+	if !s.deleteKey(notifyExpired, "expired", key) {
+		return false
+	}
+	s.addDirty(1)
+	atomic.AddUint64(&expiredKeys, 1)
+	return true
+}
+
+// activeExpireCycle samples keys with a timeout and deletes the expired ones, so keys
+// nobody reads again still go away. Like Redis it repeats, for each shard, while more
+// than a quarter of the sample had expired.
+func activeExpireCycle() {
+	const sampleSize = 20
+
+	defer latencySample("expire-cycle", timeNow())
+
+	for _, s := range shards {
+		for {
+			now := timeNow()
+			due := make(map[string]time.Time)
+			sampled := 0
+
+			s.mu.RLock()
+			for k, e := range s.volatile {
+				if sampled == sampleSize {
+					break
+				}
+				sampled++
+				if !e.live(now) {
+					due[k] = e.expireAt
+				}
+			}
+			s.mu.RUnlock()
+
+			for k, when := range due {
+				expireKey(k, when)
+			}
+
+			if len(due) <= sampleSize/4 {
+				break
+			}
 		}
 	}
+}
 
-	return
+func init() {
+	every(100*time.Millisecond, nil, func(time.Time) {
+		// Keys do not expire while a script runs, as in Redis.
+		execMu.RLock()
+		activeExpireCycle()
+		execMu.RUnlock()
+	})
 }
@@ -0,0 +1,243 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistoryLen is how many samples are kept for each event, as in Redis.
+const latencyHistoryLen = 160
+
+// LatencySample is one latency spike of an event.
+type LatencySample struct {
+	Time    time.Time
+	Latency time.Duration
+}
+
+// LatencyEvent is the latest and worst latency spike of an event, as reported by
+// LATENCY LATEST.
+type LatencyEvent struct {
+	Name   string
+	Time   time.Time
+	Latest time.Duration
+	Max    time.Duration
+}
+
+// latencySeries holds the recent spikes of an event, oldest first, and the worst
+// spike since the event was last reset.
+type latencySeries struct {
+	samples []LatencySample
+	max     time.Duration
+}
+
+var (
+	latencyEvents = make(map[string]*latencySeries)
+	latencyMu     sync.Mutex
+
+	// latencyMonitorThreshold is a time.Duration, accessed atomically as every
+	// command reads it.
+	latencyMonitorThreshold int64
+)
+
+// latencyAdvice is what LATENCY DOCTOR suggests for each event.
+var latencyAdvice = map[string]string{
+	"command": "Check your Slow Log to understand what are the commands you are running which are too slow to execute. " +
+		"Commands like KEYS work on the whole keyspace and take longer the more keys there are.",
+	"snapshot-serialize": "Snapshots serialize the whole keyspace while holding its locks. " +
+		"Consider fewer save points, or saving when the load is lower.",
+	"expire-cycle": "Deleting expired keys is slowing down the active expire cycle. " +
+		"Many keys probably expire at the same time: consider adding some randomness to their time to live.",
+	"eviction-cycle": "Evicting keys to get back under maxmemory is slow. " +
+		"Consider raising maxmemory, or writing fewer or smaller values at once.",
+}
+
+// SetLatencyMonitorThreshold sets the latency above which events are recorded by
+// the latency monitor, like the latency-monitor-threshold directive. Zero, the
+// default, disables the monitor.
+//
+// The events monitored are:
+//
+//	command             Commands, as reported by the slow log
+//	snapshot-serialize  Writing the keyspace out by SAVE, BGSAVE and SaveRDB
+//	expire-cycle        Active expire cycles, deleting keys whose timeout passed
+//	eviction-cycle      Evicting keys to stay within maxmemory
+func SetLatencyMonitorThreshold(d time.Duration) {
+	atomic.StoreInt64(&latencyMonitorThreshold, int64(d))
+}
+
+// The LATENCY LATEST command reports the latest latency events logged.
+//
+// Return value
+// Array reply: for each event, its name, the time of its latest latency spike, that
+// spike's latency and the maximum latency of the event.
+func LatencyLatest() []LatencyEvent {
+	defer call("latency|latest")()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	out := make([]LatencyEvent, 0, len(latencyEvents))
+	for name, series := range latencyEvents {
+		latest := series.samples[len(series.samples)-1]
+		out = append(out, LatencyEvent{Name: name, Time: latest.Time, Latest: latest.Latency, Max: series.max})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out
+}
+
+// The LATENCY HISTORY command returns the raw data of the event's latency spikes
+// time series.
+//
+// Return value
+// Array reply: the spikes of the event, oldest first, or an empty list if the event
+// never had one.
+func LatencyHistory(event string) []LatencySample {
+	defer call("latency|history", event)()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	series, ok := latencyEvents[event]
+	if !ok {
+		return []LatencySample{}
+	}
+	return append([]LatencySample(nil), series.samples...)
+}
+
+// The LATENCY RESET command resets the latency spikes time series of all, or only
+// some, events.
+//
+// Return value
+// Integer reply: the number of event time series that were reset.
+func LatencyReset(event ...string) int {
+	defer call("latency|reset", event...)()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	reset := 0
+	if len(event) == 0 {
+		reset = len(latencyEvents)
+		latencyEvents = make(map[string]*latencySeries)
+	}
+	for _, name := range event {
+		if _, ok := latencyEvents[name]; ok {
+			delete(latencyEvents, name)
+			reset++
+		}
+	}
+
+	return reset
+}
+
+// The LATENCY DOCTOR command reports about different latency-related issues and
+// advises about possible remedies.
+//
+// Return value
+// Bulk string reply: a human readable latency analysis report.
+func LatencyDoctor() string {
+	defer call("latency|doctor")()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	if len(latencyEvents) == 0 {
+		return "Dave, no latency spike was observed during the lifetime of this Redis instance, " +
+			"not in the slightest bit. I honestly think you ought to sleep tonight.\n"
+	}
+
+	names := make([]string, 0, len(latencyEvents))
+	for name := range latencyEvents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Dave, I have observed latency spikes in this Redis instance. " +
+		"You don't mind talking about it, do you Dave?\n\n")
+	for i, name := range names {
+		series := latencyEvents[name]
+
+		var sum time.Duration
+		for _, s := range series.samples {
+			sum += s.Latency
+		}
+		avg := sum / time.Duration(len(series.samples))
+		var deviation time.Duration
+		for _, s := range series.samples {
+			if d := s.Latency - avg; d > 0 {
+				deviation += d
+			} else {
+				deviation -= d
+			}
+		}
+		deviation /= time.Duration(len(series.samples))
+
+		period := time.Duration(0)
+		if n := len(series.samples); n > 1 {
+			period = series.samples[n-1].Time.Sub(series.samples[0].Time) / time.Duration(n-1)
+		}
+
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %dms, mean deviation %dms, period %d sec). Worst all time event %dms.\n",
+			i+1, name, len(series.samples), avg/time.Millisecond, deviation/time.Millisecond,
+			period/time.Second, series.max/time.Millisecond)
+	}
+
+	b.WriteString("\nI have a few advices for you:\n\n")
+	for _, name := range names {
+		if advice, ok := latencyAdvice[name]; ok {
+			b.WriteString("- " + advice + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// latencyAddSampleIfNeeded records that event took latency, if the latency monitor
+// is enabled and that is at least its threshold. Spikes within the same second are
+// merged, keeping the worst.
+func latencyAddSampleIfNeeded(event string, latency time.Duration) {
+	threshold := time.Duration(atomic.LoadInt64(&latencyMonitorThreshold))
+	if threshold <= 0 || latency < threshold {
+		return
+	}
+
+	now := timeNow()
+
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+
+	series, ok := latencyEvents[event]
+	if !ok {
+		series = &latencySeries{}
+		latencyEvents[event] = series
+	}
+	if latency > series.max {
+		series.max = latency
+	}
+
+	if n := len(series.samples); n > 0 && series.samples[n-1].Time.Unix() == now.Unix() {
+		if latency > series.samples[n-1].Latency {
+			series.samples[n-1].Latency = latency
+		}
+		return
+	}
+
+	series.samples = append(series.samples, LatencySample{Time: now, Latency: latency})
+	if len(series.samples) > latencyHistoryLen {
+		series.samples = series.samples[1:]
+	}
+}
+
+// latencySample records the latency of event, which started at start. Code
+// monitoring an event starts with
+//
+//	defer latencySample("event", timeNow())
+func latencySample(event string, start time.Time) {
+	latencyAddSampleIfNeeded(event, timeSince(start))
+}
@@ -0,0 +1,393 @@
+package redis
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Limits of the compact encodings, like the directives of the same names. They
+// are read by every write to a compact value, so they are accessed atomically.
+var (
+	hashMaxListpackEntries int64 = 128
+	hashMaxListpackValue   int64 = 64
+	setMaxIntsetEntries    int64 = 512
+	setMaxListpackEntries  int64 = 128
+	setMaxListpackValue    int64 = 64
+)
+
+// listpackEntryOverhead approximates the bytes a listpack spends on each entry
+// besides its contents: the encoding byte and the back length.
+const listpackEntryOverhead = 2
+
+// SetHashMaxListpackEntries sets how many fields a hash holds in the compact
+// listpack encoding before it is converted to a hash table, like the
+// hash-max-listpack-entries directive. The default is 128.
+func SetHashMaxListpackEntries(n int) {
+	atomic.StoreInt64(&hashMaxListpackEntries, int64(n))
+}
+
+// SetHashMaxListpackValue sets the longest field or value, in bytes, a hash holds
+// in the compact listpack encoding before it is converted to a hash table, like
+// the hash-max-listpack-value directive. The default is 64.
+func SetHashMaxListpackValue(n int) {
+	atomic.StoreInt64(&hashMaxListpackValue, int64(n))
+}
+
+// SetSetMaxIntsetEntries sets how many members a set made only of integers holds
+// in the compact intset encoding before it is converted to a hash table, like the
+// set-max-intset-entries directive. The default is 512.
+func SetSetMaxIntsetEntries(n int) {
+	atomic.StoreInt64(&setMaxIntsetEntries, int64(n))
+}
+
+// SetSetMaxListpackEntries sets how many members a set holds in the compact
+// listpack encoding before it is converted to a hash table, like the
+// set-max-listpack-entries directive. The default is 128.
+func SetSetMaxListpackEntries(n int) {
+	atomic.StoreInt64(&setMaxListpackEntries, int64(n))
+}
+
+// SetSetMaxListpackValue sets the longest member, in bytes, a set holds in the
+// compact listpack encoding before it is converted to a hash table, like the
+// set-max-listpack-value directive. The default is 64.
+func SetSetMaxListpackValue(n int) {
+	atomic.StoreInt64(&setMaxListpackValue, int64(n))
+}
+
+// listpackList is a short list held in a single slice, as Redis holds short lists
+// in a single listpack, until it outgrows list-max-listpack-size and becomes a
+// quicklist. The elements are entries[start:], see pushFront.
+type listpackList struct {
+	entries []string
+	start   int
+	bytes   int
+}
+
+// pushFront puts v before the elements buf[start:] and returns the new buf and
+// start. When there is no room left before start, buf is reallocated with as
+// much room before the elements as they take, so that pushes at the head, like
+// appends at the tail, take amortized constant time.
+func pushFront(buf []string, start int, v string) ([]string, int) {
+	if start == 0 {
+		room := len(buf)
+		if room < 4 {
+			room = 4
+		}
+		grown := make([]string, room+len(buf), room+cap(buf))
+		copy(grown[room:], buf)
+		buf, start = grown, room
+	}
+	start--
+	buf[start] = v
+	return buf, start
+}
+
+// pushBack appends v to the elements buf[start:] and returns the new buf and
+// start. When buf is full and the room left before start is at least as large as
+// the elements, they are moved to the front instead of growing buf, so that a
+// list used as a queue does not grow without bounds.
+func pushBack(buf []string, start int, v string) ([]string, int) {
+	if len(buf) == cap(buf) && start > 0 && start >= len(buf)-start {
+		n := copy(buf, buf[start:])
+		for i := n; i < len(buf); i++ {
+			buf[i] = ""
+		}
+		buf, start = buf[:n], 0
+	}
+	return append(buf, v), start
+}
+
+// popFront removes the first of the elements buf[start:], which must not be
+// empty, and returns it with the new buf and start.
+func popFront(buf []string, start int) (string, []string, int) {
+	v := buf[start]
+	buf[start] = ""
+	start++
+	if start == len(buf) {
+		buf, start = buf[:0], 0
+	}
+	return v, buf, start
+}
+
+// popBack removes the last of the elements buf[start:], which must not be
+// empty, and returns it with the new buf and start.
+func popBack(buf []string, start int) (string, []string, int) {
+	v := buf[len(buf)-1]
+	buf[len(buf)-1] = ""
+	buf = buf[:len(buf)-1]
+	if start == len(buf) {
+		buf, start = buf[:0], 0
+	}
+	return v, buf, start
+}
+
+// fits reports whether the list is within list-max-listpack-size.
+func (l *listpackList) fits() bool {
+	fill := int(atomic.LoadInt64(&listMaxListpackSize))
+	if fill > 0 {
+		return l.len() <= fill
+	}
+	return l.bytes <= quicklistSizeLimits[-fill-1]
+}
+
+func (l *listpackList) len() int {
+	return len(l.entries) - l.start
+}
+
+func (l *listpackList) view() []string {
+	return l.entries[l.start:]
+}
+
+func (l *listpackList) pushHead(v string) {
+	l.entries, l.start = pushFront(l.entries, l.start, v)
+	l.bytes += len(v)
+}
+
+func (l *listpackList) pushTail(v string) {
+	l.entries, l.start = pushBack(l.entries, l.start, v)
+	l.bytes += len(v)
+}
+
+func (l *listpackList) popHead() (v string, ok bool) {
+	if l.len() == 0 {
+		return "", false
+	}
+	v, l.entries, l.start = popFront(l.entries, l.start)
+	l.bytes -= len(v)
+	return v, true
+}
+
+func (l *listpackList) popTail() (v string, ok bool) {
+	if l.len() == 0 {
+		return "", false
+	}
+	v, l.entries, l.start = popBack(l.entries, l.start)
+	l.bytes -= len(v)
+	return v, true
+}
+
+func (l *listpackList) index(i int) (string, bool) {
+	entries := l.view()
+	if i < 0 {
+		i += len(entries)
+	}
+	if i < 0 || i >= len(entries) {
+		return "", false
+	}
+	return entries[i], true
+}
+
+func (l *listpackList) rangeOf(start, stop int) List {
+	entries := l.view()
+	start, stop, ok := clampRange(start, stop, len(entries))
+	if !ok {
+		return make(List, 0)
+	}
+	return append(make(List, 0, stop+1-start), entries[start:stop+1]...)
+}
+
+func (l *listpackList) each(f func(v string) bool) {
+	for _, v := range l.view() {
+		if !f(v) {
+			return
+		}
+	}
+}
+
+func (l *listpackList) slice() List {
+	return append(make(List, 0, l.len()), l.view()...)
+}
+
+func (l *listpackList) encoding() string {
+	return "listpack"
+}
+
+// listpackSet is a small set held as a slice of its members, until it outgrows
+// set-max-listpack-entries or set-max-listpack-value and becomes a hash table.
+type listpackSet struct {
+	members []string
+}
+
+// takes reports whether the set can take member and stay a listpack.
+func (s *listpackSet) takes(member string) bool {
+	return int64(len(s.members)) < atomic.LoadInt64(&setMaxListpackEntries) &&
+		int64(len(member)) <= atomic.LoadInt64(&setMaxListpackValue)
+}
+
+func (s *listpackSet) has(member string) bool {
+	for _, m := range s.members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *listpackSet) add(member string) {
+	s.members = append(s.members, member)
+}
+
+func (s *listpackSet) len() int {
+	return len(s.members)
+}
+
+func (s *listpackSet) each(f func(member string) bool) {
+	for _, m := range s.members {
+		if !f(m) {
+			return
+		}
+	}
+}
+
+func (s *listpackSet) encoding() string {
+	return "listpack"
+}
+
+// listpackHash is a small hash held as a slice of its fields, each followed by
+// its value, until it outgrows hash-max-listpack-entries or
+// hash-max-listpack-value and becomes a hash table.
+type listpackHash struct {
+	entries []string
+}
+
+// takes reports whether the hash can take field set to value and stay a
+// listpack.
+func (h *listpackHash) takes(field, value string) bool {
+	maxValue := atomic.LoadInt64(&hashMaxListpackValue)
+	if int64(len(field)) > maxValue || int64(len(value)) > maxValue {
+		return false
+	}
+	if _, exists := h.get(field); exists {
+		return true
+	}
+	return int64(h.len()) < atomic.LoadInt64(&hashMaxListpackEntries)
+}
+
+func (h *listpackHash) find(field string) int {
+	for i := 0; i < len(h.entries); i += 2 {
+		if h.entries[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *listpackHash) get(field string) (string, bool) {
+	if i := h.find(field); i >= 0 {
+		return h.entries[i+1], true
+	}
+	return "", false
+}
+
+func (h *listpackHash) set(field, value string) (old string, existed bool) {
+	if i := h.find(field); i >= 0 {
+		old, h.entries[i+1] = h.entries[i+1], value
+		return old, true
+	}
+	h.entries = append(h.entries, field, value)
+	return "", false
+}
+
+func (h *listpackHash) remove(field string) (old string, existed bool) {
+	i := h.find(field)
+	if i < 0 {
+		return "", false
+	}
+	old = h.entries[i+1]
+	h.entries = append(h.entries[:i], h.entries[i+2:]...)
+	return old, true
+}
+
+func (h *listpackHash) len() int {
+	return len(h.entries) / 2
+}
+
+func (h *listpackHash) each(f func(field, value string) bool) {
+	for i := 0; i < len(h.entries); i += 2 {
+		if !f(h.entries[i], h.entries[i+1]) {
+			return
+		}
+	}
+}
+
+func (h *listpackHash) encoding() string {
+	return "listpack"
+}
+
+// intset is a set made only of integers, held sorted, until it outgrows
+// set-max-intset-entries or gets a member that is not an integer.
+type intset struct {
+	values []int64
+}
+
+// intsetValue returns member as an integer, if it is the canonical form of one and
+// so can be held in an intset.
+func intsetValue(member string) (int64, bool) {
+	n, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != member {
+		return 0, false
+	}
+	return n, true
+}
+
+// search returns where n is, or would be inserted, in the set.
+func (s *intset) search(n int64) (int, bool) {
+	lo, hi := 0, len(s.values)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if s.values[mid] < n {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(s.values) && s.values[lo] == n
+}
+
+// takes reports whether the set can take member and stay an intset.
+func (s *intset) takes(member string) bool {
+	n, ok := intsetValue(member)
+	if !ok {
+		return false
+	}
+	if _, found := s.search(n); found {
+		return true
+	}
+	return int64(len(s.values)) < atomic.LoadInt64(&setMaxIntsetEntries)
+}
+
+func (s *intset) has(member string) bool {
+	n, ok := intsetValue(member)
+	if !ok {
+		return false
+	}
+	_, found := s.search(n)
+	return found
+}
+
+func (s *intset) add(member string) {
+	n, _ := intsetValue(member)
+	i, found := s.search(n)
+	if found {
+		return
+	}
+	s.values = append(s.values, 0)
+	copy(s.values[i+1:], s.values[i:])
+	s.values[i] = n
+}
+
+func (s *intset) len() int {
+	return len(s.values)
+}
+
+func (s *intset) each(f func(member string) bool) {
+	for _, n := range s.values {
+		if !f(strconv.FormatInt(n, 10)) {
+			return
+		}
+	}
+}
+
+func (s *intset) encoding() string {
+	return "intset"
+}
@@ -1,13 +1,38 @@
 package redis
 
-import "sync"
+import (
+    "strconv"
+)
 
 type List []string
 
-var (
-    allLists map[string]List = make(map[string]List)
-    listsMu  sync.RWMutex
-)
+// listValue is the value of a list key, in one of its encodings: a listpackList
+// while it is short, then a quicklist.
+type listValue interface {
+    len() int
+    pushHead(v string)
+    pushTail(v string)
+    popHead() (string, bool)
+    popTail() (string, bool)
+    index(i int) (string, bool)
+    rangeOf(start, stop int) List
+    each(f func(v string) bool)
+    slice() List
+    encoding() string
+}
+
+// newListValue returns a list holding the elements of l, in the encoding its
+// size calls for.
+func newListValue(l List) listValue {
+    lp := &listpackList{}
+    for _, v := range l {
+        lp.pushTail(v)
+    }
+    if !lp.fits() {
+        return quicklistFrom(l)
+    }
+    return lp
+}
 
 // Insert all the specified values at the tail of the list stored at key.
 // If key does not exist, it is created as empty list before performing the
@@ -22,23 +47,157 @@ var (
 // element, b as second element and c as third element.
 
 // Return value
-// Integer reply: the length of the list after the push operation.
+// Integer reply: the length of the list after the push operation, or 0 on an
+// error reply, such as ErrOOM.
 func Rpush(key string, value ...string) int {
-    listsMu.Lock()
-    defer listsMu.Unlock()
+    defer callKey("rpush", key, func() []string { return value })()
+
+    n, _ := push(key, "rpush", value)
+    return n
+}
+
+// Insert all the specified values at the head of the list stored at key.
+// If key does not exist, it is created as empty list before performing the
+// push operations. When key holds a value that is not a list, an error is
+// returned.
+//
+// It is possible to push multiple elements using a single command call
+// just specifying multiple arguments at the end of the command. Elements
+// are inserted one after the other to the head of the list, from the
+// leftmost element to the rightmost element. So for instance the command
+// LPUSH mylist a b c will result into a list containing c as first
+// element, b as second element and a as third element.
+//
+// Return value
+// Integer reply: the length of the list after the push operations, or 0 on an
+// error reply, such as ErrOOM.
+func Lpush(key string, value ...string) int {
+    defer callKey("lpush", key, func() []string { return value })()
+
+    n, _ := push(key, "lpush", value)
+    return n
+}
+
+// push adds values to the head or the tail of the list stored at key, for
+// LPUSH and RPUSH, named by op, and returns the length of the list.
+func push(key, op string, value []string) (int, error) {
+    if err := performEvictions(); err != nil {
+        return 0, err
+    }
+    accessKey(key)
 
-    _, exists := allLists[key]
+    s := shardFor(key)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, err := s.lookupWrite(key, typeList)
+    if err != nil {
+        return 0, err
+    }
+    exists := e != nil
     if !exists {
-        allLists[key] = List{}
+        e = s.add(key, typeList, &listpackList{})
     }
 
+    list := e.value.(listValue)
+    compact := e.compact()
+    var size int64
     for _, v := range value {
-        allLists[key] = append(allLists[key], v)
+        if op == "lpush" {
+            list.pushHead(v)
+        } else {
+            list.pushTail(v)
+        }
+        size += elemOverhead + int64(len(v))
+    }
+    if lp, ok := list.(*listpackList); ok && !lp.fits() {
+        list = quicklistFrom(lp.view())
+        e.value = list
+    }
+    if compact {
+        e.measure(key)
+    } else {
+        e.grow(size)
+    }
+    s.addDirty(len(value))
+
+    event := ChangeEvent{Op: op, TypeName: "list", KeyName: key, NewValue: append([]string(nil), value...)}
+    if subscribed() {
+        event.Data = list.slice()
+    }
+    publish(event)
+    if !exists {
+        notifyKeyspaceEvent(notifyNew, "list", "new", key)
+    }
+    notifyKeyspaceEvent(notifyList, "list", op, key)
+
+    return list.len(), nil
+}
+
+// Removes and returns the first element of the list stored at key.
+//
+// Return value
+// Bulk string reply: the value of the first element, or nil when key does not
+// exist.
+func Lpop(key string) string {
+    defer call("lpop", key)()
+
+    v, _, _ := pop(key, "lpop")
+    return v
+}
+
+// Removes and returns the last element of the list stored at key.
+//
+// Return value
+// Bulk string reply: the value of the last element, or nil when key does not
+// exist.
+func Rpop(key string) string {
+    defer call("rpop", key)()
+
+    v, _, _ := pop(key, "rpop")
+    return v
+}
+
+// pop removes an element from the head or the tail of the list stored at key,
+// for LPOP and RPOP, named by op, and reports whether there was one. The key is
+// deleted with its last element.
+func pop(key, op string) (string, bool, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, err := s.lookupWrite(key, typeList)
+    if e == nil {
+        return "", false, err
     }
 
-    publish <- notice{"list", key, "", allLists[key]}
+    list := e.value.(listValue)
+    var v string
+    if op == "lpop" {
+        v, _ = list.popHead()
+    } else {
+        v, _ = list.popTail()
+    }
+    if e.compact() {
+        e.measure(key)
+    } else {
+        e.grow(-(elemOverhead + int64(len(v))))
+    }
+    s.addDirty(1)
 
-    return len(allLists[key])
+    event := ChangeEvent{Op: op, TypeName: "list", KeyName: key, OldValue: v}
+    if subscribed() {
+        event.Data = list.slice()
+    }
+    publish(event)
+    notifyKeyspaceEvent(notifyList, "list", op, key)
+    if list.len() == 0 {
+        s.deleteKey(notifyGeneric, "del", key)
+    }
+
+    return v, true, nil
 }
 
 // Returns the specified elements of the list stored at key. The offsets
@@ -64,26 +223,26 @@ func Rpush(key string, value ...string) int {
 // Return value
 // Array reply: list of elements in the specified range.
 func Lrange(key string, start, stop int) (out List) {
-    listsMu.Lock()
-    defer listsMu.Unlock()
+    defer callKey("lrange", key, func() []string { return []string{strconv.Itoa(start), strconv.Itoa(stop)} })()
 
-    out = make(List, 0)
+    out, _ = lrange(key, start, stop)
+    return
+}
 
-    _, exists := allLists[key]
-    if !exists {
-        return
-    }
-    if start < 0 {
-        start = len(allLists[key]) + start
-    }
-    if stop < 0 {
-        stop = len(allLists[key]) + stop
-    }
-    stop++
+// lrange returns the elements of the list stored at key from start to stop.
+func lrange(key string, start, stop int) (List, error) {
+    accessKey(key)
 
-    out = append(out, allLists[key][start:stop]...)
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
 
-    return
+    e, err := s.lookupRead(key, typeList)
+    if e == nil {
+        return make(List, 0), err
+    }
+
+    return e.value.(listValue).rangeOf(start, stop), nil
 }
 
 // Returns the length of the list stored at key. If key does not exist,
@@ -93,14 +252,59 @@ func Lrange(key string, start, stop int) (out List) {
 // Return value
 // Integer reply: the length of the list at key.
 func Llen(key string) int {
-    listsMu.Lock()
-    defer listsMu.Unlock()
+    defer call("llen", key)()
 
-    _, exists := allLists[key]
+    n, _ := llen(key)
+    return n
+}
 
-    if !exists {
-        return 0
+// llen returns the length of the list stored at key.
+func llen(key string) (int, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, err := s.lookupRead(key, typeList)
+    if e == nil {
+        return 0, err
+    }
+
+    return e.value.(listValue).len(), nil
+}
+
+// Returns the element at index index in the list stored at key. The index is
+// zero-based, so 0 means the first element, 1 the second element and so on.
+// Negative indices can be used to designate elements starting at the tail of
+// the list. Here, -1 means the last element, -2 means the penultimate and so
+// forth.
+//
+// When the value at key is not a list, an error is returned.
+//
+// Return value
+// Bulk string reply: the requested element, or nil when index is out of range.
+func Lindex(key string, index int) string {
+    defer callKey("lindex", key, func() []string { return []string{strconv.Itoa(index)} })()
+
+    v, _, _ := lindex(key, index)
+    return v
+}
+
+// lindex returns the element at index in the list stored at key, and whether
+// there is one.
+func lindex(key string, index int) (string, bool, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, err := s.lookupRead(key, typeList)
+    if e == nil {
+        return "", false, err
     }
 
-    return len(allLists[key])
+    v, ok := e.value.(listValue).index(index)
+    return v, ok, nil
 }
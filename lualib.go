@@ -0,0 +1,1351 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file holds the Lua libraries scripts can use, as Redis loads them: the
+// base library, string, table and math, and the bit and cjson libraries. The io,
+// os, debug and package libraries are left out, as Redis leaves them out.
+
+// luaArgs are the arguments of a call to a library function, with helpers
+// checking them that raise the errors Lua raises.
+type luaArgs struct {
+	L    *luaState
+	name string
+	v    []luaValue
+}
+
+func (a luaArgs) get(n int) luaValue {
+	if n > len(a.v) {
+		return nil
+	}
+	return a.v[n-1]
+}
+
+func (a luaArgs) argError(n int, msg string) {
+	a.L.errorf("bad argument #%d to '%s' (%s)", n, a.name, msg)
+}
+
+func (a luaArgs) typeError(n int, want string) {
+	got := "no value"
+	if n <= len(a.v) {
+		got = luaTypeName(a.v[n-1])
+	}
+	a.argError(n, fmt.Sprintf("%s expected, got %s", want, got))
+}
+
+func (a luaArgs) any(n int) luaValue {
+	if n > len(a.v) {
+		a.argError(n, "value expected")
+	}
+	return a.v[n-1]
+}
+
+func (a luaArgs) table(n int) *luaTable {
+	t, ok := a.get(n).(*luaTable)
+	if !ok {
+		a.typeError(n, "table")
+	}
+	return t
+}
+
+func (a luaArgs) str(n int) string {
+	s, ok := luaToString(a.get(n))
+	if !ok {
+		a.typeError(n, "string")
+	}
+	return s
+}
+
+func (a luaArgs) optStr(n int, def string) string {
+	if a.get(n) == nil {
+		return def
+	}
+	return a.str(n)
+}
+
+func (a luaArgs) number(n int) float64 {
+	x, ok := luaToNumber(a.get(n))
+	if !ok {
+		a.typeError(n, "number")
+	}
+	return x
+}
+
+func (a luaArgs) int(n int) int {
+	x := a.number(n)
+	if x >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if x <= math.MinInt32 {
+		return math.MinInt32
+	}
+	return int(x)
+}
+
+func (a luaArgs) optInt(n int, def int) int {
+	if a.get(n) == nil {
+		return def
+	}
+	return a.int(n)
+}
+
+// newLuaLib returns a table of library functions, set in the order of their
+// names so that traversals of the table are the same every time.
+func newLuaLib(t *luaTable, funcs map[string]func(a luaArgs) []luaValue) *luaTable {
+	names := make([]string, 0, len(funcs))
+	for fname := range funcs {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+	for _, fname := range names {
+		t.set(fname, &goFunction{fname, funcs[fname]})
+	}
+	return t
+}
+
+func values(v ...luaValue) []luaValue {
+	return v
+}
+
+// newLuaState returns a state with the libraries loaded and readonly globals:
+// scripts can neither set globals nor read globals that do not exist.
+func newLuaState(chunk string) *luaState {
+	L := &luaState{chunk: chunk, rand: rand.New(rand.NewSource(0))}
+	G := newLuaLib(newLuaTable(0, 32), luaBaseLib)
+	L.globals = G
+	G.set("_G", G)
+	G.set("_VERSION", "Lua 5.1")
+
+	str := newLuaLib(newLuaTable(0, len(luaStringLib)), luaStringLib)
+	L.stringMeta = newLuaTable(0, 1)
+	L.stringMeta.set("__index", str)
+	L.stringMeta.readonly = true
+
+	libs := map[string]*luaTable{
+		"string": str,
+		"table":  newLuaLib(newLuaTable(0, len(luaTableLib)), luaTableLib),
+		"math":   newLuaLib(newLuaTable(0, len(luaMathLib)), luaMathLib),
+		"bit":    newLuaLib(newLuaTable(0, len(luaBitLib)), luaBitLib),
+		"cjson":  newLuaLib(newLuaTable(0, len(luaCjsonLib)), luaCjsonLib),
+	}
+	libs["math"].set("pi", math.Pi)
+	libs["math"].set("huge", math.Inf(1))
+	libs["cjson"].set("null", luaNull)
+	for _, name := range []string{"bit", "cjson", "math", "string", "table"} {
+		libs[name].readonly = true
+		G.set(name, libs[name])
+	}
+
+	G.meta = newLuaTable(0, 1)
+	G.meta.set("__index", &goFunction{"__index", func(a luaArgs) []luaValue {
+		name, _ := luaToString(a.get(2))
+		a.L.errorf("Script attempted to access nonexistent global variable '%s'", name)
+		return nil
+	}})
+	G.meta.readonly = true
+	G.readonly = true
+	return L
+}
+
+// luaNull is cjson.null, the JSON null in tables, where nil cannot be stored.
+var luaNull = &luaUserdata{"cjson.null"}
+
+var luaBaseLib = map[string]func(a luaArgs) []luaValue{
+	"assert": func(a luaArgs) []luaValue {
+		if !luaTruthy(a.any(1)) {
+			panic(&luaError{a.optStr(2, "assertion failed!")})
+		}
+		return a.v
+	},
+	"error": func(a luaArgs) []luaValue {
+		msg := a.get(1)
+		if s, ok := msg.(string); ok {
+			if level := a.optInt(2, 1); level > 0 {
+				msg = a.L.where(level) + s
+			}
+		}
+		panic(&luaError{msg})
+	},
+	"getmetatable": func(a luaArgs) []luaValue {
+		mt := a.L.metatable(a.any(1))
+		if mt == nil {
+			return values(nil)
+		}
+		if protected := mt.getString("__metatable"); protected != nil {
+			return values(protected)
+		}
+		return values(mt)
+	},
+	"setmetatable": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		mt, ok := a.get(2).(*luaTable)
+		if !ok && a.get(2) != nil {
+			a.argError(2, "nil or table expected")
+		}
+		if t.readonly {
+			a.L.errorf("Attempt to modify a readonly table")
+		}
+		if t.meta != nil && t.meta.getString("__metatable") != nil {
+			a.L.errorf("cannot change a protected metatable")
+		}
+		t.meta = mt
+		return values(t)
+	},
+	"ipairs": func(a luaArgs) []luaValue {
+		return values(luaIpairsIter, a.table(1), float64(0))
+	},
+	"pairs": func(a luaArgs) []luaValue {
+		return values(luaNext, a.table(1), nil)
+	},
+	"next": luaNext.fn,
+	"pcall": func(a luaArgs) []luaValue {
+		results, e := a.L.pcall(a.any(1), a.v[1:])
+		if e != nil {
+			return values(false, e.value)
+		}
+		return append(values(true), results...)
+	},
+	"xpcall": func(a luaArgs) []luaValue {
+		handler := a.get(2)
+		results, e := a.L.pcall(a.get(1), nil)
+		if e != nil {
+			return append(values(false), first(a.L.call(handler, values(e.value))))
+		}
+		return append(values(true), results...)
+	},
+	"rawequal": func(a luaArgs) []luaValue {
+		return values(rawEqual(a.any(1), a.any(2)))
+	},
+	"rawget": func(a luaArgs) []luaValue {
+		return values(a.table(1).get(a.any(2)))
+	},
+	"rawset": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		a.L.rawset(t, a.any(2), a.any(3))
+		return values(t)
+	},
+	"select": func(a luaArgs) []luaValue {
+		if s, ok := a.get(1).(string); ok && s == "#" {
+			return values(float64(len(a.v) - 1))
+		}
+		n := a.int(1)
+		if n < 0 {
+			n = len(a.v) + n
+		} else if n == 0 {
+			a.argError(1, "index out of range")
+		}
+		if n < 1 {
+			a.argError(1, "index out of range")
+		}
+		if n >= len(a.v) {
+			return nil
+		}
+		return a.v[n:]
+	},
+	"tonumber": func(a luaArgs) []luaValue {
+		base := a.optInt(2, 10)
+		if base == 10 {
+			if x, ok := luaToNumber(a.any(1)); ok {
+				return values(x)
+			}
+			return values(nil)
+		}
+		if base < 2 || base > 36 {
+			a.argError(2, "base out of range")
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(a.str(1)), base, 64)
+		if err != nil {
+			return values(nil)
+		}
+		return values(float64(n))
+	},
+	"tostring": func(a luaArgs) []luaValue {
+		return values(a.L.tostring(a.any(1)))
+	},
+	"type": func(a luaArgs) []luaValue {
+		return values(luaTypeName(a.any(1)))
+	},
+	"unpack": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		i, j := a.optInt(2, 1), a.optInt(3, t.length())
+		if i > j {
+			return nil
+		}
+		if j-i >= 8000 {
+			a.L.errorf("too many results to unpack")
+		}
+		out := make([]luaValue, 0, j-i+1)
+		for ; i <= j; i++ {
+			out = append(out, t.get(float64(i)))
+		}
+		return out
+	},
+}
+
+var luaNext = &goFunction{"next", func(a luaArgs) []luaValue {
+	k, v, ok := a.table(1).next(a.get(2))
+	if !ok {
+		a.L.errorf("invalid key to 'next'")
+	}
+	if k == nil {
+		return values(nil)
+	}
+	return values(k, v)
+}}
+
+var luaIpairsIter = &goFunction{"ipairs_aux", func(a luaArgs) []luaValue {
+	i := a.number(2) + 1
+	v := a.table(1).get(i)
+	if v == nil {
+		return nil
+	}
+	return values(i, v)
+}}
+
+// strRange returns the byte offsets of the substring from i to j, counting
+// from 1, or from the end for negative positions, as string.sub does.
+func strRange(length, i, j int) (int, int) {
+	if i < 0 {
+		i += length + 1
+	}
+	if j < 0 {
+		j += length + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > length {
+		j = length
+	}
+	if i > j {
+		return 0, 0
+	}
+	return i - 1, j
+}
+
+var luaStringLib = map[string]func(a luaArgs) []luaValue{
+	"byte": func(a luaArgs) []luaValue {
+		s := a.str(1)
+		i := a.optInt(2, 1)
+		from, to := strRange(len(s), i, a.optInt(3, i))
+		out := make([]luaValue, 0, to-from)
+		for _, c := range []byte(s[from:to]) {
+			out = append(out, float64(c))
+		}
+		return out
+	},
+	"char": func(a luaArgs) []luaValue {
+		b := make([]byte, len(a.v))
+		for i := range a.v {
+			c := a.int(i + 1)
+			if c < 0 || c > 255 {
+				a.argError(i+1, "invalid value")
+			}
+			b[i] = byte(c)
+		}
+		return values(string(b))
+	},
+	"find": func(a luaArgs) []luaValue {
+		return strFind(a, true)
+	},
+	"match": func(a luaArgs) []luaValue {
+		return strFind(a, false)
+	},
+	"gmatch": func(a luaArgs) []luaValue {
+		s, p := a.str(1), a.str(2)
+		pos := 0
+		return values(&goFunction{"gmatch_aux", func(b luaArgs) []luaValue {
+			for ; pos <= len(s); pos++ {
+				ms := &luaMatchState{L: a.L, src: s, pat: p}
+				if e := ms.match(pos, 0); e != -1 {
+					start := pos
+					pos = e
+					if e == start {
+						pos++
+					}
+					return ms.captures(start, e, true)
+				}
+			}
+			return nil
+		}})
+	},
+	"gsub": strGsub,
+	"len": func(a luaArgs) []luaValue {
+		return values(float64(len(a.str(1))))
+	},
+	"lower": func(a luaArgs) []luaValue {
+		return values(strings.ToLower(a.str(1)))
+	},
+	"upper": func(a luaArgs) []luaValue {
+		return values(strings.ToUpper(a.str(1)))
+	},
+	"rep": func(a luaArgs) []luaValue {
+		s, n := a.str(1), a.int(2)
+		if n <= 0 || s == "" {
+			return values("")
+		}
+		if len(s)*n/n != len(s) || len(s)*n > luaMaxString {
+			a.L.errorf("resulting string too large")
+		}
+		return values(strings.Repeat(s, n))
+	},
+	"reverse": func(a luaArgs) []luaValue {
+		b := []byte(a.str(1))
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return values(string(b))
+	},
+	"sub": func(a luaArgs) []luaValue {
+		s := a.str(1)
+		from, to := strRange(len(s), a.int(2), a.optInt(3, -1))
+		return values(s[from:to])
+	},
+	"format": strFormat,
+}
+
+// strFind is string.find, or string.match when find is false.
+func strFind(a luaArgs, find bool) []luaValue {
+	s, p := a.str(1), a.str(2)
+	init := a.optInt(3, 1)
+	if init < 0 {
+		init += len(s) + 1
+	}
+	init--
+	if init < 0 {
+		init = 0
+	} else if init > len(s) {
+		return values(nil)
+	}
+
+	if find && (luaTruthy(a.get(4)) || !strings.ContainsAny(p, "^$*+?.([%-")) {
+		if i := strings.Index(s[init:], p); i >= 0 {
+			return values(float64(init+i+1), float64(init+i+len(p)))
+		}
+		return values(nil)
+	}
+
+	anchor := strings.HasPrefix(p, "^")
+	pi := 0
+	if anchor {
+		pi = 1
+	}
+	for start := init; start <= len(s); start++ {
+		ms := &luaMatchState{L: a.L, src: s, pat: p}
+		if e := ms.match(start, pi); e != -1 {
+			if find {
+				return append(values(float64(start+1), float64(e)), ms.captures(-1, -1, false)...)
+			}
+			return ms.captures(start, e, true)
+		}
+		if anchor {
+			break
+		}
+	}
+	return values(nil)
+}
+
+func strGsub(a luaArgs) []luaValue {
+	s, p := a.str(1), a.str(2)
+	repl := a.get(3)
+	switch repl.(type) {
+	case string, float64, *luaTable, *luaFunction, *goFunction:
+	default:
+		a.argError(3, "string/function/table expected")
+	}
+	maxN := a.optInt(4, len(s)+1)
+
+	anchor := strings.HasPrefix(p, "^")
+	pi := 0
+	if anchor {
+		pi = 1
+	}
+	var b strings.Builder
+	pos, n := 0, 0
+	for n < maxN {
+		ms := &luaMatchState{L: a.L, src: s, pat: p}
+		e := ms.match(pos, pi)
+		if e != -1 {
+			n++
+			ms.addValue(&b, pos, e, repl)
+		}
+		if e != -1 && e > pos {
+			pos = e
+		} else if pos < len(s) {
+			b.WriteByte(s[pos])
+			pos++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(s[pos:])
+	return values(b.String(), float64(n))
+}
+
+// strFormat is string.format, formatting with the C conversions Lua takes.
+func strFormat(a luaArgs) []luaValue {
+	format := a.str(1)
+	var b strings.Builder
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && isDigit(format[i]) {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && isDigit(format[i]) {
+				i++
+			}
+		}
+		if i >= len(format) || i-start > 10 {
+			a.L.errorf("invalid format (repeated flags)")
+		}
+		spec := "%" + format[start:i]
+
+		arg++
+		switch conv := format[i]; conv {
+		case 'c':
+			b.WriteByte(byte(a.number(arg)))
+		case 'd', 'i':
+			fmt.Fprintf(&b, spec+"d", int64(a.number(arg)))
+		case 'o', 'u', 'x', 'X':
+			if conv == 'u' {
+				conv = 'd'
+			}
+			fmt.Fprintf(&b, spec+string(conv), uint64(int64(a.number(arg))))
+		case 'e', 'E', 'f', 'g', 'G':
+			x := a.number(arg)
+			if math.IsInf(x, 0) || math.IsNaN(x) {
+				fmt.Fprintf(&b, strings.Replace(spec, "0", "", -1)+"s", luaNumberString(x))
+				break
+			}
+			fmt.Fprintf(&b, spec+string(conv), x)
+		case 'q':
+			s := a.str(arg)
+			b.WriteByte('"')
+			for j := 0; j < len(s); j++ {
+				switch s[j] {
+				case '"', '\\', '\n':
+					b.WriteByte('\\')
+					b.WriteByte(s[j])
+				case '\r':
+					b.WriteString(`\r`)
+				case 0:
+					b.WriteString(`\000`)
+				default:
+					b.WriteByte(s[j])
+				}
+			}
+			b.WriteByte('"')
+		case 's':
+			fmt.Fprintf(&b, spec+"s", a.str(arg))
+		default:
+			a.L.errorf("invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return values(b.String())
+}
+
+// Lua patterns, as matched by lstrlib.c. Positions are byte offsets, and -1
+// stands for no match.
+
+const (
+	luaMaxCaptures = 32
+	capUnfinished  = -1
+	capPosition    = -2
+)
+
+type luaMatchState struct {
+	L        *luaState
+	src, pat string
+	level    int
+	capture  [luaMaxCaptures]struct{ init, len int }
+	depth    int
+}
+
+func (ms *luaMatchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.L.errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.L.errorf("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' && p < len(ms.pat) {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isLuaLetter(c)
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > 32 && c < 127 && !isLuaLetter(c) && !isDigit(c)
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isLuaLetter(c) || isDigit(c)
+	case 'x':
+		res = isDigit(c) || ((c|0x20) >= 'a' && (c|0x20) <= 'f')
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+func isLuaLetter(c byte) bool {
+	return (c|0x20) >= 'a' && (c|0x20) <= 'z'
+}
+
+// matchBracketClass matches c against the class from the '[' at p to the ']'
+// at ec.
+func (ms *luaMatchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	p++
+	if ms.pat[p] == '^' {
+		sig = false
+		p++
+	}
+	for ; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case ms.pat[p+1] == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *luaMatchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+func (ms *luaMatchState) match(s, p int) int {
+	ms.depth++
+	defer func() { ms.depth-- }()
+	if ms.depth > luaMaxDepth {
+		ms.L.errorf("pattern too complex")
+	}
+
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 >= len(ms.pat) {
+				break
+			}
+			switch next := ms.pat[p+1]; {
+			case next == 'b':
+				if s = ms.matchBalance(s, p+2); s == -1 {
+					return -1
+				}
+				p += 4
+				continue
+			case next == 'f':
+				p += 2
+				if p >= len(ms.pat) || ms.pat[p] != '[' {
+					ms.L.errorf("missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p)
+				var prev, cur byte
+				if s > 0 {
+					prev = ms.src[s-1]
+				}
+				if s < len(ms.src) {
+					cur = ms.src[s]
+				}
+				if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+					return -1
+				}
+				p = ep
+				continue
+			case isDigit(next):
+				if s = ms.matchCapture(s, next); s == -1 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		}
+
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if r := ms.match(s+1, ep+1); r != -1 {
+						return r
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s, p = s+1, ep
+	}
+	return s
+}
+
+func (ms *luaMatchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if r := ms.match(s+i, ep+1); r != -1 {
+			return r
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) minExpand(s, p, ep int) int {
+	for {
+		if r := ms.match(s, ep+1); r != -1 {
+			return r
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *luaMatchState) startCapture(s, p, what int) int {
+	if ms.level >= luaMaxCaptures {
+		ms.L.errorf("too many captures")
+	}
+	ms.capture[ms.level].init = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.level--
+	}
+	return r
+}
+
+func (ms *luaMatchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.L.errorf("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].init
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.capture[l].len = capUnfinished
+	}
+	return r
+}
+
+func (ms *luaMatchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.L.errorf("unbalanced pattern")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		if ms.src[i] == e {
+			if cont--; cont == 0 {
+				return i + 1
+			}
+		} else if ms.src[i] == b {
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) matchCapture(s int, l byte) int {
+	i := int(l - '1')
+	if i < 0 || i >= ms.level || ms.capture[i].len == capUnfinished {
+		ms.L.errorf("invalid capture index")
+	}
+	c := ms.capture[i]
+	capture := ms.src[c.init : c.init+c.len]
+	if strings.HasPrefix(ms.src[s:], capture) {
+		return s + len(capture)
+	}
+	return -1
+}
+
+// capture returns capture i of the match from s to e.
+func (ms *luaMatchState) captureValue(i, s, e int) luaValue {
+	if i >= ms.level {
+		if i != 0 {
+			ms.L.errorf("invalid capture index")
+		}
+		return ms.src[s:e]
+	}
+	c := ms.capture[i]
+	switch c.len {
+	case capUnfinished:
+		ms.L.errorf("unfinished capture")
+	case capPosition:
+		return float64(c.init + 1)
+	}
+	return ms.src[c.init : c.init+c.len]
+}
+
+// captures returns the captures of the match from s to e, or the whole match
+// if the pattern has none and whole is set.
+func (ms *luaMatchState) captures(s, e int, whole bool) []luaValue {
+	n := ms.level
+	if n == 0 && whole {
+		n = 1
+	}
+	out := make([]luaValue, n)
+	for i := range out {
+		out[i] = ms.captureValue(i, s, e)
+	}
+	return out
+}
+
+// addValue writes the replacement of the match from s to e, as gsub does.
+func (ms *luaMatchState) addValue(b *strings.Builder, s, e int, repl luaValue) {
+	var v luaValue
+	switch r := repl.(type) {
+	case string, float64:
+		rs, _ := luaToString(r)
+		for i := 0; i < len(rs); i++ {
+			if rs[i] != '%' || i+1 == len(rs) {
+				b.WriteByte(rs[i])
+				continue
+			}
+			i++
+			switch c := rs[i]; {
+			case c == '0':
+				b.WriteString(ms.src[s:e])
+			case isDigit(c):
+				capture, _ := luaToString(ms.captureValue(int(c-'1'), s, e))
+				b.WriteString(capture)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return
+	case *luaTable:
+		v, _ = ms.L.gettable(r, ms.captureValue(0, s, e))
+	default:
+		v = first(ms.L.call(r, ms.captures(s, e, true)))
+	}
+
+	if !luaTruthy(v) {
+		b.WriteString(ms.src[s:e])
+		return
+	}
+	rs, ok := luaToString(v)
+	if !ok {
+		ms.L.errorf("invalid replacement value (a %s)", luaTypeName(v))
+	}
+	b.WriteString(rs)
+}
+
+var luaTableLib = map[string]func(a luaArgs) []luaValue{
+	"concat": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		sep := a.optStr(2, "")
+		i, j := a.optInt(3, 1), a.optInt(4, t.length())
+		var b strings.Builder
+		for k := i; k <= j; k++ {
+			s, ok := luaToString(t.get(float64(k)))
+			if !ok {
+				a.L.errorf("invalid value (at index %d) in table for 'concat'", k)
+			}
+			b.WriteString(s)
+			if k != j {
+				b.WriteString(sep)
+			}
+			if b.Len() > luaMaxString {
+				a.L.errorf("string length overflow")
+			}
+		}
+		return values(b.String())
+	},
+	"insert": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		n := t.length()
+		switch len(a.v) {
+		case 2:
+			a.L.rawset(t, float64(n+1), a.v[1])
+		case 3:
+			pos := a.int(2)
+			if pos > n+1 {
+				n = pos - 1
+			}
+			for i := n + 1; i > pos; i-- {
+				a.L.rawset(t, float64(i), t.get(float64(i-1)))
+			}
+			a.L.rawset(t, float64(pos), a.v[2])
+		default:
+			a.L.errorf("wrong number of arguments to 'insert'")
+		}
+		return nil
+	},
+	"remove": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		n := t.length()
+		pos := a.optInt(2, n)
+		if n == 0 {
+			return nil
+		}
+		v := t.get(float64(pos))
+		for i := pos; i < n; i++ {
+			a.L.rawset(t, float64(i), t.get(float64(i+1)))
+		}
+		a.L.rawset(t, float64(n), nil)
+		return values(v)
+	},
+	"sort": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		comp := a.get(2)
+		if comp != nil {
+			switch comp.(type) {
+			case *luaFunction, *goFunction:
+			default:
+				a.typeError(2, "function")
+			}
+		}
+		n := t.length()
+		items := make([]luaValue, n)
+		for i := range items {
+			items[i] = t.get(float64(i + 1))
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			if comp != nil {
+				return luaTruthy(first(a.L.call(comp, values(items[i], items[j]))))
+			}
+			return a.L.less(items[i], items[j])
+		})
+		for i, v := range items {
+			a.L.rawset(t, float64(i+1), v)
+		}
+		return nil
+	},
+	"getn": func(a luaArgs) []luaValue {
+		return values(float64(a.table(1).length()))
+	},
+	"maxn": func(a luaArgs) []luaValue {
+		t := a.table(1)
+		max := 0.0
+		for k, _, _ := t.next(nil); k != nil; k, _, _ = t.next(k) {
+			if n, ok := k.(float64); ok && n > max {
+				max = n
+			}
+		}
+		return values(max)
+	},
+}
+
+func mathFunc(f func(float64) float64) func(a luaArgs) []luaValue {
+	return func(a luaArgs) []luaValue {
+		return values(f(a.number(1)))
+	}
+}
+
+var luaMathLib = map[string]func(a luaArgs) []luaValue{
+	"abs":   mathFunc(math.Abs),
+	"acos":  mathFunc(math.Acos),
+	"asin":  mathFunc(math.Asin),
+	"atan":  mathFunc(math.Atan),
+	"ceil":  mathFunc(math.Ceil),
+	"cos":   mathFunc(math.Cos),
+	"cosh":  mathFunc(math.Cosh),
+	"exp":   mathFunc(math.Exp),
+	"floor": mathFunc(math.Floor),
+	"log":   mathFunc(math.Log),
+	"log10": mathFunc(math.Log10),
+	"sin":   mathFunc(math.Sin),
+	"sinh":  mathFunc(math.Sinh),
+	"sqrt":  mathFunc(math.Sqrt),
+	"tan":   mathFunc(math.Tan),
+	"tanh":  mathFunc(math.Tanh),
+	"deg": mathFunc(func(x float64) float64 {
+		return x * 180 / math.Pi
+	}),
+	"rad": mathFunc(func(x float64) float64 {
+		return x * math.Pi / 180
+	}),
+	"atan2": func(a luaArgs) []luaValue {
+		return values(math.Atan2(a.number(1), a.number(2)))
+	},
+	"fmod": func(a luaArgs) []luaValue {
+		return values(math.Mod(a.number(1), a.number(2)))
+	},
+	"pow": func(a luaArgs) []luaValue {
+		return values(math.Pow(a.number(1), a.number(2)))
+	},
+	"ldexp": func(a luaArgs) []luaValue {
+		return values(math.Ldexp(a.number(1), a.int(2)))
+	},
+	"frexp": func(a luaArgs) []luaValue {
+		frac, exp := math.Frexp(a.number(1))
+		return values(frac, float64(exp))
+	},
+	"modf": func(a luaArgs) []luaValue {
+		i, frac := math.Modf(a.number(1))
+		return values(i, frac)
+	},
+	"max": func(a luaArgs) []luaValue {
+		max := a.number(1)
+		for i := 2; i <= len(a.v); i++ {
+			if x := a.number(i); x > max {
+				max = x
+			}
+		}
+		return values(max)
+	},
+	"min": func(a luaArgs) []luaValue {
+		min := a.number(1)
+		for i := 2; i <= len(a.v); i++ {
+			if x := a.number(i); x < min {
+				min = x
+			}
+		}
+		return values(min)
+	},
+	// random is seeded the same way before every script, so that scripts
+	// calling it replicate as Redis expects.
+	"random": func(a luaArgs) []luaValue {
+		r := a.L.rand.Float64()
+		switch len(a.v) {
+		case 0:
+			return values(r)
+		case 1:
+			m := a.int(1)
+			if m < 1 {
+				a.argError(1, "interval is empty")
+			}
+			return values(math.Floor(r*float64(m)) + 1)
+		case 2:
+			l, u := a.int(1), a.int(2)
+			if l > u {
+				a.argError(2, "interval is empty")
+			}
+			return values(math.Floor(r*float64(u-l+1)) + float64(l))
+		}
+		a.L.errorf("wrong number of arguments")
+		return nil
+	},
+	"randomseed": func(a luaArgs) []luaValue {
+		a.L.rand.Seed(int64(a.int(1)))
+		return nil
+	},
+}
+
+// The bit library is LuaBitOp, working on 32-bit integers.
+
+func (a luaArgs) bit(n int) uint32 {
+	x := a.number(n)
+	return uint32(int64(math.Floor(x + 0.5)))
+}
+
+func bitResult(x uint32) []luaValue {
+	return values(float64(int32(x)))
+}
+
+func bitFold(op func(x, y uint32) uint32) func(a luaArgs) []luaValue {
+	return func(a luaArgs) []luaValue {
+		x := a.bit(1)
+		for i := 2; i <= len(a.v); i++ {
+			x = op(x, a.bit(i))
+		}
+		return bitResult(x)
+	}
+}
+
+var luaBitLib = map[string]func(a luaArgs) []luaValue{
+	"tobit": func(a luaArgs) []luaValue {
+		return bitResult(a.bit(1))
+	},
+	"bnot": func(a luaArgs) []luaValue {
+		return bitResult(^a.bit(1))
+	},
+	"band": bitFold(func(x, y uint32) uint32 { return x & y }),
+	"bor":  bitFold(func(x, y uint32) uint32 { return x | y }),
+	"bxor": bitFold(func(x, y uint32) uint32 { return x ^ y }),
+	"lshift": func(a luaArgs) []luaValue {
+		return bitResult(a.bit(1) << (a.bit(2) & 31))
+	},
+	"rshift": func(a luaArgs) []luaValue {
+		return bitResult(a.bit(1) >> (a.bit(2) & 31))
+	},
+	"arshift": func(a luaArgs) []luaValue {
+		return bitResult(uint32(int32(a.bit(1)) >> (a.bit(2) & 31)))
+	},
+	"rol": func(a luaArgs) []luaValue {
+		x, n := a.bit(1), a.bit(2)&31
+		return bitResult(x<<n | x>>(32-n))
+	},
+	"ror": func(a luaArgs) []luaValue {
+		x, n := a.bit(1), a.bit(2)&31
+		return bitResult(x>>n | x<<(32-n))
+	},
+	"bswap": func(a luaArgs) []luaValue {
+		x := a.bit(1)
+		return bitResult(x>>24 | (x>>8)&0xff00 | (x&0xff00)<<8 | x<<24)
+	},
+	"tohex": func(a luaArgs) []luaValue {
+		x, n := a.bit(1), a.optInt(2, 8)
+		digits := "0123456789abcdef"
+		if n < 0 {
+			n, digits = -n, "0123456789ABCDEF"
+		}
+		if n > 8 {
+			n = 8
+		}
+		b := make([]byte, n)
+		for i := n - 1; i >= 0; i-- {
+			b[i] = digits[x&15]
+			x >>= 4
+		}
+		return values(string(b))
+	},
+}
+
+var luaCjsonLib = map[string]func(a luaArgs) []luaValue{
+	"encode": func(a luaArgs) []luaValue {
+		var b bytes.Buffer
+		jsonEncode(a.L, &b, a.any(1), 0)
+		return values(b.String())
+	},
+	"decode": func(a luaArgs) []luaValue {
+		dec := json.NewDecoder(strings.NewReader(a.str(1)))
+		dec.UseNumber()
+		v, err := jsonDecode(dec)
+		if err == nil {
+			if _, err = dec.Token(); err == io.EOF {
+				return values(v)
+			} else if err == nil {
+				err = fmt.Errorf("trailing data")
+			}
+		}
+		a.L.errorf("Expected value but found invalid token: %v", err)
+		return nil
+	},
+}
+
+func jsonEncode(L *luaState, b *bytes.Buffer, v luaValue, depth int) {
+	if depth > 1000 {
+		L.errorf("Cannot serialise, excessive nesting (1001)")
+	}
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			L.errorf("Cannot serialise number: must not be NaN or Inf")
+		}
+		b.WriteString(luaNumberString(v))
+	case string:
+		s, _ := json.Marshal(v)
+		b.Write(s)
+	case *luaTable:
+		// Tables whose keys are all positive integers are arrays, the others
+		// objects, as cjson tells them apart.
+		n, array := 0, true
+		for k, _, _ := v.next(nil); k != nil; k, _, _ = v.next(k) {
+			i := arrayIndex(k)
+			if i == 0 {
+				array = false
+				break
+			}
+			if i > n {
+				n = i
+			}
+		}
+		if array && n > 0 {
+			b.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					b.WriteByte(',')
+				}
+				jsonEncode(L, b, v.get(float64(i)), depth+1)
+			}
+			b.WriteByte(']')
+			return
+		}
+		b.WriteByte('{')
+		count := 0
+		for k, value, _ := v.next(nil); k != nil; k, value, _ = v.next(k) {
+			key, ok := luaToString(k)
+			if !ok {
+				L.errorf("Cannot serialise %s: table key must be a number or string", luaTypeName(k))
+			}
+			if count > 0 {
+				b.WriteByte(',')
+			}
+			count++
+			s, _ := json.Marshal(key)
+			b.Write(s)
+			b.WriteByte(':')
+			jsonEncode(L, b, value, depth+1)
+		}
+		b.WriteByte('}')
+	default:
+		if v == luaNull {
+			b.WriteString("null")
+			return
+		}
+		L.errorf("Cannot serialise %s: type not supported", luaTypeName(v))
+	}
+}
+
+// jsonDecode decodes the next JSON value from dec, keeping the order of the
+// keys of objects.
+func jsonDecode(dec *json.Decoder) (luaValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case nil:
+		return luaNull, nil
+	case bool, string:
+		return tok, nil
+	case json.Number:
+		return strconv.ParseFloat(string(tok), 64)
+	case json.Delim:
+		t := newLuaTable(0, 0)
+		n := 0
+		for dec.More() {
+			var key luaValue
+			if tok == '{' {
+				if key, err = jsonDecode(dec); err != nil {
+					return nil, err
+				}
+			} else {
+				n++
+				key = float64(n)
+			}
+			v, err := jsonDecode(dec)
+			if err != nil {
+				return nil, err
+			}
+			t.set(key, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected %v", tok)
+}
@@ -0,0 +1,1125 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file compiles Lua 5.1 source into the syntax tree that luavm.go runs.
+// Names are resolved while parsing: locals become slots of their function's
+// frame, and locals used by nested functions are marked as captured, so they are
+// kept in cells the closures share.
+
+// Tokens of the lexer. Single-character tokens are their own byte.
+const (
+	tokEOF = iota + 256
+	tokName
+	tokNumber
+	tokString
+	tokEq     // ==
+	tokNe     // ~=
+	tokLe     // <=
+	tokGe     // >=
+	tokConcat // ..
+	tokDots   // ...
+
+	tokAnd
+	tokBreak
+	tokDo
+	tokElse
+	tokElseif
+	tokEnd
+	tokFalse
+	tokFor
+	tokFunction
+	tokIf
+	tokIn
+	tokLocal
+	tokNil
+	tokNot
+	tokOr
+	tokRepeat
+	tokReturn
+	tokThen
+	tokTrue
+	tokUntil
+	tokWhile
+)
+
+var luaKeywords = map[string]int{
+	"and": tokAnd, "break": tokBreak, "do": tokDo, "else": tokElse, "elseif": tokElseif,
+	"end": tokEnd, "false": tokFalse, "for": tokFor, "function": tokFunction, "if": tokIf,
+	"in": tokIn, "local": tokLocal, "nil": tokNil, "not": tokNot, "or": tokOr,
+	"repeat": tokRepeat, "return": tokReturn, "then": tokThen, "true": tokTrue,
+	"until": tokUntil, "while": tokWhile,
+}
+
+// luaSyntaxError is a compilation error, such as an unexpected symbol.
+type luaSyntaxError struct {
+	msg string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return e.msg
+}
+
+type luaToken struct {
+	kind int
+	text string  // names and strings
+	num  float64 // numbers
+	line int
+}
+
+type luaLexer struct {
+	chunk string
+	src   string
+	pos   int
+	line  int
+}
+
+func (lx *luaLexer) errorf(format string, args ...interface{}) {
+	panic(&luaSyntaxError{fmt.Sprintf("%s:%d: %s", lx.chunk, lx.line, fmt.Sprintf(format, args...))})
+}
+
+func (lx *luaLexer) peekByte(offset int) byte {
+	if lx.pos+offset < len(lx.src) {
+		return lx.src[lx.pos+offset]
+	}
+	return 0
+}
+
+// next returns the next token of the source.
+func (lx *luaLexer) next() luaToken {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					lx.longString(level)
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return lx.token()
+		}
+	}
+	return luaToken{kind: tokEOF, line: lx.line}
+}
+
+func (lx *luaLexer) token() luaToken {
+	c := lx.src[lx.pos]
+	tok := luaToken{line: lx.line}
+
+	switch {
+	case isLuaAlpha(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isLuaAlpha(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		tok.text = lx.src[start:lx.pos]
+		if kw, ok := luaKeywords[tok.text]; ok {
+			tok.kind = kw
+		} else {
+			tok.kind = tokName
+		}
+		return tok
+	case isDigit(c) || (c == '.' && isDigit(lx.peekByte(1))):
+		tok.kind, tok.num = tokNumber, lx.number()
+		return tok
+	case c == '"' || c == '\'':
+		tok.kind, tok.text = tokString, lx.quotedString(c)
+		return tok
+	case c == '[':
+		if level := lx.longBracketLevel(); level >= 0 {
+			tok.kind, tok.text = tokString, lx.longString(level)
+			return tok
+		}
+	}
+
+	two := ""
+	if lx.pos+1 < len(lx.src) {
+		two = lx.src[lx.pos : lx.pos+2]
+	}
+	switch two {
+	case "==":
+		tok.kind = tokEq
+	case "~=":
+		tok.kind = tokNe
+	case "<=":
+		tok.kind = tokLe
+	case ">=":
+		tok.kind = tokGe
+	case "..":
+		tok.kind = tokConcat
+		if lx.peekByte(2) == '.' {
+			tok.kind = tokDots
+			lx.pos++
+		}
+	}
+	if tok.kind != 0 {
+		lx.pos += 2
+		return tok
+	}
+
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) < 0 {
+		lx.errorf("unexpected symbol near '%c'", c)
+	}
+	lx.pos++
+	tok.kind = int(c)
+	return tok
+}
+
+func isLuaAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (lx *luaLexer) number() float64 {
+	start := lx.pos
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if (c == '+' || c == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') &&
+			!strings.HasPrefix(strings.ToLower(lx.src[start:]), "0x") {
+			lx.pos++
+			continue
+		}
+		if !isLuaAlpha(c) && !isDigit(c) && c != '.' {
+			break
+		}
+		lx.pos++
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := parseLuaNumber(text)
+	if !ok {
+		lx.errorf("malformed number near '%s'", text)
+	}
+	return n
+}
+
+// longBracketLevel returns the level of the long bracket opening at the current
+// position, such as 2 for [==[, or -1 if there is none.
+func (lx *luaLexer) longBracketLevel() int {
+	level := 0
+	for lx.peekByte(1+level) == '=' {
+		level++
+	}
+	if lx.peekByte(1+level) != '[' {
+		return -1
+	}
+	return level
+}
+
+func (lx *luaLexer) longString(level int) string {
+	lx.pos += level + 2
+	// A newline right after the opening bracket is skipped.
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s
+}
+
+func (lx *luaLexer) quotedString(quote byte) string {
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			lx.errorf("unfinished string")
+		}
+		c := lx.src[lx.pos]
+		switch c {
+		case quote:
+			lx.pos++
+			return b.String()
+		case '\n':
+			lx.errorf("unfinished string")
+		case '\\':
+			lx.pos++
+			if lx.pos >= len(lx.src) {
+				lx.errorf("unfinished string")
+			}
+			e := lx.src[lx.pos]
+			lx.pos++
+			switch e {
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'v':
+				b.WriteByte('\v')
+			case '\n':
+				lx.line++
+				b.WriteByte('\n')
+			default:
+				if !isDigit(e) {
+					b.WriteByte(e)
+					continue
+				}
+				n := int(e - '0')
+				for i := 0; i < 2 && isDigit(lx.peekByte(0)); i++ {
+					n = n*10 + int(lx.src[lx.pos]-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					lx.errorf("escape sequence too large")
+				}
+				b.WriteByte(byte(n))
+			}
+		default:
+			b.WriteByte(c)
+			lx.pos++
+		}
+	}
+}
+
+// parseLuaNumber converts s to a number as Lua does, accepting surrounding
+// spaces, decimal numbers with an optional exponent, and hexadecimal integers.
+func parseLuaNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	body := s
+	if strings.HasPrefix(body, "-") {
+		neg, body = true, body[1:]
+	} else if strings.HasPrefix(body, "+") {
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil || strings.HasPrefix(body[2:], "+") || strings.HasPrefix(body[2:], "-") {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if body == "" || strings.ContainsAny(body, "xXpP_") {
+		return 0, false
+	}
+	lower := strings.ToLower(body)
+	if strings.HasPrefix(lower, "inf") || strings.HasPrefix(lower, "nan") {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// Syntax tree. Expressions and statements carry the line they start on, for
+// error messages.
+
+type luaExpr interface{}
+type luaStmt interface{}
+
+type (
+	constExpr  struct{ v luaValue }
+	varargExpr struct{}
+	localExpr  struct{ v *localVar }
+	upvalExpr  struct {
+		idx  int
+		name string
+	}
+	globalExpr struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj, key luaExpr
+		line     int
+	}
+	callExpr struct {
+		fn   luaExpr
+		args []luaExpr
+		line int
+	}
+	methodCallExpr struct {
+		obj  luaExpr
+		name string
+		args []luaExpr
+		line int
+	}
+	functionExpr struct{ proto *funcProto }
+	binopExpr    struct {
+		op   int
+		a, b luaExpr
+		line int
+	}
+	andExpr  struct{ a, b luaExpr }
+	orExpr   struct{ a, b luaExpr }
+	unopExpr struct {
+		op   int
+		a    luaExpr
+		line int
+	}
+	parenExpr struct{ e luaExpr }
+	tableExpr struct {
+		items []tableItem
+		line  int
+	}
+)
+
+// tableItem is an entry of a table constructor: a positional value when key is
+// nil.
+type tableItem struct {
+	key, value luaExpr
+}
+
+type (
+	localStmt struct {
+		vars  []*localVar
+		exprs []luaExpr
+	}
+	assignStmt struct {
+		targets []luaExpr
+		exprs   []luaExpr
+		line    int
+	}
+	callStmt struct {
+		call luaExpr
+		line int
+	}
+	doStmt    struct{ block []luaStmt }
+	whileStmt struct {
+		cond  luaExpr
+		block []luaStmt
+	}
+	repeatStmt struct {
+		block []luaStmt
+		cond  luaExpr
+	}
+	ifStmt struct {
+		conds     []luaExpr
+		blocks    [][]luaStmt
+		elseBlock []luaStmt
+	}
+	numForStmt struct {
+		v                  *localVar
+		start, limit, step luaExpr
+		block              []luaStmt
+		line               int
+	}
+	genForStmt struct {
+		vars  []*localVar
+		exprs []luaExpr
+		block []luaStmt
+		line  int
+	}
+	localFunctionStmt struct {
+		v     *localVar
+		proto *funcProto
+	}
+	returnStmt struct {
+		exprs []luaExpr
+		line  int
+	}
+	breakStmt struct{}
+)
+
+// localVar is a local variable, held in a slot of its function's frame. A
+// captured one is held in a cell shared with the closures using it.
+type localVar struct {
+	name     string
+	slot     int
+	captured bool
+}
+
+// upvalDesc locates an upvalue of a function when its closure is created: a
+// local of the enclosing function, or one of the enclosing function's upvalues.
+type upvalDesc struct {
+	name      string
+	fromLocal bool
+	local     *localVar
+	index     int
+}
+
+// funcProto is a compiled function.
+type funcProto struct {
+	name   string
+	params []*localVar
+	vararg bool
+	body   []luaStmt
+	nslots int
+	upvals []upvalDesc
+	line   int
+}
+
+// funcState tracks the scopes of the function being parsed.
+type funcState struct {
+	parent *funcState
+	proto  *funcProto
+	scopes [][]*localVar
+}
+
+type luaParser struct {
+	lx    *luaLexer
+	tok   luaToken
+	ahead *luaToken
+	fs    *funcState
+}
+
+// compileLua compiles a chunk of Lua source, named chunk in error messages, into
+// a function taking any arguments.
+func compileLua(chunk, src string) (proto *funcProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			se, ok := r.(*luaSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = se
+		}
+	}()
+
+	p := &luaParser{lx: &luaLexer{chunk: chunk, src: src, line: 1}}
+	p.advance()
+	proto = &funcProto{name: "main chunk", vararg: true, line: 0}
+	p.fs = &funcState{proto: proto}
+	p.openScope()
+	proto.body = p.block()
+	if p.tok.kind != tokEOF {
+		p.errorNear("'<eof>' expected")
+	}
+	return proto, nil
+}
+
+func (p *luaParser) advance() {
+	if p.ahead != nil {
+		p.tok, p.ahead = *p.ahead, nil
+		return
+	}
+	p.tok = p.lx.next()
+}
+
+func (p *luaParser) peek() luaToken {
+	if p.ahead == nil {
+		t := p.lx.next()
+		p.ahead = &t
+	}
+	return *p.ahead
+}
+
+func tokenText(t luaToken) string {
+	switch t.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokName, tokString:
+		return t.text
+	case tokNumber:
+		return luaNumberString(t.num)
+	case tokEq:
+		return "=="
+	case tokNe:
+		return "~="
+	case tokLe:
+		return "<="
+	case tokGe:
+		return ">="
+	case tokConcat:
+		return ".."
+	case tokDots:
+		return "..."
+	}
+	if t.kind < 256 {
+		return string(rune(t.kind))
+	}
+	for kw, kind := range luaKeywords {
+		if kind == t.kind {
+			return kw
+		}
+	}
+	return "?"
+}
+
+func (p *luaParser) errorNear(msg string) {
+	panic(&luaSyntaxError{fmt.Sprintf("%s:%d: %s near '%s'", p.lx.chunk, p.tok.line, msg, tokenText(p.tok))})
+}
+
+func (p *luaParser) check(kind int, what string) {
+	if p.tok.kind != kind {
+		p.errorNear(fmt.Sprintf("'%s' expected", what))
+	}
+}
+
+func (p *luaParser) expect(kind int, what string) {
+	p.check(kind, what)
+	p.advance()
+}
+
+// expectMatch expects the token closing what opened on line.
+func (p *luaParser) expectMatch(kind int, what, opener string, line int) {
+	if p.tok.kind != kind {
+		if line == p.tok.line {
+			p.check(kind, what)
+		}
+		p.errorNear(fmt.Sprintf("'%s' expected (to close '%s' at line %d)", what, opener, line))
+	}
+	p.advance()
+}
+
+func (p *luaParser) name() string {
+	p.check(tokName, "<name>")
+	name := p.tok.text
+	p.advance()
+	return name
+}
+
+func (p *luaParser) openScope() {
+	p.fs.scopes = append(p.fs.scopes, nil)
+}
+
+func (p *luaParser) closeScope() {
+	p.fs.scopes = p.fs.scopes[:len(p.fs.scopes)-1]
+}
+
+// declare creates a local variable. It is visible once activated, so that
+// local x = x reads the outer x.
+func (p *luaParser) declare(name string) *localVar {
+	v := &localVar{name: name, slot: p.fs.proto.nslots}
+	p.fs.proto.nslots++
+	return v
+}
+
+func (p *luaParser) activate(vars ...*localVar) {
+	scope := &p.fs.scopes[len(p.fs.scopes)-1]
+	*scope = append(*scope, vars...)
+}
+
+// resolve returns the expression reading the variable name.
+func (p *luaParser) resolve(name string, line int) luaExpr {
+	if v := findLocal(p.fs, name); v != nil {
+		return &localExpr{v}
+	}
+	if idx := findUpval(p.fs, name); idx >= 0 {
+		return &upvalExpr{idx, name}
+	}
+	return &globalExpr{name, line}
+}
+
+func findLocal(fs *funcState, name string) *localVar {
+	for i := len(fs.scopes) - 1; i >= 0; i-- {
+		scope := fs.scopes[i]
+		for j := len(scope) - 1; j >= 0; j-- {
+			if scope[j].name == name {
+				return scope[j]
+			}
+		}
+	}
+	return nil
+}
+
+// findUpval returns the index of the upvalue of fs named name, adding it if an
+// enclosing function has such a local, or -1.
+func findUpval(fs *funcState, name string) int {
+	for i, u := range fs.proto.upvals {
+		if u.name == name {
+			return i
+		}
+	}
+	if fs.parent == nil {
+		return -1
+	}
+	if v := findLocal(fs.parent, name); v != nil {
+		v.captured = true
+		fs.proto.upvals = append(fs.proto.upvals, upvalDesc{name: name, fromLocal: true, local: v})
+		return len(fs.proto.upvals) - 1
+	}
+	if idx := findUpval(fs.parent, name); idx >= 0 {
+		fs.proto.upvals = append(fs.proto.upvals, upvalDesc{name: name, index: idx})
+		return len(fs.proto.upvals) - 1
+	}
+	return -1
+}
+
+func blockFollows(kind int) bool {
+	switch kind {
+	case tokElse, tokElseif, tokEnd, tokUntil, tokEOF:
+		return true
+	}
+	return false
+}
+
+// block parses statements up to the end of a block, in the current scope.
+func (p *luaParser) block() []luaStmt {
+	var stmts []luaStmt
+	for !blockFollows(p.tok.kind) {
+		if p.tok.kind == tokReturn {
+			stmts = append(stmts, p.returnStatement())
+			break
+		}
+		if p.tok.kind == tokBreak {
+			p.advance()
+			stmts = append(stmts, &breakStmt{})
+			if p.tok.kind == ';' {
+				p.advance()
+			}
+			break
+		}
+		if s := p.statement(); s != nil {
+			stmts = append(stmts, s)
+		}
+		if p.tok.kind == ';' {
+			p.advance()
+		}
+	}
+	return stmts
+}
+
+// scopedBlock parses a block in a scope of its own.
+func (p *luaParser) scopedBlock() []luaStmt {
+	p.openScope()
+	defer p.closeScope()
+	return p.block()
+}
+
+func (p *luaParser) returnStatement() luaStmt {
+	line := p.tok.line
+	p.advance()
+	s := &returnStmt{line: line}
+	if !blockFollows(p.tok.kind) && p.tok.kind != ';' {
+		s.exprs = p.exprList()
+	}
+	if p.tok.kind == ';' {
+		p.advance()
+	}
+	return s
+}
+
+func (p *luaParser) statement() luaStmt {
+	line := p.tok.line
+	switch p.tok.kind {
+	case tokIf:
+		return p.ifStatement(line)
+	case tokWhile:
+		p.advance()
+		cond := p.expr()
+		p.expect(tokDo, "do")
+		block := p.scopedBlock()
+		p.expectMatch(tokEnd, "end", "while", line)
+		return &whileStmt{cond, block}
+	case tokDo:
+		p.advance()
+		block := p.scopedBlock()
+		p.expectMatch(tokEnd, "end", "do", line)
+		return &doStmt{block}
+	case tokFor:
+		return p.forStatement(line)
+	case tokRepeat:
+		p.advance()
+		// The condition sees the locals of the block.
+		p.openScope()
+		block := p.block()
+		p.expectMatch(tokUntil, "until", "repeat", line)
+		cond := p.expr()
+		p.closeScope()
+		return &repeatStmt{block, cond}
+	case tokFunction:
+		return p.functionStatement(line)
+	case tokLocal:
+		p.advance()
+		if p.tok.kind == tokFunction {
+			p.advance()
+			v := p.declare(p.name())
+			p.activate(v)
+			return &localFunctionStmt{v, p.functionBody(v.name, false, line)}
+		}
+		var names []string
+		for {
+			names = append(names, p.name())
+			if p.tok.kind != ',' {
+				break
+			}
+			p.advance()
+		}
+		var exprs []luaExpr
+		if p.tok.kind == '=' {
+			p.advance()
+			exprs = p.exprList()
+		}
+		vars := make([]*localVar, len(names))
+		for i, name := range names {
+			vars[i] = p.declare(name)
+		}
+		p.activate(vars...)
+		return &localStmt{vars, exprs}
+	case ';':
+		p.advance()
+		return nil
+	}
+	return p.exprStatement(line)
+}
+
+func (p *luaParser) ifStatement(line int) luaStmt {
+	s := &ifStmt{}
+	p.advance()
+	for {
+		s.conds = append(s.conds, p.expr())
+		p.expect(tokThen, "then")
+		s.blocks = append(s.blocks, p.scopedBlock())
+		if p.tok.kind != tokElseif {
+			break
+		}
+		p.advance()
+	}
+	if p.tok.kind == tokElse {
+		p.advance()
+		s.elseBlock = p.scopedBlock()
+	}
+	p.expectMatch(tokEnd, "end", "if", line)
+	return s
+}
+
+func (p *luaParser) forStatement(line int) luaStmt {
+	p.advance()
+	first := p.name()
+
+	if p.tok.kind == '=' {
+		p.advance()
+		s := &numForStmt{line: line}
+		s.start = p.expr()
+		p.expect(',', ",")
+		s.limit = p.expr()
+		if p.tok.kind == ',' {
+			p.advance()
+			s.step = p.expr()
+		}
+		p.expect(tokDo, "do")
+		p.openScope()
+		s.v = p.declare(first)
+		p.activate(s.v)
+		s.block = p.block()
+		p.closeScope()
+		p.expectMatch(tokEnd, "end", "for", line)
+		return s
+	}
+
+	names := []string{first}
+	for p.tok.kind == ',' {
+		p.advance()
+		names = append(names, p.name())
+	}
+	if p.tok.kind != tokIn {
+		p.errorNear("'=' or 'in' expected")
+	}
+	p.advance()
+	s := &genForStmt{line: line, exprs: p.exprList()}
+	p.expect(tokDo, "do")
+	p.openScope()
+	for _, name := range names {
+		s.vars = append(s.vars, p.declare(name))
+	}
+	p.activate(s.vars...)
+	s.block = p.block()
+	p.closeScope()
+	p.expectMatch(tokEnd, "end", "for", line)
+	return s
+}
+
+func (p *luaParser) functionStatement(line int) luaStmt {
+	p.advance()
+	nameLine := p.tok.line
+	name := p.name()
+	target := p.resolve(name, nameLine)
+	fullName := name
+	method := false
+	for p.tok.kind == '.' || p.tok.kind == ':' {
+		method = p.tok.kind == ':'
+		p.advance()
+		key := p.name()
+		fullName += "." + key
+		target = &indexExpr{target, &constExpr{key}, nameLine}
+		if method {
+			break
+		}
+	}
+	fn := &functionExpr{p.functionBody(fullName, method, line)}
+	return &assignStmt{targets: []luaExpr{target}, exprs: []luaExpr{fn}, line: line}
+}
+
+// functionBody parses the parameters and body of a function, adding self as the
+// first parameter of methods.
+func (p *luaParser) functionBody(name string, method bool, line int) *funcProto {
+	proto := &funcProto{name: name, line: line}
+	p.fs = &funcState{parent: p.fs, proto: proto}
+	p.openScope()
+
+	if method {
+		proto.params = append(proto.params, p.declare("self"))
+	}
+	p.expect('(', "(")
+	if p.tok.kind != ')' {
+		for {
+			if p.tok.kind == tokDots {
+				p.advance()
+				proto.vararg = true
+				break
+			}
+			proto.params = append(proto.params, p.declare(p.name()))
+			if p.tok.kind != ',' {
+				break
+			}
+			p.advance()
+		}
+	}
+	p.activate(proto.params...)
+	p.expect(')', ")")
+	proto.body = p.block()
+	p.expectMatch(tokEnd, "end", "function", line)
+
+	p.fs = p.fs.parent
+	return proto
+}
+
+func (p *luaParser) exprStatement(line int) luaStmt {
+	e := p.suffixedExpr()
+	if p.tok.kind == '=' || p.tok.kind == ',' {
+		targets := []luaExpr{e}
+		for p.tok.kind == ',' {
+			p.advance()
+			targets = append(targets, p.suffixedExpr())
+		}
+		p.expect('=', "=")
+		for _, t := range targets {
+			switch t.(type) {
+			case *localExpr, *upvalExpr, *globalExpr, *indexExpr:
+			default:
+				p.errorNear("syntax error")
+			}
+		}
+		return &assignStmt{targets: targets, exprs: p.exprList(), line: line}
+	}
+	switch e.(type) {
+	case *callExpr, *methodCallExpr:
+		return &callStmt{e, line}
+	}
+	p.errorNear("syntax error")
+	return nil
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.tok.kind == ',' {
+		p.advance()
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	switch p.tok.kind {
+	case tokName:
+		line := p.tok.line
+		return p.resolve(p.name(), line)
+	case '(':
+		line := p.tok.line
+		p.advance()
+		e := p.expr()
+		p.expectMatch(')', ")", "(", line)
+		return &parenExpr{e}
+	}
+	p.errorNear("unexpected symbol")
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	e := p.primaryExpr()
+	for {
+		line := p.tok.line
+		switch p.tok.kind {
+		case '.':
+			p.advance()
+			e = &indexExpr{e, &constExpr{p.name()}, line}
+		case '[':
+			p.advance()
+			key := p.expr()
+			p.expect(']', "]")
+			e = &indexExpr{e, key, line}
+		case ':':
+			p.advance()
+			name := p.name()
+			e = &methodCallExpr{e, name, p.callArgs(), line}
+		case '(', tokString, '{':
+			e = &callExpr{e, p.callArgs(), line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	switch p.tok.kind {
+	case tokString:
+		s := p.tok.text
+		p.advance()
+		return []luaExpr{&constExpr{s}}
+	case '{':
+		return []luaExpr{p.tableConstructor()}
+	case '(':
+		line := p.tok.line
+		p.advance()
+		var args []luaExpr
+		if p.tok.kind != ')' {
+			args = p.exprList()
+		}
+		p.expectMatch(')', ")", "(", line)
+		return args
+	}
+	p.errorNear("function arguments expected")
+	return nil
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	line := p.tok.line
+	p.expect('{', "{")
+	t := &tableExpr{line: line}
+	for p.tok.kind != '}' {
+		switch {
+		case p.tok.kind == tokName && p.peek().kind == '=':
+			key := &constExpr{p.name()}
+			p.advance()
+			t.items = append(t.items, tableItem{key, p.expr()})
+		case p.tok.kind == '[':
+			p.advance()
+			key := p.expr()
+			p.expect(']', "]")
+			p.expect('=', "=")
+			t.items = append(t.items, tableItem{key, p.expr()})
+		default:
+			t.items = append(t.items, tableItem{nil, p.expr()})
+		}
+		if p.tok.kind != ',' && p.tok.kind != ';' {
+			break
+		}
+		p.advance()
+	}
+	p.expectMatch('}', "}", "{", line)
+	return t
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	switch p.tok.kind {
+	case tokNumber:
+		n := p.tok.num
+		p.advance()
+		return &constExpr{n}
+	case tokString:
+		s := p.tok.text
+		p.advance()
+		return &constExpr{s}
+	case tokNil:
+		p.advance()
+		return &constExpr{nil}
+	case tokTrue:
+		p.advance()
+		return &constExpr{true}
+	case tokFalse:
+		p.advance()
+		return &constExpr{false}
+	case tokDots:
+		if !p.fs.proto.vararg {
+			p.errorNear("cannot use '...' outside a vararg function")
+		}
+		p.advance()
+		return &varargExpr{}
+	case '{':
+		return p.tableConstructor()
+	case tokFunction:
+		line := p.tok.line
+		p.advance()
+		return &functionExpr{p.functionBody("anonymous", false, line)}
+	}
+	return p.suffixedExpr()
+}
+
+// Binary operator priorities, left and right, as in Lua 5.1.
+var luaBinaryPriority = map[int][2]int{
+	'+': {6, 6}, '-': {6, 6},
+	'*': {7, 7}, '/': {7, 7}, '%': {7, 7},
+	'^':       {10, 9},
+	tokConcat: {5, 4},
+	tokEq:     {3, 3}, tokNe: {3, 3}, '<': {3, 3}, tokLe: {3, 3}, '>': {3, 3}, tokGe: {3, 3},
+	tokAnd: {2, 2},
+	tokOr:  {1, 1},
+}
+
+const luaUnaryPriority = 8
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression whose binary operators bind tighter than limit.
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var e luaExpr
+	switch op := p.tok.kind; op {
+	case tokNot, '-', '#':
+		line := p.tok.line
+		p.advance()
+		operand := p.subExpr(luaUnaryPriority)
+		if c, ok := operand.(*constExpr); ok && op == '-' {
+			if n, ok := c.v.(float64); ok {
+				e = &constExpr{-n}
+				break
+			}
+		}
+		e = &unopExpr{op, operand, line}
+	default:
+		e = p.simpleExpr()
+	}
+
+	for {
+		op := p.tok.kind
+		prio, ok := luaBinaryPriority[op]
+		if !ok || prio[0] <= limit {
+			return e
+		}
+		line := p.tok.line
+		p.advance()
+		rhs := p.subExpr(prio[1])
+		switch op {
+		case tokAnd:
+			e = &andExpr{e, rhs}
+		case tokOr:
+			e = &orExpr{e, rhs}
+		default:
+			e = &binopExpr{op, e, rhs, line}
+		}
+	}
+}
@@ -0,0 +1,1160 @@
+package redis
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// This file runs the syntax trees compiled by luaparse.go. Values are Go values:
+// nil, bool, float64, string, *luaTable, *luaFunction, *goFunction and
+// *luaUserdata. Lua errors are Go panics carrying a *luaError, recovered by pcall
+// and by the code running the script.
+
+type luaValue interface{}
+
+// luaMaxDepth limits nested calls, like LUAI_MAXCCALLS, so runaway recursion is
+// a Lua error rather than a Go stack overflow.
+const luaMaxDepth = 200
+
+// luaMaxString limits the strings a script can build, like proto-max-bulk-len.
+const luaMaxString = 512 << 20
+
+// luaFunction is a Lua closure.
+type luaFunction struct {
+	proto  *funcProto
+	upvals []*luaCell
+}
+
+// luaCell holds a local variable captured by closures.
+type luaCell struct {
+	v luaValue
+}
+
+// goFunction is a function of the libraries, written in Go.
+type goFunction struct {
+	name string
+	fn   func(a luaArgs) []luaValue
+}
+
+// luaUserdata is an opaque value, such as cjson.null.
+type luaUserdata struct {
+	name string
+}
+
+// luaError is a Lua error in flight, carrying the value passed to error.
+type luaError struct {
+	value luaValue
+}
+
+// luaInterrupt aborts a script from its interrupt hook. pcall does not catch it.
+type luaInterrupt struct {
+	err error
+}
+
+// luaState runs scripts. It is used by one goroutine at a time.
+type luaState struct {
+	chunk      string
+	globals    *luaTable
+	stringMeta *luaTable
+	rand       *rand.Rand
+
+	// line is the line being run, for error messages, and callLines the lines
+	// the running functions were called from.
+	line      int
+	callLines []int
+	depth     int
+
+	// interrupt, when set, is called every so often while the script runs, and
+	// stops it when it returns an error.
+	interrupt func() error
+	steps     int
+}
+
+type luaFrame struct {
+	regs    []luaValue
+	varargs []luaValue
+	upvals  []*luaCell
+}
+
+func (f *luaFrame) get(v *localVar) luaValue {
+	if v.captured {
+		return f.regs[v.slot].(*luaCell).v
+	}
+	return f.regs[v.slot]
+}
+
+func (f *luaFrame) set(v *localVar, value luaValue) {
+	if v.captured {
+		f.regs[v.slot].(*luaCell).v = value
+		return
+	}
+	f.regs[v.slot] = value
+}
+
+// declare gives a local variable its first value, in a new cell if it is
+// captured, so each run of a loop body has variables of its own.
+func (f *luaFrame) declare(v *localVar, value luaValue) {
+	if v.captured {
+		f.regs[v.slot] = &luaCell{value}
+		return
+	}
+	f.regs[v.slot] = value
+}
+
+// errorf raises a Lua error with the position of the line being run.
+func (L *luaState) errorf(format string, args ...interface{}) {
+	panic(&luaError{fmt.Sprintf("%s:%d: %s", L.chunk, L.line, fmt.Sprintf(format, args...))})
+}
+
+// where returns the position of the function at level of the call stack, as
+// error does: 1 for the function calling error, 2 for its caller and so on.
+func (L *luaState) where(level int) string {
+	line := L.line
+	if level > 1 {
+		i := len(L.callLines) - level + 1
+		if i < 0 {
+			return ""
+		}
+		line = L.callLines[i]
+	}
+	return fmt.Sprintf("%s:%d: ", L.chunk, line)
+}
+
+// tick is called on every loop iteration and function call, and calls the
+// interrupt hook every so often.
+func (L *luaState) tick() {
+	L.steps++
+	if L.steps&1023 == 0 && L.interrupt != nil {
+		if err := L.interrupt(); err != nil {
+			panic(&luaInterrupt{err})
+		}
+	}
+}
+
+// run calls fn with args, returning its results or the error it raised.
+func (L *luaState) run(fn luaValue, args ...luaValue) (results []luaValue, err error) {
+	depth, lines := L.depth, len(L.callLines)
+	defer func() {
+		if r := recover(); r != nil {
+			i, ok := r.(*luaInterrupt)
+			if !ok {
+				panic(r)
+			}
+			L.depth, L.callLines = depth, L.callLines[:lines]
+			err = i.err
+		}
+	}()
+
+	results, e := L.pcall(fn, args)
+	if e != nil {
+		return nil, e
+	}
+	return results, nil
+}
+
+// pcall calls fn with args in protected mode, returning its results or the
+// error it raised. Interrupts are not caught.
+func (L *luaState) pcall(fn luaValue, args []luaValue) (results []luaValue, e *luaError) {
+	depth, lines := L.depth, len(L.callLines)
+	defer func() {
+		if r := recover(); r != nil {
+			le, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			L.depth, L.callLines = depth, L.callLines[:lines]
+			e = le
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+func (e *luaError) Error() string {
+	if s, ok := e.value.(string); ok {
+		return s
+	}
+	if n, ok := e.value.(float64); ok {
+		return luaNumberString(n)
+	}
+	return fmt.Sprintf("(error object is a %s value)", luaTypeName(e.value))
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaFunction, *goFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaTruthy(v luaValue) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return v != nil
+}
+
+// luaNumberString formats a number as Lua does, with %.14g.
+func luaNumberString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// luaToNumber converts v to a number, as arithmetic does for strings.
+func luaToNumber(v luaValue) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseLuaNumber(v)
+	}
+	return 0, false
+}
+
+// luaToString converts v to a string, as concatenation does for numbers.
+func luaToString(v luaValue) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return luaNumberString(v), true
+	}
+	return "", false
+}
+
+// luaTable is a Lua table: an array part holding the keys 1 to n, and a hash
+// part that keeps its keys in insertion order, so next and pairs are
+// deterministic, as scripts need.
+type luaTable struct {
+	arr  []luaValue
+	hash map[luaValue]int // key -> index in keys and vals
+	keys []luaValue
+	vals []luaValue // nil for removed keys, kept so traversals can go on
+	dead int
+
+	meta     *luaTable
+	readonly bool
+}
+
+func newLuaTable(narr, nhash int) *luaTable {
+	t := &luaTable{}
+	if narr > 0 {
+		t.arr = make([]luaValue, 0, narr)
+	}
+	if nhash > 0 {
+		t.hash = make(map[luaValue]int, nhash)
+	}
+	return t
+}
+
+// arrayIndex returns k as an index of the array part, or 0 if it is not a
+// positive integer.
+func arrayIndex(k luaValue) int {
+	if n, ok := k.(float64); ok && n >= 1 && n <= math.MaxInt32 && n == math.Trunc(n) {
+		return int(n)
+	}
+	return 0
+}
+
+// normKey returns the key under which k is stored: -0 and 0 are the same key.
+func normKey(k luaValue) luaValue {
+	if n, ok := k.(float64); ok && n == 0 {
+		return float64(0)
+	}
+	return k
+}
+
+func (t *luaTable) get(k luaValue) luaValue {
+	if i := arrayIndex(k); i >= 1 && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if idx, ok := t.hash[normKey(k)]; ok {
+		return t.vals[idx]
+	}
+	return nil
+}
+
+func (t *luaTable) getString(k string) luaValue {
+	if idx, ok := t.hash[k]; ok {
+		return t.vals[idx]
+	}
+	return nil
+}
+
+// set stores v under k, which must not be nil or NaN, removing k for a nil v.
+func (t *luaTable) set(k, v luaValue) {
+	if i := arrayIndex(k); i >= 1 {
+		if i <= len(t.arr) {
+			t.arr[i-1] = v
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+			return
+		}
+		if i == len(t.arr)+1 && v != nil {
+			t.hashSet(k, nil)
+			t.arr = append(t.arr, v)
+			t.extendArray()
+			return
+		}
+	}
+	t.hashSet(normKey(k), v)
+}
+
+func (t *luaTable) hashSet(k, v luaValue) {
+	if idx, ok := t.hash[k]; ok {
+		if t.vals[idx] == nil && v != nil {
+			t.dead--
+		} else if t.vals[idx] != nil && v == nil {
+			t.dead++
+		}
+		t.vals[idx] = v
+		return
+	}
+	if v == nil {
+		return
+	}
+
+	// Adding keys while traversing a table is not allowed in Lua, so this is
+	// where removed keys can be dropped.
+	if t.dead > 8 && t.dead > len(t.keys)/2 {
+		keys, vals := t.keys[:0], t.vals[:0]
+		for i, key := range t.keys {
+			if value := t.vals[i]; value != nil {
+				t.hash[key] = len(keys)
+				keys, vals = append(keys, key), append(vals, value)
+			} else {
+				delete(t.hash, key)
+			}
+		}
+		for i := len(keys); i < len(t.keys); i++ {
+			t.keys[i], t.vals[i] = nil, nil
+		}
+		t.keys, t.vals, t.dead = keys, vals, 0
+	}
+
+	if t.hash == nil {
+		t.hash = make(map[luaValue]int)
+	}
+	t.hash[k] = len(t.keys)
+	t.keys = append(t.keys, k)
+	t.vals = append(t.vals, v)
+}
+
+// setArray stores the positional items of a table constructor under the keys
+// 1 to n. As in Lua, they go to the array part even if some are nil, so that
+// {...} has the length of ....
+func (t *luaTable) setArray(items []luaValue) {
+	for len(items) > 0 && items[len(items)-1] == nil {
+		items = items[:len(items)-1]
+	}
+	if len(items) == 0 {
+		return
+	}
+	for i := range items {
+		t.hashSet(float64(i+1), nil)
+	}
+	t.arr = items
+	t.extendArray()
+}
+
+// extendArray moves the keys that follow the array part from the hash part into
+// it.
+func (t *luaTable) extendArray() {
+	for {
+		next := float64(len(t.arr) + 1)
+		idx, ok := t.hash[next]
+		if !ok || t.vals[idx] == nil {
+			break
+		}
+		t.arr = append(t.arr, t.vals[idx])
+		t.hashSet(next, nil)
+	}
+}
+
+// length returns a border of the table, as the # operator.
+func (t *luaTable) length() int {
+	return len(t.arr)
+}
+
+// next returns the key and value following k in a traversal of the table, nil
+// when there are none left, and false when k is not a key of the table.
+func (t *luaTable) next(k luaValue) (luaValue, luaValue, bool) {
+	i, h := 0, 0
+	if k != nil {
+		ai := arrayIndex(k)
+		if idx, ok := t.hash[normKey(k)]; ok && (ai == 0 || ai > len(t.arr)) {
+			i, h = len(t.arr), idx+1
+		} else if ai >= 1 {
+			// Past the end of an array part that shrank while it was traversed,
+			// the hash part is next.
+			i = ai
+		} else {
+			return nil, nil, false
+		}
+	}
+	for ; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for ; h < len(t.keys); h++ {
+		if t.vals[h] != nil {
+			return t.keys[h], t.vals[h], true
+		}
+	}
+	return nil, nil, true
+}
+
+// metatable returns the metatable of v, if it has one.
+func (L *luaState) metatable(v luaValue) *luaTable {
+	switch v := v.(type) {
+	case *luaTable:
+		return v.meta
+	case string:
+		return L.stringMeta
+	}
+	return nil
+}
+
+func (L *luaState) metafield(v luaValue, event string) luaValue {
+	if mt := L.metatable(v); mt != nil {
+		return mt.getString(event)
+	}
+	return nil
+}
+
+// gettable indexes obj with key, following __index, and reports whether obj can
+// be indexed.
+func (L *luaState) gettable(obj, key luaValue) (luaValue, bool) {
+	for loop := 0; loop < 100; loop++ {
+		var h luaValue
+		if t, ok := obj.(*luaTable); ok {
+			if v := t.get(key); v != nil || t.meta == nil {
+				return v, true
+			}
+			if h = t.meta.getString("__index"); h == nil {
+				return nil, true
+			}
+		} else if h = L.metafield(obj, "__index"); h == nil {
+			return nil, false
+		}
+		switch h.(type) {
+		case *luaFunction, *goFunction:
+			return first(L.call(h, []luaValue{obj, key})), true
+		}
+		obj = h
+	}
+	L.errorf("loop in gettable")
+	return nil, false
+}
+
+// settable stores v under key in obj, following __newindex, and reports whether
+// obj can be indexed.
+func (L *luaState) settable(obj, key, v luaValue) bool {
+	for loop := 0; loop < 100; loop++ {
+		var h luaValue
+		if t, ok := obj.(*luaTable); ok {
+			if t.meta == nil || t.get(key) != nil {
+				L.rawset(t, key, v)
+				return true
+			}
+			if h = t.meta.getString("__newindex"); h == nil {
+				L.rawset(t, key, v)
+				return true
+			}
+		} else if h = L.metafield(obj, "__newindex"); h == nil {
+			return false
+		}
+		switch h.(type) {
+		case *luaFunction, *goFunction:
+			L.call(h, []luaValue{obj, key, v})
+			return true
+		}
+		obj = h
+	}
+	L.errorf("loop in settable")
+	return false
+}
+
+func (L *luaState) rawset(t *luaTable, key, v luaValue) {
+	if t.readonly {
+		L.errorf("Attempt to modify a readonly table")
+	}
+	switch k := key.(type) {
+	case nil:
+		L.errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			L.errorf("table index is NaN")
+		}
+	}
+	t.set(key, v)
+}
+
+func first(values []luaValue) luaValue {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// call calls fn with args and returns its results.
+func (L *luaState) call(fn luaValue, args []luaValue) []luaValue {
+	switch f := fn.(type) {
+	case *luaFunction:
+		return L.callLua(f, args)
+	case *goFunction:
+		return f.fn(luaArgs{L, f.name, args})
+	}
+	if h := L.metafield(fn, "__call"); h != nil {
+		return L.call(h, append([]luaValue{fn}, args...))
+	}
+	L.errorf("attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+func (L *luaState) callLua(f *luaFunction, args []luaValue) []luaValue {
+	if L.depth >= luaMaxDepth {
+		L.errorf("stack overflow")
+	}
+	L.depth++
+	L.callLines = append(L.callLines, L.line)
+	L.tick()
+
+	p := f.proto
+	frame := &luaFrame{regs: make([]luaValue, p.nslots), upvals: f.upvals}
+	for i, v := range p.params {
+		var arg luaValue
+		if i < len(args) {
+			arg = args[i]
+		}
+		frame.declare(v, arg)
+	}
+	if p.vararg && len(args) > len(p.params) {
+		frame.varargs = args[len(p.params):]
+	}
+
+	_, results := L.execBlock(frame, p.body)
+
+	L.callLines = L.callLines[:len(L.callLines)-1]
+	L.depth--
+	return results
+}
+
+// closure creates a closure of proto, capturing its upvalues from frame.
+func (L *luaState) closure(frame *luaFrame, proto *funcProto) *luaFunction {
+	f := &luaFunction{proto: proto, upvals: make([]*luaCell, len(proto.upvals))}
+	for i, u := range proto.upvals {
+		if u.fromLocal {
+			f.upvals[i] = frame.regs[u.local.slot].(*luaCell)
+		} else {
+			f.upvals[i] = frame.upvals[u.index]
+		}
+	}
+	return f
+}
+
+// Control flow out of a block.
+const (
+	ctrlNone = iota
+	ctrlBreak
+	ctrlReturn
+)
+
+func (L *luaState) execBlock(f *luaFrame, stmts []luaStmt) (int, []luaValue) {
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *localStmt:
+			values := L.evalN(f, s.exprs, len(s.vars))
+			for i, v := range s.vars {
+				f.declare(v, values[i])
+			}
+
+		case *assignStmt:
+			L.assign(f, s)
+
+		case *callStmt:
+			L.evalCall(f, s.call)
+
+		case *doStmt:
+			if ctrl, results := L.execBlock(f, s.block); ctrl != ctrlNone {
+				return ctrl, results
+			}
+
+		case *whileStmt:
+			for luaTruthy(L.eval(f, s.cond)) {
+				L.tick()
+				ctrl, results := L.execBlock(f, s.block)
+				if ctrl == ctrlBreak {
+					break
+				}
+				if ctrl == ctrlReturn {
+					return ctrl, results
+				}
+			}
+
+		case *repeatStmt:
+			for {
+				L.tick()
+				ctrl, results := L.execBlock(f, s.block)
+				if ctrl == ctrlBreak {
+					break
+				}
+				if ctrl == ctrlReturn {
+					return ctrl, results
+				}
+				if luaTruthy(L.eval(f, s.cond)) {
+					break
+				}
+			}
+
+		case *ifStmt:
+			block := s.elseBlock
+			for i, cond := range s.conds {
+				if luaTruthy(L.eval(f, cond)) {
+					block = s.blocks[i]
+					break
+				}
+			}
+			if ctrl, results := L.execBlock(f, block); ctrl != ctrlNone {
+				return ctrl, results
+			}
+
+		case *numForStmt:
+			if ctrl, results := L.numFor(f, s); ctrl == ctrlReturn {
+				return ctrl, results
+			}
+
+		case *genForStmt:
+			if ctrl, results := L.genFor(f, s); ctrl == ctrlReturn {
+				return ctrl, results
+			}
+
+		case *localFunctionStmt:
+			if s.v.captured {
+				cell := &luaCell{}
+				f.regs[s.v.slot] = cell
+				cell.v = L.closure(f, s.proto)
+			} else {
+				f.regs[s.v.slot] = L.closure(f, s.proto)
+			}
+
+		case *returnStmt:
+			if len(s.exprs) == 1 {
+				if _, ok := s.exprs[0].(*callExpr); ok {
+					return ctrlReturn, L.evalMulti(f, s.exprs[0])
+				}
+			}
+			return ctrlReturn, L.evalList(f, s.exprs)
+
+		case *breakStmt:
+			return ctrlBreak, nil
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (L *luaState) assign(f *luaFrame, s *assignStmt) {
+	// The tables and keys of the targets are evaluated before the values.
+	type target struct {
+		obj, key luaValue
+	}
+	targets := make([]target, len(s.targets))
+	for i, t := range s.targets {
+		if ix, ok := t.(*indexExpr); ok {
+			targets[i] = target{L.eval(f, ix.obj), L.eval(f, ix.key)}
+		}
+	}
+
+	values := L.evalN(f, s.exprs, len(s.targets))
+	for i, t := range s.targets {
+		switch t := t.(type) {
+		case *localExpr:
+			f.set(t.v, values[i])
+		case *upvalExpr:
+			f.upvals[t.idx].v = values[i]
+		case *globalExpr:
+			L.line = t.line
+			L.setGlobal(t.name, values[i])
+		case *indexExpr:
+			L.line = t.line
+			if !L.settable(targets[i].obj, targets[i].key, values[i]) {
+				L.typeError(t.obj, targets[i].obj, "index")
+			}
+		}
+	}
+}
+
+func (L *luaState) numFor(f *luaFrame, s *numForStmt) (int, []luaValue) {
+	L.line = s.line
+	start, ok := luaToNumber(L.eval(f, s.start))
+	if !ok {
+		L.errorf("'for' initial value must be a number")
+	}
+	limit, ok := luaToNumber(L.eval(f, s.limit))
+	if !ok {
+		L.errorf("'for' limit must be a number")
+	}
+	step := 1.0
+	if s.step != nil {
+		if step, ok = luaToNumber(L.eval(f, s.step)); !ok {
+			L.errorf("'for' step must be a number")
+		}
+	}
+
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		L.tick()
+		f.declare(s.v, i)
+		ctrl, results := L.execBlock(f, s.block)
+		if ctrl == ctrlBreak {
+			break
+		}
+		if ctrl == ctrlReturn {
+			return ctrl, results
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (L *luaState) genFor(f *luaFrame, s *genForStmt) (int, []luaValue) {
+	init := L.evalN(f, s.exprs, 3)
+	fn, state, control := init[0], init[1], init[2]
+
+	for {
+		L.tick()
+		L.line = s.line
+		results := L.call(fn, []luaValue{state, control})
+		if len(results) == 0 || results[0] == nil {
+			break
+		}
+		control = results[0]
+		for i, v := range s.vars {
+			var value luaValue
+			if i < len(results) {
+				value = results[i]
+			}
+			f.declare(v, value)
+		}
+		ctrl, results := L.execBlock(f, s.block)
+		if ctrl == ctrlBreak {
+			break
+		}
+		if ctrl == ctrlReturn {
+			return ctrl, results
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (L *luaState) getGlobal(name string) luaValue {
+	v, _ := L.gettable(L.globals, name)
+	return v
+}
+
+func (L *luaState) setGlobal(name string, v luaValue) {
+	L.settable(L.globals, name, v)
+}
+
+// eval evaluates e to a single value.
+func (L *luaState) eval(f *luaFrame, e luaExpr) luaValue {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.v
+	case *localExpr:
+		return f.get(e.v)
+	case *upvalExpr:
+		return f.upvals[e.idx].v
+	case *globalExpr:
+		L.line = e.line
+		return L.getGlobal(e.name)
+	case *indexExpr:
+		obj := L.eval(f, e.obj)
+		key := L.eval(f, e.key)
+		L.line = e.line
+		v, ok := L.gettable(obj, key)
+		if !ok {
+			L.typeError(e.obj, obj, "index")
+		}
+		return v
+	case *callExpr, *methodCallExpr:
+		return first(L.evalCall(f, e))
+	case *varargExpr:
+		return first(f.varargs)
+	case *functionExpr:
+		return L.closure(f, e.proto)
+	case *andExpr:
+		if a := L.eval(f, e.a); !luaTruthy(a) {
+			return a
+		}
+		return L.eval(f, e.b)
+	case *orExpr:
+		if a := L.eval(f, e.a); luaTruthy(a) {
+			return a
+		}
+		return L.eval(f, e.b)
+	case *binopExpr:
+		a, b := L.eval(f, e.a), L.eval(f, e.b)
+		L.line = e.line
+		return L.binop(e, a, b)
+	case *unopExpr:
+		a := L.eval(f, e.a)
+		L.line = e.line
+		return L.unop(e, a)
+	case *parenExpr:
+		return L.eval(f, e.e)
+	case *tableExpr:
+		return L.table(f, e)
+	}
+	panic(fmt.Sprintf("lua: unknown expression %T", e))
+}
+
+// evalMulti evaluates e to all its values: those of a call or of ..., or the
+// single value of any other expression.
+func (L *luaState) evalMulti(f *luaFrame, e luaExpr) []luaValue {
+	switch e := e.(type) {
+	case *callExpr, *methodCallExpr:
+		return L.evalCall(f, e)
+	case *varargExpr:
+		return append([]luaValue(nil), f.varargs...)
+	}
+	return []luaValue{L.eval(f, e)}
+}
+
+// evalList evaluates a list of expressions, the last of which gives all its
+// values.
+func (L *luaState) evalList(f *luaFrame, exprs []luaExpr) []luaValue {
+	if len(exprs) == 0 {
+		return nil
+	}
+	values := make([]luaValue, 0, len(exprs))
+	for _, e := range exprs[:len(exprs)-1] {
+		values = append(values, L.eval(f, e))
+	}
+	return append(values, L.evalMulti(f, exprs[len(exprs)-1])...)
+}
+
+// evalN evaluates a list of expressions to exactly n values, dropping extra
+// ones and padding with nils.
+func (L *luaState) evalN(f *luaFrame, exprs []luaExpr, n int) []luaValue {
+	values := L.evalList(f, exprs)
+	for len(values) < n {
+		values = append(values, nil)
+	}
+	return values[:n]
+}
+
+func (L *luaState) evalCall(f *luaFrame, e luaExpr) []luaValue {
+	var fn luaValue
+	var args []luaValue
+	var fnExpr luaExpr
+	switch e := e.(type) {
+	case *callExpr:
+		fn, fnExpr = L.eval(f, e.fn), e.fn
+		args = L.evalList(f, e.args)
+		L.line = e.line
+	case *methodCallExpr:
+		obj := L.eval(f, e.obj)
+		L.line = e.line
+		v, ok := L.gettable(obj, e.name)
+		if !ok {
+			L.typeError(e.obj, obj, "index")
+		}
+		fn, fnExpr = v, e
+		args = append([]luaValue{obj}, L.evalList(f, e.args)...)
+		L.line = e.line
+	}
+
+	switch fn.(type) {
+	case *luaFunction, *goFunction:
+	default:
+		if L.metafield(fn, "__call") == nil {
+			L.typeError(fnExpr, fn, "call")
+		}
+	}
+	return L.call(fn, args)
+}
+
+// typeError raises the error of an operation on a value of the wrong type,
+// naming the variable holding it, as in "attempt to index global 'x' (a nil
+// value)".
+func (L *luaState) typeError(e luaExpr, v luaValue, op string) {
+	if name := describeExpr(e); name != "" {
+		L.errorf("attempt to %s %s (a %s value)", op, name, luaTypeName(v))
+	}
+	L.errorf("attempt to %s a %s value", op, luaTypeName(v))
+}
+
+func describeExpr(e luaExpr) string {
+	switch e := e.(type) {
+	case *globalExpr:
+		return fmt.Sprintf("global '%s'", e.name)
+	case *localExpr:
+		return fmt.Sprintf("local '%s'", e.v.name)
+	case *upvalExpr:
+		return fmt.Sprintf("upvalue '%s'", e.name)
+	case *methodCallExpr:
+		return fmt.Sprintf("method '%s'", e.name)
+	case *indexExpr:
+		if c, ok := e.key.(*constExpr); ok {
+			if s, ok := c.v.(string); ok {
+				return fmt.Sprintf("field '%s'", s)
+			}
+		}
+	}
+	return ""
+}
+
+func (L *luaState) table(f *luaFrame, e *tableExpr) *luaTable {
+	t := newLuaTable(0, 0)
+	var items []luaValue
+	for i, item := range e.items {
+		if item.key != nil {
+			k := L.eval(f, item.key)
+			v := L.eval(f, item.value)
+			L.line = e.line
+			L.rawset(t, k, v)
+			continue
+		}
+		if i == len(e.items)-1 {
+			items = append(items, L.evalMulti(f, item.value)...)
+			continue
+		}
+		items = append(items, L.eval(f, item.value))
+	}
+	t.setArray(items)
+	return t
+}
+
+var luaArithEvents = map[int]string{
+	'+': "__add", '-': "__sub", '*': "__mul", '/': "__div", '%': "__mod", '^': "__pow",
+}
+
+func (L *luaState) binop(e *binopExpr, a, b luaValue) luaValue {
+	switch e.op {
+	case '+', '-', '*', '/', '%', '^':
+		return L.arith(e, a, b)
+	case tokConcat:
+		return L.concat(e, a, b)
+	case tokEq:
+		return L.equal(a, b)
+	case tokNe:
+		return !L.equal(a, b)
+	case '<':
+		return L.less(a, b)
+	case '>':
+		return L.less(b, a)
+	case tokLe:
+		return L.lessEqual(a, b)
+	case tokGe:
+		return L.lessEqual(b, a)
+	}
+	panic(fmt.Sprintf("lua: unknown operator %d", e.op))
+}
+
+func arith(op int, x, y float64) float64 {
+	switch op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	case '/':
+		return x / y
+	case '%':
+		return x - math.Floor(x/y)*y
+	}
+	return math.Pow(x, y)
+}
+
+func (L *luaState) arith(e *binopExpr, a, b luaValue) luaValue {
+	x, okA := luaToNumber(a)
+	y, okB := luaToNumber(b)
+	if okA && okB {
+		return arith(e.op, x, y)
+	}
+	if h := L.binaryMetamethod(a, b, luaArithEvents[e.op]); h != nil {
+		return first(L.call(h, []luaValue{a, b}))
+	}
+	if okA {
+		L.typeError(e.b, b, "perform arithmetic on")
+	}
+	L.typeError(e.a, a, "perform arithmetic on")
+	return nil
+}
+
+func (L *luaState) binaryMetamethod(a, b luaValue, event string) luaValue {
+	if h := L.metafield(a, event); h != nil {
+		return h
+	}
+	return L.metafield(b, event)
+}
+
+func (L *luaState) concat(e *binopExpr, a, b luaValue) luaValue {
+	x, okA := luaToString(a)
+	y, okB := luaToString(b)
+	if okA && okB {
+		if len(x)+len(y) > luaMaxString {
+			L.errorf("string length overflow")
+		}
+		return x + y
+	}
+	if h := L.binaryMetamethod(a, b, "__concat"); h != nil {
+		return first(L.call(h, []luaValue{a, b}))
+	}
+	if okA {
+		L.typeError(e.b, b, "concatenate")
+	}
+	L.typeError(e.a, a, "concatenate")
+	return nil
+}
+
+// rawEqual compares two values without metamethods.
+func rawEqual(a, b luaValue) bool {
+	return a == b
+}
+
+func (L *luaState) equal(a, b luaValue) bool {
+	if a == b {
+		return true
+	}
+	ta, ok1 := a.(*luaTable)
+	tb, ok2 := b.(*luaTable)
+	if !ok1 || !ok2 || ta.meta == nil || tb.meta == nil {
+		return false
+	}
+	h := ta.meta.getString("__eq")
+	if h == nil || h != tb.meta.getString("__eq") {
+		return false
+	}
+	return luaTruthy(first(L.call(h, []luaValue{a, b})))
+}
+
+func (L *luaState) less(a, b luaValue) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	if h := L.orderMetamethod(a, b, "__lt"); h != nil {
+		return luaTruthy(first(L.call(h, []luaValue{a, b})))
+	}
+	L.compareError(a, b)
+	return false
+}
+
+func (L *luaState) lessEqual(a, b luaValue) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x <= y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x <= y
+		}
+	}
+	if h := L.orderMetamethod(a, b, "__le"); h != nil {
+		return luaTruthy(first(L.call(h, []luaValue{a, b})))
+	}
+	if h := L.orderMetamethod(a, b, "__lt"); h != nil {
+		return !luaTruthy(first(L.call(h, []luaValue{b, a})))
+	}
+	L.compareError(a, b)
+	return false
+}
+
+// orderMetamethod returns the metamethod comparing a and b, which both need to
+// have.
+func (L *luaState) orderMetamethod(a, b luaValue, event string) luaValue {
+	if luaTypeName(a) != luaTypeName(b) {
+		return nil
+	}
+	h := L.metafield(a, event)
+	if h == nil || h != L.metafield(b, event) {
+		return nil
+	}
+	return h
+}
+
+func (L *luaState) compareError(a, b luaValue) {
+	ta, tb := luaTypeName(a), luaTypeName(b)
+	if ta == tb {
+		L.errorf("attempt to compare two %s values", ta)
+	}
+	L.errorf("attempt to compare %s with %s", ta, tb)
+}
+
+func (L *luaState) unop(e *unopExpr, a luaValue) luaValue {
+	switch e.op {
+	case tokNot:
+		return !luaTruthy(a)
+	case '-':
+		if x, ok := luaToNumber(a); ok {
+			return -x
+		}
+		if h := L.metafield(a, "__unm"); h != nil {
+			return first(L.call(h, []luaValue{a, a}))
+		}
+		L.typeError(e.a, a, "perform arithmetic on")
+	case '#':
+		switch v := a.(type) {
+		case string:
+			return float64(len(v))
+		case *luaTable:
+			return float64(v.length())
+		}
+		L.typeError(e.a, a, "get length of")
+	}
+	return nil
+}
+
+// tostring converts v to a string as the tostring function does, using the
+// __tostring metamethod.
+func (L *luaState) tostring(v luaValue) string {
+	if h := L.metafield(v, "__tostring"); h != nil {
+		s, ok := first(L.call(h, []luaValue{v})).(string)
+		if !ok {
+			L.errorf("'__tostring' must return a string")
+		}
+		return s
+	}
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return luaNumberString(v)
+	case string:
+		return v
+	case *luaUserdata:
+		return fmt.Sprintf("userdata: %p", v)
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
@@ -0,0 +1,268 @@
+package redis
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the command latency histograms. Commands
+// on an in-memory keyspace mostly take microseconds, so the buckets start there.
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// commandStat holds the calls and latency histogram of one command. Its fields
+// are accessed atomically.
+type commandStat struct {
+	calls   uint64
+	usec    uint64
+	buckets [len(latencyBuckets)]uint64 // calls per bucket, not cumulative
+}
+
+func (c *commandStat) record(took time.Duration) {
+	atomic.AddUint64(&c.calls, 1)
+	atomic.AddUint64(&c.usec, uint64(took/time.Microsecond))
+	for i, bound := range latencyBuckets {
+		if took <= bound {
+			atomic.AddUint64(&c.buckets[i], 1)
+			break
+		}
+	}
+}
+
+func (c *commandStat) load() (calls, usec uint64) {
+	return atomic.LoadUint64(&c.calls), atomic.LoadUint64(&c.usec)
+}
+
+var publishExpvarOnce sync.Once
+
+// MetricsHandler returns an http.Handler that serves the package's metrics for
+// Prometheus to scrape: command calls and latency histograms, keys by type, memory,
+// pub/sub subscriptions and their queue depths, snapshots, and expired and evicted
+// keys. Scrapers that ask for application/openmetrics-text get the OpenMetrics
+// format, others the Prometheus text format.
+//
+//	http.Handle("/metrics", redis.MetricsHandler())
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		}
+
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, openMetrics)
+		bw.Flush()
+	})
+}
+
+// PublishExpvar publishes the package's metrics as the expvar variable "redis",
+// served with the other expvars on /debug/vars. Calling it more than once has no
+// further effect.
+func PublishExpvar() {
+	publishExpvarOnce.Do(func() {
+		expvar.Publish("redis", expvar.Func(func() interface{} {
+			return metricsMap()
+		}))
+	})
+}
+
+// metricsWriter writes metric families in the Prometheus text or OpenMetrics
+// format, which differ in how counters are named and how the exposition ends.
+type metricsWriter struct {
+	w           *bufio.Writer
+	openMetrics bool
+}
+
+// family writes the HELP and TYPE lines of a metric. Counter samples are named
+// with a _total suffix, which OpenMetrics leaves out of the family name.
+func (m metricsWriter) family(name, typ, help string) {
+	if typ == "counter" && m.openMetrics {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m metricsWriter) sample(name, labels string, value interface{}) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(m.w, "%s%s %v\n", name, labels, value)
+}
+
+func (m metricsWriter) single(name, typ, help string, value interface{}) {
+	m.family(name, typ, help)
+	m.sample(name, "", value)
+}
+
+func writeMetrics(w *bufio.Writer, openMetrics bool) {
+	m := metricsWriter{w: w, openMetrics: openMetrics}
+
+	names, stats := sortedCommandStats()
+	m.family("redis_commands_total", "counter", "Number of calls per command.")
+	for i, name := range names {
+		calls, _ := stats[i].load()
+		m.sample("redis_commands_total", fmt.Sprintf("cmd=%q", name), calls)
+	}
+	m.family("redis_command_duration_seconds", "histogram", "Latency of commands.")
+	for i, name := range names {
+		var cumulative uint64
+		for b, bound := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&stats[i].buckets[b])
+			m.sample("redis_command_duration_seconds_bucket", fmt.Sprintf("cmd=%q,le=\"%g\"", name, bound.Seconds()), cumulative)
+		}
+		calls, usec := stats[i].load()
+		m.sample("redis_command_duration_seconds_bucket", fmt.Sprintf("cmd=%q,le=\"+Inf\"", name), calls)
+		m.sample("redis_command_duration_seconds_sum", fmt.Sprintf("cmd=%q", name), float64(usec)/1e6)
+		m.sample("redis_command_duration_seconds_count", fmt.Sprintf("cmd=%q", name), calls)
+	}
+
+	counts := typeCounts()
+	m.family("redis_keys", "gauge", "Number of keys by type.")
+	for _, typeName := range []string{"hash", "list", "set", "string"} {
+		m.sample("redis_keys", fmt.Sprintf("type=%q", typeName), counts[typeName])
+	}
+	volatile := 0
+	for _, s := range shards {
+		s.mu.RLock()
+		volatile += len(s.volatile)
+		s.mu.RUnlock()
+	}
+	m.single("redis_expiring_keys", "gauge", "Number of keys with a timeout.", volatile)
+	m.single("redis_keyspace_hits_total", "counter", "Lookups of existing keys by read commands.", atomic.LoadUint64(&keyspaceHits))
+	m.single("redis_keyspace_misses_total", "counter", "Lookups of missing keys by read commands.", atomic.LoadUint64(&keyspaceMisses))
+	m.single("redis_expired_keys_total", "counter", "Keys deleted because their timeout passed.", atomic.LoadUint64(&expiredKeys))
+	m.single("redis_evicted_keys_total", "counter", "Keys evicted to stay within maxmemory.", atomic.LoadUint64(&evictedKeys))
+	m.single("redis_error_replies_total", "counter", "Commands that failed with an error reply.", atomic.LoadUint64(&errorReplies))
+
+	maxmemoryMu.RLock()
+	limit := maxmemory
+	maxmemoryMu.RUnlock()
+	m.single("redis_memory_used_bytes", "gauge", "Approximate memory used by the keyspace.", UsedMemory())
+	m.single("redis_memory_peak_bytes", "gauge", "Peak approximate memory used by the keyspace.", atomic.LoadInt64(&peakMemory))
+	m.single("redis_memory_max_bytes", "gauge", "The maxmemory limit, 0 for none.", limit)
+
+	consumerMu.RLock()
+	subs := consumers
+	consumerMu.RUnlock()
+	m.single("redis_pubsub_subscriptions", "gauge", "Number of open subscriptions.", len(subs))
+	m.family("redis_pubsub_pending_messages", "gauge", "Messages waiting in each subscription's channel.")
+	for _, s := range subs {
+		m.sample("redis_pubsub_pending_messages", fmt.Sprintf("subscription=\"%d\"", s.ID()), s.Pending())
+	}
+	m.single("redis_pubsub_messages_total", "counter", "Messages and change events published.", atomic.LoadUint64(&publishCount))
+	m.single("redis_pubsub_dropped_messages_total", "counter", "Messages dropped by slow consumer policies.", atomic.LoadUint64(&droppedMessages))
+	m.single("redis_pubsub_slow_disconnects_total", "counter", "Subscriptions closed for not keeping up.", atomic.LoadUint64(&slowDisconnects))
+
+	saveMu.Lock()
+	count, failures, took, last := saves, saveFailures, saveDuration, lastSaveDuration
+	lastOK := lastSave
+	saveMu.Unlock()
+	m.family("redis_rdb_save_duration_seconds", "summary", "Time taken by snapshots.")
+	m.sample("redis_rdb_save_duration_seconds_sum", "", took.Seconds())
+	m.sample("redis_rdb_save_duration_seconds_count", "", count)
+	m.single("redis_rdb_last_save_duration_seconds", "gauge", "Time taken by the last snapshot.", last.Seconds())
+	m.single("redis_rdb_save_failures_total", "counter", "Snapshots that failed.", failures)
+	m.single("redis_rdb_last_save_timestamp_seconds", "gauge", "Unix time of the last successful snapshot.", lastOK.Unix())
+	m.single("redis_rdb_changes_since_last_save", "gauge", "Changes not yet in a snapshot.", dirtyCount()-atomic.LoadUint64(&dirtyAtSave))
+
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
+
+// metricsMap returns the metrics published with PublishExpvar.
+func metricsMap() map[string]interface{} {
+	commands := make(map[string]interface{})
+	names, stats := sortedCommandStats()
+	for i, name := range names {
+		calls, usec := stats[i].load()
+		commands[name] = map[string]uint64{"calls": calls, "usec": usec}
+	}
+
+	subscriptions := make(map[string]int)
+	consumerMu.RLock()
+	for _, s := range consumers {
+		subscriptions[fmt.Sprint(s.ID())] = s.Pending()
+	}
+	consumerMu.RUnlock()
+
+	saveMu.Lock()
+	snapshots := map[string]interface{}{
+		"saves":                 saves,
+		"failures":              saveFailures,
+		"duration_seconds":      saveDuration.Seconds(),
+		"last_duration_seconds": lastSaveDuration.Seconds(),
+		"last_save":             lastSave.Unix(),
+	}
+	saveMu.Unlock()
+
+	return map[string]interface{}{
+		"commands":           commands,
+		"keys":               typeCounts(),
+		"keyspace_hits":      atomic.LoadUint64(&keyspaceHits),
+		"keyspace_misses":    atomic.LoadUint64(&keyspaceMisses),
+		"expired_keys":       atomic.LoadUint64(&expiredKeys),
+		"evicted_keys":       atomic.LoadUint64(&evictedKeys),
+		"error_replies":      atomic.LoadUint64(&errorReplies),
+		"used_memory":        UsedMemory(),
+		"pending_messages":   subscriptions,
+		"published_messages": atomic.LoadUint64(&publishCount),
+		"dropped_messages":   atomic.LoadUint64(&droppedMessages),
+		"slow_disconnects":   atomic.LoadUint64(&slowDisconnects),
+		"snapshots":          snapshots,
+		"changes_since_save": dirtyCount() - atomic.LoadUint64(&dirtyAtSave),
+		"commands_processed": atomic.LoadUint64(&totalCommands),
+	}
+}
+
+// sortedCommandStats returns the names of the commands called so far, sorted,
+// and their stats.
+func sortedCommandStats() (names []string, stats []*commandStat) {
+	byName := make(map[string]*commandStat)
+	commandStats.Range(func(name, stat interface{}) bool {
+		names = append(names, name.(string))
+		byName[name.(string)] = stat.(*commandStat)
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		stats = append(stats, byName[name])
+	}
+	return
+}
+
+// typeCounts returns the number of keys of each type. Keys that expired but were
+// not deleted yet are included, as in Redis's DBSIZE.
+func typeCounts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, s := range shards {
+		s.mu.RLock()
+		for _, e := range s.entries {
+			counts[e.typ.String()]++
+		}
+		s.mu.RUnlock()
+	}
+
+	return counts
+}
@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMonitorBufferSize = 1000
+
+// MonitorEvent is a command executed while a monitor was open.
+type MonitorEvent struct {
+	// Time is when the command started.
+	Time time.Time
+	// DB is the database the command ran against, always 0.
+	DB int
+	// Client identifies who ran the command. With no network server in front of
+	// the package, it is the file and line of the code outside the package that
+	// called the command.
+	Client string
+	// Args are the command name and its arguments.
+	Args []string
+}
+
+// String formats the event as a line of Redis's MONITOR output, such as
+//
+//	1339518083.107412 [0 main.go:42] "keys" "*"
+func (e MonitorEvent) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [%d %s]", e.Time.Unix(), e.Time.Nanosecond()/1000, e.DB, e.Client)
+	for _, arg := range e.Args {
+		b.WriteByte(' ')
+		b.WriteString(reprString(arg))
+	}
+	return b.String()
+}
+
+// CommandMonitor streams every command executed to its Channel, in the order they
+// started, until it is closed. A monitor that does not keep up misses commands
+// rather than slowing them down; Dropped counts them.
+type CommandMonitor struct {
+	closeOnce sync.Once
+	sendMu    sync.Mutex
+	closed    bool
+	dropped   uint64
+
+	Channel chan MonitorEvent
+}
+
+var (
+	monitors   []*CommandMonitor
+	monitorsMu sync.Mutex
+
+	// monitorCount lets commands skip building events when nobody monitors.
+	monitorCount int32
+
+	// packagePrefix is the prefix of the function names of this package, used to
+	// find the caller of a command outside of it.
+	packagePrefix = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(reprString).Pointer()).Name(), "reprString")
+)
+
+// MONITOR is a debugging command that streams back every command processed by the
+// Redis server. It can help in understanding what is happening to the database.
+//
+// The package has no network server yet, so commands are streamed to the returned
+// monitor's Channel rather than over a connection; MonitorEvent.String formats them
+// the way MONITOR does on the wire.
+func Monitor() *CommandMonitor {
+	defer call("monitor")()
+
+	m := &CommandMonitor{Channel: make(chan MonitorEvent, defaultMonitorBufferSize)}
+
+	monitorsMu.Lock()
+	monitors = append(append([]*CommandMonitor(nil), monitors...), m)
+	atomic.StoreInt32(&monitorCount, int32(len(monitors)))
+	monitorsMu.Unlock()
+
+	return m
+}
+
+// Close stops the monitor and closes its Channel. It is safe to call more than
+// once.
+func (m *CommandMonitor) Close() error {
+	m.closeOnce.Do(func() {
+		monitorsMu.Lock()
+		remaining := make([]*CommandMonitor, 0, len(monitors))
+		for _, other := range monitors {
+			if other != m {
+				remaining = append(remaining, other)
+			}
+		}
+		monitors = remaining
+		atomic.StoreInt32(&monitorCount, int32(len(monitors)))
+		monitorsMu.Unlock()
+
+		m.sendMu.Lock()
+		m.closed = true
+		close(m.Channel)
+		m.sendMu.Unlock()
+	})
+	return nil
+}
+
+// Dropped returns the number of commands the monitor missed because its Channel
+// was full.
+func (m *CommandMonitor) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// feedMonitors sends a command to every open monitor. Like Redis, MONITOR itself is
+// not shown.
+// monitored reports whether a monitor is attached, for commands to build the
+// arguments it receives.
+func monitored() bool {
+	return atomic.LoadInt32(&monitorCount) > 0
+}
+
+func feedMonitors(start time.Time, name string, args []string) {
+	if atomic.LoadInt32(&monitorCount) == 0 || name == "monitor" {
+		return
+	}
+
+	ev := MonitorEvent{
+		Time:   start,
+		Client: callerOutsidePackage(),
+		Args:   append(strings.Split(name, "|"), args...),
+	}
+
+	monitorsMu.Lock()
+	local := monitors
+	monitorsMu.Unlock()
+
+	for _, m := range local {
+		m.sendMu.Lock()
+		if !m.closed {
+			select {
+			case m.Channel <- ev:
+			default:
+				atomic.AddUint64(&m.dropped, 1)
+			}
+		}
+		m.sendMu.Unlock()
+	}
+}
+
+// callerOutsidePackage returns the file and line of the innermost caller that is
+// not part of this package.
+func callerOutsidePackage() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePrefix) || strings.HasSuffix(frame.File, "_test.go") {
+			file := frame.File
+			if i := strings.LastIndexByte(file, '/'); i >= 0 {
+				file = file[i+1:]
+			}
+			return fmt.Sprintf("%s:%d", file, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// reprString quotes s the way Redis does in MONITOR output, escaping quotes,
+// backslashes and non-printable bytes.
+func reprString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
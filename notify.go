@@ -0,0 +1,166 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Keyspace notification classes, one per notify-keyspace-events flag.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyModule               // d
+	notifyKeyMiss              // m
+	notifyNew                  // n
+
+	// notifyAll is the A flag. Like Redis it does not include key-miss and new
+	// key events, which have to be asked for explicitly.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// notifyFlagChars lists the class flags in the order Redis reports them.
+var notifyFlagChars = []struct {
+	char  byte
+	class int32
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'d', notifyModule},
+}
+
+// notifyFlags holds the enabled notification classes. Notifications are off by
+// default, as in Redis, since they cost a message per write.
+var notifyFlags int32
+
+// SetNotifyKeyspaceEvents selects which keyspace events are published, using the
+// flags of Redis's notify-keyspace-events setting:
+//
+//	K     Keyspace events, published with __keyspace@<db>__ prefix.
+//	E     Keyevent events, published with __keyevent@<db>__ prefix.
+//	g     Generic commands (non-type specific) like DEL, EXPIRE, PERSIST, ...
+//	$     String commands
+//	l     List commands
+//	s     Set commands
+//	h     Hash commands
+//	z     Sorted set commands
+//	t     Stream commands
+//	d     Module key type events
+//	x     Expired events (events generated every time a key expires)
+//	e     Evicted events (events generated when a key is evicted for maxmemory)
+//	m     Key miss events (events generated when a key that doesn't exist is accessed)
+//	n     New key events (Note: not included in the 'A' class)
+//	A     Alias for "g$lshzxetd", so that the "AKE" string means all the events except "m" and "n".
+//
+// At least one of K or E must be present for anything to be published. An empty
+// string disables notifications.
+func SetNotifyKeyspaceEvents(flags string) error {
+	var parsed int32
+
+	for i := 0; i < len(flags); i++ {
+		switch c := flags[i]; c {
+		case 'A':
+			parsed |= notifyAll
+		case 'K':
+			parsed |= notifyKeyspace
+		case 'E':
+			parsed |= notifyKeyevent
+		case 'm':
+			parsed |= notifyKeyMiss
+		case 'n':
+			parsed |= notifyNew
+		default:
+			class := int32(0)
+			for _, f := range notifyFlagChars {
+				if f.char == c {
+					class = f.class
+				}
+			}
+			if class == 0 {
+				return fmt.Errorf("redis: invalid keyspace event flag %q", c)
+			}
+			parsed |= class
+		}
+	}
+
+	atomic.StoreInt32(&notifyFlags, parsed)
+	return nil
+}
+
+// GetNotifyKeyspaceEvents returns the enabled keyspace event flags, in the form
+// SetNotifyKeyspaceEvents accepts.
+func GetNotifyKeyspaceEvents() string {
+	flags := atomic.LoadInt32(&notifyFlags)
+
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, f := range notifyFlagChars {
+			if flags&f.class != 0 {
+				b.WriteByte(f.char)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	if flags&notifyKeyMiss != 0 {
+		b.WriteByte('m')
+	}
+	if flags&notifyNew != 0 {
+		b.WriteByte('n')
+	}
+
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes event on key to the __keyspace@0__:<key> channel,
+// with the event name as payload, and to the __keyevent@0__:<event> channel, with
+// the key name as payload, when class and the respective K or E flag are enabled.
+// typeName is the type of the key the event happened to.
+func notifyKeyspaceEvent(class int32, typeName, event, key string) {
+	flags := atomic.LoadInt32(&notifyFlags)
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&notifyKeyspace != 0 {
+		publish(ChangeEvent{
+			TypeName: typeName,
+			KeyName:  key,
+			Data:     event,
+			Channel:  "__keyspace@0__:" + key,
+			Op:       event,
+		})
+	}
+	if flags&notifyKeyevent != 0 {
+		publish(ChangeEvent{
+			TypeName: typeName,
+			KeyName:  key,
+			Data:     key,
+			Channel:  "__keyevent@0__:" + event,
+			Op:       event,
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package redis
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the internal encoding of the value stored at key.
+//
+// Objects can be encoded in different ways:
+//
+//	Strings can be encoded as raw (normal string encoding), int (strings
+//	representing integers in a 64 bit signed interval) or embstr (strings of up
+//	to 44 bytes).
+//	Lists can be encoded as listpack, the compact encoding of short lists, or
+//	quicklist.
+//	Sets can be encoded as intset, for small sets composed solely of integers,
+//	listpack, for small sets, or hashtable.
+//	Hashes can be encoded as listpack, for small hashes, or hashtable.
+//
+// Values move to the general encodings as they outgrow the thresholds set by
+// SetListMaxListpackSize, SetSetMaxIntsetEntries, SetSetMaxListpackEntries,
+// SetSetMaxListpackValue, SetHashMaxListpackEntries and SetHashMaxListpackValue.
+//
+// Return value
+// Bulk string reply: the encoding of the object, or nil if the key doesn't exist.
+func ObjectEncoding(key string) string {
+	defer call("object|encoding", key)()
+
+	expireIfNeeded(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return ""
+	}
+
+	switch v := e.value.(type) {
+	case string:
+		if _, isInt := intsetValue(v); isInt {
+			return "int"
+		}
+		if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case interface{ encoding() string }:
+		return v.encoding()
+	}
+	return ""
+}
+
+// Returns the number of seconds since the object stored at the specified key was
+// last accessed by a command. OBJECT itself does not count as an access.
+//
+// Return value
+// Integer reply: the idle time in seconds, or -1 if the key doesn't exist.
+func ObjectIdletime(key string) int {
+	defer call("object|idletime", key)()
+
+	info, ok := objectInfo(key)
+	if !ok {
+		return -1
+	}
+	return int(timeSince(time.Unix(0, atomic.LoadInt64(&info.lastAccess))) / time.Second)
+}
+
+// Returns the logarithmic access frequency counter of the object stored at the
+// specified key, the value the LFU eviction policies compare. Unlike Redis, the
+// counter is maintained whatever the maxmemory policy.
+//
+// Return value
+// Integer reply: the counter's value, or -1 if the key doesn't exist.
+func ObjectFreq(key string) int {
+	defer call("object|freq", key)()
+
+	info, ok := objectInfo(key)
+	if !ok {
+		return -1
+	}
+	return int(info.lfuDecrement(timeNow().UnixNano()))
+}
+
+// Returns the reference count of the object stored at the specified key. Values
+// are never shared between keys, so this is always 1.
+//
+// Return value
+// Integer reply: the number of references, or -1 if the key doesn't exist.
+func ObjectRefcount(key string) int {
+	defer call("object|refcount", key)()
+
+	if _, ok := objectInfo(key); !ok {
+		return -1
+	}
+	return 1
+}
+
+// objectInfo returns the metadata of key for the OBJECT commands, which don't
+// count as accesses.
+func objectInfo(key string) (*keyInfo, bool) {
+	expireIfNeeded(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return &e.keyInfo, true
+}
+
+// The MEMORY USAGE command reports the number of bytes that a key and its value
+// require to be stored in RAM.
+//
+// The reported usage is the total of memory allocations for data and
+// administrative overheads that a key and its value require.
+//
+// For nested data types, the optional SAMPLES option can be provided, where count
+// is the number of sampled nested values. The samples are averaged to estimate the
+// total size. By default, this option is set to 5. To sample all of the
+// nested values, use SAMPLES 0.
+//
+// Return value
+// Integer reply: the memory usage in bytes, or 0 when the key does not exist. As
+// every key takes some memory, 0 only ever means the key does not exist.
+func MemoryUsage(key string, samples int) int64 {
+	defer callKey("memory|usage", key, func() []string { return []string{"SAMPLES", strconv.Itoa(samples)} })()
+
+	expireIfNeeded(key)
+
+	s := shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return 0
+	}
+	return keyOverhead + int64(len(key)) + e.valueSize(samples)
+}
+
+// The MEMORY STATS command returns a map about the memory usage of the keyspace:
+//
+//	peak.allocated      Peak memory used by the keyspace, in bytes
+//	total.allocated     Memory currently used by the keyspace, in bytes
+//	overhead.total      Memory used by keys and per-key bookkeeping
+//	keys.count          The total number of keys
+//	keys.bytes-per-key  The ratio between total.allocated and keys.count
+//	dataset.bytes       The size of the values, total.allocated minus overhead.total
+//	expires.count       The number of keys with a timeout set
+//
+// As for UsedMemory, these are estimates based on the size of keys and values
+// rather than what the Go runtime allocated.
+//
+// Return value
+// Map reply: memory usage metrics and their values.
+func MemoryStats() map[string]int64 {
+	defer call("memory|stats")()
+
+	stats := make(map[string]int64)
+
+	for _, s := range shards {
+		s.mu.RLock()
+		for key := range s.entries {
+			stats["overhead.total"] += keyOverhead + int64(len(key))
+		}
+		stats["keys.count"] += int64(len(s.entries))
+		stats["expires.count"] += int64(len(s.volatile))
+		s.mu.RUnlock()
+	}
+
+	stats["peak.allocated"] = atomic.LoadInt64(&peakMemory)
+	stats["total.allocated"] = UsedMemory()
+	stats["dataset.bytes"] = stats["total.allocated"] - stats["overhead.total"]
+	if stats["keys.count"] > 0 {
+		stats["keys.bytes-per-key"] = stats["total.allocated"] / stats["keys.count"]
+	}
+
+	return stats
+}
+
+// valueSize estimates the size of the entry's value, without the per-key
+// overhead. For lists, sets and hashes the size of up to samples elements is
+// extrapolated to the whole value; samples 0 measures all of them. The caller
+// holds the entry's shard lock.
+func (e *entry) valueSize(samples int) int64 {
+	var size, measured, total int64
+	measure := func(n int) bool {
+		size += elemOverhead + int64(n)
+		measured++
+		return samples <= 0 || measured < int64(samples)
+	}
+
+	switch v := e.value.(type) {
+	case string:
+		return int64(len(v))
+	case *intset:
+		return int64(8 * v.len())
+	case *listpackList:
+		return int64(v.bytes + listpackEntryOverhead*v.len())
+	case *listpackSet:
+		size := 0
+		for _, m := range v.members {
+			size += len(m) + listpackEntryOverhead
+		}
+		return int64(size)
+	case *listpackHash:
+		size := 0
+		for _, entry := range v.entries {
+			size += len(entry) + listpackEntryOverhead
+		}
+		return int64(size)
+	case listValue:
+		total = int64(v.len())
+		v.each(func(elem string) bool {
+			return measure(len(elem))
+		})
+	case setValue:
+		total = int64(v.len())
+		v.each(func(m string) bool {
+			return measure(len(m))
+		})
+	case hashValue:
+		total = int64(v.len())
+		v.each(func(field, value string) bool {
+			return measure(len(field) + len(value))
+		})
+	}
+
+	if measured == 0 {
+		return 0
+	}
+	return size * total / measured
+}
@@ -1,26 +1,146 @@
 package redis
 
 import (
+	"context"
 	"regexp"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-type notice struct {
+// ChangeEvent describes one change to the keyspace, as delivered to
+// subscriptions whose patterns match the key name. Messages published to a
+// channel, including keyspace notifications, are delivered as ChangeEvents too,
+// with Channel set and Data holding the message payload.
+type ChangeEvent struct {
+	// TypeName is the type of the key: "hash", "list", "set" or "string".
 	TypeName, KeyName, FieldName string
-	Data                         interface{}
+
+	// Data is the value of the key after the change: a Hash, List, []string
+	// (for sets) or string, or nil when the key was removed.
+	Data interface{}
+
+	// Channel is set on messages published to a pub/sub channel, such as keyspace
+	// notifications, and Data then holds the message payload. Change events
+	// leave it empty.
+	Channel string
+
+	// Op names the change, using the keyspace notification event names:
+	// "set", "incrby", "decrby", "hset", "hdel", "lpush", "rpush", "lpop",
+	// "rpop", "sadd", "del", "expired" and so on.
+	Op string
+
+	// DB is the database the key belongs to. The package has only database 0.
+	DB int
+
+	// Seq numbers change events in the order they were made, starting at 1. It
+	// is zero on channel messages. Subscriptions receive the changes to a key in
+	// Seq order; those to different keys may arrive out of order.
+	Seq uint64
+
+	// Time is when the event was published.
+	Time time.Time
+
+	// OldValue and NewValue, when set, hold the part of the key that changed,
+	// before and after the change: a field value for hash commands, the whole
+	// string for string commands, the pushed or added elements for RPUSH and
+	// SADD, and the removed value, shaped like Data, for deletes.
+	OldValue, NewValue interface{}
 }
 
-type consumer struct {
-	exps    []*regexp.Regexp
-	Channel chan notice
+// SlowConsumerPolicy decides what happens to a message for a subscription whose
+// Channel is full because its reader is not keeping up.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest buffered message to make room, so the
+	// reader always sees the most recent changes. This is the default.
+	DropOldest SlowConsumerPolicy = iota
+
+	// DropNewest discards the message being published.
+	DropNewest
+
+	// Disconnect closes the subscription, like Redis's client-output-buffer-limit
+	// for pubsub clients. It also applies the soft limit of SubscriptionOptions.
+	Disconnect
+
+	// Block makes the publishing writer wait until the reader makes room. The
+	// writer holds the lock of the shard of the key it changed, so a stalled
+	// reader stalls every write to the keys of that shard, whether it matches
+	// them or not; use it only for readers that are guaranteed to keep up.
+	Block
+)
+
+// SubscriptionOptions configure how a subscription is buffered and what happens
+// when its reader falls behind.
+type SubscriptionOptions struct {
+	// Context closes the subscription when it is done. Nil means never.
+	Context context.Context
+
+	// BufferSize is the capacity of Channel, and therefore the hard limit on
+	// messages waiting for the reader. Defaults to 1000.
+	BufferSize int
+
+	// Policy applies once Channel is full.
+	Policy SlowConsumerPolicy
+
+	// With the Disconnect policy, the subscription is also closed once at least
+	// SoftLimit messages have been waiting for SoftLimitDuration. A zero
+	// SoftLimit disables the soft limit.
+	SoftLimit         int
+	SoftLimitDuration time.Duration
+
+	// Regexp makes patterns unanchored regular expressions, as Psubscribe took
+	// before it matched glob-style patterns like Redis.
+	Regexp bool
+}
+
+// Subscription is a set of channel and pattern subscriptions, whose messages
+// and change events are delivered on Channel. Once the subscription is closed,
+// it receives nothing more and Channel is closed.
+type Subscription struct {
+	mu       sync.Mutex
+	exps     []*regexp.Regexp
+	patterns []string
+	channels map[string]bool
+
+	// sendMu is held while a message is delivered to Channel, so deliveries to
+	// a subscription are ordered and Close can wait for an in-flight send
+	// before closing it.
+	sendMu    sync.Mutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	softSince time.Time
+
+	id      uint64
+	opts    SubscriptionOptions
+	dropped uint64
+
+	Channel chan ChangeEvent
 }
 
+const defaultSubscriptionBufferSize = 1000
+
 var (
-	publish      = make(chan notice, 1000)
-	consumers    []consumer
-	consumerMu   sync.RWMutex
-	publishCount uint64 = 0
+	consumers       []*Subscription
+	consumerMu      sync.RWMutex
+	consumerList    atomic.Value // consumers, stored whenever it changes
+	publishCount    uint64       = 0
+	subscriptionIDs uint64
+
+	// changeSeq numbers change events, without a lock, so writers to keys of
+	// different shards number, log and deliver theirs concurrently. A
+	// subscription sees the changes to a key in Seq order, as writers to a key
+	// hold the lock of its shard, but changes to keys of different shards may
+	// arrive out of Seq order.
+	changeSeq uint64
+
+	// droppedMessages and slowDisconnects count, across all subscriptions, the
+	// messages lost and the subscriptions closed for not keeping up.
+	droppedMessages uint64
+	slowDisconnects uint64
 )
 
 // Subscribes the client to the given patterns.
@@ -29,38 +149,470 @@ var (
 // h*llo subscribes to hllo and heeeello
 // h[ae]llo subscribes to hello and hallo, but not hillo
 // Use \ to escape special characters if you want to match them verbatim.
-func Psubscribe(pattern ...string) consumer {
-	exps := []*regexp.Regexp{}
+// Patterns match the whole channel of a message, such as a keyspace
+// notification, or the whole key name of a change event; see
+// SubscriptionOptions.Regexp for regular expressions. Invalid patterns are
+// ignored; PsubscribeWithOptions reports them.
+func Psubscribe(pattern ...string) *Subscription {
+	return PsubscribeContext(context.Background(), pattern...)
+}
 
-	for _, p := range pattern {
-		r, _ := regexp.Compile(p)
-		exps = append(exps, r)
+// PsubscribeContext is like Psubscribe, but the subscription is closed when ctx
+// is done.
+func PsubscribeContext(ctx context.Context, pattern ...string) *Subscription {
+	s, _ := psubscribe(SubscriptionOptions{Context: ctx}, pattern, true)
+	return s
+}
+
+// PsubscribeWithOptions is like Psubscribe, with control over buffering and the
+// slow consumer policy.
+//
+// Return value
+// The subscription, or an error and no subscription if a pattern is invalid.
+func PsubscribeWithOptions(opts SubscriptionOptions, pattern ...string) (*Subscription, error) {
+	return psubscribe(opts, pattern, false)
+}
+
+func psubscribe(opts SubscriptionOptions, pattern []string, skipInvalid bool) (*Subscription, error) {
+	defer call("psubscribe", pattern...)()
+
+	compile := compileGlob
+	if opts.Regexp {
+		compile = regexp.Compile
+	}
+	patterns, exps, err := compilePatterns(pattern, compile, skipInvalid)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSubscription(opts)
+	s.addPatterns(patterns, exps)
+	return s, nil
+}
+
+// Subscribes the client to the specified channels. Only messages published to
+// exactly these channel names, with PUBLISH or as keyspace notifications, are
+// received; change events are not.
+func Subscribe(channel ...string) *Subscription {
+	return SubscribeContext(context.Background(), channel...)
+}
+
+// SubscribeContext is like Subscribe, but the subscription is closed when ctx is
+// done.
+func SubscribeContext(ctx context.Context, channel ...string) *Subscription {
+	return SubscribeWithOptions(SubscriptionOptions{Context: ctx}, channel...)
+}
+
+// SubscribeWithOptions is like Subscribe, with control over buffering and the
+// slow consumer policy.
+func SubscribeWithOptions(opts SubscriptionOptions, channel ...string) *Subscription {
+	defer call("subscribe", channel...)()
+
+	s := newSubscription(opts)
+	for _, ch := range channel {
+		s.channels[ch] = true
+	}
+	return s
+}
+
+func newSubscription(opts SubscriptionOptions) *Subscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultSubscriptionBufferSize
+	}
+
+	s := &Subscription{
+		id:       atomic.AddUint64(&subscriptionIDs, 1),
+		channels: make(map[string]bool),
+		done:     make(chan struct{}),
+		opts:     opts,
+		Channel:  make(chan ChangeEvent, opts.BufferSize),
 	}
-	c := consumer{exps: exps, Channel: make(chan notice, 1000)}
 
 	consumerMu.Lock()
-	consumers = append(consumers, c)
+	consumers = append(consumers, s)
+	consumerList.Store(consumers)
 	consumerMu.Unlock()
 
-	return c
+	if opts.Context != nil && opts.Context.Done() != nil {
+		go func() {
+			select {
+			case <-opts.Context.Done():
+				s.Close()
+			case <-s.done:
+			}
+		}()
+	}
+
+	return s
+}
+
+// compilePatterns compiles the patterns of a subscription with compile,
+// returning those kept with their matchers. An invalid pattern is an error, or is
+// left out if skipInvalid is set, so that no subscription ever holds a nil
+// matcher.
+func compilePatterns(pattern []string, compile func(string) (*regexp.Regexp, error), skipInvalid bool) (patterns []string, exps []*regexp.Regexp, err error) {
+	for _, p := range pattern {
+		r, err := compile(p)
+		if err != nil {
+			if skipInvalid {
+				continue
+			}
+			return nil, nil, err
+		}
+		patterns = append(patterns, p)
+		exps = append(exps, r)
+	}
+	return patterns, exps, nil
+}
+
+// addPatterns subscribes s to patterns, matched by exps.
+func (s *Subscription) addPatterns(patterns []string, exps []*regexp.Regexp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.patterns = append(s.patterns, patterns...)
+	s.exps = append(s.exps, exps...)
+}
+
+// Unsubscribes the client from the given channels, or from all of them if none
+// is given.
+//
+// Return value
+// Integer reply: the number of channels and patterns the client is still
+// subscribed to.
+func (s *Subscription) Unsubscribe(channel ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(channel) == 0 {
+		s.channels = make(map[string]bool)
+	}
+	for _, ch := range channel {
+		delete(s.channels, ch)
+	}
+
+	return len(s.channels) + len(s.patterns)
+}
+
+// Unsubscribes the client from the given patterns, or from all of them if none
+// is given.
+//
+// Return value
+// Integer reply: the number of channels and patterns the client is still
+// subscribed to.
+func (s *Subscription) PUnsubscribe(pattern ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(pattern) == 0 {
+		s.exps, s.patterns = nil, nil
+	}
+	for _, p := range pattern {
+		for i := 0; i < len(s.patterns); i++ {
+			if s.patterns[i] == p {
+				s.exps = append(s.exps[:i:i], s.exps[i+1:]...)
+				s.patterns = append(s.patterns[:i:i], s.patterns[i+1:]...)
+				i--
+			}
+		}
+	}
+
+	return len(s.channels) + len(s.patterns)
+}
+
+// Close unsubscribes from everything, removes the subscription from dispatch
+// and closes Channel. Notices still buffered in Channel can be drained. Close
+// may be called more than once.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		consumerMu.Lock()
+		remaining := make([]*Subscription, 0, len(consumers))
+		for _, c := range consumers {
+			if c != s {
+				remaining = append(remaining, c)
+			}
+		}
+		consumers = remaining
+		consumerList.Store(consumers)
+		consumerMu.Unlock()
+
+		s.sendMu.Lock()
+		s.closed = true
+		close(s.Channel)
+		s.sendMu.Unlock()
+	})
+
+	return nil
 }
 
-func init() {
-	go func() {
-		for v := range publish {
-			consumerMu.RLock()
-			local_consumers := consumers[:]
-			consumerMu.RUnlock()
+// Dropped returns the number of messages this subscription lost because its
+// reader did not keep up.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// ID returns the number identifying the subscription in metrics, unique within
+// the process.
+func (s *Subscription) ID() uint64 {
+	return s.id
+}
+
+// Pending returns the number of messages waiting in Channel.
+func (s *Subscription) Pending() int {
+	return len(s.Channel)
+}
+
+// send delivers n on Channel, applying the slow consumer policy when it is full.
+// It reports false once the subscription is closed, or if it has to be closed
+// for exceeding its limits.
+func (s *Subscription) send(n ChangeEvent) bool {
+	if !s.enqueue(n) {
+		if s.opts.Policy == Disconnect {
+			s.Close()
+		}
+		return false
+	}
+	return true
+}
+
+func (s *Subscription) enqueue(n ChangeEvent) bool {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	if s.opts.Policy == Disconnect && s.opts.SoftLimit > 0 {
+		if len(s.Channel) < s.opts.SoftLimit {
+			s.softSince = time.Time{}
+		} else if s.softSince.IsZero() {
+			s.softSince = timeNow()
+		} else if timeSince(s.softSince) >= s.opts.SoftLimitDuration {
+			s.disconnected()
+			return false
+		}
+	}
+
+	for {
+		select {
+		case s.Channel <- n:
+			return true
+		default:
+		}
+
+		switch s.opts.Policy {
+		case Block:
+			select {
+			case s.Channel <- n:
+				return true
+			case <-s.done:
+				return false
+			}
+
+		case DropNewest:
+			s.drop()
+			return true
+
+		case Disconnect:
+			s.disconnected()
+			return false
 
-			for _, c := range local_consumers {
-				for _, r := range c.exps {
-					if r.MatchString(v.KeyName) == true {
-						// fmt.Println("Publishing:", v.KeyName)
-						c.Channel <- v
-					}
-				}
+		default:
+			select {
+			case <-s.Channel:
+				s.drop()
+			default:
 			}
-			atomic.AddUint64(&publishCount, 1)
 		}
-	}()
+	}
+}
+
+func (s *Subscription) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+	atomic.AddUint64(&droppedMessages, 1)
+}
+
+func (s *Subscription) disconnected() {
+	s.drop()
+	atomic.AddUint64(&slowDisconnects, 1)
+}
+
+// publish delivers n to every matching subscription, returning the number of
+// deliveries. Recipients are decided when n is published, and no subscription
+// can hold up the writer unless it uses the Block policy.
+func publish(n ChangeEvent) (receivers int) {
+	n.Time = timeNow()
+	if n.Channel == "" {
+		invalidateTrackedKey(n.KeyName)
+
+		n.Seq = atomic.AddUint64(&changeSeq, 1)
+		appendChangeLog(n)
+	}
+
+	for _, c := range currentConsumers() {
+		for i := c.deliveries(n); i > 0; i-- {
+			receivers++
+			if !c.send(n) {
+				break
+			}
+		}
+	}
+	atomic.AddUint64(&publishCount, 1)
+
+	return
+}
+
+// subscribed reports whether any subscription is open, so that commands can skip
+// copying the Data of change events nobody receives.
+func subscribed() bool {
+	return len(currentConsumers()) > 0
+}
+
+// currentConsumers returns the subscriptions open, for writers to read without
+// taking consumerMu.
+func currentConsumers() []*Subscription {
+	subs, _ := consumerList.Load().([]*Subscription)
+	return subs
+}
+
+// Posts a message to the given channel.
+//
+// Return value
+// Integer reply: the number of clients that received the message. A client
+// subscribed to the channel and to matching patterns receives it once for each.
+func Publish(channel, message string) int {
+	defer call("publish", channel, message)()
+
+	return publish(ChangeEvent{Data: message, Channel: channel})
+}
+
+// Lists the currently active channels. An active channel is a Pub/Sub channel
+// with one or more subscribers (not including clients subscribed to patterns).
+// If no pattern is specified, all the channels are listed, otherwise only
+// channels matching the specified glob-style pattern are listed.
+//
+// Return value
+// Array reply: a list of active channels, optionally matching the specified pattern,
+// or an error if pattern is invalid.
+func PubsubChannels(pattern string) ([]string, error) {
+	defer call("pubsub|channels", pattern)()
+
+	var r *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if r, err = compileGlob(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return activeChannels(r), nil
+}
+
+// activeChannels returns the channels with subscribers matching r, or all of them
+// if r is nil.
+func activeChannels(r *regexp.Regexp) []string {
+
+	active := make(map[string]bool)
+	consumerMu.RLock()
+	for _, c := range consumers {
+		c.mu.Lock()
+		for ch := range c.channels {
+			if r == nil || r.MatchString(ch) {
+				active[ch] = true
+			}
+		}
+		c.mu.Unlock()
+	}
+	consumerMu.RUnlock()
+
+	out := make([]string, 0, len(active))
+	for ch := range active {
+		out = append(out, ch)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// Returns the number of subscribers (exclusive of clients subscribed to patterns)
+// for the specified channels.
+//
+// Return value
+// Map reply: each channel and its number of subscribers.
+func PubsubNumsub(channel ...string) map[string]int {
+	defer call("pubsub|numsub", channel...)()
+
+	out := make(map[string]int, len(channel))
+	for _, ch := range channel {
+		out[ch] = 0
+	}
+
+	consumerMu.RLock()
+	for _, c := range consumers {
+		c.mu.Lock()
+		for _, ch := range channel {
+			if c.channels[ch] {
+				out[ch]++
+			}
+		}
+		c.mu.Unlock()
+	}
+	consumerMu.RUnlock()
+
+	return out
+}
+
+// Returns the number of unique patterns that are subscribed to by clients (that
+// are performed using the PSUBSCRIBE command).
+//
+// Return value
+// Integer reply: the number of patterns all the clients are subscribed to.
+func PubsubNumpat() int {
+	defer call("pubsub|numpat")()
+
+	return numPatterns()
+}
+
+// numPatterns returns the number of unique patterns subscribed to.
+func numPatterns() int {
+	patterns := make(map[string]bool)
+
+	consumerMu.RLock()
+	for _, c := range consumers {
+		c.mu.Lock()
+		for _, p := range c.patterns {
+			patterns[p] = true
+		}
+		c.mu.Unlock()
+	}
+	consumerMu.RUnlock()
+
+	return len(patterns)
+}
+
+// deliveries returns how many copies of n the consumer receives: one for a
+// subscription to its channel and one for each matching pattern. Change events
+// are matched against the key name, messages against the channel they were
+// published on.
+func (s *Subscription) deliveries(n ChangeEvent) (count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := n.KeyName
+	if n.Channel != "" {
+		target = n.Channel
+		if s.channels[n.Channel] {
+			count++
+		}
+	}
+
+	for _, r := range s.exps {
+		if r.MatchString(target) == true {
+			count++
+		}
+	}
+
+	return
 }
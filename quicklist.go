@@ -0,0 +1,371 @@
+package redis
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// quicklistSizeLimits are the node sizes, in bytes, of the negative
+// list-max-listpack-size settings, -1 to -5.
+var quicklistSizeLimits = [...]int{4096, 8192, 16384, 32768, 65536}
+
+// Nodes smaller than this are not worth compressing, as in Redis.
+const quicklistMinCompressBytes = 48
+
+// The list-max-listpack-size and list-compress-depth settings, accessed
+// atomically.
+var (
+	listMaxListpackSize int64 = -2
+	listCompressDepth   int64 = 0
+)
+
+// SetListMaxListpackSize sets how many elements each node of a list holds, like
+// the list-max-listpack-size directive. A positive size is a number of elements,
+// while -1 to -5 limit nodes to 4, 8, 16, 32 or 64 KB. The default is -2. Lists
+// that fit in a single node are held in the compact listpack encoding. Lists
+// already converted to quicklists keep their node size.
+func SetListMaxListpackSize(size int) {
+	if size == 0 {
+		size = 1
+	}
+	if size < -len(quicklistSizeLimits) {
+		size = -len(quicklistSizeLimits)
+	}
+
+	atomic.StoreInt64(&listMaxListpackSize, int64(size))
+}
+
+// SetListCompressDepth sets how many nodes at each end of a list are left
+// uncompressed, like the list-compress-depth directive; the nodes in between are
+// compressed. The ends are what pushes and pops touch, so they are kept ready.
+// Zero, the default, disables compression. It applies to lists created
+// afterwards.
+func SetListCompressDepth(depth int) {
+	if depth < 0 {
+		depth = 0
+	}
+
+	atomic.StoreInt64(&listCompressDepth, int64(depth))
+}
+
+// quicklist is a list stored as a doubly linked list of nodes holding runs of
+// elements, like Redis's quicklist: pushes and pops at either end are O(1), and
+// indexing walks nodes rather than elements from the nearest end.
+type quicklist struct {
+	head, tail *quicklistNode
+	count      int // elements
+	nodes      int
+
+	fill  int // list-max-listpack-size when the list was created
+	depth int // list-compress-depth when the list was created
+}
+
+// quicklistNode holds a run of elements, either as they are or, for interior
+// nodes of a compressed list, deflated. Uncompressed, the elements are
+// entries[start:], see pushFront.
+type quicklistNode struct {
+	prev, next *quicklistNode
+
+	entries    []string // nil while compressed
+	start      int
+	compressed []byte
+	count      int
+	bytes      int // total length of the entries
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{
+		fill:  int(atomic.LoadInt64(&listMaxListpackSize)),
+		depth: int(atomic.LoadInt64(&listCompressDepth)),
+	}
+}
+
+// quicklistFrom returns a quicklist holding the elements of l.
+func quicklistFrom(l List) *quicklist {
+	q := newQuicklist()
+	for _, v := range l {
+		q.pushTail(v)
+	}
+	return q
+}
+
+func (q *quicklist) len() int {
+	return q.count
+}
+
+func (q *quicklist) encoding() string {
+	return "quicklist"
+}
+
+// allows reports whether node can take another element of n bytes under the
+// list's fill setting. An empty node takes any element.
+func (q *quicklist) allows(node *quicklistNode, n int) bool {
+	if node == nil {
+		return false
+	}
+	if node.count == 0 {
+		return true
+	}
+	if q.fill > 0 {
+		return node.count < q.fill
+	}
+	return node.bytes+n <= quicklistSizeLimits[-q.fill-1]
+}
+
+func (q *quicklist) pushHead(v string) {
+	if !q.allows(q.head, len(v)) {
+		node := &quicklistNode{next: q.head}
+		if q.head != nil {
+			q.head.prev = node
+		} else {
+			q.tail = node
+		}
+		q.head = node
+		q.nodes++
+	}
+
+	q.head.entries, q.head.start = pushFront(q.head.entries, q.head.start, v)
+	q.head.count++
+	q.head.bytes += len(v)
+	q.count++
+	q.compressEnds()
+}
+
+func (q *quicklist) pushTail(v string) {
+	if !q.allows(q.tail, len(v)) {
+		node := &quicklistNode{prev: q.tail}
+		if q.tail != nil {
+			q.tail.next = node
+		} else {
+			q.head = node
+		}
+		q.tail = node
+		q.nodes++
+	}
+
+	q.tail.entries, q.tail.start = pushBack(q.tail.entries, q.tail.start, v)
+	q.tail.count++
+	q.tail.bytes += len(v)
+	q.count++
+	q.compressEnds()
+}
+
+func (q *quicklist) popHead() (v string, ok bool) {
+	node := q.head
+	if node == nil {
+		return "", false
+	}
+	node.decompress()
+
+	v, node.entries, node.start = popFront(node.entries, node.start)
+	q.removed(node, v)
+	return v, true
+}
+
+func (q *quicklist) popTail() (v string, ok bool) {
+	node := q.tail
+	if node == nil {
+		return "", false
+	}
+	node.decompress()
+
+	v, node.entries, node.start = popBack(node.entries, node.start)
+	q.removed(node, v)
+	return v, true
+}
+
+// removed accounts for v having been taken out of node, unlinking the node when
+// that emptied it.
+func (q *quicklist) removed(node *quicklistNode, v string) {
+	node.count--
+	node.bytes -= len(v)
+	q.count--
+
+	if node.count == 0 {
+		if node.prev != nil {
+			node.prev.next = node.next
+		} else {
+			q.head = node.next
+		}
+		if node.next != nil {
+			node.next.prev = node.prev
+		} else {
+			q.tail = node.prev
+		}
+		q.nodes--
+	}
+	q.compressEnds()
+}
+
+// index returns the element at index i, counting from the tail for negative
+// indexes, walking from whichever end is nearer.
+func (q *quicklist) index(i int) (string, bool) {
+	if i < 0 {
+		i += q.count
+	}
+	if i < 0 || i >= q.count {
+		return "", false
+	}
+
+	if i < q.count/2 {
+		for node := q.head; node != nil; node = node.next {
+			if i < node.count {
+				return node.view()[i], true
+			}
+			i -= node.count
+		}
+	} else {
+		i = q.count - 1 - i
+		for node := q.tail; node != nil; node = node.prev {
+			if i < node.count {
+				return node.view()[node.count-1-i], true
+			}
+			i -= node.count
+		}
+	}
+	return "", false
+}
+
+// rangeOf returns the elements from start to stop, inclusive, with the offsets
+// of LRANGE: negative ones count from the tail and out of range ones are clamped.
+func (q *quicklist) rangeOf(start, stop int) List {
+	out := make(List, 0)
+	start, stop, ok := clampRange(start, stop, q.count)
+	if !ok {
+		return out
+	}
+
+	i := 0
+	for node := q.head; node != nil && i <= stop; node = node.next {
+		if i+node.count > start {
+			entries := node.view()
+			from, to := 0, node.count
+			if start > i {
+				from = start - i
+			}
+			if stop+1 < i+node.count {
+				to = stop + 1 - i
+			}
+			out = append(out, entries[from:to]...)
+		}
+		i += node.count
+	}
+	return out
+}
+
+// clampRange turns the offsets of LRANGE into indexes of a list of n elements,
+// reporting whether the range has any.
+func clampRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop
+}
+
+// each calls f with every element, head to tail, until f returns false.
+func (q *quicklist) each(f func(v string) bool) {
+	for node := q.head; node != nil; node = node.next {
+		for _, v := range node.view() {
+			if !f(v) {
+				return
+			}
+		}
+	}
+}
+
+// slice returns a copy of all the elements.
+func (q *quicklist) slice() List {
+	out := make(List, 0, q.count)
+	q.each(func(v string) bool {
+		out = append(out, v)
+		return true
+	})
+	return out
+}
+
+// compressEnds restores, after a push or pop, the compression of the nodes near
+// the ends: the depth nodes at each end are uncompressed, and the node next to
+// them, which may just have left or joined them, compressed.
+func (q *quicklist) compressEnds() {
+	if q.depth <= 0 {
+		return
+	}
+
+	forward, backward := q.head, q.tail
+	for i := 0; i < q.depth && forward != nil; i++ {
+		forward.decompress()
+		backward.decompress()
+		forward, backward = forward.next, backward.prev
+	}
+
+	if q.nodes > 2*q.depth {
+		forward.compress()
+		backward.compress()
+	}
+}
+
+// view returns the entries of the node, decoding them without storing the result
+// if the node is compressed, so that readers sharing the list do not modify it.
+func (node *quicklistNode) view() []string {
+	if node.entries != nil {
+		return node.entries[node.start:]
+	}
+	return node.decode()
+}
+
+func (node *quicklistNode) compress() {
+	if node.entries == nil || node.bytes < quicklistMinCompressBytes {
+		return
+	}
+
+	var raw []byte
+	var n [binary.MaxVarintLen64]byte
+	for _, v := range node.entries[node.start:] {
+		raw = append(raw, n[:binary.PutUvarint(n[:], uint64(len(v)))]...)
+		raw = append(raw, v...)
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(raw)
+	w.Close()
+
+	// Like Redis, keep nodes that barely compress as they are.
+	if buf.Len()+8 >= len(raw) {
+		return
+	}
+	node.compressed = buf.Bytes()
+	node.entries = nil
+}
+
+func (node *quicklistNode) decompress() {
+	if node.entries == nil {
+		node.entries, node.start = node.decode(), 0
+		node.compressed = nil
+	}
+}
+
+func (node *quicklistNode) decode() []string {
+	raw, _ := io.ReadAll(flate.NewReader(bytes.NewReader(node.compressed)))
+
+	entries := make([]string, 0, node.count)
+	for len(raw) > 0 {
+		n, size := binary.Uvarint(raw)
+		raw = raw[size:]
+		entries = append(entries, string(raw[:n]))
+		raw = raw[n:]
+	}
+	return entries
+}
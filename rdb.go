@@ -0,0 +1,1334 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RDB opcodes and object types, as defined in Redis's rdb.h.
+const (
+	rdbOpcodeSlotInfo      = 0xF4
+	rdbOpcodeFunction2     = 0xF5
+	rdbOpcodeFunctionPreGA = 0xF6
+	rdbOpcodeModuleAux     = 0xF7
+	rdbOpcodeIdle          = 0xF8
+	rdbOpcodeFreq          = 0xF9
+	rdbOpcodeAux           = 0xFA
+	rdbOpcodeResizeDB      = 0xFB
+	rdbOpcodeExpireTimeMs  = 0xFC
+	rdbOpcodeExpireTime    = 0xFD
+	rdbOpcodeSelectDB      = 0xFE
+	rdbOpcodeEOF           = 0xFF
+
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZset            = 3
+	rdbTypeHash            = 4
+	rdbTypeZset2           = 5
+	rdbTypeModulePreGA     = 6
+	rdbTypeModule2         = 7
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZsetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpacks = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZsetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStreamListpack2 = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStreamListpack3 = 21
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+
+	quicklistNodeContainerPlain = 1
+
+	// The oldest and newest RDB versions ReadRDB understands, and the version
+	// WriteRDB produces. Version 9 is loadable by every Redis since 5.0.
+	rdbMinVersion   = 1
+	rdbMaxVersion   = 12
+	rdbWriteVersion = 9
+
+	// Lengths in the file are not trusted with allocations: strings longer
+	// than Redis's proto-max-bulk-len default are rejected, and buffers for
+	// longer strings or sequences grow in steps of rdbReadChunk bytes or items
+	// as the input arrives, so that a corrupt length runs out of input rather
+	// than memory.
+	rdbMaxStringLen = 512 << 20
+	rdbReadChunk    = 64 << 10
+
+	// LZF turns at most 3 bytes into 264, with a back reference.
+	lzfMaxRatio = 88
+)
+
+var errRDBCorrupt = errors.New("redis: corrupt RDB file")
+
+// rdbValue is a decoded key, in the shape the package stores it.
+type rdbValue struct {
+	typeName string
+	str      string
+	list     List
+	set      RedisSet
+	hash     map[string]string
+	expireAt time.Time
+}
+
+// Load an RDB snapshot, as written by Redis's SAVE or BGSAVE, from fileName. Keys
+// from database 0 are added to the keyspace, replacing any existing key of the
+// same name, together with their expire times. Keys that have already expired are
+// not loaded.
+//
+// Return value
+// The names of keys that were read but could not be loaded, because they belong to
+// a database other than 0 or hold a type the package does not store (sorted sets,
+// streams and module types), and any error reading the file.
+func LoadRDB(fileName string) (skipped []string, err error) {
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+
+	fo, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fo.Close()
+
+	return ReadRDB(fo)
+}
+
+// Save the keyspace to fileName as an RDB snapshot that a real Redis server can
+// load. The file is written next to its final location and renamed into place, so
+// a crash never leaves a truncated snapshot behind.
+func SaveRDB(fileName string) error {
+	return writeFileAtomic(fileName, func(w *bufio.Writer) error {
+		defer latencySample("snapshot-serialize", timeNow())
+		return WriteRDB(w)
+	})
+}
+
+// ReadRDB loads an RDB stream into the keyspace. See LoadRDB. The keys are loaded
+// at once, once the stream has been read: scripts and commands wait for the load
+// to finish, and never see the keyspace half loaded.
+func ReadRDB(r io.Reader) (skipped []string, err error) {
+	rd := &rdbReader{r: bufio.NewReader(r)}
+
+	values, skipped, err := rd.readAll()
+	if err != nil {
+		return skipped, err
+	}
+
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	for key, v := range values {
+		storeRDBValue(key, v)
+	}
+
+	return skipped, nil
+}
+
+// WriteRDB writes the keyspace to w in RDB format. Strings, lists, sets and hashes
+// are written with the plain (non-compact) encodings, which every Redis version
+// loads and converts to its preferred encoding.
+func WriteRDB(w io.Writer) error {
+	snap := snapshotKeyspace()
+	hashes, lists, sets, strs, keyExpires := snap.hashes, snap.lists, snap.sets, snap.strings, snap.expires
+
+	rw := &rdbWriter{w: bufio.NewWriter(w)}
+
+	rw.write([]byte(fmt.Sprintf("REDIS%04d", rdbWriteVersion)))
+	rw.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	rw.writeAux("ctime", strconv.FormatInt(timeNow().Unix(), 10))
+
+	rw.writeByte(rdbOpcodeSelectDB)
+	rw.writeLength(0)
+	rw.writeByte(rdbOpcodeResizeDB)
+	rw.writeLength(uint64(len(hashes) + len(lists) + len(sets) + len(strs)))
+	rw.writeLength(uint64(len(keyExpires)))
+
+	writeKey := func(key string, rdbType byte) {
+		if when, ok := keyExpires[key]; ok {
+			rw.writeByte(rdbOpcodeExpireTimeMs)
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(when.UnixNano()/int64(time.Millisecond)))
+			rw.write(b[:])
+		}
+		rw.writeByte(rdbType)
+		rw.writeString(key)
+	}
+
+	for key, s := range strs {
+		writeKey(key, rdbTypeString)
+		rw.writeString(s)
+	}
+	for key, list := range lists {
+		writeKey(key, rdbTypeList)
+		rw.writeLength(uint64(len(list)))
+		for _, v := range list {
+			rw.writeString(v)
+		}
+	}
+	for key, members := range sets {
+		writeKey(key, rdbTypeSet)
+		rw.writeLength(uint64(len(members)))
+		for m := range members {
+			rw.writeString(m)
+		}
+	}
+	for key, hash := range hashes {
+		writeKey(key, rdbTypeHash)
+		rw.writeLength(uint64(len(hash)))
+		for f, v := range hash {
+			rw.writeString(f)
+			rw.writeString(v)
+		}
+	}
+
+	rw.writeByte(rdbOpcodeEOF)
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], rw.crc)
+	rw.write(sum[:])
+
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.w.Flush()
+}
+
+// storeRDBValue replaces whatever key holds with a value read from an RDB file.
+func storeRDBValue(key string, v rdbValue) {
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleteKey(notifyGeneric, "del", key) {
+		s.addDirty(1)
+	}
+	// A client may have cached that the key did not exist.
+	invalidateTrackedKey(key)
+
+	var e *entry
+	switch v.typeName {
+	case "string":
+		e = s.add(key, typeString, v.str)
+	case "list":
+		e = s.add(key, typeList, newListValue(v.list))
+	case "set":
+		e = s.add(key, typeSet, newSetValue(v.set))
+	case "hash":
+		e = s.add(key, typeHash, newHashValue(v.hash))
+	default:
+		return
+	}
+
+	if !v.expireAt.IsZero() {
+		s.setExpire(key, e, v.expireAt)
+	}
+
+	e.measure(key)
+}
+
+// rdbReader decodes an RDB stream, keeping a running CRC64 of everything read so
+// the checksum in the footer can be verified.
+type rdbReader struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+}
+
+func (rd *rdbReader) readAll() (values map[string]rdbValue, skipped []string, err error) {
+	header := make([]byte, 9)
+	if err = rd.readFull(header); err != nil {
+		return
+	}
+	if string(header[:5]) != "REDIS" {
+		return nil, nil, errors.New("redis: not an RDB file")
+	}
+	rd.version, err = strconv.Atoi(string(header[5:]))
+	if err != nil || rd.version < rdbMinVersion || rd.version > rdbMaxVersion {
+		return nil, nil, fmt.Errorf("redis: unsupported RDB version %q", header[5:])
+	}
+
+	values = make(map[string]rdbValue)
+	db := uint64(0)
+	now := timeNow()
+
+	for {
+		var expireAt time.Time
+
+		op, err := rd.readByte()
+		if err != nil {
+			return nil, skipped, err
+		}
+
+		switch op {
+		case rdbOpcodeEOF:
+			return values, skipped, rd.verifyChecksum()
+
+		case rdbOpcodeSelectDB:
+			if db, err = rd.readLength(); err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeResizeDB:
+			if _, err = rd.readLength(); err == nil {
+				_, err = rd.readLength()
+			}
+			if err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = rd.readLength()
+			}
+			if err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeAux:
+			if _, err = rd.readString(); err == nil {
+				_, err = rd.readString()
+			}
+			if err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeModuleAux:
+			if _, err = rd.readLength(); err == nil {
+				err = rd.skipModuleValue(true)
+			}
+			if err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeFunction2:
+			if _, err = rd.readString(); err != nil {
+				return nil, skipped, err
+			}
+			continue
+
+		case rdbOpcodeFunctionPreGA:
+			return nil, skipped, errors.New("redis: pre-release RDB function format is not supported")
+
+		case rdbOpcodeExpireTime:
+			b := make([]byte, 4)
+			if err = rd.readFull(b); err != nil {
+				return nil, skipped, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			if op, err = rd.readObjectPrefix(); err != nil {
+				return nil, skipped, err
+			}
+
+		case rdbOpcodeExpireTimeMs:
+			b := make([]byte, 8)
+			if err = rd.readFull(b); err != nil {
+				return nil, skipped, err
+			}
+			var ok bool
+			if expireAt, ok = unixMilliExpire(int64(binary.LittleEndian.Uint64(b))); !ok {
+				return nil, skipped, errRDBCorrupt
+			}
+			if op, err = rd.readObjectPrefix(); err != nil {
+				return nil, skipped, err
+			}
+
+		case rdbOpcodeIdle, rdbOpcodeFreq:
+			if err = rd.skipLRUInfo(op); err != nil {
+				return nil, skipped, err
+			}
+			if op, err = rd.readObjectPrefix(); err != nil {
+				return nil, skipped, err
+			}
+		}
+
+		key, err := rd.readString()
+		if err != nil {
+			return nil, skipped, err
+		}
+		v, err := rd.readObject(op)
+		if err != nil {
+			return nil, skipped, fmt.Errorf("%v (key %q)", err, key)
+		}
+
+		if db != 0 || v.typeName == "" {
+			skipped = append(skipped, key)
+			continue
+		}
+		if !expireAt.IsZero() && !expireAt.After(now) {
+			continue
+		}
+		v.expireAt = expireAt
+		values[key] = v
+	}
+}
+
+// readObjectPrefix reads the object type following an expire, idle or freq opcode,
+// skipping any further LRU/LFU information in between.
+func (rd *rdbReader) readObjectPrefix() (byte, error) {
+	for {
+		op, err := rd.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if op != rdbOpcodeIdle && op != rdbOpcodeFreq {
+			return op, nil
+		}
+		if err = rd.skipLRUInfo(op); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (rd *rdbReader) skipLRUInfo(op byte) error {
+	if op == rdbOpcodeFreq {
+		_, err := rd.readByte()
+		return err
+	}
+	_, err := rd.readLength()
+	return err
+}
+
+func (rd *rdbReader) verifyChecksum() error {
+	if rd.version < 5 {
+		return nil
+	}
+
+	expected := rd.crc
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rd.r, b); err != nil {
+		return err
+	}
+	sum := binary.LittleEndian.Uint64(b)
+	if sum != 0 && sum != expected {
+		return errors.New("redis: RDB checksum mismatch")
+	}
+	return nil
+}
+
+// readObject decodes a value of the given RDB type. Types the package has nowhere
+// to store are read and discarded, returning an rdbValue with an empty typeName.
+func (rd *rdbReader) readObject(rdbType byte) (v rdbValue, err error) {
+	switch rdbType {
+	case rdbTypeString:
+		v.typeName = "string"
+		v.str, err = rd.readString()
+
+	case rdbTypeList:
+		v.typeName = "list"
+		v.list, err = rd.readStrings(1)
+
+	case rdbTypeSet:
+		var members []string
+		if members, err = rd.readStrings(1); err == nil {
+			v.typeName, v.set = "set", toRedisSet(members)
+		}
+
+	case rdbTypeHash:
+		var pairs []string
+		if pairs, err = rd.readStrings(2); err == nil {
+			v.typeName, v.hash = "hash", toHashMap(pairs)
+		}
+
+	case rdbTypeZset, rdbTypeZset2:
+		var n uint64
+		if n, err = rd.readLength(); err != nil {
+			return
+		}
+		for i := uint64(0); i < n && err == nil; i++ {
+			if _, err = rd.readString(); err == nil {
+				_, err = rd.readDouble(rdbType == rdbTypeZset2)
+			}
+		}
+
+	case rdbTypeListZiplist:
+		var blob string
+		if blob, err = rd.readString(); err == nil {
+			v.typeName = "list"
+			v.list, err = parseZiplist([]byte(blob))
+		}
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		v.typeName = "list"
+		v.list, err = rd.readQuicklist(rdbType == rdbTypeListQuicklist2)
+
+	case rdbTypeSetIntset:
+		var blob string
+		var members []string
+		if blob, err = rd.readString(); err == nil {
+			if members, err = parseIntset([]byte(blob)); err == nil {
+				v.typeName, v.set = "set", toRedisSet(members)
+			}
+		}
+
+	case rdbTypeSetListpack:
+		var blob string
+		var members []string
+		if blob, err = rd.readString(); err == nil {
+			if members, err = parseListpack([]byte(blob)); err == nil {
+				v.typeName, v.set = "set", toRedisSet(members)
+			}
+		}
+
+	case rdbTypeHashZipmap:
+		var blob string
+		var pairs []string
+		if blob, err = rd.readString(); err == nil {
+			if pairs, err = parseZipmap([]byte(blob)); err == nil {
+				v.typeName, v.hash = "hash", toHashMap(pairs)
+			}
+		}
+
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		var blob string
+		var pairs []string
+		if blob, err = rd.readString(); err == nil {
+			if rdbType == rdbTypeHashZiplist {
+				pairs, err = parseZiplist([]byte(blob))
+			} else {
+				pairs, err = parseListpack([]byte(blob))
+			}
+			if err == nil && len(pairs)%2 != 0 {
+				err = errRDBCorrupt
+			}
+			if err == nil {
+				v.typeName, v.hash = "hash", toHashMap(pairs)
+			}
+		}
+
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		_, err = rd.readString()
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpack2, rdbTypeStreamListpack3:
+		err = rd.skipStream(rdbType)
+
+	case rdbTypeModule2:
+		if _, err = rd.readLength(); err == nil {
+			err = rd.skipModuleValue(false)
+		}
+
+	case rdbTypeModulePreGA:
+		err = errors.New("redis: pre-release RDB module format is not supported")
+
+	default:
+		err = fmt.Errorf("redis: unsupported RDB object type %d", rdbType)
+	}
+
+	return
+}
+
+// unixMilliExpire returns the expire time ms milliseconds after the epoch,
+// reporting whether it is one the keyspace can hold: not before the epoch, and
+// early enough, until 2262, for its nanoseconds to fit an int64.
+func unixMilliExpire(ms int64) (time.Time, bool) {
+	if ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// readStrings reads a length-prefixed sequence of strings, with perItem strings
+// for each counted item.
+func (rd *rdbReader) readStrings(perItem int) ([]string, error) {
+	n, err := rd.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32/uint64(perItem) {
+		return nil, errRDBCorrupt
+	}
+	n *= uint64(perItem)
+
+	out := make([]string, 0, minLength(n, rdbReadChunk))
+	for i := uint64(0); i < n; i++ {
+		s, err := rd.readString()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (rd *rdbReader) readQuicklist(v2 bool) (List, error) {
+	n, err := rd.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	list := List{}
+	for i := uint64(0); i < n; i++ {
+		container := uint64(0)
+		if v2 {
+			if container, err = rd.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := rd.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var items []string
+		switch {
+		case container == quicklistNodeContainerPlain:
+			items = []string{blob}
+		case v2:
+			items, err = parseListpack([]byte(blob))
+		default:
+			items, err = parseZiplist([]byte(blob))
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, items...)
+	}
+	return list, nil
+}
+
+func (rd *rdbReader) skipStream(rdbType byte) (err error) {
+	lengths := func(n int) {
+		for i := 0; i < n && err == nil; i++ {
+			_, err = rd.readLength()
+		}
+	}
+	raw := func(n int) {
+		if err == nil {
+			err = rd.readFull(make([]byte, n))
+		}
+	}
+
+	var listpacks, groups, pending, consumers uint64
+
+	if listpacks, err = rd.readLength(); err != nil {
+		return
+	}
+	for i := uint64(0); i < listpacks && err == nil; i++ {
+		if _, err = rd.readString(); err == nil {
+			_, err = rd.readString()
+		}
+	}
+
+	// Length, last ID and, from version 2, first ID, max deleted ID and
+	// entries added.
+	lengths(3)
+	if rdbType >= rdbTypeStreamListpack2 {
+		lengths(5)
+	}
+
+	if err == nil {
+		groups, err = rd.readLength()
+	}
+	for g := uint64(0); g < groups && err == nil; g++ {
+		if _, err = rd.readString(); err != nil {
+			return
+		}
+		lengths(2)
+		if rdbType >= rdbTypeStreamListpack2 {
+			lengths(1)
+		}
+
+		if err == nil {
+			pending, err = rd.readLength()
+		}
+		for p := uint64(0); p < pending && err == nil; p++ {
+			raw(16 + 8)
+			lengths(1)
+		}
+
+		if err == nil {
+			consumers, err = rd.readLength()
+		}
+		for c := uint64(0); c < consumers && err == nil; c++ {
+			if _, err = rd.readString(); err != nil {
+				return
+			}
+			raw(8)
+			if rdbType >= rdbTypeStreamListpack3 {
+				raw(8)
+			}
+			if err == nil {
+				pending, err = rd.readLength()
+			}
+			for p := uint64(0); p < pending && err == nil; p++ {
+				raw(16)
+			}
+		}
+	}
+
+	return
+}
+
+// skipModuleValue discards a module value serialized with the self-describing
+// opcodes Redis uses from module API version 2. For MODULE_AUX the when-opcode and
+// when fields come first.
+func (rd *rdbReader) skipModuleValue(aux bool) error {
+	if aux {
+		for i := 0; i < 2; i++ {
+			if _, err := rd.readLength(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		op, err := rd.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			_, err = rd.readLength()
+		case rdbModuleOpcodeFloat:
+			err = rd.readFull(make([]byte, 4))
+		case rdbModuleOpcodeDouble:
+			err = rd.readFull(make([]byte, 8))
+		case rdbModuleOpcodeString:
+			_, err = rd.readString()
+		default:
+			err = errRDBCorrupt
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rd *rdbReader) readFull(b []byte) error {
+	if _, err := io.ReadFull(rd.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	rd.crc = crc64Update(rd.crc, b)
+	return nil
+}
+
+// readBytes reads a string of n bytes, growing the buffer as they are read.
+func (rd *rdbReader) readBytes(n uint64) ([]byte, error) {
+	if n > rdbMaxStringLen {
+		return nil, errRDBCorrupt
+	}
+
+	buf := make([]byte, 0, minLength(n, rdbReadChunk))
+	for uint64(len(buf)) < n {
+		chunk := int(minLength(n-uint64(len(buf)), rdbReadChunk))
+		buf = append(buf, make([]byte, chunk)...)
+		if err := rd.readFull(buf[len(buf)-chunk:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func minLength(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (rd *rdbReader) readByte() (byte, error) {
+	var b [1]byte
+	err := rd.readFull(b[:])
+	return b[0], err
+}
+
+// readLengthEncoding reads an RDB length, which may instead announce one of the
+// special string encodings.
+func (rd *rdbReader) readLengthEncoding() (length uint64, encoded bool, err error) {
+	b, err := rd.readByte()
+	if err != nil {
+		return
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := rd.readByte()
+		return uint64(b&0x3F)<<8 | uint64(next), false, err
+	case 2:
+		switch b {
+		case 0x80:
+			buf := make([]byte, 4)
+			err = rd.readFull(buf)
+			return uint64(binary.BigEndian.Uint32(buf)), false, err
+		case 0x81:
+			buf := make([]byte, 8)
+			err = rd.readFull(buf)
+			return binary.BigEndian.Uint64(buf), false, err
+		}
+		return 0, false, errRDBCorrupt
+	default:
+		return uint64(b & 0x3F), true, nil
+	}
+}
+
+func (rd *rdbReader) readLength() (uint64, error) {
+	length, encoded, err := rd.readLengthEncoding()
+	if err == nil && encoded {
+		err = errRDBCorrupt
+	}
+	return length, err
+}
+
+func (rd *rdbReader) readString() (string, error) {
+	length, encoded, err := rd.readLengthEncoding()
+	if err != nil {
+		return "", err
+	}
+
+	if !encoded {
+		buf, err := rd.readBytes(length)
+		return string(buf), err
+	}
+
+	switch length {
+	case rdbEncInt8:
+		b, err := rd.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		buf := make([]byte, 2)
+		err = rd.readFull(buf)
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), err
+	case rdbEncInt32:
+		buf := make([]byte, 4)
+		err = rd.readFull(buf)
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), err
+	case rdbEncLZF:
+		clen, err := rd.readLength()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := rd.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := rd.readBytes(clen)
+		if err != nil {
+			return "", err
+		}
+		if ulen > rdbMaxStringLen || ulen > clen*lzfMaxRatio {
+			return "", errRDBCorrupt
+		}
+		out, err := lzfDecompress(compressed, int(ulen))
+		return string(out), err
+	}
+
+	return "", errRDBCorrupt
+}
+
+// readDouble reads a sorted set score, either as the 8 byte binary double of
+// ZSET_2 or the length-prefixed text of the original ZSET encoding.
+func (rd *rdbReader) readDouble(binaryEncoded bool) (float64, error) {
+	if binaryEncoded {
+		buf := make([]byte, 8)
+		if err := rd.readFull(buf); err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+	}
+
+	n, err := rd.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, n)
+	if err = rd.readFull(buf); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// rdbWriter encodes an RDB stream, keeping the running CRC64 for the footer. The
+// first write error is remembered and later writes are ignored.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (rw *rdbWriter) write(b []byte) {
+	if rw.err != nil {
+		return
+	}
+	_, rw.err = rw.w.Write(b)
+	rw.crc = crc64Update(rw.crc, b)
+}
+
+func (rw *rdbWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+func (rw *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.writeByte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		b := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		rw.write(b)
+	default:
+		b := make([]byte, 9)
+		b[0] = 0x81
+		binary.BigEndian.PutUint64(b[1:], n)
+		rw.write(b)
+	}
+}
+
+// writeString writes s, using the compact integer encodings when s is the
+// canonical form of a small integer, as Redis does.
+func (rw *rdbWriter) writeString(s string) {
+	if len(s) <= 11 {
+		if i, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(i, 10) == s {
+			switch {
+			case i >= math.MinInt8 && i <= math.MaxInt8:
+				rw.write([]byte{0xC0 | rdbEncInt8, byte(int8(i))})
+			case i >= math.MinInt16 && i <= math.MaxInt16:
+				b := []byte{0xC0 | rdbEncInt16, 0, 0}
+				binary.LittleEndian.PutUint16(b[1:], uint16(int16(i)))
+				rw.write(b)
+			default:
+				b := []byte{0xC0 | rdbEncInt32, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(b[1:], uint32(int32(i)))
+				rw.write(b)
+			}
+			return
+		}
+	}
+
+	rw.writeLength(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) writeAux(key, value string) {
+	rw.writeByte(rdbOpcodeAux)
+	rw.writeString(key)
+	rw.writeString(value)
+}
+
+func toRedisSet(members []string) RedisSet {
+	set := make(RedisSet, len(members))
+	for _, m := range members {
+		set[m] = true
+	}
+	return set
+}
+
+func toHashMap(pairs []string) map[string]string {
+	m := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		m[pairs[i]] = pairs[i+1]
+	}
+	return m
+}
+
+// parseZiplist decodes the entries of a ziplist, the compact encoding used for
+// small lists, hashes and sorted sets before Redis 7.
+func parseZiplist(b []byte) ([]string, error) {
+	const headerSize = 10
+
+	if len(b) < headerSize+1 {
+		return nil, errRDBCorrupt
+	}
+
+	var out []string
+	pos := headerSize
+	for {
+		if pos >= len(b) {
+			return nil, errRDBCorrupt
+		}
+		if b[pos] == 0xFF {
+			return out, nil
+		}
+
+		// Skip the previous entry's length.
+		if b[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(b) {
+			return nil, errRDBCorrupt
+		}
+
+		enc := b[pos]
+		var (
+			n      int
+			isInt  bool
+			intVal int64
+		)
+
+		switch {
+		case enc>>6 == 0:
+			n, pos = int(enc&0x3F), pos+1
+		case enc>>6 == 1:
+			if pos+2 > len(b) {
+				return nil, errRDBCorrupt
+			}
+			n, pos = int(enc&0x3F)<<8|int(b[pos+1]), pos+2
+		case enc>>6 == 2:
+			if pos+5 > len(b) {
+				return nil, errRDBCorrupt
+			}
+			n, pos = int(binary.BigEndian.Uint32(b[pos+1:])), pos+5
+		default:
+			isInt = true
+			pos++
+			size := 0
+			switch enc {
+			case 0xC0:
+				size = 2
+			case 0xD0:
+				size = 4
+			case 0xE0:
+				size = 8
+			case 0xF0:
+				size = 3
+			case 0xFE:
+				size = 1
+			default:
+				if enc < 0xF1 || enc > 0xFD {
+					return nil, errRDBCorrupt
+				}
+				intVal = int64(enc&0x0F) - 1
+			}
+			if pos+size > len(b) {
+				return nil, errRDBCorrupt
+			}
+			switch size {
+			case 1:
+				intVal = int64(int8(b[pos]))
+			case 2:
+				intVal = int64(int16(binary.LittleEndian.Uint16(b[pos:])))
+			case 3:
+				intVal = int64(int32(uint32(b[pos])<<8|uint32(b[pos+1])<<16|uint32(b[pos+2])<<24) >> 8)
+			case 4:
+				intVal = int64(int32(binary.LittleEndian.Uint32(b[pos:])))
+			case 8:
+				intVal = int64(binary.LittleEndian.Uint64(b[pos:]))
+			}
+			pos += size
+		}
+
+		if isInt {
+			out = append(out, strconv.FormatInt(intVal, 10))
+			continue
+		}
+		if pos+n > len(b) {
+			return nil, errRDBCorrupt
+		}
+		out = append(out, string(b[pos:pos+n]))
+		pos += n
+	}
+}
+
+// parseListpack decodes the entries of a listpack, the compact encoding that
+// replaced the ziplist in Redis 7.
+func parseListpack(b []byte) ([]string, error) {
+	const headerSize = 6
+
+	if len(b) < headerSize+1 {
+		return nil, errRDBCorrupt
+	}
+
+	var out []string
+	pos := headerSize
+	for {
+		if pos >= len(b) {
+			return nil, errRDBCorrupt
+		}
+		enc := b[pos]
+		if enc == 0xFF {
+			return out, nil
+		}
+
+		start := pos
+		var (
+			str    []byte
+			isInt  bool
+			intVal int64
+		)
+
+		need := func(n int) bool { return pos+n <= len(b) }
+
+		switch {
+		case enc&0x80 == 0:
+			isInt, intVal, pos = true, int64(enc&0x7F), pos+1
+		case enc&0xC0 == 0x80:
+			n := int(enc & 0x3F)
+			if !need(1 + n) {
+				return nil, errRDBCorrupt
+			}
+			str, pos = b[pos+1:pos+1+n], pos+1+n
+		case enc&0xE0 == 0xC0:
+			if !need(2) {
+				return nil, errRDBCorrupt
+			}
+			v := int64(enc&0x1F)<<8 | int64(b[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			isInt, intVal, pos = true, v, pos+2
+		case enc&0xF0 == 0xE0:
+			if !need(2) {
+				return nil, errRDBCorrupt
+			}
+			n := int(enc&0x0F)<<8 | int(b[pos+1])
+			if !need(2 + n) {
+				return nil, errRDBCorrupt
+			}
+			str, pos = b[pos+2:pos+2+n], pos+2+n
+		case enc == 0xF0:
+			if !need(5) {
+				return nil, errRDBCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(b[pos+1:]))
+			if !need(5 + n) {
+				return nil, errRDBCorrupt
+			}
+			str, pos = b[pos+5:pos+5+n], pos+5+n
+		case enc == 0xF1:
+			if !need(3) {
+				return nil, errRDBCorrupt
+			}
+			isInt, intVal, pos = true, int64(int16(binary.LittleEndian.Uint16(b[pos+1:]))), pos+3
+		case enc == 0xF2:
+			if !need(4) {
+				return nil, errRDBCorrupt
+			}
+			v := int64(int32(uint32(b[pos+1])<<8|uint32(b[pos+2])<<16|uint32(b[pos+3])<<24) >> 8)
+			isInt, intVal, pos = true, v, pos+4
+		case enc == 0xF3:
+			if !need(5) {
+				return nil, errRDBCorrupt
+			}
+			isInt, intVal, pos = true, int64(int32(binary.LittleEndian.Uint32(b[pos+1:]))), pos+5
+		case enc == 0xF4:
+			if !need(9) {
+				return nil, errRDBCorrupt
+			}
+			isInt, intVal, pos = true, int64(binary.LittleEndian.Uint64(b[pos+1:])), pos+9
+		default:
+			return nil, errRDBCorrupt
+		}
+
+		if isInt {
+			out = append(out, strconv.FormatInt(intVal, 10))
+		} else {
+			out = append(out, string(str))
+		}
+
+		// Skip the back-length, which encodes the size of this entry.
+		size := pos - start
+		switch {
+		case size < 128:
+			pos++
+		case size < 16384:
+			pos += 2
+		case size < 2097152:
+			pos += 3
+		case size < 268435456:
+			pos += 4
+		default:
+			pos += 5
+		}
+	}
+}
+
+// parseIntset decodes an intset, the encoding of small sets of integers.
+func parseIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errRDBCorrupt
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(b) < 8+n*width {
+		return nil, errRDBCorrupt
+	}
+
+	out := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		p := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		out = append(out, strconv.FormatInt(v, 10))
+	}
+	return out, nil
+}
+
+// parseZipmap decodes a zipmap, the small hash encoding of Redis before 2.6.
+func parseZipmap(b []byte) ([]string, error) {
+	if len(b) < 2 {
+		return nil, errRDBCorrupt
+	}
+
+	var out []string
+	pos := 1
+	readLen := func() (int, bool) {
+		if pos >= len(b) {
+			return 0, false
+		}
+		l := int(b[pos])
+		switch {
+		case l < 253:
+			pos++
+		case l == 253:
+			if pos+5 > len(b) {
+				return 0, false
+			}
+			l = int(binary.LittleEndian.Uint32(b[pos+1:]))
+			pos += 5
+		default:
+			return 0, false
+		}
+		return l, true
+	}
+
+	for {
+		if pos >= len(b) {
+			return nil, errRDBCorrupt
+		}
+		if b[pos] == 0xFF {
+			return out, nil
+		}
+
+		klen, ok := readLen()
+		if !ok || pos+klen > len(b) {
+			return nil, errRDBCorrupt
+		}
+		key := string(b[pos : pos+klen])
+		pos += klen
+
+		vlen, ok := readLen()
+		if !ok || pos+1+vlen > len(b) {
+			return nil, errRDBCorrupt
+		}
+		free := int(b[pos])
+		pos++
+		value := string(b[pos : pos+vlen])
+		pos += vlen + free
+
+		out = append(out, key, value)
+	}
+}
+
+// lzfDecompress expands LZF-compressed RDB strings.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, errRDBCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errRDBCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errRDBCorrupt
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+n+2 > outLen {
+			return nil, errRDBCorrupt
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errRDBCorrupt
+	}
+	return out, nil
+}
+
+// crc64Table is the table for the Jones CRC-64 Redis uses for RDB checksums. It is
+// not one of the polynomials in hash/crc64, and unlike those it uses no initial or
+// final inversion.
+var crc64Table = func() (t [256]uint64) {
+	const reflectedPoly = 0x95AC9329AC4BC9B5
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ reflectedPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+func crc64Update(crc uint64, b []byte) uint64 {
+	for _, c := range b {
+		crc = crc64Table[byte(crc)^c] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,482 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conn is an adapter with the API of the redigo client, for code written
+// against it to run on the package in development and tests: the Conn interface
+// and its replies, Pool, and the helpers converting replies, such as String and
+// Strings, named and typed as redigo names and types them.
+//
+// Replies are those redigo returns: []byte for bulk strings, string for simple
+// strings such as OK, int64 for integers, []interface{} for arrays, nil, and
+// Error for errors. Commands sent with Send run when they are flushed, in order;
+// commands between MULTI and EXEC run atomically, when EXEC runs.
+
+// Conn is a connection to the keyspace, as redigo's Conn.
+type Conn interface {
+	// Close closes the connection.
+	Close() error
+
+	// Err returns a non-nil value when the connection is not usable.
+	Err() error
+
+	// Do sends a command, flushing the commands sent before it, and returns
+	// its reply. Given an empty name, Do only flushes and returns the replies
+	// not received yet.
+	Do(commandName string, args ...interface{}) (reply interface{}, err error)
+
+	// Send queues a command, to run on the next Flush.
+	Send(commandName string, args ...interface{}) error
+
+	// Flush runs the queued commands.
+	Flush() error
+
+	// Receive returns the reply of the oldest command flushed and not received
+	// yet.
+	Receive() (reply interface{}, err error)
+}
+
+// Error is an error reply, as redigo's Error.
+type Error string
+
+func (err Error) Error() string { return string(err) }
+
+// Argument is implemented by arguments with a value of their own to send, as
+// redigo's Argument.
+type Argument interface {
+	RedisArg() interface{}
+}
+
+// ErrNil is the error of the reply helpers given a nil reply.
+var ErrNil = errors.New("redigo: nil returned")
+
+var (
+	errConnClosed = errors.New("redigo: closed")
+	errNoReply    = errors.New("redigo: no reply to receive")
+)
+
+type conn struct {
+	mu     sync.Mutex
+	closed bool
+
+	// sent holds the commands sent and not flushed, and replies those of the
+	// commands flushed and not received.
+	sent    [][]string
+	replies []interface{}
+
+	// queued holds the commands of a transaction, from MULTI to EXEC, while
+	// multi is set. failed is set when one of them could not be queued.
+	multi  bool
+	queued [][]string
+	failed bool
+}
+
+// NewConn returns a Conn.
+func NewConn() Conn {
+	return &conn{}
+}
+
+// Dial returns a Conn, as redigo's Dial. network and address are ignored, as
+// there is no server to connect to.
+func Dial(network, address string) (Conn, error) {
+	return NewConn(), nil
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+	c.closed = true
+	c.sent, c.replies, c.queued = nil, nil, nil
+	return nil
+}
+
+func (c *conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+	return nil
+}
+
+func (c *conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errConnClosed
+	}
+	if commandName != "" {
+		c.sent = append(c.sent, redigoArgs(commandName, args))
+	}
+	c.flush()
+
+	replies := c.replies
+	c.replies = nil
+	if commandName == "" {
+		return replies, nil
+	}
+
+	var err error
+	for _, reply := range replies {
+		if e, ok := reply.(Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+func (c *conn) Send(commandName string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+	c.sent = append(c.sent, redigoArgs(commandName, args))
+	return nil
+}
+
+func (c *conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+	c.flush()
+	return nil
+}
+
+// Receive returns the oldest reply not received. Unlike redigo, which would
+// wait for a reply forever, it flushes the commands sent if there is none, and
+// fails if there still is none.
+func (c *conn) Receive() (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errConnClosed
+	}
+	if len(c.replies) == 0 {
+		c.flush()
+	}
+	if len(c.replies) == 0 {
+		return nil, errNoReply
+	}
+
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// flush runs the commands sent, keeping their replies. Each command is taken off
+// c.sent before it runs, so that one panicking is not run again.
+func (c *conn) flush() {
+	for len(c.sent) > 0 {
+		args := c.sent[0]
+		c.sent = c.sent[1:]
+		c.replies = append(c.replies, c.run(args))
+	}
+	c.sent = nil
+}
+
+// run runs a command, or queues it in a transaction, and returns its reply.
+func (c *conn) run(args []string) interface{} {
+	switch strings.ToLower(args[0]) {
+	case "multi":
+		if c.multi {
+			return Error("ERR MULTI calls can not be nested")
+		}
+		c.multi, c.queued, c.failed = true, nil, false
+		return "OK"
+	case "discard":
+		if !c.multi {
+			return Error("ERR DISCARD without MULTI")
+		}
+		c.multi, c.queued = false, nil
+		return "OK"
+	case "exec":
+		if !c.multi {
+			return Error("ERR EXEC without MULTI")
+		}
+		c.multi = false
+		if c.failed {
+			return Error("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return c.exec()
+	}
+
+	if c.multi {
+		// Only the commands of the command table can be queued: scripts and
+		// functions are atomic already.
+		if _, err := lookupCommand(args); err != nil {
+			c.failed = true
+			return Error(err.Error())
+		}
+		c.queued = append(c.queued, args)
+		return "QUEUED"
+	}
+
+	return redigoReply(runClientCommand(args))
+}
+
+// exec runs the commands of a transaction atomically, as scripts run, and
+// returns their replies.
+func (c *conn) exec() interface{} {
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	defer trace("exec")()
+	replies := make([]interface{}, len(c.queued))
+	for i, args := range c.queued {
+		replies[i] = redigoReply(execCommand(args, nil))
+	}
+	c.queued = nil
+	return replies
+}
+
+// redigoReply converts a reply of the package to the reply redigo returns.
+func redigoReply(reply interface{}, err error) interface{} {
+	if err != nil {
+		return Error(err.Error())
+	}
+	switch r := reply.(type) {
+	case statusReply:
+		return string(r)
+	case string:
+		return []byte(r)
+	case []interface{}:
+		out := make([]interface{}, len(r))
+		for i, v := range r {
+			out[i] = redigoReply(v, nil)
+		}
+		return out
+	}
+	return reply
+}
+
+// redigoArgs formats a command and its arguments as redigo does.
+func redigoArgs(commandName string, args []interface{}) []string {
+	out := make([]string, 1, 1+len(args))
+	out[0] = commandName
+	for _, arg := range args {
+		if a, ok := arg.(Argument); ok {
+			arg = a.RedisArg()
+		}
+		switch v := arg.(type) {
+		case nil:
+			out = append(out, "")
+		case string:
+			out = append(out, v)
+		case []byte:
+			out = append(out, string(v))
+		case int:
+			out = append(out, strconv.Itoa(v))
+		case int64:
+			out = append(out, strconv.FormatInt(v, 10))
+		case float64:
+			out = append(out, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			out = append(out, strconv.Itoa(boolToInt(v)))
+		default:
+			out = append(out, fmt.Sprint(v))
+		}
+	}
+	return out
+}
+
+// Pool is a pool of connections, as redigo's Pool. As connections hold nothing
+// but the commands sent and their replies, Get returns a new one each time, and
+// only Dial is used.
+type Pool struct {
+	// Dial returns a new connection. It defaults to NewConn.
+	Dial func() (Conn, error)
+
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	Wait        bool
+}
+
+// Get returns a connection. Its Err method returns the error of Dial, if any.
+func (p *Pool) Get() Conn {
+	if p.Dial == nil {
+		return NewConn()
+	}
+	c, err := p.Dial()
+	if err != nil {
+		return errorConn{err}
+	}
+	return c
+}
+
+// Close closes the pool.
+func (p *Pool) Close() error {
+	return nil
+}
+
+// errorConn is the connection Pool.Get returns when it cannot dial one.
+type errorConn struct{ err error }
+
+func (ec errorConn) Close() error                                   { return nil }
+func (ec errorConn) Err() error                                     { return ec.err }
+func (ec errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, ec.err }
+func (ec errorConn) Send(string, ...interface{}) error              { return ec.err }
+func (ec errorConn) Flush() error                                   { return ec.err }
+func (ec errorConn) Receive() (interface{}, error)                  { return nil, ec.err }
+
+// The helpers converting replies, as redigo's: given the reply and the error of
+// Do or Receive, they return the error, or the reply converted, or ErrNil when
+// it is nil.
+
+// String converts a bulk or simple string reply, or an integer, to a string.
+func String(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch r := reply.(type) {
+	case []byte:
+		return string(r), nil
+	case string:
+		return r, nil
+	case int64:
+		return strconv.FormatInt(r, 10), nil
+	case nil:
+		return "", ErrNil
+	case Error:
+		return "", r
+	}
+	return "", fmt.Errorf("redigo: unexpected type for String, got type %T", reply)
+}
+
+// Bytes converts a bulk or simple string reply to a []byte.
+func Bytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch r := reply.(type) {
+	case []byte:
+		return r, nil
+	case string:
+		return []byte(r), nil
+	case nil:
+		return nil, ErrNil
+	case Error:
+		return nil, r
+	}
+	return nil, fmt.Errorf("redigo: unexpected type for Bytes, got type %T", reply)
+}
+
+// Int64 converts an integer reply, or a bulk string holding one, to an int64.
+func Int64(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch r := reply.(type) {
+	case int64:
+		return r, nil
+	case []byte:
+		return strconv.ParseInt(string(r), 10, 64)
+	case nil:
+		return 0, ErrNil
+	case Error:
+		return 0, r
+	}
+	return 0, fmt.Errorf("redigo: unexpected type for Int64, got type %T", reply)
+}
+
+// Int converts an integer reply, or a bulk string holding one, to an int.
+func Int(reply interface{}, err error) (int, error) {
+	n, err := Int64(reply, err)
+	return int(n), err
+}
+
+// Bool converts an integer reply, or a bulk string holding a boolean, to a
+// bool: integers are true unless they are 0.
+func Bool(reply interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	switch r := reply.(type) {
+	case int64:
+		return r != 0, nil
+	case []byte:
+		return strconv.ParseBool(string(r))
+	case nil:
+		return false, ErrNil
+	case Error:
+		return false, r
+	}
+	return false, fmt.Errorf("redigo: unexpected type for Bool, got type %T", reply)
+}
+
+// Values converts an array reply to an []interface{}.
+func Values(reply interface{}, err error) ([]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch r := reply.(type) {
+	case []interface{}:
+		return r, nil
+	case nil:
+		return nil, ErrNil
+	case Error:
+		return nil, r
+	}
+	return nil, fmt.Errorf("redigo: unexpected type for Values, got type %T", reply)
+}
+
+// Strings converts an array reply of bulk strings to a []string, nil elements
+// being empty strings.
+func Strings(reply interface{}, err error) ([]string, error) {
+	values, err := Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case []byte:
+			out[i] = string(v)
+		case string:
+			out[i] = v
+		case nil:
+		default:
+			return nil, fmt.Errorf("redigo: unexpected element type for Strings, got type %T", v)
+		}
+	}
+	return out, nil
+}
+
+// StringMap converts an array reply of field and value pairs, like that of
+// HGETALL, to a map[string]string.
+func StringMap(reply interface{}, err error) (map[string]string, error) {
+	values, err := Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, errors.New("redigo: StringMap expects even number of values result")
+	}
+	out := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		out[values[i]] = values[i+1]
+	}
+	return out, nil
+}
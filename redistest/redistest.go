@@ -0,0 +1,384 @@
+// Package redistest helps testing code that uses go-local-redis: it provides
+// instances with a keyspace of their own for the duration of a test, optionally
+// served over the network, assertions on keys, a fake clock, and snapshots of
+// the keyspace.
+//
+// The package keeps a single keyspace, so instances take turns: New waits for
+// the instance of any other test to be cleaned up. Tests using instances must
+// not run in parallel with each other, and a test with an instance shares it
+// with its subtests rather than asking for another.
+//
+// Besides the keyspace, the settings of go-local-redis changed while an instance
+// lives are restored when it is cleaned up, along with the scripts and function
+// libraries loaded: see redis.SaveSettings for what is not restored.
+package redistest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redis "github.com/AnimationMentor/go-local-redis"
+)
+
+var (
+	// instanceMu is held for the lifetime of an instance.
+	instanceMu sync.Mutex
+
+	// current is the instance alive, if any, so that a test asking for a
+	// second one, which would wait for itself forever, fails instead.
+	current   *Instance
+	currentMu sync.Mutex
+)
+
+// Instance is an empty keyspace for a test. The package's functions and
+// clients run against it until the test ends, when the keyspace is restored as
+// it was before New.
+type Instance struct {
+	// Clock is the clock of the package while the instance lives. It starts at
+	// the time New was called, and only moves when told to.
+	Clock *redis.ManualClock
+
+	t               testing.TB
+	saved           *Snapshot
+	prevClock       redis.Clock
+	restoreSettings func()
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// New returns an instance with an empty keyspace, cleaned up when the test and
+// its subtests end. The test fails if it or a test it is a subtest of has an
+// instance already.
+func New(t testing.TB) *Instance {
+	t.Helper()
+
+	currentMu.Lock()
+	parent := current
+	currentMu.Unlock()
+	if parent != nil && (t.Name() == parent.t.Name() || strings.HasPrefix(t.Name(), parent.t.Name()+"/")) {
+		t.Fatalf("redistest: New called again within %s, whose instance its subtests share", parent.t.Name())
+		return nil
+	}
+
+	instanceMu.Lock()
+	in := &Instance{t: t, Clock: redis.NewManualClock(time.Now())}
+	saved, err := snapshot()
+	if err != nil {
+		instanceMu.Unlock()
+		t.Fatalf("redistest: saving the keyspace: %v", err)
+	}
+	in.saved = saved
+	flush()
+	in.prevClock = redis.SetClock(in.Clock)
+	in.restoreSettings = redis.SaveSettings()
+
+	currentMu.Lock()
+	current = in
+	currentMu.Unlock()
+
+	t.Cleanup(in.cleanup)
+	return in
+}
+
+func (in *Instance) cleanup() {
+	in.mu.Lock()
+	if in.listener != nil {
+		in.listener.Close()
+	}
+	for c := range in.conns {
+		c.Close()
+	}
+	in.mu.Unlock()
+	in.wg.Wait()
+
+	redis.SetClock(in.prevClock)
+	in.restoreSettings()
+	if err := restore(in.saved); err != nil {
+		in.t.Errorf("redistest: restoring the keyspace: %v", err)
+	}
+
+	currentMu.Lock()
+	current = nil
+	currentMu.Unlock()
+	instanceMu.Unlock()
+}
+
+// Snapshot is a copy of the keyspace, with the times to live of its keys.
+type Snapshot struct {
+	rdb []byte
+}
+
+// Snapshot returns a copy of the keyspace, for Restore to bring it back, such as
+// between subtests.
+func (in *Instance) Snapshot() *Snapshot {
+	snap, err := snapshot()
+	if err != nil {
+		in.t.Errorf("redistest: taking a snapshot: %v", err)
+	}
+	return snap
+}
+
+// Restore replaces the keyspace with a snapshot. Keys whose time to live has
+// run out since the snapshot was taken are not restored.
+func (in *Instance) Restore(snap *Snapshot) {
+	if err := restore(snap); err != nil {
+		in.t.Errorf("redistest: restoring a snapshot: %v", err)
+	}
+}
+
+func snapshot() (*Snapshot, error) {
+	var b bytes.Buffer
+	if err := redis.WriteRDB(&b); err != nil {
+		return nil, err
+	}
+	return &Snapshot{rdb: b.Bytes()}, nil
+}
+
+func restore(snap *Snapshot) error {
+	flush()
+	if snap == nil {
+		return nil
+	}
+	_, err := redis.ReadRDB(bytes.NewReader(snap.rdb))
+	return err
+}
+
+func flush() {
+	if keys := redis.Keys(""); len(keys) > 0 {
+		redis.Del(keys...)
+	}
+}
+
+// AssertKeyEquals reports an error unless key holds the string want.
+func AssertKeyEquals(t testing.TB, key, want string) {
+	t.Helper()
+
+	if typ := redis.Type(key); typ != "string" {
+		t.Errorf("key %q is a %s, want string %q", key, typeName(typ), want)
+		return
+	}
+	if got := redis.Get(key); got != want {
+		t.Errorf("key %q is %q, want %q", key, got, want)
+	}
+}
+
+// AssertTTL reports an error unless key has want to live, to the millisecond, or
+// does not expire if want is 0. As the clock of the instance only moves when told
+// to, times to live do not run down while the test runs.
+func AssertTTL(t testing.TB, key string, want time.Duration) {
+	t.Helper()
+
+	ttl := redis.Pttl(key)
+	switch {
+	case ttl == -2:
+		t.Errorf("key %q does not exist, want a TTL of %v", key, want)
+	case ttl == -1 && want != 0:
+		t.Errorf("key %q does not expire, want a TTL of %v", key, want)
+	case ttl >= 0 && want == 0:
+		t.Errorf("key %q has a TTL of %v, want none", key, time.Duration(ttl)*time.Millisecond)
+	case ttl >= 0:
+		if got := time.Duration(ttl) * time.Millisecond; got != want {
+			t.Errorf("key %q has a TTL of %v, want %v", key, got, want)
+		}
+	}
+}
+
+// AssertHash reports an error unless key holds a hash with the fields and
+// values of want, and no others.
+func AssertHash(t testing.TB, key string, want map[string]string) {
+	t.Helper()
+
+	if typ := redis.Type(key); typ != "hash" {
+		t.Errorf("key %q is a %s, want hash %v", key, typeName(typ), want)
+		return
+	}
+	if got := redis.Hgetall(key).ToMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("key %q is hash %v, want %v", key, got, want)
+	}
+}
+
+func typeName(typ string) string {
+	if typ == "" {
+		return "missing key"
+	}
+	return typ
+}
+
+// Addr returns the address of a server of the RESP protocol in front of the
+// instance, for clients connecting over the network, such as those of other
+// processes. The server is started on the first call, on a free port of the
+// loopback interface, and stops with the instance. Each connection runs its
+// commands as a redis.Conn does, and Pub/Sub commands are not supported.
+func (in *Instance) Addr() string {
+	in.t.Helper()
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.listener == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			in.t.Fatalf("redistest: listening: %v", err)
+		}
+		in.listener = l
+		in.conns = make(map[net.Conn]bool)
+		in.wg.Add(1)
+		go in.serve(l)
+	}
+	return in.listener.Addr().String()
+}
+
+func (in *Instance) serve(l net.Listener) {
+	defer in.wg.Done()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		in.mu.Lock()
+		in.conns[c] = true
+		in.wg.Add(1)
+		in.mu.Unlock()
+		go in.serveConn(c)
+	}
+}
+
+func (in *Instance) serveConn(c net.Conn) {
+	defer in.wg.Done()
+	defer func() {
+		in.mu.Lock()
+		delete(in.conns, c)
+		in.mu.Unlock()
+		c.Close()
+	}()
+
+	conn := redis.NewConn()
+	defer conn.Close()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				writeReply(w, redis.Error(perr))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(args[0])
+		if name == "quit" {
+			writeReply(w, "OK")
+			w.Flush()
+			return
+		}
+		params := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			params[i] = arg
+		}
+		reply, err := conn.Do(args[0], params...)
+		if e, ok := err.(redis.Error); ok {
+			reply = e
+		}
+		writeReply(w, reply)
+
+		// Replies are sent once the commands pipelined with them have run.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// protocolError is an error in a request, which is replied to before closing
+// the connection.
+type protocolError string
+
+func (e protocolError) Error() string { return string(e) }
+
+// readCommand reads a command, as an array of bulk strings or inline.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, protocolError("ERR Protocol error: invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, protocolError(fmt.Sprintf("ERR Protocol error: expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return nil, protocolError("ERR Protocol error: invalid bulk length")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writeReply writes a reply of a redis.Conn.
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case redis.Error:
+		fmt.Fprintf(w, "-%s\r\n", r)
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(r), r)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeReply(w, v)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unexpected reply %T\r\n", reply)
+	}
+}
@@ -0,0 +1,186 @@
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	redis "github.com/AnimationMentor/go-local-redis"
+)
+
+func TestInstance(t *testing.T) {
+	redis.Set("redistest outside", "kept")
+	defer redis.Del("redistest outside")
+
+	t.Run("isolated", func(t *testing.T) {
+		in := New(t)
+		if keys := redis.Keys(""); len(keys) != 0 {
+			t.Errorf("New left keys %v", keys)
+		}
+
+		redis.Set("k", "v")
+		redis.HSet("h", "f", "1")
+		AssertKeyEquals(t, "k", "v")
+		AssertHash(t, "h", map[string]string{"f": "1"})
+		AssertTTL(t, "k", 0)
+
+		snap := in.Snapshot()
+		redis.Set("k", "changed")
+		redis.Del("h")
+		in.Restore(snap)
+		AssertKeyEquals(t, "k", "v")
+		AssertHash(t, "h", map[string]string{"f": "1"})
+	})
+
+	if got := redis.Get("redistest outside"); got != "kept" {
+		t.Errorf("Cleanup left %q", got)
+	}
+	if got := redis.Exists("k"); got != 0 {
+		t.Error("Cleanup kept a key of the instance")
+	}
+}
+
+func TestClock(t *testing.T) {
+	in := New(t)
+	start := in.Clock.Now()
+
+	redis.Set("short", "1")
+	redis.Expire("short", 10)
+	redis.Set("long", "1")
+	redis.Expire("long", 3600)
+	AssertTTL(t, "long", time.Hour)
+
+	in.Clock.Advance(time.Minute)
+	if got := in.Clock.Now().Sub(start); got != time.Minute {
+		t.Errorf("Clock moved %v", got)
+	}
+	if redis.Exists("short") != 0 {
+		t.Error("Key outlived its TTL")
+	}
+	AssertTTL(t, "long", 59*time.Minute)
+}
+
+// fakeT records the errors of assertions.
+type fakeT struct {
+	testing.TB
+	name   string
+	errors []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Name() string { return t.name }
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func TestNestedNew(t *testing.T) {
+	New(t)
+
+	for _, name := range []string{t.Name(), t.Name() + "/subtest"} {
+		ft := &fakeT{name: name}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			New(ft)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("New within %s is waiting for its parent's instance", name)
+		}
+		if len(ft.errors) != 1 || !strings.Contains(ft.errors[0], "New called again") {
+			t.Errorf("New within %s failed with %q", name, ft.errors)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	var sha string
+	t.Run("instance", func(t *testing.T) {
+		New(t)
+		if err := redis.SetNotifyKeyspaceEvents("KEA"); err != nil {
+			t.Fatal(err)
+		}
+		redis.SetMaxmemory(1 << 30)
+		var err error
+		if sha, err = redis.ScriptLoad("return 1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if got := redis.GetNotifyKeyspaceEvents(); got != "" {
+		t.Errorf("Cleanup left keyspace events %q", got)
+	}
+	if got := redis.ScriptExists(sha); got[0] != 0 {
+		t.Error("Cleanup kept a script loaded by the instance")
+	}
+	if info := redis.Info("memory"); !strings.Contains(info, "maxmemory:0\r\n") {
+		t.Errorf("Cleanup left maxmemory set:\n%s", info)
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	New(t)
+	redis.Set("k", "v")
+	redis.Pexpire("k", 5000)
+	redis.HSet("h", "f", "1")
+
+	for _, test := range []struct {
+		assert func(t testing.TB)
+		want   string
+	}{
+		{func(t testing.TB) { AssertKeyEquals(t, "k", "w") }, `key "k" is "v", want "w"`},
+		{func(t testing.TB) { AssertKeyEquals(t, "h", "v") }, `key "h" is a hash, want string "v"`},
+		{func(t testing.TB) { AssertKeyEquals(t, "missing", "v") }, `key "missing" is a missing key, want string "v"`},
+		{func(t testing.TB) { AssertHash(t, "h", map[string]string{"f": "2"}) }, `key "h" is hash map[f:1], want map[f:2]`},
+		{func(t testing.TB) { AssertTTL(t, "k", 0) }, `key "k" has a TTL of`},
+		{func(t testing.TB) { AssertTTL(t, "k", 10*time.Second) }, `key "k" has a TTL of`},
+		{func(t testing.TB) { AssertTTL(t, "h", time.Second) }, `key "h" does not expire, want a TTL of 1s`},
+		{func(t testing.TB) { AssertTTL(t, "missing", time.Second) }, `key "missing" does not exist, want a TTL of 1s`},
+		{func(t testing.TB) { AssertTTL(t, "k", 5*time.Second) }, ``},
+	} {
+		ft := &fakeT{}
+		test.assert(ft)
+		switch {
+		case test.want == "" && len(ft.errors) != 0:
+			t.Errorf("Unexpected errors %q", ft.errors)
+		case test.want != "" && (len(ft.errors) != 1 || !strings.HasPrefix(ft.errors[0], test.want)):
+			t.Errorf("Errors %q, want %q", ft.errors, test.want)
+		}
+	}
+}
+
+func TestAddr(t *testing.T) {
+	in := New(t)
+
+	c, err := net.Dial("tcp", in.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Two pipelined commands, an inline one and an unknown one.
+	io.WriteString(c, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nhello\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\nDEL k missing\r\nNOSUCH\r\n")
+	want := "+OK\r\n$5\r\nhello\r\n:1\r\n-ERR unknown command 'NOSUCH'\r\n"
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(bufio.NewReader(c), got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Replies %q, want %q", got, want)
+	}
+}
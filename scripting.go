@@ -0,0 +1,442 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scripts run one at a time, with execMu held for writing, so that nothing else
+// touches the keyspace while they do: a script is as atomic as a single command.
+// Commands called from scripts with redis.call run by name through the command
+// table.
+
+var (
+	errNoScript     = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errNotBusy      = errors.New("NOTBUSY No scripts in execution right now.")
+	errUnkillable   = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	errScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL...")
+)
+
+var (
+	// scripts holds the compiled scripts by the SHA1 digest of their body.
+	scripts   = make(map[string]*funcProto)
+	scriptsMu sync.Mutex
+
+	// lua is the state scripts run in, created by the first script. It is only
+	// used with execMu held for writing.
+	lua *luaState
+
+	// runningScript is the script being run, if any, for SCRIPT KILL.
+	runningScript *scriptRun
+	runningMu     sync.Mutex
+
+	// luaTimeLimit is a time.Duration, accessed atomically.
+	luaTimeLimit = int64(5 * time.Second)
+)
+
+// scriptRun is a script being run. Its fields are guarded by runningMu.
+type scriptRun struct {
+	start  time.Time
+	wrote  bool // it called a write command
+	killed bool // SCRIPT KILL stopped it
+}
+
+// callScript is call for EVAL and EVALSHA, which wait for every other command to
+// finish and keep them waiting while the script runs. args builds the arguments
+// when they are needed, as for callKey.
+func callScript(name string, args func() []string) func() {
+	execMu.Lock()
+	done := traceLazy(name, nil, args)
+
+	return func() {
+		done()
+		execMu.Unlock()
+	}
+}
+
+// SetLuaTimeLimit sets how long a script runs before SCRIPT KILL can stop it,
+// like the lua-time-limit directive. Scripts are never stopped otherwise, as
+// stopping them midway would break their atomicity. The default is 5 seconds.
+func SetLuaTimeLimit(d time.Duration) {
+	atomic.StoreInt64(&luaTimeLimit, int64(d))
+}
+
+// Evaluates a Lua 5.1 script atomically, with the keys it accesses in the KEYS
+// table and further arguments in the ARGV table. The script calls commands with
+// redis.call, which raises their errors, or redis.pcall, which returns them.
+// Replies are converted between Redis and Lua as Redis converts them: integers
+// to numbers, nil to false, arrays to tables, status replies to a table with an
+// ok field and errors to a table with an err field, and back, numbers being
+// truncated to integers and true returned as 1.
+//
+// Scripts are cached, so that EVALSHA can run them by their SHA1 digest.
+//
+// Return value
+// The value returned by the script: nil, an int64, a string or an []interface{}
+// of those, or the error it raised or returned with redis.error_reply.
+func Eval(script string, keys []string, args ...string) (interface{}, error) {
+	defer callScript("eval", func() []string { return scriptCallArgs(script, keys, args) })()
+
+	sha, proto, err := loadScript(script)
+	if err != nil {
+		return nil, err
+	}
+
+	return runScript(sha, proto, keys, args)
+}
+
+// Evaluates a script cached by EVAL or SCRIPT LOAD by its SHA1 digest. It is
+// otherwise identical to EVAL.
+//
+// Return value
+// The value returned by the script, or a NOSCRIPT error if no script has the
+// digest.
+func EvalSha(sha1 string, keys []string, args ...string) (interface{}, error) {
+	defer callScript("evalsha", func() []string { return scriptCallArgs(sha1, keys, args) })()
+
+	sha1 = strings.ToLower(sha1)
+	scriptsMu.Lock()
+	proto, ok := scripts[sha1]
+	scriptsMu.Unlock()
+	if !ok {
+		return nil, errorReply(errNoScript)
+	}
+
+	return runScript(sha1, proto, keys, args)
+}
+
+func scriptCallArgs(script string, keys, args []string) []string {
+	out := make([]string, 0, 2+len(keys)+len(args))
+	out = append(out, script, strconv.Itoa(len(keys)))
+	out = append(out, keys...)
+	return append(out, args...)
+}
+
+// Loads a script into the script cache, without running it, so that EVALSHA can
+// run it.
+//
+// Return value
+// Bulk string reply: the SHA1 digest of the script, or an error if it does not
+// compile.
+func ScriptLoad(script string) (string, error) {
+	defer call("script|load", script)()
+
+	sha, _, err := loadScript(script)
+	return sha, err
+}
+
+// Returns information about the existence of the scripts in the script cache.
+//
+// Return value
+// Array reply: for each SHA1 digest, 1 if the script is cached and 0 if it is not.
+func ScriptExists(sha1 ...string) []int {
+	defer call("script|exists", sha1...)()
+
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+
+	out := make([]int, len(sha1))
+	for i, sha := range sha1 {
+		_, ok := scripts[strings.ToLower(sha)]
+		out[i] = boolToInt(ok)
+	}
+	return out
+}
+
+// Flushes the script cache.
+//
+// Return value
+// Simple string reply: OK.
+func ScriptFlush() string {
+	defer call("script|flush")()
+
+	scriptsMu.Lock()
+	scripts = make(map[string]*funcProto)
+	scriptsMu.Unlock()
+
+	return "OK"
+}
+
+// Kills the script currently running, provided it has not written to the
+// keyspace: a script that wrote cannot be stopped without breaking its
+// atomicity. As in Redis, where SCRIPT KILL is only served once a script has run
+// for the time limit, SCRIPT KILL waits until the script has run that long. The
+// wait is on the clock of the package: with a ManualClock, ScriptKill returns
+// only once another goroutine advances the clock past the time limit.
+//
+// Return value
+// nil if the script was killed, a NOTBUSY error if no script is running, or an
+// UNKILLABLE error if it wrote to the keyspace.
+func ScriptKill() error {
+	// Not call, as it would wait for the script to end.
+	defer trace("script|kill")()
+
+	for {
+		runningMu.Lock()
+		run := runningScript
+		if run == nil {
+			runningMu.Unlock()
+			return errorReply(errNotBusy)
+		}
+		if run.wrote {
+			runningMu.Unlock()
+			return errorReply(errUnkillable)
+		}
+		wait := time.Duration(atomic.LoadInt64(&luaTimeLimit)) - timeSince(run.start)
+		if wait <= 0 {
+			run.killed = true
+			runningMu.Unlock()
+			return nil
+		}
+		runningMu.Unlock()
+
+		sleep(wait)
+	}
+}
+
+// loadScript compiles script, unless it is cached, and returns its SHA1 digest.
+func loadScript(script string) (string, *funcProto, error) {
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	scriptsMu.Lock()
+	proto, ok := scripts[sha]
+	scriptsMu.Unlock()
+	if ok {
+		return sha, proto, nil
+	}
+
+	proto, err := compileLua("user_script", script)
+	if err != nil {
+		return "", nil, errorReply(fmt.Errorf("ERR Error compiling script (new function): %v", err))
+	}
+
+	scriptsMu.Lock()
+	scripts[sha] = proto
+	scriptsMu.Unlock()
+	return sha, proto, nil
+}
+
+// runScript runs a compiled script, with execMu held for writing.
+func runScript(sha string, proto *funcProto, keys, args []string) (interface{}, error) {
+	if lua == nil {
+		lua = newLuaState("user_script")
+		lua.globals.set("redis", newRedisLib())
+	}
+	L := lua
+	L.globals.set("KEYS", stringsToLua(keys))
+	L.globals.set("ARGV", stringsToLua(args))
+	// Scripts get the same random numbers every time, as in Redis.
+	L.rand.Seed(0)
+
+	run := &scriptRun{start: timeNow()}
+	runningMu.Lock()
+	runningScript = run
+	runningMu.Unlock()
+	defer func() {
+		runningMu.Lock()
+		runningScript = nil
+		runningMu.Unlock()
+	}()
+
+	L.interrupt = func() error {
+		runningMu.Lock()
+		defer runningMu.Unlock()
+
+		if run.killed {
+			return errScriptKilled
+		}
+		return nil
+	}
+
+	results, err := L.run(&luaFunction{proto: proto})
+	if err != nil {
+		return nil, errorReply(scriptError(L, sha, err))
+	}
+
+	reply, err := luaToReply(first(results))
+	if err != nil {
+		return nil, errorReply(err)
+	}
+	return plainReply(reply), nil
+}
+
+// scriptError returns the error reply of a script that raised err.
+func scriptError(L *luaState, sha string, err error) error {
+	e, ok := err.(*luaError)
+	if !ok {
+		return err
+	}
+	msg := e.Error()
+	if t, ok := e.value.(*luaTable); ok {
+		// An error of redis.call, or a table raised by the script.
+		if s, ok := t.getString("err").(string); ok {
+			msg = s
+		}
+	} else {
+		msg = "ERR " + msg
+	}
+	return fmt.Errorf("%s script: %s, on @%s:%d.", msg, sha, L.chunk, L.line)
+}
+
+// newRedisLib returns the redis table of scripts.
+func newRedisLib() *luaTable {
+	t := newLuaLib(newLuaTable(0, 10), map[string]func(a luaArgs) []luaValue{
+		"call": func(a luaArgs) []luaValue {
+			reply, err := scriptCall(a)
+			if err != nil {
+				panic(&luaError{errorTable(err)})
+			}
+			return values(replyToLua(reply))
+		},
+		"pcall": func(a luaArgs) []luaValue {
+			reply, err := scriptCall(a)
+			if err != nil {
+				return values(errorTable(err))
+			}
+			return values(replyToLua(reply))
+		},
+		"error_reply": func(a luaArgs) []luaValue {
+			return values(errorTable(errors.New(a.str(1))))
+		},
+		"status_reply": func(a luaArgs) []luaValue {
+			return values(replyToLua(statusReply(a.str(1))))
+		},
+		"sha1hex": func(a luaArgs) []luaValue {
+			sum := sha1.Sum([]byte(a.str(1)))
+			return values(hex.EncodeToString(sum[:]))
+		},
+		// log checks its arguments and discards the message, as the package
+		// keeps no log.
+		"log": func(a luaArgs) []luaValue {
+			if level := a.int(1); level < 0 || level > 3 {
+				a.L.errorf("Invalid debug level.")
+			}
+			a.str(2)
+			return nil
+		},
+	})
+	t.set("LOG_DEBUG", float64(0))
+	t.set("LOG_VERBOSE", float64(1))
+	t.set("LOG_NOTICE", float64(2))
+	t.set("LOG_WARNING", float64(3))
+	t.readonly = true
+	return t
+}
+
+// scriptCall runs the command of a call to redis.call or redis.pcall.
+func scriptCall(a luaArgs) (interface{}, error) {
+	if len(a.v) == 0 {
+		a.L.errorf("Please specify at least one argument for this redis lib call")
+	}
+	args := make([]string, len(a.v))
+	for i, v := range a.v {
+		s, ok := luaToString(v)
+		if !ok {
+			a.L.errorf("Lua redis lib command arguments must be strings or integers")
+		}
+		args[i] = s
+	}
+
+	return execCommand(args, func(cmd *command) error {
+		if cmd.flags&cmdWrite != 0 {
+			runningMu.Lock()
+			runningScript.wrote = true
+			runningMu.Unlock()
+		}
+		return nil
+	})
+}
+
+func errorTable(err error) *luaTable {
+	t := newLuaTable(0, 1)
+	t.set("err", err.Error())
+	return t
+}
+
+func stringsToLua(values []string) *luaTable {
+	t := newLuaTable(len(values), 0)
+	for i, v := range values {
+		t.set(float64(i+1), v)
+	}
+	return t
+}
+
+// replyToLua converts the reply of a command to the value redis.call returns.
+func replyToLua(reply interface{}) luaValue {
+	switch r := reply.(type) {
+	case int64:
+		return float64(r)
+	case string:
+		return r
+	case statusReply:
+		t := newLuaTable(0, 1)
+		t.set("ok", string(r))
+		return t
+	case []interface{}:
+		t := newLuaTable(len(r), 0)
+		for i, v := range r {
+			t.set(float64(i+1), replyToLua(v))
+		}
+		return t
+	case error:
+		return errorTable(r)
+	}
+	return false
+}
+
+// luaToReply converts the value returned by a script to its reply. The elements
+// of a table are those from 1 up to the first nil.
+func luaToReply(v luaValue) (interface{}, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+	case float64:
+		return int64(v), nil
+	case string:
+		return v, nil
+	case *luaTable:
+		if msg, ok := v.getString("err").(string); ok {
+			return nil, errors.New(msg)
+		}
+		if status, ok := v.getString("ok").(string); ok {
+			return statusReply(status), nil
+		}
+		out := []interface{}{}
+		for i := 1; ; i++ {
+			elem := v.get(float64(i))
+			if elem == nil {
+				break
+			}
+			reply, err := luaToReply(elem)
+			if err != nil {
+				reply = err
+			}
+			out = append(out, reply)
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// plainReply turns status replies into strings, for callers of the Go API.
+func plainReply(reply interface{}) interface{} {
+	switch r := reply.(type) {
+	case statusReply:
+		return string(r)
+	case []interface{}:
+		for i, v := range r {
+			r[i] = plainReply(v)
+		}
+	}
+	return reply
+}
@@ -2,91 +2,373 @@ package redis
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// SavePoint is one "save <seconds> <changes>" rule: the keyspace is saved in the
+// background once Seconds have passed since the last save and at least Changes
+// writes have been made since then.
+type SavePoint struct {
+	Seconds int
+	Changes int
+}
+
+// bgsaveRetryDelay is how long save points wait after a failed background save
+// before trying again, so a full disk is not hammered every cron tick.
+const bgsaveRetryDelay = 5 * time.Second
+
 var (
-	lastPublishCount    uint64 = 0
-	DefaultDumpFileName        = "../redisServer.dump.json"
+	DefaultDumpFileName = "../redisServer.dump.json"
 	fileWriteMu         sync.Mutex
+
+	// dirtyAtSave is dirtyCount when the last successful save took its
+	// snapshot.
+	dirtyAtSave uint64
+
+	saveMu          sync.Mutex
+	savePoints      []SavePoint
+	lastSave        = timeNow()
+	lastSaveOK      = true
+	lastSaveAttempt time.Time
+	bgsaveRunning   bool
+
+	// saves and saveFailures count the snapshots attempted and those that
+	// failed; saveDuration is the time they took in total.
+	saves            uint64
+	saveFailures     uint64
+	saveDuration     time.Duration
+	lastSaveDuration time.Duration
+
+	shutdownOnce sync.Once
+	cronStop     = make(chan struct{})
 )
 
+var errBgsaveInProgress = errors.New("ERR Background save already in progress")
+
 // Save the DB in background. The OK code is immediately returned. Redis forks, the parent
 // continues to serve the clients, the child saves the DB on disk then exits. A client my
 // be able to check if the operation succeeded using the LASTSAVE command.
 // Please refer to the persistence documentation for detailed information.
 //
+// If complete is not nil, true is sent on it once the DB was saved, or false if the
+// save failed or was not started.
+//
 // Return value
-// Simple string reply
+// Simple string reply: OK, or the error reply "ERR Background save already in
+// progress" when a background save, started by BgSave or a save point, is still
+// running. No other save is started then.
 func BgSave(fileName string, complete chan bool) string {
-	pubCount := atomic.LoadUint64(&publishCount)
-	if pubCount > atomic.LoadUint64(&lastPublishCount) {
-		atomic.StoreUint64(&lastPublishCount, pubCount)
+	defer call("bgsave", fileName)()
 
-		go func() {
-			fileWriteMu.Lock()
-			defer fileWriteMu.Unlock()
+	return bgsave(fileName, complete)
+}
 
-			fo, _ := os.Create(fileName)
-			defer fo.Close()
-			w := bufio.NewWriter(fo)
+// bgsave saves the DB in the background, for BGSAVE and the save points.
+func bgsave(fileName string, complete chan bool) string {
+	saveMu.Lock()
+	if bgsaveRunning {
+		saveMu.Unlock()
+		if complete != nil {
+			go func() { complete <- false }()
+		}
+		return errorReply(errBgsaveInProgress).Error()
+	}
+	bgsaveRunning = true
+	lastSaveAttempt = timeNow()
+	saveMu.Unlock()
 
-			// TODO: Lock around each key (checking existence) instead of around the whole
-			// hash so that other operations may sneak in.
+	go func() {
+		err := save(fileName)
 
-			allMaps := make(map[string]map[string]string)
+		saveMu.Lock()
+		bgsaveRunning = false
+		saveMu.Unlock()
 
-			hashesMu.RLock()
-			for key, hash := range allHashes {
-				allMaps[key] = hash.ToMap()
-			}
-			hashesMu.RUnlock()
-			b1, err := json.MarshalIndent(&allMaps, "", "    ")
-			if err != nil {
-				println(err.Error())
-				return
-			}
-			w.Write(b1)
-
-			listsMu.RLock()
-			b2, err := json.MarshalIndent(&allLists, "", "    ")
-			listsMu.RUnlock()
-			if err != nil {
-				println(err.Error())
-				return
-			}
-			w.Write(b2)
-
-			setsMu.RLock()
-			b3, err := json.MarshalIndent(&allSets, "", "    ")
-			setsMu.RUnlock()
-			if err != nil {
-				println(err.Error())
-				return
-			}
-			w.Write(b3)
-
-			stringsMu.RLock()
-			b4, err := json.MarshalIndent(&allStrings, "", "    ")
-			stringsMu.RUnlock()
-			if err != nil {
-				println(err.Error())
-				return
-			}
-			w.Write(b4)
+		if err != nil {
+			println(err.Error())
+		}
+		if complete != nil {
+			complete <- err == nil
+		}
+	}()
+
+	return "OK"
+}
 
-			w.Flush()
+// The SAVE commands performs a synchronous save of the dataset producing a point in
+// time snapshot of all the data inside the Redis instance, in the form of a JSON file.
+//
+// Return value
+// nil on success, or the error that stopped the file being written.
+func Save(fileName string) error {
+	// Not call, as the snapshot waits for scripts itself.
+	defer trace("save", fileName)()
+
+	return save(fileName)
+}
+
+// save writes the DB to fileName and records the outcome for LASTSAVE and the
+// save points.
+func save(fileName string) error {
+	changes := dirtyCount()
+
+	start := timeNow()
+	err := writeFileAtomic(fileName, func(w *bufio.Writer) error {
+		defer latencySample("snapshot-serialize", timeNow())
+		return writeDump(w)
+	})
+	took := timeSince(start)
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	saves++
+	saveDuration += took
+	lastSaveDuration = took
+	if err != nil {
+		saveFailures++
+	}
 
-			if complete != nil {
-				complete <- true
+	lastSaveOK = err == nil
+	if err == nil {
+		lastSave = timeNow()
+		atomic.StoreUint64(&dirtyAtSave, changes)
+	}
+
+	return err
+}
+
+// Return the UNIX TIME of the last DB save executed with success. A client may check if
+// a BGSAVE command succeeded reading the LASTSAVE value, then issuing a BGSAVE command
+// and checking at regular intervals every N seconds if LASTSAVE changed.
+//
+// Return value
+// Integer reply: an UNIX time stamp.
+func Lastsave() int64 {
+	defer call("lastsave")()
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	return lastSave.Unix()
+}
+
+// SetSavePoints replaces the rules that trigger an automatic background save to
+// DefaultDumpFileName, like the save directive of redis.conf. With no points,
+// automatic saving is disabled. After Shutdown, points are recorded but no longer
+// trigger saves.
+//
+//	SetSavePoints(SavePoint{900, 1}, SavePoint{300, 10}, SavePoint{60, 10000})
+func SetSavePoints(points ...SavePoint) {
+	saveMu.Lock()
+	savePoints = append([]SavePoint(nil), points...)
+	saveMu.Unlock()
+}
+
+// Shutdown stops automatic saving and performs a final synchronous save of the DB to
+// DefaultDumpFileName, so no change is lost when the process exits. Automatic saving
+// stays stopped for the rest of the process, whatever the save points: Shutdown is
+// meant to be called once, on the way out.
+func Shutdown() error {
+	shutdownOnce.Do(func() {
+		close(cronStop)
+	})
+
+	return save(DefaultDumpFileName)
+}
+
+// addDirty records n changes to the keys of the shard. Each shard counts its
+// own, so writers to different shards do not contend for a counter.
+func (s *shard) addDirty(n int) {
+	if n > 0 {
+		atomic.AddUint64(&s.dirty, uint64(n))
+	}
+}
+
+// dirtyCount returns the number of changes made to the keyspace.
+func dirtyCount() (n uint64) {
+	for _, s := range shards {
+		n += atomic.LoadUint64(&s.dirty)
+	}
+	return
+}
+
+// checkSavePoints starts a background save when any save point is satisfied.
+func checkSavePoints(now time.Time) {
+	changes := dirtyCount() - atomic.LoadUint64(&dirtyAtSave)
+
+	saveMu.Lock()
+	due := false
+	if !bgsaveRunning && (lastSaveOK || now.Sub(lastSaveAttempt) > bgsaveRetryDelay) {
+		for _, p := range savePoints {
+			if changes >= uint64(p.Changes) && now.Sub(lastSave) >= time.Duration(p.Seconds)*time.Second {
+				due = true
+				break
 			}
-		}()
+		}
 	}
+	saveMu.Unlock()
 
-	return "OK"
+	if due {
+		bgsave(DefaultDumpFileName, nil)
+	}
+}
+
+func writeDump(w *bufio.Writer) error {
+	// The keyspace is copied under its locks and marshalled outside of them, so
+	// other commands only wait for the copy.
+	snap := snapshotKeyspace()
+	snap.mapStrings(dumpEncode)
+
+	b1, err := json.MarshalIndent(&snap.hashes, "", "    ")
+	if err != nil {
+		return err
+	}
+	w.Write(b1)
+
+	b2, err := json.MarshalIndent(&snap.lists, "", "    ")
+	if err != nil {
+		return err
+	}
+	w.Write(b2)
+
+	b3, err := json.MarshalIndent(&snap.sets, "", "    ")
+	if err != nil {
+		return err
+	}
+	w.Write(b3)
+
+	b4, err := json.MarshalIndent(&snap.strings, "", "    ")
+	if err != nil {
+		return err
+	}
+	w.Write(b4)
+
+	// Expire times, as UNIX times in milliseconds.
+	allExpires := make(map[string]int64)
+	for key, when := range snap.expires {
+		allExpires[key] = when.UnixNano() / int64(time.Millisecond)
+	}
+	b5, err := json.MarshalIndent(&allExpires, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b5)
+
+	return err
+}
+
+// dumpBinaryPrefix marks the strings of a JSON dump that are written in base64:
+// those that are not valid UTF-8, which JSON strings cannot hold, and those that
+// start with the prefix themselves. Every other string is written as it is, so
+// text stays readable and older dumps load unchanged.
+const dumpBinaryPrefix = "\x00base64:"
+
+// dumpEncode returns s as it is written to a JSON dump.
+func dumpEncode(s string) string {
+	if utf8.ValidString(s) && !strings.HasPrefix(s, dumpBinaryPrefix) {
+		return s
+	}
+	return dumpBinaryPrefix + base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// dumpDecode returns the string that dumpEncode wrote as s.
+func dumpDecode(s string) string {
+	if !strings.HasPrefix(s, dumpBinaryPrefix) {
+		return s
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(dumpBinaryPrefix):])
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// mapStrings replaces every key name, field, member and value of the snapshot
+// with f of it. Expire times are kept under the mapped key names.
+func (snap *keyspaceSnapshot) mapStrings(f func(string) string) {
+	hashes := make(map[string]map[string]string, len(snap.hashes))
+	for key, fields := range snap.hashes {
+		mapped := make(map[string]string, len(fields))
+		for field, value := range fields {
+			mapped[f(field)] = f(value)
+		}
+		hashes[f(key)] = mapped
+	}
+	snap.hashes = hashes
+
+	lists := make(map[string]List, len(snap.lists))
+	for key, list := range snap.lists {
+		for i, v := range list {
+			list[i] = f(v)
+		}
+		lists[f(key)] = list
+	}
+	snap.lists = lists
+
+	sets := make(map[string]RedisSet, len(snap.sets))
+	for key, set := range snap.sets {
+		mapped := make(RedisSet, len(set))
+		for member := range set {
+			mapped[f(member)] = true
+		}
+		sets[f(key)] = mapped
+	}
+	snap.sets = sets
+
+	strs := make(map[string]string, len(snap.strings))
+	for key, value := range snap.strings {
+		strs[f(key)] = f(value)
+	}
+	snap.strings = strs
+
+	expires := make(map[string]time.Time, len(snap.expires))
+	for key, when := range snap.expires {
+		expires[f(key)] = when
+	}
+	snap.expires = expires
+}
+
+// writeFileAtomic writes a file next to fileName and renames it into place once it is
+// complete, so readers never see a partial dump.
+func writeFileAtomic(fileName string, write func(w *bufio.Writer) error) error {
+	if fileName == "" {
+		return errors.New("redis: no file name to save to")
+	}
+
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err = write(w); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fileName)
 }
 
 //// Load any backup before doing anything else.
@@ -104,24 +386,61 @@ func InitDB(fileName string) {
 
 		allMaps := make(map[string]map[string]string)
 		dec.Decode(&allMaps)
-		hashesMu.Lock()
-		for key, aMap := range allMaps {
-			hash := NewHash()
-			hash.m = aMap
-			allHashes[key] = hash
+		allLists := make(map[string]List)
+		dec.Decode(&allLists)
+		allSets := make(map[string]RedisSet)
+		dec.Decode(&allSets)
+		allStrings := make(map[string]string)
+		dec.Decode(&allStrings)
+		// Dumps written before expires were saved end here.
+		allExpires := make(map[string]int64)
+		dec.Decode(&allExpires)
+
+		snap := keyspaceSnapshot{hashes: allMaps, lists: allLists, sets: allSets, strings: allStrings}
+		snap.mapStrings(dumpDecode)
+		allMaps, allLists, allSets, allStrings = snap.hashes, snap.lists, snap.sets, snap.strings
+		expires := make(map[string]int64, len(allExpires))
+		for key, ms := range allExpires {
+			expires[dumpDecode(key)] = ms
 		}
-		hashesMu.Unlock()
+		allExpires = expires
 
-		listsMu.Lock()
-		dec.Decode(&allLists)
-		listsMu.Unlock()
+		// Like ReadRDB, the keys are loaded at once.
+		execMu.Lock()
+		defer execMu.Unlock()
 
-		setsMu.Lock()
-		dec.Decode(&allSets)
-		setsMu.Unlock()
+		load := func(key string, typ valueType, value interface{}) {
+			s := shardFor(key)
+			s.mu.Lock()
+			s.deleteKey(notifyGeneric, "del", key)
+			invalidateTrackedKey(key)
+			e := s.add(key, typ, value)
+			if ms, ok := allExpires[key]; ok {
+				// A corrupt expire, out of range, is dropped with the
+				// key kept, rather than read as a past deadline.
+				if when, valid := unixMilliExpire(ms); valid {
+					s.setExpire(key, e, when)
+				}
+			}
+			e.measure(key)
+			s.mu.Unlock()
+		}
 
-		stringsMu.Lock()
-		dec.Decode(&allStrings)
-		stringsMu.Unlock()
+		for key, aMap := range allMaps {
+			load(key, typeHash, newHashValue(aMap))
+		}
+		for key, list := range allLists {
+			load(key, typeList, newListValue(list))
+		}
+		for key, set := range allSets {
+			load(key, typeSet, newSetValue(set))
+		}
+		for key, str := range allStrings {
+			load(key, typeString, str)
+		}
 	}
 }
+
+func init() {
+	every(100*time.Millisecond, cronStop, checkSavePoints)
+}
@@ -1,50 +1,146 @@
 package redis
 
-import "sync"
-
 type RedisSet map[string]bool
 
-var (
-    allSets   map[string]RedisSet = make(map[string]RedisSet)
-    setCounts map[string]int      = make(map[string]int)
-    setsMu    sync.RWMutex
-)
+// setValue is the value of a set key, in one of its encodings: an intset while
+// it holds only integers, a listpackSet while it is small, then a RedisSet.
+type setValue interface {
+    has(member string) bool
+    len() int
+    each(f func(member string) bool)
+    encoding() string
+}
+
+// newSetValue returns a set holding members, in the encoding they call for.
+func newSetValue(members RedisSet) setValue {
+    var set setValue = &intset{}
+    for m := range members {
+        set, _ = setAdd(set, m)
+    }
+    return set
+}
+
+// setAdd adds member to set and reports whether it was not already there. The
+// set is returned converted to a more general encoding when its current one
+// cannot take the member.
+func setAdd(set setValue, member string) (setValue, bool) {
+    if set.has(member) {
+        return set, false
+    }
+
+    switch s := set.(type) {
+    case *intset:
+        if s.takes(member) {
+            s.add(member)
+            return s, true
+        }
+        lp := &listpackSet{}
+        s.each(func(m string) bool {
+            if !lp.takes(m) {
+                lp = nil
+                return false
+            }
+            lp.add(m)
+            return true
+        })
+        if lp != nil {
+            return setAdd(lp, member)
+        }
+    case *listpackSet:
+        if s.takes(member) {
+            s.add(member)
+            return s, true
+        }
+    case RedisSet:
+        s[member] = true
+        return s, true
+    }
+
+    hashtable := make(RedisSet, set.len()+1)
+    set.each(func(m string) bool {
+        hashtable[m] = true
+        return true
+    })
+    return setAdd(hashtable, member)
+}
+
+// setMembers returns the members of set as a slice.
+func setMembers(set setValue) []string {
+    out := make([]string, 0, set.len())
+    set.each(func(m string) bool {
+        out = append(out, m)
+        return true
+    })
+    return out
+}
 
 // Add the specified members to the set stored at key. Specified members that are already a member of this set are ignored. If key does not exist, a new set is created before adding the specified members.
 // An error is returned when the value stored at key is not a set.
 //
 // Return value
-// Integer reply: the number of elements that were added to the set, not including all the elements already present into the set.
+// Integer reply: the number of elements that were added to the set, not including all the elements already present into the set, or 0 on an error reply, such as ErrOOM.
 func Sadd(key string, member ...string) (additions int) {
-    setsMu.Lock()
-    defer setsMu.Unlock()
+    defer callKey("sadd", key, func() []string { return member })()
 
-    s, exists := allSets[key]
+    additions, _ = sadd(key, member)
+    return
+}
+
+// sadd adds members to the set stored at key and returns how many were new.
+func sadd(key string, member []string) (additions int, err error) {
+    if err := performEvictions(); err != nil {
+        return 0, err
+    }
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, err := s.lookupWrite(key, typeSet)
+    if err != nil {
+        return 0, err
+    }
+    exists := e != nil
     if !exists {
-        setCounts[key] = 0
-        allSets[key] = RedisSet{}
-        s = allSets[key]
+        e = s.add(key, typeSet, &intset{})
     }
+    set := e.value.(setValue)
+    compact := e.compact()
 
+    var added []string
+    var size int64
     for _, m := range member {
-        _, existed := s[m]
-        if !existed {
+        var isNew bool
+        if set, isNew = setAdd(set, m); isNew {
             additions++
-            setCounts[key]++
+            added = append(added, m)
+            size += elemOverhead + int64(len(m))
         }
-        s[m] = true
     }
+    e.value = set
+    if compact {
+        e.measure(key)
+    } else {
+        e.grow(size)
+    }
+    s.addDirty(additions)
 
     // Publish as an array (not the internal storage hash representation)
     //
-    var out []string
-    for k, _ := range allSets[key] {
-        out = append(out, k)
+    event := ChangeEvent{Op: "sadd", TypeName: "set", KeyName: key, NewValue: added}
+    if subscribed() {
+        event.Data = setMembers(set)
+    }
+    publish(event)
+    if !exists {
+        notifyKeyspaceEvent(notifyNew, "set", "new", key)
+    }
+    if additions > 0 {
+        notifyKeyspaceEvent(notifySet, "set", "sadd", key)
     }
 
-    publish <- notice{"set", key, "", out}
-
-    return
+    return additions, nil
 }
 
 // Returns all the members of the set value stored at key.
@@ -53,26 +149,70 @@ func Sadd(key string, member ...string) (additions int) {
 // Return value
 // Array reply: all elements of the set.
 func Smembers(key string) (out []string) {
-    setsMu.RLock()
-    defer setsMu.RUnlock()
+    defer call("smembers", key)()
 
-    s, _ := allSets[key]
-    for k, _ := range s {
-        out = append(out, k)
-    }
+    out, _ = smembers(key)
     return
 }
 
+// smembers returns the members of the set stored at key.
+func smembers(key string) ([]string, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, err := s.lookupRead(key, typeSet)
+    if e == nil {
+        return nil, err
+    }
+    return setMembers(e.value.(setValue)), nil
+}
+
 // Returns all the members of the set value stored at key.
 // This has the same effect as running SINTER with one argument key.
 //
 // Return value
 // Array reply: all elements of the set.
 func Scard(key string) (count int) {
-    setsMu.RLock()
-    defer setsMu.RUnlock()
-
-    count, _ = setCounts[key]
+    defer call("scard", key)()
 
+    count, _ = scard(key)
     return
 }
+
+// scard returns the number of members of the set stored at key.
+func scard(key string) (int, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, err := s.lookupRead(key, typeSet)
+    if e == nil {
+        return 0, err
+    }
+    return e.value.(setValue).len(), nil
+}
+
+func (s RedisSet) has(member string) bool {
+    return s[member]
+}
+
+func (s RedisSet) len() int {
+    return len(s)
+}
+
+func (s RedisSet) each(f func(member string) bool) {
+    for m := range s {
+        if !f(m) {
+            return
+        }
+    }
+}
+
+func (s RedisSet) encoding() string {
+    return "hashtable"
+}
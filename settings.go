@@ -0,0 +1,90 @@
+package redis
+
+import "sync/atomic"
+
+// SaveSettings returns a function that restores the settings of the package as
+// they are when it is called, for tests that change them: maxmemory with its
+// policy and samples, the keyspace events notified, the save points, the limits
+// of the compact encodings, the slow log and its thresholds, the latency monitor
+// threshold, the size of the change log and the script time limit. The scripts
+// loaded and the function libraries are restored too.
+//
+// The keyspace is not restored, nor are the change log's events and sequence
+// numbers, which only go forward, the latency samples, the statistics of INFO or
+// the clock.
+func SaveSettings() (restore func()) {
+	maxmemoryMu.RLock()
+	limit, policy, samples := maxmemory, maxmemoryPolicy, maxmemorySamples
+	maxmemoryMu.RUnlock()
+
+	notify := atomic.LoadInt32(&notifyFlags)
+
+	saveMu.Lock()
+	points := append([]SavePoint(nil), savePoints...)
+	saveMu.Unlock()
+
+	// The settings accessed atomically.
+	atomics := [...]*int64{
+		&hashMaxListpackEntries, &hashMaxListpackValue,
+		&setMaxIntsetEntries, &setMaxListpackEntries, &setMaxListpackValue,
+		&listMaxListpackSize, &listCompressDepth,
+		&slowlogLogSlowerThan, &latencyMonitorThreshold, &luaTimeLimit,
+	}
+	var values [len(atomics)]int64
+	for i, p := range atomics {
+		values[i] = atomic.LoadInt64(p)
+	}
+
+	slowlogMu.Lock()
+	slowEntries, slowMaxLen := append([]SlowlogEntry(nil), slowlog...), slowlogMaxLen
+	slowlogMu.Unlock()
+
+	changeLogSize := len(currentChangeLog().slots)
+
+	scriptsMu.Lock()
+	savedScripts := make(map[string]*funcProto, len(scripts))
+	for sha, proto := range scripts {
+		savedScripts[sha] = proto
+	}
+	scriptsMu.Unlock()
+
+	functionsMu.Lock()
+	savedLibraries := make(map[string]*Library, len(libraries))
+	for name, lib := range libraries {
+		savedLibraries[name] = lib
+	}
+	savedFunctions := make(map[string]*Function, len(functions))
+	for name, fn := range functions {
+		savedFunctions[name] = fn
+	}
+	functionsMu.Unlock()
+
+	return func() {
+		maxmemoryMu.Lock()
+		maxmemory, maxmemoryPolicy, maxmemorySamples = limit, policy, samples
+		maxmemoryMu.Unlock()
+
+		atomic.StoreInt32(&notifyFlags, notify)
+		SetSavePoints(points...)
+
+		for i, p := range atomics {
+			atomic.StoreInt64(p, values[i])
+		}
+
+		slowlogMu.Lock()
+		slowlog, slowlogMaxLen = slowEntries, slowMaxLen
+		slowlogMu.Unlock()
+
+		if len(currentChangeLog().slots) != changeLogSize {
+			SetChangeLogSize(changeLogSize)
+		}
+
+		scriptsMu.Lock()
+		scripts = savedScripts
+		scriptsMu.Unlock()
+
+		functionsMu.Lock()
+		libraries, functions = savedLibraries, savedFunctions
+		functionsMu.Unlock()
+	}
+}
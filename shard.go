@@ -0,0 +1,265 @@
+package redis
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWrongType is the error of commands run against a key holding a value of
+// another type, such as HGET on a list.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// shardCount is the number of shards the keyspace is split into. Every shard has
+// its own lock, so commands on keys in different shards run in parallel.
+const shardCount = 256
+
+// valueType tags the type of the value an entry holds.
+type valueType uint8
+
+const (
+	typeString valueType = iota + 1
+	typeList
+	typeSet
+	typeHash
+)
+
+// String returns the name of the type, as reported by TYPE.
+func (t valueType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeList:
+		return "list"
+	case typeSet:
+		return "set"
+	case typeHash:
+		return "hash"
+	}
+	return ""
+}
+
+// entry is a key of the keyspace: its value, tagged with the value's type, its
+// timeout and the metadata kept for eviction.
+type entry struct {
+	keyInfo
+
+	typ      valueType
+	value    interface{} // string, listValue, setValue or hashValue, following typ
+	expireAt time.Time   // zero when the key has no timeout
+}
+
+// live reports whether the entry has not passed its timeout.
+func (e *entry) live(now time.Time) bool {
+	return e.expireAt.IsZero() || now.Before(e.expireAt)
+}
+
+// shard holds the keys whose name hashes to it, guarded by mu.
+type shard struct {
+	// dirty counts the changes made to the shard's keys, for the save points.
+	// It comes first to be 64-bit aligned for atomic access.
+	dirty uint64
+
+	mu sync.RWMutex
+
+	entries map[string]*entry
+	// volatile indexes the entries of keys with a timeout, which the active
+	// expire cycle and the volatile eviction policies sample from.
+	volatile map[string]*entry
+}
+
+var shards = newShards()
+
+func newShards() (s [shardCount]*shard) {
+	for i := range s {
+		s[i] = &shard{
+			entries:  make(map[string]*entry),
+			volatile: make(map[string]*entry),
+		}
+	}
+	return
+}
+
+// shardIndex returns the shard key belongs to, hashing its name with FNV-1a.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % shardCount)
+}
+
+func shardFor(key string) *shard {
+	return shards[shardIndex(key)]
+}
+
+// lockKeys write-locks the shards holding keys and returns the function that
+// unlocks them. Shards are locked once each and in index order, so commands on
+// several keys never deadlock each other.
+func lockKeys(keys ...string) (unlock func()) {
+	var locked [shardCount]bool
+	for _, k := range keys {
+		locked[shardIndex(k)] = true
+	}
+
+	for i, l := range locked {
+		if l {
+			shards[i].mu.Lock()
+		}
+	}
+
+	return func() {
+		for i := shardCount - 1; i >= 0; i-- {
+			if locked[i] {
+				shards[i].mu.Unlock()
+			}
+		}
+	}
+}
+
+// rLockAll read-locks every shard, in index order, for a consistent view of the
+// whole keyspace, and returns the function that unlocks them.
+func rLockAll() (unlock func()) {
+	for _, s := range shards {
+		s.mu.RLock()
+	}
+
+	return func() {
+		for i := shardCount - 1; i >= 0; i-- {
+			shards[i].mu.RUnlock()
+		}
+	}
+}
+
+// lookupRead returns the entry of key for a command reading a value of type typ,
+// counting a keyspace hit or miss. It returns nil when there is no such key, and
+// ErrWrongType when the key holds another type. The caller holds s.mu.
+func (s *shard) lookupRead(key string, typ valueType) (*entry, error) {
+	e, ok := s.entries[key]
+	recordLookup(key, ok)
+	return checkType(e, typ)
+}
+
+// lookupWrite is lookupRead for commands writing to key, which do not count as
+// keyspace hits or misses.
+func (s *shard) lookupWrite(key string, typ valueType) (*entry, error) {
+	return checkType(s.entries[key], typ)
+}
+
+func checkType(e *entry, typ valueType) (*entry, error) {
+	if e != nil && e.typ != typ {
+		atomic.AddUint64(&errorReplies, 1)
+		return nil, ErrWrongType
+	}
+	return e, nil
+}
+
+// add creates key holding value, of type typ. The caller holds s.mu for writing
+// and checked that key does not exist.
+func (s *shard) add(key string, typ valueType, value interface{}) *entry {
+	now := timeNow().UnixNano()
+	e := &entry{
+		keyInfo: keyInfo{lastAccess: now, lfuCounter: lfuInitVal, lfuDecrAt: now},
+		typ:     typ,
+		value:   value,
+	}
+	s.entries[key] = e
+	e.grow(keyOverhead + int64(len(key)))
+	return e
+}
+
+// setExpire sets the timeout of an entry, or removes it for a zero when. The
+// caller holds s.mu for writing.
+func (s *shard) setExpire(key string, e *entry, when time.Time) {
+	e.expireAt = when
+	if when.IsZero() {
+		delete(s.volatile, key)
+	} else {
+		s.volatile[key] = e
+	}
+}
+
+// deleteKey removes key, publishing the keyspace event named event, of class, if
+// it existed. The caller holds s.mu for writing.
+func (s *shard) deleteKey(class int32, event, key string) bool {
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+
+	delete(s.entries, key)
+	delete(s.volatile, key)
+	e.grow(-atomic.LoadInt64(&e.size))
+
+	old := e.value
+	switch v := old.(type) {
+	case listValue:
+		old = v.slice()
+	case setValue:
+		old = setMembers(v)
+	case hashValue:
+		old = hashData(v)
+	}
+	publish(ChangeEvent{Op: event, TypeName: e.typ.String(), KeyName: key, OldValue: old})
+	notifyKeyspaceEvent(class, e.typ.String(), event, key)
+	return true
+}
+
+// keyspaceSnapshot is a copy of the keyspace, taken for writing it out without
+// holding the shard locks.
+type keyspaceSnapshot struct {
+	hashes  map[string]map[string]string
+	lists   map[string]List
+	sets    map[string]RedisSet
+	strings map[string]string
+	expires map[string]time.Time
+}
+
+// snapshotKeyspace copies the whole keyspace at one point in time.
+func snapshotKeyspace() keyspaceSnapshot {
+	snap := keyspaceSnapshot{
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string]List),
+		sets:    make(map[string]RedisSet),
+		strings: make(map[string]string),
+		expires: make(map[string]time.Time),
+	}
+
+	// Scripts are atomic, so snapshots wait for them.
+	execMu.RLock()
+	defer execMu.RUnlock()
+	unlock := rLockAll()
+	defer unlock()
+
+	for _, s := range shards {
+		for key, e := range s.entries {
+			switch v := e.value.(type) {
+			case hashValue:
+				fields := make(map[string]string, v.len())
+				v.each(func(field, value string) bool {
+					fields[field] = value
+					return true
+				})
+				snap.hashes[key] = fields
+			case listValue:
+				snap.lists[key] = v.slice()
+			case setValue:
+				members := make(RedisSet, v.len())
+				v.each(func(m string) bool {
+					members[m] = true
+					return true
+				})
+				snap.sets[key] = members
+			case string:
+				snap.strings[key] = v
+			}
+			if !e.expireAt.IsZero() {
+				snap.expires[key] = e.expireAt
+			}
+		}
+	}
+
+	return snap
+}
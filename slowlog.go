@@ -0,0 +1,155 @@
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on what a slow log entry keeps of a command, as in Redis, so a command
+// with huge arguments does not pin them in memory.
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+// SlowlogEntry is a command that took longer than the slow log threshold.
+type SlowlogEntry struct {
+	// ID is unique to the entry and increases with every entry logged; it is not
+	// reset by SlowlogReset.
+	ID int64
+	// Time is when the command started.
+	Time time.Time
+	// Duration is how long the command took.
+	Duration time.Duration
+	// Args are the command name and its arguments, shortened as Redis does.
+	Args []string
+}
+
+var (
+	slowlog       []SlowlogEntry // newest first
+	slowlogNextID int64
+	slowlogMu     sync.Mutex
+
+	// slowlogLogSlowerThan is a time.Duration, accessed atomically as every
+	// command reads it.
+	slowlogLogSlowerThan = int64(10 * time.Millisecond)
+	slowlogMaxLen        = 128
+)
+
+// SetSlowlogLogSlowerThan sets how long a command has to take to be logged, like
+// the slowlog-log-slower-than directive. A negative duration disables the slow log,
+// while zero logs every command. The default is 10ms.
+func SetSlowlogLogSlowerThan(d time.Duration) {
+	atomic.StoreInt64(&slowlogLogSlowerThan, int64(d))
+}
+
+// SetSlowlogMaxLen sets how many entries the slow log keeps, like the
+// slowlog-max-len directive, dropping the oldest entries beyond it. The default
+// is 128.
+func SetSlowlogMaxLen(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	slowlogMu.Lock()
+	slowlogMaxLen = n
+	if len(slowlog) > n {
+		slowlog = slowlog[:n]
+	}
+	slowlogMu.Unlock()
+}
+
+// The SLOWLOG GET command returns entries from the slow log in chronological
+// order, from the most recent to the oldest.
+//
+// The Redis Slow Log is a system to log queries that exceeded a specified execution
+// time. The execution time does not include I/O operations like talking with the
+// client, but just the time needed to actually execute the command (this is the
+// only stage of command execution where the thread is blocked and can not serve
+// other requests in the meantime).
+//
+// A count of -1 returns all entries.
+//
+// Return value
+// Array reply: a list of slow log entries.
+func SlowlogGet(count int) []SlowlogEntry {
+	defer call("slowlog|get", fmt.Sprint(count))()
+
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+
+	if count < 0 || count > len(slowlog) {
+		count = len(slowlog)
+	}
+	return append([]SlowlogEntry(nil), slowlog[:count]...)
+}
+
+// This command returns the current number of entries in the slow log.
+//
+// Return value
+// Integer reply: the number of entries in the slow log.
+func SlowlogLen() int {
+	defer call("slowlog|len")()
+
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+
+	return len(slowlog)
+}
+
+// This command resets the slow log, clearing all entries in it.
+//
+// Return value
+// Simple string reply: OK.
+func SlowlogReset() string {
+	defer call("slowlog|reset")()
+
+	slowlogMu.Lock()
+	slowlog = nil
+	slowlogMu.Unlock()
+
+	return "OK"
+}
+
+// slowlogPushIfNeeded logs a command that started at start and took took, if that
+// is over the threshold.
+// slowlogTakes reports whether a command that took took is logged.
+func slowlogTakes(took time.Duration) bool {
+	threshold := time.Duration(atomic.LoadInt64(&slowlogLogSlowerThan))
+	return threshold >= 0 && took >= threshold
+}
+
+func slowlogPushIfNeeded(start time.Time, took time.Duration, name string, args []string) {
+	if !slowlogTakes(took) {
+		return
+	}
+
+	argv := strings.Split(name, "|")
+	for i, arg := range args {
+		if len(argv) == slowlogMaxArgc-1 {
+			argv = append(argv, fmt.Sprintf("... (%d more arguments)", len(args)-i))
+			break
+		}
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		argv = append(argv, arg)
+	}
+
+	slowlogMu.Lock()
+	defer slowlogMu.Unlock()
+
+	if slowlogMaxLen == 0 {
+		return
+	}
+	entry := SlowlogEntry{ID: slowlogNextID, Time: start, Duration: took, Args: argv}
+	slowlogNextID++
+
+	slowlog = append([]SlowlogEntry{entry}, slowlog...)
+	if len(slowlog) > slowlogMaxLen {
+		slowlog = slowlog[:slowlogMaxLen]
+	}
+}
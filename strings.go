@@ -2,28 +2,80 @@ package redis
 
 import (
     "strconv"
-    "sync"
+    "time"
 )
 
-var (
-    allStrings map[string]string = make(map[string]string)
-    stringsMu  sync.RWMutex
-)
+// setOptions are the options of SET.
+type setOptions struct {
+    nx, xx   bool      // only set the key if it does not, or does, exist
+    keepTTL  bool      // keep the timeout of the key being overwritten
+    expireAt time.Time // the timeout to give the key, if not zero
+}
 
 // Set key to hold the string value. If key already holds a value, it
 // is overwritten, regardless of its type. Any previous time to live
 // associated with the key is discarded on successful SET operation.
+//
+// Return value
+// Simple string reply: OK, or "" on an error reply, such as ErrOOM.
 func Set(key, value string) string {
-    stringsMu.Lock()
-    defer stringsMu.Unlock()
+    defer call("set", key, value)()
 
-    allStrings[key] = value
-
-    publish <- notice{"string", key, "", allStrings[key]}
+    if _, err := setString(key, value, setOptions{}); err != nil {
+        return ""
+    }
 
     return "OK"
 }
 
+// setString sets key to hold the string value, following the options of SET,
+// and reports whether it did.
+func setString(key, value string, opt setOptions) (bool, error) {
+    if err := performEvictions(); err != nil {
+        return false, err
+    }
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, exists := s.entries[key]
+    if (opt.nx && exists) || (opt.xx && !exists) {
+        return false, nil
+    }
+
+    event := ChangeEvent{Op: "set", TypeName: "string", KeyName: key, Data: value, NewValue: value}
+    if !exists {
+        e = s.add(key, typeString, value)
+        e.grow(int64(len(value)))
+    } else {
+        if old, ok := e.value.(string); ok {
+            event.OldValue = old
+        }
+        e.typ, e.value = typeString, value
+        e.measure(key)
+        if !opt.keepTTL {
+            s.setExpire(key, e, time.Time{})
+        }
+    }
+    if !opt.expireAt.IsZero() {
+        s.setExpire(key, e, opt.expireAt)
+    }
+
+    s.addDirty(1)
+    publish(event)
+    if !exists {
+        notifyKeyspaceEvent(notifyNew, "string", "new", key)
+    }
+    notifyKeyspaceEvent(notifyString, "string", "set", key)
+    if !opt.expireAt.IsZero() {
+        notifyKeyspaceEvent(notifyGeneric, "string", "expire", key)
+    }
+
+    return true, nil
+}
+
 // Get the value of key. If the key does not exist the special value nil
 // is returned. An error is returned if the value stored at key is not a
 // string, because GET only handles string values.
@@ -31,10 +83,26 @@ func Set(key, value string) string {
 // Return value
 // Bulk string reply: the value of key, or nil when key does not exist.
 func Get(key string) string {
-    stringsMu.RLock()
-    defer stringsMu.RUnlock()
+    defer call("get", key)()
 
-    return allStrings[key]
+    value, _, _ := getString(key)
+    return value
+}
+
+// getString returns the value of key and whether it exists.
+func getString(key string) (string, bool, error) {
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, err := s.lookupRead(key, typeString)
+    if e == nil {
+        return "", false, err
+    }
+
+    return e.value.(string), true, nil
 }
 
 // Set key to hold string value if key does not exist. In that case,
@@ -44,20 +112,12 @@ func Get(key string) string {
 // Return value
 // Integer reply, specifically:
 // 1 if the key was set
-// 0 if the key was not set
+// 0 if the key was not set, or on an error reply, such as ErrOOM
 func Setnx(key, value string) int {
-    stringsMu.Lock()
-    defer stringsMu.Unlock()
-
-    _, exists := allStrings[key]
-    if exists {
-        return 0
-    }
-    allStrings[key] = value
-
-    publish <- notice{"string", key, "", allStrings[key]}
+    defer call("setnx", key, value)()
 
-    return 1
+    ok, _ := setString(key, value, setOptions{nx: true})
+    return boolToInt(ok)
 }
 
 // Increments the number stored at key by one. If the key does not exist,
@@ -66,40 +126,81 @@ func Setnx(key, value string) int {
 // that can not be represented as integer.
 //
 // Return value
-// String reply: the value of key after the increment
+// String reply: the value of key after the increment, or "" on an error reply,
+// such as ErrOOM.
 func Incr(key string) string {
-    stringsMu.Lock()
-    defer stringsMu.Unlock()
+    defer call("incr", key)()
 
-    val, exists := allStrings[key]
-    if !exists {
-        val = "0"
+    n, err := incrBy(key, 1, "incrby")
+    if err != nil {
+        return ""
     }
-    i, _ := strconv.Atoi(val)
-    allStrings[key] = strconv.Itoa(i + 1)
-
-    publish <- notice{"string", key, "", allStrings[key]}
-
-    return allStrings[key]
+    return strconv.FormatInt(n, 10)
 }
 
 // Decrements the number stored at key by one. If the key does not exist, it is set to 0 before performing the operation. An error is returned if the key contains a value of the wrong type or contains a string that can not be represented as integer. This operation is limited to 64 bit signed integers.
 // See INCR for extra information on increment/decrement operations.
 //
 // Return value
-// String reply: the value of key after the decrement
+// String reply: the value of key after the decrement, or "" on an error reply,
+// such as ErrOOM.
 func Decr(key string) string {
-    stringsMu.Lock()
-    defer stringsMu.Unlock()
+    defer call("decr", key)()
+
+    n, err := incrBy(key, -1, "decrby")
+    if err != nil {
+        return ""
+    }
+    return strconv.FormatInt(n, 10)
+}
 
-    val, exists := allStrings[key]
+// incrBy adds delta to the integer stored at key, publishing the change as
+// event, and returns the new value.
+func incrBy(key string, delta int64, event string) (int64, error) {
+    if err := performEvictions(); err != nil {
+        return 0, err
+    }
+    accessKey(key)
+
+    s := shardFor(key)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, err := s.lookupWrite(key, typeString)
+    if err != nil {
+        return 0, err
+    }
+    exists := e != nil
+    val := "0"
+    if exists {
+        val = e.value.(string)
+    }
+    i, err := strconv.ParseInt(val, 10, 64)
+    if err != nil {
+        return 0, errorReply(errNotInteger)
+    }
+    if (delta > 0 && i > maxInt64-delta) || (delta < 0 && i < minInt64-delta) {
+        return 0, errorReply(errOverflow)
+    }
+    newVal := strconv.FormatInt(i+delta, 10)
     if !exists {
-        val = "0"
+        e = s.add(key, typeString, newVal)
+        e.grow(int64(len(newVal)))
+    } else {
+        e.value = newVal
+        e.grow(int64(len(newVal) - len(val)))
     }
-    i, _ := strconv.Atoi(val)
-    allStrings[key] = strconv.Itoa(i - 1)
 
-    publish <- notice{"string", key, "", allStrings[key]}
+    s.addDirty(1)
+    ev := ChangeEvent{Op: event, TypeName: "string", KeyName: key, Data: newVal, NewValue: newVal}
+    if exists {
+        ev.OldValue = val
+    }
+    publish(ev)
+    if !exists {
+        notifyKeyspaceEvent(notifyNew, "string", "new", key)
+    }
+    notifyKeyspaceEvent(notifyString, "string", event, key)
 
-    return allStrings[key]
+    return i + delta, nil
 }
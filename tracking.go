@@ -0,0 +1,429 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Client-side caching, as CLIENT TRACKING provides it: a TrackingClient keeps
+// the replies of the reads it makes in a near cache, and the keyspace tells it
+// which keys changed so that it drops them. In the default mode the keyspace
+// remembers the keys each client read, and tells it once when one of them
+// changes; in broadcasting mode it tells the client about every key matching its
+// prefixes instead, remembering nothing.
+
+// TrackingOptions are the options of CLIENT TRACKING.
+type TrackingOptions struct {
+	// BCast enables broadcasting mode, with invalidations for every changed key
+	// matching Prefixes, or for every key if there are none.
+	BCast    bool
+	Prefixes []string
+
+	// OptIn only caches the reads following a call to Caching(true), and
+	// OptOut caches all reads but those following a call to Caching(false).
+	OptIn, OptOut bool
+
+	// NoLoop leaves out of the invalidations the keys the client changed
+	// itself, through Do. The near cache still drops them. Changes the
+	// keyspace makes on its own to those keys while the write runs, such as
+	// expiring or evicting them, count as the client's too.
+	NoLoop bool
+
+	// OnInvalidate, when set, is called with the keys invalidated, after the
+	// near cache dropped them. It is called from a goroutine of the client, one
+	// message at a time, and may run commands.
+	OnInvalidate func(keys []string)
+
+	// Push, when set, receives the invalidations as the RESP3 push messages a
+	// Redis server sends to clients that enabled tracking, such as
+	//
+	//	>2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n
+	Push io.Writer
+}
+
+// TrackingClient reads the keyspace through a near cache, which is kept up to
+// date with invalidation messages. Values returned from the cache are shared
+// between the callers reading them and must not be modified.
+type TrackingClient struct {
+	opts TrackingOptions
+
+	mu      sync.Mutex
+	cache   map[string]interface{} // reads by command and arguments
+	byKey   map[string][]string    // the cache entries of each key
+	epoch   uint64                 // counts invalidations, so reads racing with them are not cached
+	caching int                    // 1 or -1 for CLIENT CACHING yes or no, for the next read
+
+	// pending holds the invalidations waiting to be delivered by the client's
+	// goroutine, woken by wake.
+	pending [][]string
+	wake    *sync.Cond
+	closed  bool
+
+	// tracked holds the keys the client is remembered to have read, in the
+	// default mode, and is guarded by trackingMu.
+	tracked map[string]bool
+}
+
+var (
+	// trackedKeys holds the clients that read each key, in the default mode,
+	// and bcastClients the clients in broadcasting mode.
+	trackedKeys  = make(map[string]map[*TrackingClient]bool)
+	bcastClients = make(map[*TrackingClient]bool)
+	trackingMu   sync.Mutex
+
+	// trackingClients lets writes skip invalidation when nobody tracks keys.
+	trackingClients int32
+
+	// trackingWriters holds the client whose write to each key is running, for
+	// NOLOOP. The write holds the execMu stripes of its keys, so no other
+	// command on them runs meanwhile.
+	trackingWriters = make(map[string]*TrackingClient)
+)
+
+var (
+	errTrackingOptInOut = errors.New("ERR You can't use OPTIN and OPTOUT at the same time")
+	errTrackingBCastOpt = errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	errTrackingPrefix   = errors.New("ERR PREFIX option requires BCAST mode to be enabled")
+	errTrackingCaching  = errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+)
+
+// Enables the tracking feature of the Redis server, that is used for server
+// assisted client side caching, for a new client.
+//
+// Return value
+// The tracking client, or an error if the options are inconsistent.
+func ClientTracking(opts TrackingOptions) (*TrackingClient, error) {
+	defer call("client|tracking", "on")()
+
+	switch {
+	case opts.OptIn && opts.OptOut:
+		return nil, errorReply(errTrackingOptInOut)
+	case opts.BCast && (opts.OptIn || opts.OptOut):
+		return nil, errorReply(errTrackingBCastOpt)
+	case !opts.BCast && len(opts.Prefixes) > 0:
+		return nil, errorReply(errTrackingPrefix)
+	}
+	opts.Prefixes = append([]string(nil), opts.Prefixes...)
+
+	c := &TrackingClient{
+		opts:    opts,
+		cache:   make(map[string]interface{}),
+		byKey:   make(map[string][]string),
+		tracked: make(map[string]bool),
+	}
+	c.wake = sync.NewCond(&c.mu)
+	if opts.OnInvalidate != nil || opts.Push != nil {
+		go c.deliver()
+	}
+
+	trackingMu.Lock()
+	if opts.BCast {
+		bcastClients[c] = true
+	}
+	trackingMu.Unlock()
+	atomic.AddInt32(&trackingClients, 1)
+
+	return c, nil
+}
+
+// Close disables tracking for the client and empties its near cache.
+func (c *TrackingClient) Close() {
+	trackingMu.Lock()
+	delete(bcastClients, c)
+	for key := range c.tracked {
+		delete(trackedKeys[key], c)
+		if len(trackedKeys[key]) == 0 {
+			delete(trackedKeys, key)
+		}
+	}
+	c.tracked = nil
+	trackingMu.Unlock()
+
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		atomic.AddInt32(&trackingClients, -1)
+	}
+	c.cache, c.byKey = make(map[string]interface{}), make(map[string][]string)
+	c.wake.Signal()
+	c.mu.Unlock()
+}
+
+// Caching decides whether the next read is cached, like CLIENT CACHING, for
+// clients with OptIn or OptOut.
+func (c *TrackingClient) Caching(yes bool) error {
+	if !c.opts.OptIn && !c.opts.OptOut {
+		return errorReply(errTrackingCaching)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.caching = -1
+	if yes {
+		c.caching = 1
+	}
+	return nil
+}
+
+// Get is GET through the near cache.
+func (c *TrackingClient) Get(key string) string {
+	v, _ := c.read([]string{key}, "get\x00"+key, func() (interface{}, error) {
+		return Get(key), nil
+	})
+	return v.(string)
+}
+
+// HGet is HGET through the near cache.
+func (c *TrackingClient) HGet(key, field string) string {
+	v, _ := c.read([]string{key}, "hget\x00"+key+"\x00"+field, func() (interface{}, error) {
+		return HGet(key, field), nil
+	})
+	return v.(string)
+}
+
+// Hgetall is HGETALL through the near cache. The hash returned is shared with
+// the other callers reading it from the cache.
+func (c *TrackingClient) Hgetall(key string) Hash {
+	v, _ := c.read([]string{key}, "hgetall\x00"+key, func() (interface{}, error) {
+		return Hgetall(key), nil
+	})
+	return v.(Hash)
+}
+
+// Smembers is SMEMBERS through the near cache.
+func (c *TrackingClient) Smembers(key string) []string {
+	v, _ := c.read([]string{key}, "smembers\x00"+key, func() (interface{}, error) {
+		return Smembers(key), nil
+	})
+	return v.([]string)
+}
+
+// Lrange is LRANGE through the near cache.
+func (c *TrackingClient) Lrange(key string, start, stop int) List {
+	cacheKey := "lrange\x00" + key + "\x00" + strconv.Itoa(start) + "\x00" + strconv.Itoa(stop)
+	v, _ := c.read([]string{key}, cacheKey, func() (interface{}, error) {
+		return Lrange(key, start, stop), nil
+	})
+	return v.(List)
+}
+
+// Do runs a command, given by name and arguments as a client sends it. The
+// replies of read-only commands go through the near cache, and writes count as
+// the client's own for NoLoop. Replies are nil, an int64, a string or an
+// []interface{} of those.
+func (c *TrackingClient) Do(args ...string) (interface{}, error) {
+	cmd, err := lookupCommand(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys := cmd.keys(args); cmd.flags&cmdReadonly != 0 && len(keys) > 0 {
+		// The replies of Do are cached apart from those of Get and the others,
+		// which are of different types.
+		cacheKey := "do\x00" + strings.ToLower(args[0]) + "\x00" + strings.Join(args[1:], "\x00")
+		return c.read(keys, cacheKey, func() (interface{}, error) {
+			reply, err := runCommand(args)
+			return plainReply(reply), err
+		})
+	}
+
+	if keys := cmd.keys(args); c.opts.NoLoop && cmd.flags&cmdWrite != 0 && len(keys) > 0 {
+		// The write runs alone on its keys, so that the changes published for
+		// them are known to be the client's.
+		unlock := execMu.lockKeys(keys)
+		setTrackingWriter(keys, c)
+		defer func() {
+			setTrackingWriter(keys, nil)
+			unlock()
+		}()
+
+		reply, err := execCommand(args, nil)
+		return plainReply(reply), err
+	}
+
+	reply, err := runCommand(args)
+	return plainReply(reply), err
+}
+
+// read returns the cached reply of a read of keys, or makes the read with load
+// and caches its reply.
+func (c *TrackingClient) read(keys []string, cacheKey string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	caching := c.caching
+	c.caching = 0
+	if v, ok := c.cache[cacheKey]; ok {
+		c.mu.Unlock()
+		return v, nil
+	}
+	epoch, closed := c.epoch, c.closed
+	c.mu.Unlock()
+
+	track := !closed && ((c.opts.OptIn && caching > 0) || (!c.opts.OptIn && caching >= 0))
+	if track && c.opts.BCast {
+		for _, key := range keys {
+			track = track && c.matches(key)
+		}
+	}
+	if !track {
+		return load()
+	}
+
+	// The keys are tracked before they are read, so a change made after the
+	// read is invalidated and the reply is not cached.
+	if !c.opts.BCast {
+		trackingMu.Lock()
+		if c.tracked != nil {
+			for _, key := range keys {
+				if trackedKeys[key] == nil {
+					trackedKeys[key] = make(map[*TrackingClient]bool)
+				}
+				trackedKeys[key][c] = true
+				c.tracked[key] = true
+			}
+		}
+		trackingMu.Unlock()
+	}
+
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+
+	c.mu.Lock()
+	if c.epoch == epoch && !c.closed {
+		c.cache[cacheKey] = v
+		for _, key := range keys {
+			c.byKey[key] = append(c.byKey[key], cacheKey)
+		}
+	}
+	c.mu.Unlock()
+	return v, nil
+}
+
+// matches reports whether key matches the prefixes of a client in broadcasting
+// mode.
+func (c *TrackingClient) matches(key string) bool {
+	if len(c.opts.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range c.opts.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateTrackedKey tells the clients tracking key that it changed.
+func invalidateTrackedKey(key string) {
+	if atomic.LoadInt32(&trackingClients) == 0 {
+		return
+	}
+
+	trackingMu.Lock()
+	clients := trackedKeys[key]
+	delete(trackedKeys, key)
+	for c := range clients {
+		delete(c.tracked, key)
+	}
+	for c := range bcastClients {
+		if c.matches(key) {
+			if clients == nil {
+				clients = make(map[*TrackingClient]bool)
+			}
+			clients[c] = true
+		}
+	}
+	writer := trackingWriters[key]
+	trackingMu.Unlock()
+
+	for c := range clients {
+		c.invalidate(key, c.opts.NoLoop && c == writer)
+	}
+}
+
+// setTrackingWriter records c as the writer of keys, or forgets the writer if c
+// is nil.
+func setTrackingWriter(keys []string, c *TrackingClient) {
+	trackingMu.Lock()
+	for _, key := range keys {
+		if c != nil {
+			trackingWriters[key] = c
+		} else {
+			delete(trackingWriters, key)
+		}
+	}
+	trackingMu.Unlock()
+}
+
+// invalidate drops key from the near cache, and queues the invalidation message
+// unless quiet is set.
+func (c *TrackingClient) invalidate(key string, quiet bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for _, cacheKey := range c.byKey[key] {
+		delete(c.cache, cacheKey)
+	}
+	delete(c.byKey, key)
+
+	if !quiet && !c.closed && (c.opts.OnInvalidate != nil || c.opts.Push != nil) {
+		c.pending = append(c.pending, []string{key})
+		c.wake.Signal()
+	}
+}
+
+// deliver delivers the invalidation messages, until the client is closed.
+func (c *TrackingClient) deliver() {
+	var w *bufio.Writer
+	if c.opts.Push != nil {
+		w = bufio.NewWriter(c.opts.Push)
+	}
+
+	for {
+		c.mu.Lock()
+		for len(c.pending) == 0 && !c.closed {
+			c.wake.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		pending := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+
+		for _, keys := range pending {
+			if c.opts.OnInvalidate != nil {
+				c.opts.OnInvalidate(keys)
+			}
+			if w != nil {
+				writePushInvalidate(w, keys)
+			}
+		}
+		if w != nil {
+			w.Flush()
+		}
+	}
+}
+
+// writePushInvalidate writes the RESP3 push message invalidating keys, or every
+// key if keys is nil.
+func writePushInvalidate(w *bufio.Writer, keys []string) {
+	w.WriteString(">2\r\n$10\r\ninvalidate\r\n")
+	if keys == nil {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("*" + strconv.Itoa(len(keys)) + "\r\n")
+	for _, key := range keys {
+		w.WriteString("$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n")
+	}
+}